@@ -0,0 +1,110 @@
+package sendmail
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Archive keeps a copy of the messages accepted for delivery.
+type Archive struct {
+	// Dir stores the messages as eml files partitioned by date:
+	// Dir/YYYY/MM/DD/<id>.eml, empty to not store.
+	Dir string `yaml:"dir,omitempty"`
+	// Address receives a blind copy of the messages, empty to not send.
+	Address string `yaml:"address,omitempty"`
+	// SenderDomains limit the archiving to the messages of the senders
+	// of the domains, all messages are archived if empty.
+	SenderDomains []string `yaml:"sender_domains,omitempty"`
+}
+
+// Enabled reports whether the messages are stored or copied.
+func (a *Archive) Enabled() bool {
+	return a != nil && (a.Dir != "" || a.Address != "")
+}
+
+// Or return the archive with the fields not set taken from d.
+func (a Archive) Or(d Archive) Archive {
+	if a.Dir == "" {
+		a.Dir = d.Dir
+	}
+	if a.Address == "" {
+		a.Address = d.Address
+	}
+	if len(a.SenderDomains) == 0 {
+		a.SenderDomains = d.SenderDomains
+	}
+	return a
+}
+
+// Validate check the archive address.
+func (a Archive) Validate() error {
+	if a.Address != "" {
+		if _, err := mail.ParseAddress(a.Address); err != nil {
+			return fmt.Errorf("invalid archive address %q: %s", a.Address, err)
+		}
+	}
+	if len(a.SenderDomains) > 0 && a.Dir == "" && a.Address == "" {
+		return errors.New("archive sender domains are set without dir or address")
+	}
+	return nil
+}
+
+// Match reports whether the messages of the sender are archived.
+func (a *Archive) Match(sender string) bool {
+	if !a.Enabled() {
+		return false
+	}
+	if len(a.SenderDomains) == 0 {
+		return true
+	}
+	domain := GetDomainFromAddress(sender)
+	for _, d := range a.SenderDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store the message of the envelope in Dir and add Address to its
+// recipients, the messages of not matched senders are skipped.
+func (a *Archive) Store(e *Envelope) error {
+	if !a.Match(e.GetSender()) {
+		return nil
+	}
+	if a.Dir != "" {
+		msg, err := e.GenerateMessage()
+		if err != nil {
+			return err
+		}
+		id, err := newQueueID()
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(a.Dir, time.Now().Format("2006/01/02"))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, id+".eml"), msg); err != nil {
+			return err
+		}
+	}
+	if a.Address != "" {
+		address, err := mail.ParseAddress(a.Address)
+		if err != nil {
+			return err
+		}
+		for _, rcpt := range e.Recipients {
+			if strings.EqualFold(rcpt, address.Address) {
+				return nil
+			}
+		}
+		e.Recipients = append(e.Recipients, address.Address)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package sendmail_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := &sendmail.Archive{
+		Dir:           dir,
+		Address:       "Archive <archive@example.com>",
+		SenderDomains: []string{"Example.com"},
+	}
+	send := func(sender string) *fakeTransport {
+		transport := &fakeTransport{}
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Sender:     sender,
+			Recipients: []string{"user@example.org"},
+			Body:       []byte("TEST"),
+			Transport:  transport,
+			Archive:    archive,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := envelope.Send()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for result := range results {
+			if result.Level < sendmail.WarnLevel {
+				t.Error(result.Error)
+			}
+		}
+		return transport
+	}
+
+	transport := send("sender@example.com")
+	if len(transport.delivered) != 2 || transport.delivered[1] != "archive@example.com" {
+		t.Error("Expected blind copy to archive@example.com got", transport.delivered)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, time.Now().Format("2006/01/02"), "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("Expected 1 archived message got", files)
+	}
+	msg, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), "From: sender@example.com") || strings.Contains(string(msg), "archive@example.com") {
+		t.Errorf("Unexpected archived message:\n%s", msg)
+	}
+
+	// Other sender domains are not archived
+	transport = send("sender@example.net")
+	if len(transport.delivered) != 1 {
+		t.Error("Expected no blind copy got", transport.delivered)
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*", "*", "*", "*.eml"))
+	if len(files) != 1 {
+		t.Error("Expected 1 archived message got", files)
+	}
+
+	if err := (sendmail.Archive{Address: "invalid"}).Validate(); err == nil {
+		t.Error("Expected error of invalid archive address")
+	}
+}
@@ -0,0 +1,351 @@
+// Package audit records the outcome of message deliveries per recipient
+// in SQLite database, so it can be found out later whether the message
+// was delivered.
+package audit
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	// SQLite driver
+	_ "modernc.org/sqlite"
+
+	"github.com/n0madic/sendmail"
+)
+
+// Statuses of the delivery to the recipient.
+const (
+	// StatusDelivered the message was accepted by the server.
+	StatusDelivered = "delivered"
+	// StatusFailed the delivery failed, the queue may retry it.
+	StatusFailed = "failed"
+	// StatusQueued the message was spooled to the queue.
+	StatusQueued = "queued"
+	// StatusDeferred the delivery was postponed by the rate limit.
+	StatusDeferred = "deferred"
+	// StatusSuppressed the recipient is in the suppression list.
+	StatusSuppressed = "suppressed"
+	// StatusBounced the queue gave up the delivery.
+	StatusBounced = "bounced"
+	// StatusQuarantined the message was held by the virus scanner.
+	StatusQuarantined = "quarantined"
+)
+
+// DefaultRetention of the records.
+const DefaultRetention = 30 * 24 * time.Hour
+
+const schema = `
+CREATE TABLE IF NOT EXISTS deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id TEXT NOT NULL DEFAULT '',
+	queue_id TEXT NOT NULL DEFAULT '',
+	sender TEXT NOT NULL DEFAULT '',
+	recipient TEXT NOT NULL,
+	status TEXT NOT NULL,
+	server TEXT NOT NULL DEFAULT '',
+	code INTEGER NOT NULL DEFAULT 0,
+	response TEXT NOT NULL DEFAULT '',
+	next_attempt INTEGER NOT NULL DEFAULT 0,
+	created INTEGER NOT NULL,
+	updated INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS deliveries_message
+	ON deliveries (message_id, recipient) WHERE message_id != '';
+CREATE INDEX IF NOT EXISTS deliveries_recipient ON deliveries (recipient);
+CREATE INDEX IF NOT EXISTS deliveries_updated ON deliveries (updated);
+`
+
+// queueIndex keys the records of the messages without ID on the queue ID,
+// the duplicates recorded by the older versions are removed before.
+const queueIndex = `
+DELETE FROM deliveries WHERE message_id = '' AND queue_id != '' AND id NOT IN
+	(SELECT MAX(id) FROM deliveries WHERE message_id = '' AND queue_id != '' GROUP BY queue_id, recipient);
+CREATE UNIQUE INDEX IF NOT EXISTS deliveries_queue
+	ON deliveries (queue_id, recipient) WHERE message_id = '' AND queue_id != '';
+`
+
+// Delivery is the record of the delivery to the recipient.
+type Delivery struct {
+	ID        int64  `json:"id"`
+	MessageID string `json:"message_id,omitempty"`
+	QueueID   string `json:"queue_id,omitempty"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	Status    string `json:"status"`
+	Server    string `json:"server,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	Response  string `json:"response,omitempty"`
+	// NextAttempt is the time of the next delivery attempt
+	// of the deferred recipient, nil if none.
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	Created     time.Time  `json:"created"`
+	Updated     time.Time  `json:"updated"`
+}
+
+// Query of the records, empty fields match any value.
+type Query struct {
+	MessageID string
+	Sender    string
+	Recipient string
+	Status    string
+	// Since and Until limit the time of the last update.
+	Since time.Time
+	Until time.Time
+	// Limit of the records, 100 if 0.
+	Limit int
+}
+
+// Log of the deliveries.
+type Log struct {
+	db        *sql.DB
+	retention time.Duration
+	mu        sync.Mutex
+	pruned    time.Time
+}
+
+// Open the log database at path, it's created if missing.
+// The records older than retention are removed, DefaultRetention if 0.
+func Open(path string, retention time.Duration) (*Log, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumn(db, "next_attempt INTEGER NOT NULL DEFAULT 0"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(queueIndex); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	l := &Log{db: db, retention: retention}
+	if err := l.Prune(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// addColumn add the column missing in the database of older version.
+func addColumn(db *sql.DB, column string) error {
+	name := strings.Fields(column)[0]
+	if _, err := db.Exec("SELECT " + name + " FROM deliveries LIMIT 0"); err == nil {
+		return nil
+	}
+	_, err := db.Exec("ALTER TABLE deliveries ADD COLUMN " + column)
+	return err
+}
+
+// Close the database.
+func (l *Log) Close() error {
+	return l.db.Close()
+}
+
+// Prune remove the records older than the retention.
+func (l *Log) Prune() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	_, err := l.db.Exec("DELETE FROM deliveries WHERE updated < ?", now.Add(-l.retention).UnixNano())
+	l.pruned = now
+	return err
+}
+
+// Record pass the results through storing the outcome of the recipients
+// before the result is passed. The later result of the same message and
+// recipient updates the record. Failure to store is reported as warning.
+func (l *Log) Record(results <-chan sendmail.Result) <-chan sendmail.Result {
+	out := make(chan sendmail.Result)
+	go func() {
+		defer close(out)
+		for result := range results {
+			if err := l.save(outcome(result)); err != nil {
+				out <- sendmail.Result{Level: sendmail.WarnLevel, Error: err, Message: "Audit"}
+			}
+			out <- result
+		}
+	}()
+	return out
+}
+
+// outcome of the recipients of the result, nil if it's not about them.
+func outcome(result sendmail.Result) []*Delivery {
+	rcpts, _ := result.Fields["recipients"].(string)
+	if rcpts == "" {
+		return nil
+	}
+	field := func(names ...string) string {
+		for _, name := range names {
+			if value, ok := result.Fields[name].(string); ok && value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	status := StatusFailed
+	var suppressed *sendmail.SuppressedError
+	var deferred *sendmail.DeferredError
+	switch {
+	case result.Message == "Deferred to queue":
+		status = StatusQueued
+	case result.Message == "Bounce":
+		status = StatusBounced
+	case result.Message == "Quarantined":
+		status = StatusQuarantined
+	case result.Level == sendmail.InfoLevel:
+		status = StatusDelivered
+	case errors.As(result.Error, &suppressed):
+		status = StatusSuppressed
+	case errors.As(result.Error, &deferred):
+		status = StatusDeferred
+	}
+	response := ""
+	if result.Error != nil {
+		response = result.Error.Error()
+	}
+	code, _ := result.Fields["code"].(int)
+	var next *time.Time
+	if t, ok := result.Fields["next_attempt"].(time.Time); ok {
+		next = &t
+	}
+	now := time.Now()
+	var list []*Delivery
+	for _, rcpt := range strings.Split(rcpts, ",") {
+		list = append(list, &Delivery{
+			MessageID:   field("message_id"),
+			QueueID:     field("queue_id"),
+			Sender:      field("sender"),
+			Recipient:   rcpt,
+			Status:      status,
+			Server:      field("mx", "smarthost", "server"),
+			Code:        code,
+			Response:    response,
+			NextAttempt: next,
+			Created:     now,
+			Updated:     now,
+		})
+	}
+	return list
+}
+
+// save the deliveries, the records of the same message and recipient
+// are updated, the messages without ID are matched by the queue ID.
+func (l *Log) save(deliveries []*Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, d := range deliveries {
+		if _, err := tx.Exec(`INSERT INTO deliveries
+			(message_id, queue_id, sender, recipient, status, server, code, response, next_attempt, created, updated)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (message_id, recipient) WHERE message_id != '' DO UPDATE SET
+			queue_id = excluded.queue_id, status = excluded.status, server = excluded.server,
+			code = excluded.code, response = excluded.response, next_attempt = excluded.next_attempt,
+			updated = excluded.updated
+			ON CONFLICT (queue_id, recipient) WHERE message_id = '' AND queue_id != '' DO UPDATE SET
+			status = excluded.status, server = excluded.server,
+			code = excluded.code, response = excluded.response, next_attempt = excluded.next_attempt,
+			updated = excluded.updated`,
+			d.MessageID, d.QueueID, d.Sender, d.Recipient, d.Status, d.Server, d.Code, d.Response,
+			unixNano(d.NextAttempt), d.Created.UnixNano(), d.Updated.UnixNano()); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	due := time.Since(l.pruned) > time.Hour
+	l.mu.Unlock()
+	if due {
+		return l.Prune()
+	}
+	return nil
+}
+
+// Find the records matching the query, the recently updated first.
+func (l *Log) Find(q Query) ([]Delivery, error) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, value interface{}) {
+		where = append(where, cond)
+		args = append(args, value)
+	}
+	if q.MessageID != "" {
+		add("message_id = ?", q.MessageID)
+	}
+	if q.Sender != "" {
+		add("sender = ? COLLATE NOCASE", q.Sender)
+	}
+	if q.Recipient != "" {
+		add("recipient = ? COLLATE NOCASE", q.Recipient)
+	}
+	if q.Status != "" {
+		add("status = ?", q.Status)
+	}
+	if !q.Since.IsZero() {
+		add("updated >= ?", q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		add("updated < ?", q.Until.UnixNano())
+	}
+	query := `SELECT id, message_id, queue_id, sender, recipient, status, server, code, response,
+		next_attempt, created, updated FROM deliveries`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += " ORDER BY updated DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := l.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []Delivery
+	for rows.Next() {
+		var d Delivery
+		var next, created, updated int64
+		if err := rows.Scan(&d.ID, &d.MessageID, &d.QueueID, &d.Sender, &d.Recipient, &d.Status,
+			&d.Server, &d.Code, &d.Response, &next, &created, &updated); err != nil {
+			return nil, err
+		}
+		if next != 0 {
+			t := time.Unix(0, next).UTC()
+			d.NextAttempt = &t
+		}
+		d.Created = time.Unix(0, created).UTC()
+		d.Updated = time.Unix(0, updated).UTC()
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// unixNano return the time in nanoseconds, 0 for nil.
+func unixNano(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
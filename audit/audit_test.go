@@ -0,0 +1,220 @@
+package audit_test
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	// SQLite driver
+	_ "modernc.org/sqlite"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/audit"
+)
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log, err := audit.Open(filepath.Join(dir, "audit.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	send := func(results ...sendmail.Result) {
+		in := make(chan sendmail.Result, len(results))
+		for _, result := range results {
+			in <- result
+		}
+		close(in)
+		for result := range log.Record(in) {
+			if result.Message == "Audit" {
+				t.Error(result.Error)
+			}
+		}
+	}
+	send(
+		sendmail.Result{Level: sendmail.WarnLevel, Error: errors.New("connection refused"), Message: "", Fields: sendmail.Fields{
+			"message_id": "<1@example.com>",
+			"sender":     "sender@example.com",
+			"mx":         "mx1.example.org",
+			"recipients": "user@example.org,other@example.org",
+		}},
+		sendmail.Result{Level: sendmail.InfoLevel, Error: nil, Message: "Send mail OK", Fields: sendmail.Fields{
+			"message_id": "<1@example.com>",
+			"sender":     "sender@example.com",
+			"mx":         "mx2.example.org",
+			"code":       250,
+			"recipients": "user@example.org,other@example.org",
+		}},
+		sendmail.Result{Level: sendmail.WarnLevel, Error: &sendmail.SuppressedError{Recipient: "blocked@example.org"}, Message: "Suppressed", Fields: sendmail.Fields{
+			"message_id": "<1@example.com>",
+			"sender":     "sender@example.com",
+			"recipients": "blocked@example.org",
+		}},
+		sendmail.Result{Level: sendmail.ErrorLevel, Error: errors.New("failed to deliver to some recipients"), Message: "", Fields: sendmail.Fields{
+			"sender": "sender@example.com",
+		}},
+	)
+
+	deliveries, err := log.Find(audit.Query{MessageID: "<1@example.com>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatal("Expected 3 records got", len(deliveries))
+	}
+	status := make(map[string]audit.Delivery)
+	for _, d := range deliveries {
+		status[d.Recipient] = d
+	}
+	if d := status["user@example.org"]; d.Status != audit.StatusDelivered || d.Server != "mx2.example.org" || d.Code != 250 || d.NextAttempt != nil {
+		t.Error("Unexpected record", d)
+	}
+	if d := status["blocked@example.org"]; d.Status != audit.StatusSuppressed {
+		t.Error("Unexpected record", d)
+	}
+
+	// The bounce of another message
+	send(sendmail.Result{Level: sendmail.ErrorLevel, Error: errors.New("giving up"), Message: "Bounce", Fields: sendmail.Fields{
+		"message_id": "<2@example.com>",
+		"queue_id":   "q1",
+		"sender":     "sender@example.com",
+		"recipients": "user@example.org",
+	}})
+	deliveries, err = log.Find(audit.Query{Recipient: "USER@example.org", Since: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Status != audit.StatusBounced || deliveries[0].QueueID != "q1" {
+		t.Error("Expected bounced record first got", deliveries)
+	}
+	// The later delivery of the message updates the record
+	send(sendmail.Result{Level: sendmail.InfoLevel, Message: "Send mail OK", Fields: sendmail.Fields{
+		"message_id": "<2@example.com>",
+		"sender":     "sender@example.com",
+		"recipients": "user@example.org",
+	}})
+	deliveries, err = log.Find(audit.Query{MessageID: "<2@example.com>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != audit.StatusDelivered || !deliveries[0].Created.Before(deliveries[0].Updated) {
+		t.Error("Expected updated record got", deliveries)
+	}
+	deliveries, err = log.Find(audit.Query{Status: audit.StatusFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Error("Expected no failed records got", deliveries)
+	}
+
+	// The deferred recipient with the time of the next attempt
+	next := time.Now().Add(5 * time.Minute).Round(0)
+	send(sendmail.Result{Level: sendmail.ErrorLevel, Error: errors.New("451 Greylisted"), Message: "", Fields: sendmail.Fields{
+		"message_id":   "<3@example.com>",
+		"sender":       "sender@example.com",
+		"recipients":   "user@example.org",
+		"code":         451,
+		"next_attempt": next,
+	}})
+	deliveries, err = log.Find(audit.Query{MessageID: "<3@example.com>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].NextAttempt == nil || !deliveries[0].NextAttempt.Equal(next) {
+		t.Error("Expected next attempt", next, "got", deliveries)
+	}
+
+	// The attempts of the queued message without ID update its record
+	for _, result := range []sendmail.Result{
+		{Level: sendmail.ErrorLevel, Error: errors.New("451 Greylisted"), Message: "", Fields: sendmail.Fields{
+			"queue_id":   "q2",
+			"sender":     "noid@example.com",
+			"recipients": "user@example.org",
+		}},
+		{Level: sendmail.InfoLevel, Message: "Send mail OK", Fields: sendmail.Fields{
+			"queue_id":   "q2",
+			"sender":     "noid@example.com",
+			"recipients": "user@example.org",
+		}},
+		{Level: sendmail.InfoLevel, Message: "Send mail OK", Fields: sendmail.Fields{
+			"queue_id":   "q3",
+			"sender":     "noid@example.com",
+			"recipients": "user@example.org",
+		}},
+	} {
+		send(result)
+	}
+	deliveries, err = log.Find(audit.Query{Sender: "noid@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatal("Expected record per queued message got", deliveries)
+	}
+	for _, d := range deliveries {
+		if d.Status != audit.StatusDelivered {
+			t.Error("Expected delivered record got", d)
+		}
+	}
+}
+
+func TestOpenOlderDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The table before the next attempt was recorded
+	if _, err := db.Exec(`CREATE TABLE deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL DEFAULT '',
+		queue_id TEXT NOT NULL DEFAULT '',
+		sender TEXT NOT NULL DEFAULT '',
+		recipient TEXT NOT NULL,
+		status TEXT NOT NULL,
+		server TEXT NOT NULL DEFAULT '',
+		code INTEGER NOT NULL DEFAULT 0,
+		response TEXT NOT NULL DEFAULT '',
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	// The attempts of the message without ID recorded twice
+	now := time.Now().UnixNano()
+	for _, status := range []string{audit.StatusFailed, audit.StatusDelivered} {
+		if _, err := db.Exec(`INSERT INTO deliveries (queue_id, recipient, status, created, updated)
+			VALUES ('q1', 'user@example.org', ?, ?, ?)`, status, now, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	log, err := audit.Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	deliveries, err := log.Find(audit.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != audit.StatusDelivered {
+		t.Error("Expected the last record of the queued message got", deliveries)
+	}
+}
@@ -0,0 +1,640 @@
+package sendmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// client is a minimal SMTP client which keeps the plain text
+// of the dialogue available for the transcript, even after STARTTLS.
+type client struct {
+	conn       net.Conn
+	text       *textproto.Conn
+	serverName string
+	localName  string
+	greeting   string
+	ext        map[string]string
+	tls        bool
+	timeouts   Timeouts
+	transcript io.Writer
+}
+
+// sessionOptions of the SMTP session.
+type sessionOptions struct {
+	auth      smtp.Auth
+	tlsConfig *tls.Config
+	tlsMode   string
+	// requireTLS demands verified TLS and REQUIRETLS extension (RFC 8689).
+	requireTLS bool
+	helo       string
+	timeouts   Timeouts
+	resolver   Resolver
+	family     AddressFamily
+	// tlsReport receives the result type of STARTTLS negotiation,
+	// empty for success.
+	tlsReport func(resultType string, conn net.Conn)
+}
+
+// dialClient connect to the SMTP server and read the greeting.
+func dialClient(ctx context.Context, addr string, opts sessionOptions, transcript io.Writer) (*client, error) {
+	dialer := &net.Dialer{Timeout: opts.timeouts.Dial}
+	resolver := opts.resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	conn, err := dialResolved(ctx, dialer, resolver, opts.family, addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.tlsMode == TLSImplicit {
+		conn = tls.Client(conn, opts.tlsConfig)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c := &client{
+		serverName: host,
+		localName:  opts.helo,
+		tls:        opts.tlsMode == TLSImplicit,
+		timeouts:   opts.timeouts,
+		transcript: transcript,
+	}
+	if c.localName == "" {
+		c.localName = "localhost"
+		if hostname, err := os.Hostname(); err == nil {
+			c.localName = hostname
+		}
+	}
+	c.setConn(conn)
+	c.deadline(c.timeouts.Hello)
+	_, greeting, err := c.text.ReadResponse(220)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	c.greeting = greeting
+	return c, nil
+}
+
+// watch close the connection when the context is done,
+// stop ends the watching.
+func (c *client) watch(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	conn, done := c.conn, make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// deadline limit the time of the next command.
+func (c *client) deadline(timeout time.Duration) {
+	if timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (c *client) setConn(conn net.Conn) {
+	c.conn = conn
+	if c.transcript != nil {
+		conn = &transcriptConn{Conn: conn, w: c.transcript, prefix: c.serverName}
+	}
+	c.text = textproto.NewConn(conn)
+}
+
+func (c *client) close() error {
+	return c.text.Close()
+}
+
+func (c *client) cmd(timeout time.Duration, expectCode int, format string, args ...interface{}) (int, string, error) {
+	c.deadline(timeout)
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expectCode)
+}
+
+// hello send EHLO and fall back to HELO for old servers.
+func (c *client) hello() error {
+	_, msg, err := c.cmd(c.timeouts.Hello, 250, "EHLO %s", c.localName)
+	if err != nil {
+		c.ext = nil
+		_, _, err = c.cmd(c.timeouts.Hello, 250, "HELO %s", c.localName)
+		return err
+	}
+	c.ext = make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		args := strings.SplitN(line, " ", 2)
+		if len(args) > 1 {
+			c.ext[strings.ToUpper(args[0])] = args[1]
+		} else {
+			c.ext[strings.ToUpper(args[0])] = ""
+		}
+	}
+	return nil
+}
+
+// extension reports whether an extension is supported by the server.
+func (c *client) extension(ext string) (bool, string) {
+	param, ok := c.ext[strings.ToUpper(ext)]
+	return ok, param
+}
+
+func (c *client) startTLS(config *tls.Config) error {
+	if _, _, err := c.cmd(c.timeouts.StartTLS, 220, "STARTTLS"); err != nil {
+		return err
+	}
+	conn := tls.Client(c.conn, config)
+	c.deadline(c.timeouts.StartTLS)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.setConn(conn)
+	c.tls = true
+	return c.hello()
+}
+
+func (c *client) auth(a smtp.Auth) error {
+	encoding := base64.StdEncoding
+	_, mechs := c.extension("AUTH")
+	mech, resp, err := a.Start(&smtp.ServerInfo{
+		Name: c.serverName,
+		TLS:  c.tls,
+		Auth: strings.Fields(mechs),
+	})
+	if err != nil {
+		c.quit()
+		return err
+	}
+	code, msg64, err := c.cmd(c.timeouts.Auth, 0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, encoding.EncodeToString(resp))))
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+		case 235:
+			// the last message isn't base64 because it isn't a challenge
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			// abort the AUTH
+			c.cmd(c.timeouts.Auth, 501, "*")
+			c.quit()
+			break
+		}
+		if resp == nil {
+			break
+		}
+		code, msg64, err = c.cmd(c.timeouts.Auth, 0, encoding.EncodeToString(resp))
+	}
+	return err
+}
+
+func (c *client) mail(from string, requireTLS bool) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	cmdStr := "MAIL FROM:<%s>"
+	if ok, _ := c.extension("8BITMIME"); ok {
+		cmdStr += " BODY=8BITMIME"
+	}
+	if requireTLS {
+		cmdStr += " REQUIRETLS"
+	}
+	_, _, err := c.cmd(c.timeouts.Mail, 250, cmdStr, from)
+	return err
+}
+
+func (c *client) rcpt(to string) error {
+	if err := validateLine(to); err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(c.timeouts.Mail, 25, "RCPT TO:<%s>", to); err != nil {
+		return &RecipientError{to, err}
+	}
+	return nil
+}
+
+func (c *client) data(msg []byte) error {
+	if _, _, err := c.cmd(c.timeouts.Mail, 354, "DATA"); err != nil {
+		return err
+	}
+	c.deadline(c.timeouts.Data)
+	w := c.text.DotWriter()
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	_, _, err := c.text.ReadResponse(250)
+	return err
+}
+
+func (c *client) quit() error {
+	if _, _, err := c.cmd(c.timeouts.Mail, 221, "QUIT"); err != nil {
+		return err
+	}
+	return c.close()
+}
+
+func (c *client) reset() error {
+	_, _, err := c.cmd(c.timeouts.Mail, 250, "RSET")
+	return err
+}
+
+// sendMail connects to the server at addr, switches to TLS if possible,
+// authenticates with the optional mechanism and sends the message.
+// The recipients are split into several mail transactions by MaxRecipients
+// and the limits of the server, the sessions are reconnected as needed.
+// It returns the recipients of the completed transactions,
+// the error concerns the rest of them.
+// In dry run mode the transactions end before DATA.
+// The session is aborted when the context is done.
+func (e *Envelope) sendMail(ctx context.Context, addr string, opts sessionOptions, from string, to []string, msg []byte) ([][]string, error) {
+	if opts.requireTLS {
+		if err := opts.verifiedTLS(); err != nil {
+			return nil, &RequireTLSError{addr, err}
+		}
+	}
+	var sent [][]string
+	for {
+		done, rest, err := e.session(ctx, addr, opts, from, to, msg)
+		sent = append(sent, done...)
+		if err != nil || len(rest) == 0 {
+			return sent, err
+		}
+		to = rest
+	}
+}
+
+// session sends the message in one SMTP session. It returns the recipients
+// of the completed transactions and the rest of them left for the next
+// session when the server limits the transactions per session.
+func (e *Envelope) session(ctx context.Context, addr string, opts sessionOptions, from string, to []string, msg []byte) ([][]string, []string, error) {
+	c, err := dialClient(ctx, addr, opts, e.Transcript)
+	if err != nil {
+		return nil, to, err
+	}
+	defer c.close()
+	defer c.watch(ctx)()
+	if err = c.hello(); err != nil {
+		return nil, to, err
+	}
+	if opts.tlsMode == TLSOpportunistic || opts.tlsMode == TLSStartTLS {
+		report := func(resultType string) {
+			if opts.tlsReport != nil {
+				opts.tlsReport(resultType, c.conn)
+			}
+		}
+		if ok, _ := c.extension("STARTTLS"); ok {
+			if err = c.startTLS(opts.tlsConfig); err != nil {
+				report(tlsResultType(err))
+				if opts.requireTLS {
+					return nil, to, &RequireTLSError{addr, err}
+				}
+				return nil, to, err
+			}
+			report("")
+		} else {
+			report(TLSResultSTARTTLSNotSupported)
+			if opts.requireTLS {
+				return nil, to, &RequireTLSError{addr, errors.New("server doesn't support STARTTLS")}
+			}
+			if opts.tlsMode == TLSStartTLS {
+				return nil, to, errors.New("smtp: server doesn't support STARTTLS")
+			}
+		}
+	}
+	if opts.requireTLS {
+		if ok, _ := c.extension("REQUIRETLS"); !ok {
+			return nil, to, &RequireTLSError{addr, errors.New("server doesn't support REQUIRETLS")}
+		}
+	}
+	if opts.auth != nil {
+		if ok, _ := c.extension("AUTH"); !ok {
+			return nil, to, errors.New("smtp: server doesn't support AUTH")
+		}
+		if err = c.auth(opts.auth); err != nil {
+			return nil, to, err
+		}
+	}
+	if e.dryRun && !e.probeRecipients {
+		return [][]string{to}, nil, c.quit()
+	}
+	rcptMax, mailMax := c.limits()
+	if e.MaxRecipients > 0 && (rcptMax == 0 || e.MaxRecipients < rcptMax) {
+		rcptMax = e.MaxRecipients
+	}
+	var sent [][]string
+	for len(to) > 0 && (mailMax == 0 || len(sent) < mailMax) {
+		chunk := to
+		if rcptMax > 0 && len(chunk) > rcptMax {
+			chunk = chunk[:rcptMax]
+		}
+		accepted, err := c.transaction(from, chunk, msg, opts.requireTLS, e.dryRun)
+		if err != nil {
+			return sent, to, err
+		}
+		sent = append(sent, accepted)
+		to = to[len(accepted):]
+	}
+	return sent, to, c.quit()
+}
+
+// transaction sends the message to the recipients in one mail transaction.
+// It returns the accepted recipients, the server may defer the excess
+// of them with 452 reply (RFC 5321 section 4.5.3.1.10).
+// In dry run mode the transaction is reset before DATA.
+func (c *client) transaction(from string, to []string, msg []byte, requireTLS, dryRun bool) ([]string, error) {
+	if err := c.mail(from, requireTLS); err != nil {
+		return nil, err
+	}
+	for i, addr := range to {
+		err := c.rcpt(addr)
+		var rcptErr *RecipientError
+		if i > 0 && errors.As(err, &rcptErr) && rcptErr.Code() == 452 {
+			// Too many recipients, the rest go to the next transaction
+			to = to[:i]
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return to, c.reset()
+	}
+	return to, c.data(msg)
+}
+
+// limits return the recipients per transaction and the transactions
+// per session advertised by LIMITS extension (RFC 9422), 0 if unlimited.
+func (c *client) limits() (rcptMax, mailMax int) {
+	_, param := c.extension("LIMITS")
+	for _, limit := range strings.Fields(param) {
+		kv := strings.SplitN(limit, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n <= 0 {
+			continue
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "RCPTMAX":
+			rcptMax = n
+		case "MAILMAX":
+			mailMax = n
+		}
+	}
+	return rcptMax, mailMax
+}
+
+// verifiedTLS require STARTTLS and the verification of the server
+// certificate, the pinned certificates are verified by themselves.
+func (o *sessionOptions) verifiedTLS() error {
+	switch o.tlsMode {
+	case TLSNone:
+		return errors.New("TLS is disabled")
+	case TLSOpportunistic:
+		o.tlsMode = TLSStartTLS
+	}
+	config := o.tlsConfig.Clone()
+	if config.VerifyPeerCertificate == nil {
+		config.InsecureSkipVerify = false
+	}
+	o.tlsConfig = config
+	return nil
+}
+
+// RequireTLSError reports the server which doesn't meet
+// the REQUIRETLS option of the message (RFC 8689).
+type RequireTLSError struct {
+	Server string
+	Err    error
+}
+
+func (e *RequireTLSError) Error() string {
+	return "REQUIRETLS is not met by " + e.Server + ": " + e.Err.Error()
+}
+
+func (e *RequireTLSError) Unwrap() error {
+	return e.Err
+}
+
+// RecipientError reports the recipient rejected by the server.
+type RecipientError struct {
+	Recipient string
+	Err       error
+}
+
+func (e *RecipientError) Error() string {
+	return "recipient " + e.Recipient + ": " + e.Err.Error()
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// Code return the SMTP reply code of the rejection, 0 if unknown.
+func (e *RecipientError) Code() int {
+	return replyCode(e.Err)
+}
+
+// replyCode return the SMTP reply code of the error, 0 if unknown.
+func replyCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+// greylistRetry is the retry delay of the greylisted message
+// when the server gives no hint.
+const greylistRetry = 5 * time.Minute
+
+var (
+	retryAfterRe = regexp.MustCompile(`(?i)retry-after:?\s*(\d+)\b`)
+	retryHintRe  = regexp.MustCompile(`(?i)\b(?:retry|try again)\b[^.;]{0,20}?\bin\s+(\d+)\s*(seconds?|minutes?|hours?)\b`)
+	greylistRe   = regexp.MustCompile(`(?i)gr[ae]y-?\s?list`)
+)
+
+// retryHint return the retry delay suggested by the temporary failure
+// of the server, "retry-after: 300", "try again in 5 minutes" or
+// greylisting, 0 if none.
+func retryHint(err error) time.Duration {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code < 400 || protoErr.Code >= 500 {
+		return 0
+	}
+	if m := retryAfterRe.FindStringSubmatch(protoErr.Msg); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return time.Duration(n) * time.Second
+	}
+	if m := retryHintRe.FindStringSubmatch(protoErr.Msg); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		unit := time.Second
+		switch strings.ToLower(m[2])[0] {
+		case 'm':
+			unit = time.Minute
+		case 'h':
+			unit = time.Hour
+		}
+		return time.Duration(n) * unit
+	}
+	if greylistRe.MatchString(protoErr.Msg) {
+		return greylistRetry
+	}
+	return 0
+}
+
+// chunkFields return the copy of fields for the recipients of one transaction.
+func chunkFields(fields Fields, to []string) Fields {
+	chunk := make(Fields, len(fields))
+	for k, v := range fields {
+		chunk[k] = v
+	}
+	chunk["recipients"] = strings.Join(to, ",")
+	return chunk
+}
+
+// attemptFields add the message ID, the SMTP reply code, the duration
+// of the session started at start and the retry hint of the temporary
+// failure with the time of the next attempt to the fields.
+func (e *Envelope) attemptFields(fields Fields, start time.Time, err error) Fields {
+	if id := e.Header.Get("Message-Id"); id != "" {
+		fields["message_id"] = id
+	}
+	if code := replyCode(err); code != 0 {
+		fields["code"] = code
+	} else if err == nil {
+		fields["code"] = 250
+	}
+	fields["duration"] = time.Since(start)
+	if retryAfter := retryHint(err); retryAfter > 0 {
+		fields["retry_after"] = retryAfter
+		fields["next_attempt"] = time.Now().Add(retryAfter)
+	}
+	return fields
+}
+
+// loginAuth implements the LOGIN authentication mechanism.
+type loginAuth struct {
+	username, password, host string
+}
+
+// LoginAuth returns an Auth that implements the LOGIN authentication
+// mechanism. Like smtp.PlainAuth it only sends the credentials
+// over TLS or to localhost.
+func LoginAuth(username, password, host string) smtp.Auth {
+	return &loginAuth{username, password, host}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
+
+// validateLine checks to see if a line has CR or LF as per RFC 5321
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\n\r") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	return nil
+}
+
+// transcriptConn copies the SMTP dialogue line by line to the writer.
+type transcriptConn struct {
+	net.Conn
+	w      io.Writer
+	prefix string
+	in     []byte
+	out    []byte
+}
+
+func (t *transcriptConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.in = t.log(t.in, b[:n], "<<<")
+	return n, err
+}
+
+func (t *transcriptConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.out = t.log(t.out, b[:n], ">>>")
+	return n, err
+}
+
+// log write complete lines from the buffer, keeping the incomplete tail.
+func (t *transcriptConn) log(buf, data []byte, direction string) []byte {
+	buf = append(buf, data...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return buf
+		}
+		line := bytes.TrimRight(buf[:i], "\r")
+		fmt.Fprintf(t.w, "%s %s %s\n", t.prefix, direction, line)
+		buf = buf[i+1:]
+	}
+}
+
+// syncWriter serializes writes from concurrent deliveries.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
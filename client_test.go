@@ -0,0 +1,348 @@
+package sendmail_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestTranscript(t *testing.T) {
+	test.StartSMTP()
+
+	transcript := new(bytes.Buffer)
+	config := testConfigs[0].initial
+	config.Transcript = transcript
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range envelope.SendSmarthost("localhost:"+test.PortSMTP, "", "") {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+
+	for _, expected := range []string{
+		"localhost <<< 220 ",
+		"localhost >>> MAIL FROM:<sender@localhost>",
+		"localhost >>> RCPT TO:<recipient@localhost>",
+		"localhost >>> TEST",
+		"localhost >>> .",
+		"localhost <<< 221 ",
+	} {
+		if !strings.Contains(transcript.String(), expected) {
+			t.Errorf("Expected %q in transcript:\n%s", expected, transcript)
+		}
+	}
+}
+
+func TestDataLineEndings(t *testing.T) {
+	test.StartSMTP()
+
+	transcript := new(bytes.Buffer)
+	config := testConfigs[0].initial
+	config.Body = []byte("line1\n.\nline3\rline4\n..\n.")
+	config.Transcript = transcript
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range envelope.SendSmarthost("localhost:"+test.PortSMTP, "", "") {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+
+	lines := strings.Split(transcript.String(), "\n")
+	var data []string
+	for i, line := range lines {
+		if strings.HasSuffix(line, ">>> line1") {
+			for _, line := range lines[i:] {
+				data = append(data, strings.SplitN(line, ">>> ", 2)[1])
+				if strings.HasSuffix(line, ">>> .") {
+					break
+				}
+			}
+			break
+		}
+	}
+	expected := []string{"line1", "..", "line3", "line4", "...", "..", "."}
+	if strings.Join(data, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected data lines %q got %q", expected, data)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	test.StartSMTP()
+
+	transcript := new(bytes.Buffer)
+	config := testConfigs[0].initial
+	config.SmartHost = "localhost:" + test.PortSMTP
+	config.Transcript = transcript
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := envelope.DryRun(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range errs {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+
+	if !strings.Contains(transcript.String(), ">>> RCPT TO:<recipient@localhost>") {
+		t.Errorf("Expected RCPT probe in transcript:\n%s", transcript)
+	}
+	if strings.Contains(transcript.String(), ">>> DATA") {
+		t.Errorf("Unexpected DATA in transcript:\n%s", transcript)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// The server accepts connections and never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := testConfigs[0].initial
+	config.Timeouts = sendmail.Timeouts{Hello: 100 * time.Millisecond}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var failed bool
+	for result := range envelope.SendSmarthost(listener.Addr().String(), "", "") {
+		if result.Level < sendmail.WarnLevel {
+			failed = true
+			if netErr, ok := result.Error.(net.Error); !ok || !netErr.Timeout() {
+				t.Error("Expected timeout error got", result.Error)
+			}
+		}
+	}
+	if !failed {
+		t.Error("Expected delivery error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Delivery took", elapsed)
+	}
+}
+
+// requireTLSServer is SMTPS server announcing REQUIRETLS,
+// it returns the address and the public key pin of its certificate.
+func requireTLSServer(t *testing.T) (string, string) {
+	srv := httptest.NewTLSServer(nil)
+	config, cert := srv.TLS.Clone(), srv.Certificate()
+	srv.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			text := textproto.NewConn(conn)
+			text.PrintfLine("220 localhost ESMTP")
+			for {
+				line, err := text.ReadLine()
+				if err != nil {
+					break
+				}
+				switch {
+				case strings.HasPrefix(line, "EHLO"):
+					text.PrintfLine("250-localhost\r\n250 REQUIRETLS")
+				case strings.HasPrefix(line, "MAIL") && !strings.HasSuffix(line, " REQUIRETLS"):
+					text.PrintfLine("530 5.7.10 REQUIRETLS needed")
+				case line == "DATA":
+					text.PrintfLine("354 Go ahead")
+					text.ReadDotBytes()
+					text.PrintfLine("250 OK")
+				case line == "QUIT":
+					text.PrintfLine("221 Bye")
+				default:
+					text.PrintfLine("250 OK")
+				}
+			}
+			conn.Close()
+		}
+	}()
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return l.Addr().String(), "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+}
+
+func TestRequireTLS(t *testing.T) {
+	test.StartSMTP()
+	addr, pin := requireTLSServer(t)
+
+	for _, tc := range []struct {
+		relay     sendmail.RelayConfig
+		delivered bool
+	}{
+		{sendmail.RelayConfig{Host: addr, TLS: sendmail.TLSImplicit, TLSPins: []string{pin}}, true},
+		// The certificate isn't signed by trusted CA
+		{sendmail.RelayConfig{Host: addr, TLS: sendmail.TLSImplicit}, false},
+		// The test server doesn't offer STARTTLS
+		{sendmail.RelayConfig{Host: "localhost:" + test.PortSMTP}, false},
+		{sendmail.RelayConfig{Host: "localhost:" + test.PortSMTP, TLS: sendmail.TLSNone}, false},
+	} {
+		config := testConfigs[0].initial
+		config.RequireTLS = true
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for result := range envelope.SendRelay(tc.relay) {
+			if delivered := result.Level == sendmail.InfoLevel; delivered != tc.delivered {
+				t.Errorf("Relay %s %q: expected delivered %v got %v", tc.relay.Host, tc.relay.TLS, tc.delivered, result.Error)
+			}
+			var requireTLS *sendmail.RequireTLSError
+			if !tc.delivered && tc.relay.TLS != sendmail.TLSImplicit && !errors.As(result.Error, &requireTLS) {
+				t.Error("Expected REQUIRETLS error got", result.Error)
+			}
+		}
+	}
+}
+
+// limitsServer is SMTP server advertising LIMITS RCPTMAX=3 MAILMAX=2 and
+// deferring the recipients after the second one of a transaction, it
+// rejects the recipient bad@localhost. It returns the address and
+// the recipients of the received messages.
+func limitsServer(t *testing.T) (string, func() []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	var received []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			text := textproto.NewConn(conn)
+			text.PrintfLine("220 localhost ESMTP")
+			var rcpts []string
+			for {
+				line, err := text.ReadLine()
+				if err != nil {
+					break
+				}
+				switch {
+				case strings.HasPrefix(line, "EHLO"):
+					text.PrintfLine("250-localhost\r\n250 LIMITS RCPTMAX=3 MAILMAX=2")
+				case strings.HasPrefix(line, "MAIL"):
+					rcpts = nil
+					text.PrintfLine("250 OK")
+				case strings.HasPrefix(line, "RCPT") && len(rcpts) == 2:
+					text.PrintfLine("452 4.5.3 Too many recipients")
+				case line == "RCPT TO:<bad@localhost>":
+					text.PrintfLine("550 5.1.1 No such user")
+				case strings.HasPrefix(line, "RCPT"):
+					rcpts = append(rcpts, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+					text.PrintfLine("250 OK")
+				case line == "DATA":
+					text.PrintfLine("354 Go ahead")
+					text.ReadDotBytes()
+					mu.Lock()
+					received = append(received, strings.Join(rcpts, ","))
+					mu.Unlock()
+					text.PrintfLine("250 OK")
+				case line == "QUIT":
+					text.PrintfLine("221 Bye")
+				default:
+					text.PrintfLine("250 OK")
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+}
+
+func TestRecipientLimits(t *testing.T) {
+	for _, tc := range []struct {
+		recipients    []string
+		maxRecipients int
+		delivered     []string
+		failed        string
+	}{
+		{
+			recipients: []string{"r1@localhost", "r2@localhost", "r3@localhost", "r4@localhost", "r5@localhost"},
+			// Two transactions per session, the third one reconnects
+			delivered: []string{"r1@localhost,r2@localhost", "r3@localhost,r4@localhost", "r5@localhost"},
+		},
+		{
+			recipients:    []string{"r1@localhost", "r2@localhost"},
+			maxRecipients: 1,
+			delivered:     []string{"r1@localhost", "r2@localhost"},
+		},
+		{
+			recipients: []string{"r1@localhost", "r2@localhost", "bad@localhost", "r4@localhost"},
+			delivered:  []string{"r1@localhost,r2@localhost"},
+			failed:     "bad@localhost,r4@localhost",
+		},
+	} {
+		addr, received := limitsServer(t)
+		config := testConfigs[0].initial
+		config.Recipients = tc.recipients
+		config.MaxRecipients = tc.maxRecipients
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delivered []string
+		var failed string
+		for result := range envelope.SendSmarthost(addr, "", "") {
+			if result.Level == sendmail.InfoLevel {
+				delivered = append(delivered, result.Fields["recipients"].(string))
+			} else {
+				failed = result.Fields["recipients"].(string)
+			}
+		}
+		if strings.Join(delivered, "|") != strings.Join(tc.delivered, "|") {
+			t.Errorf("Expected delivered %q got %q", tc.delivered, delivered)
+		}
+		if failed != tc.failed {
+			t.Errorf("Expected failed %q got %q", tc.failed, failed)
+		}
+		if got := received(); strings.Join(got, "|") != strings.Join(tc.delivered, "|") {
+			t.Errorf("Expected received %q got %q", tc.delivered, got)
+		}
+	}
+}
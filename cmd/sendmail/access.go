@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/n0madic/sendmail"
+)
+
+// accessFormatCommon is the Common Log Format with the message ID and
+// the duration appended
+const accessFormatCommon = "common"
+
+// accessEntry is the record of HTTP request or SMTP transaction
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Protocol  string    `json:"protocol"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Request   string    `json:"request"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	MessageID string    `json:"message_id,omitempty"`
+	Duration  float64   `json:"duration"`
+}
+
+// accessLogger write the access log of the server modes
+type accessLogger struct {
+	mu     sync.Mutex
+	path   string
+	format string
+	w      io.Writer
+	file   *os.File
+}
+
+// openAccessLog open the access log of the file, - is standard output
+func openAccessLog(path, format string) (*accessLogger, error) {
+	switch format {
+	case "":
+		format = accessFormatCommon
+	case accessFormatCommon, sendmail.LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, expected common or json", format)
+	}
+	l := &accessLogger{path: path, format: format, w: os.Stdout}
+	if path != "-" {
+		if err := l.reopen(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// reopen open the file again after the rotation
+func (l *accessLogger) reopen() error {
+	if l == nil || l.path == "-" {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %s", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, l.w = file, file
+	return nil
+}
+
+// log write the entry, the nil logger is disabled
+func (l *accessLogger) log(entry accessEntry) {
+	if l == nil {
+		return
+	}
+	line := bytes.NewBuffer(nil)
+	if l.format == sendmail.LogFormatJSON {
+		enc := json.NewEncoder(line)
+		enc.SetEscapeHTML(false)
+		enc.Encode(entry)
+	} else {
+		fmt.Fprintf(line, "%s - %s [%s] %q %d %d %q %.3f\n",
+			orDash(entry.Client),
+			orDash(entry.User),
+			entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Request,
+			entry.Status,
+			entry.Bytes,
+			orDash(entry.MessageID),
+			entry.Duration,
+		)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line.Bytes())
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessClient return the IP address of the client, empty for Unix sockets
+func accessClient(addr string) string {
+	if ip := remoteIP(addr); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// accessRecorder capture the status of the response
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// accessBody count the bytes of the request body
+type accessBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *accessBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// accessHandler log the requests to the access log,
+// the bytes are the size of the received message
+func accessHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		body := &accessBody{ReadCloser: r.Body}
+		r.Body = body
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		accessLog.log(accessEntry{
+			Time:      start,
+			Protocol:  "http",
+			Client:    accessClient(r.RemoteAddr),
+			User:      accessUser(r),
+			Request:   r.Method + " " + r.URL.RequestURI() + " " + r.Proto,
+			Status:    rec.status,
+			Bytes:     body.bytes,
+			MessageID: w.Header().Get("Message-Id"),
+			Duration:  time.Since(start).Seconds(),
+		})
+	})
+}
+
+// accessUser return the name of the token of the request
+func accessUser(r *http.Request) string {
+	token := r.Header.Get("Token")
+	if token == "" {
+		return ""
+	}
+	if limits, ok := httpTokens.lookup(token); ok && limits.Name != "" {
+		return limits.Name
+	}
+	if token == httpToken {
+		return "admin"
+	}
+	return ""
+}
+
+// logAccess log the transaction of the session with the reply of the error
+func (s *Session) logAccess(err error, defaultCode int, size int64, messageID string) {
+	if accessLog == nil {
+		return
+	}
+	entry := accessEntry{
+		Time:      s.started,
+		Protocol:  "smtp",
+		User:      s.username,
+		Request:   "MAIL FROM:<" + s.From + ">",
+		Status:    250,
+		Bytes:     size,
+		MessageID: messageID,
+		Duration:  time.Since(s.started).Seconds(),
+	}
+	if s.state != nil && s.state.RemoteAddr != nil {
+		entry.Client = accessClient(s.state.RemoteAddr.String())
+	}
+	if len(s.To) > 0 {
+		entry.Request += " RCPT TO:<" + strings.Join(s.To, ">,<") + "> DATA"
+	}
+	if err != nil {
+		entry.Status = defaultCode
+		var reply *smtp.SMTPError
+		if errors.As(err, &reply) {
+			entry.Status = reply.Code
+		}
+	}
+	accessLog.log(entry)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+// bulkMessage is a message of mailbox with the key in resume file
+type bulkMessage struct {
+	key  string
+	body []byte
+}
+
+// readMbox call fn for every message of mbox file, the key is
+// the number of the message. The >From lines are unescaped (mboxrd).
+func readMbox(path string, fn func(bulkMessage) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var body []byte
+	count := 0
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		// The blank line before the next From line is the separator
+		if bytes.HasSuffix(body, []byte("\r\n")) {
+			body = body[:len(body)-2]
+		} else {
+			body = bytes.TrimSuffix(body, []byte("\n"))
+		}
+		return fn(bulkMessage{key: strconv.Itoa(count), body: body})
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				count++
+				body = nil
+			case count > 0:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				body = append(body, line...)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// readMaildir call fn for every message of new and cur directories
+// of maildir, the key is the unique name of the message file.
+func readMaildir(dir string, fn func(bulkMessage) error) error {
+	var files []string
+	for _, sub := range []string{"new", "cur"} {
+		list, err := filepath.Glob(filepath.Join(dir, sub, "*"))
+		if err != nil {
+			return err
+		}
+		files = append(files, list...)
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(filepath.Join(dir, "cur")); err != nil {
+			return fmt.Errorf("%s is not a maildir: %s", dir, err)
+		}
+	}
+	// The unique names start with the delivery time
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		// The flags are changed by mail clients
+		key := strings.SplitN(filepath.Base(file), ":", 2)[0]
+		if err := fn(bulkMessage{key: key, body: body}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBulk send every message of the mbox file or the maildir,
+// the sent messages are appended to the resume file and skipped
+// on the next run. It exits with error if any message failed.
+func runBulk() {
+	done := make(map[string]bool)
+	var resume *os.File
+	if resumeFile != "" {
+		if data, err := ioutil.ReadFile(resumeFile); err == nil {
+			for _, key := range strings.Fields(string(data)) {
+				done[key] = true
+			}
+		} else if !os.IsNotExist(err) {
+			log.Fatalf("Failed to read resume file: %s", err)
+		}
+		var err error
+		resume, err = os.OpenFile(resumeFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open resume file: %s", err)
+		}
+		defer resume.Close()
+	}
+
+	var sent, skipped, failed int
+	send := func(msg bulkMessage) error {
+		if done[msg.key] {
+			skipped++
+			return nil
+		}
+		if !sendBulkMessage(msg) {
+			failed++
+			return nil
+		}
+		sent++
+		if resume != nil {
+			if _, err := fmt.Fprintln(resume, msg.key); err != nil {
+				return fmt.Errorf("Failed to write resume file: %s", err)
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if mboxFile != "" {
+		err = readMbox(mboxFile, send)
+	} else {
+		err = readMaildir(maildirDir, send)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.WithFields(log.Fields{
+		"sent":    sent,
+		"skipped": skipped,
+		"failed":  failed,
+	}).Warnf("Sent %d messages", sent)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// sendBulkMessage send the message to the recipients of the arguments
+// or of its headers, it logs the results and reports the success
+func sendBulkMessage(msg bulkMessage) bool {
+	errs, err := sendBulk(msg)
+	if err != nil {
+		log.WithFields(log.Fields{"message": msg.key}).Error(err)
+		return false
+	}
+	ok := true
+	for result := range record(errs) {
+		fields := getLogFields(result.Fields)
+		fields["message"] = msg.key
+		switch {
+		case result.Level > sendmail.WarnLevel:
+			log.WithFields(fields).Info(result.Message)
+		case result.Level == sendmail.WarnLevel:
+			log.WithFields(fields).Warn(result.Error)
+		default:
+			log.WithFields(fields).Error(result.Error)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// sendBulk start the delivery of the message
+func sendBulk(msg bulkMessage) (<-chan sendmail.Result, error) {
+	config := deliveryConfig()
+	config.Sender = sender
+	config.Recipients = flag.Args()
+	config.Body = msg.body
+	config.ExtractRecipients = extractRcpts || len(config.Recipients) == 0
+	config.ExcludeRecipients = excludeArgs
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		return nil, err
+	}
+	if err := receive(&envelope, sendmail.Received{Protocol: "local"}); err != nil {
+		return nil, err
+	}
+	if _, err := envelope.SetMessageID(); err != nil {
+		return nil, err
+	}
+	senderDomain := sendmail.GetDomainFromAddress(envelope.GetSender())
+	if !enforceSender(&envelope) {
+		return nil, fmt.Errorf("Attempt to unauthorized send with domain %s", senderDomain)
+	}
+	return envelope.Send()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// collect return the messages read by the reader.
+func collect(t *testing.T, read func(string, func(bulkMessage) error) error, path string) []bulkMessage {
+	var messages []bulkMessage
+	err := read(path, func(msg bulkMessage) error {
+		messages = append(messages, bulkMessage{key: msg.key, body: append([]byte(nil), msg.body...)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func TestReadMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name     string
+		mbox     string
+		expected []bulkMessage
+	}{
+		{"empty", "", nil},
+		{
+			"mboxrd",
+			"From sender@localhost Mon Jan  1 00:00:00 2024\nSubject: one\n\n>From the start\n>>From quoted\n>Fromage\n\n" +
+				"From sender@localhost Mon Jan  1 00:00:01 2024\nSubject: two\n\nbody\n",
+			[]bulkMessage{
+				{"1", []byte("Subject: one\n\nFrom the start\n>From quoted\n>Fromage\n")},
+				{"2", []byte("Subject: two\n\nbody")},
+			},
+		},
+		{
+			"last line without line break",
+			"From sender@localhost Mon Jan  1 00:00:00 2024\nSubject: one\n\nbody\n\n" +
+				"From sender@localhost Mon Jan  1 00:00:01 2024\nSubject: two\n\nlast line",
+			[]bulkMessage{
+				{"1", []byte("Subject: one\n\nbody\n")},
+				{"2", []byte("Subject: two\n\nlast line")},
+			},
+		},
+		{
+			"text before first From line",
+			"garbage\nFrom sender@localhost Mon Jan  1 00:00:00 2024\r\nSubject: one\r\n\r\nbody\r\n",
+			[]bulkMessage{{"1", []byte("Subject: one\r\n\r\nbody")}},
+		},
+	} {
+		path := filepath.Join(dir, "mbox")
+		if err := ioutil.WriteFile(path, []byte(tc.mbox), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if messages := collect(t, readMbox, path); !reflect.DeepEqual(messages, tc.expected) {
+			t.Errorf("%s: expected %q got %q", tc.name, tc.expected, messages)
+		}
+	}
+
+	if err := readMbox(filepath.Join(dir, "missing"), func(bulkMessage) error { return nil }); err == nil {
+		t.Error("Expected error of missing mbox")
+	}
+}
+
+func TestReadMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name     string
+		files    map[string]string
+		expected []bulkMessage
+	}{
+		{"empty", map[string]string{"cur/": ""}, nil},
+		{
+			"new and cur",
+			map[string]string{
+				"new/1700000002.M2P2.localhost":      "Subject: new\n\nbody\n",
+				"cur/1700000001.M1P1.localhost:2,S":  "Subject: seen\n\nbody\n",
+				"cur/1700000003.M3P3.localhost:2,RS": "Subject: replied\n\nbody",
+				"tmp/1700000000.M0P0.localhost":      "Subject: in delivery\n\nbody\n",
+			},
+			[]bulkMessage{
+				{"1700000001.M1P1.localhost", []byte("Subject: seen\n\nbody\n")},
+				{"1700000002.M2P2.localhost", []byte("Subject: new\n\nbody\n")},
+				{"1700000003.M3P3.localhost", []byte("Subject: replied\n\nbody")},
+			},
+		},
+	} {
+		maildir := filepath.Join(dir, tc.name)
+		for name, body := range tc.files {
+			path := filepath.Join(maildir, name)
+			if strings.HasSuffix(name, "/") {
+				if err := os.MkdirAll(path, 0700); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if messages := collect(t, readMaildir, maildir); !reflect.DeepEqual(messages, tc.expected) {
+			t.Errorf("%s: expected %q got %q", tc.name, tc.expected, messages)
+		}
+	}
+
+	if err := readMaildir(dir, func(bulkMessage) error { return nil }); err == nil {
+		t.Error("Expected error of directory which is not a maildir")
+	}
+}
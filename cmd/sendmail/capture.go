@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+// capturedMessage is the message kept by the capture mode
+type capturedMessage struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Size    int       `json:"size"`
+	Raw     string    `json:"raw,omitempty"`
+}
+
+// captureStore is the transport keeping the messages in memory
+// instead of delivery, the oldest are dropped over the limit
+type captureStore struct {
+	mu       sync.Mutex
+	limit    int
+	seq      int
+	messages []*capturedMessage
+}
+
+// Deliver capture the message for all recipients
+func (s *captureStore) Deliver(ctx context.Context, e *sendmail.Envelope) ([]sendmail.RecipientResult, error) {
+	data, err := e.GenerateMessage()
+	if err != nil {
+		return nil, err
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(e.Header.Get("Subject"))
+	if err != nil {
+		subject = e.Header.Get("Subject")
+	}
+
+	s.mu.Lock()
+	s.seq++
+	s.messages = append(s.messages, &capturedMessage{
+		ID:      strconv.Itoa(s.seq),
+		Created: time.Now(),
+		From:    e.GetSender(),
+		To:      e.Recipients,
+		Subject: subject,
+		Size:    len(data),
+		Raw:     string(data),
+	})
+	if s.limit > 0 && len(s.messages) > s.limit {
+		s.messages = s.messages[len(s.messages)-s.limit:]
+	}
+	s.mu.Unlock()
+
+	results := make([]sendmail.RecipientResult, 0, len(e.Recipients))
+	for _, rcpt := range e.Recipients {
+		results = append(results, sendmail.RecipientResult{Recipient: rcpt, Server: "capture"})
+	}
+	return results, nil
+}
+
+// list return the messages without content, the newest first
+func (s *captureStore) list() []capturedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]capturedMessage, 0, len(s.messages))
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		msg := *s.messages[i]
+		msg.Raw = ""
+		list = append(list, msg)
+	}
+	return list
+}
+
+// get return the message by ID, nil if not found
+func (s *captureStore) get(id string) *capturedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range s.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// remove the message by ID or all messages for empty ID,
+// it reports whether anything was removed
+func (s *captureStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id == "" {
+		removed := len(s.messages) > 0
+		s.messages = nil
+		return removed
+	}
+	for i, msg := range s.messages {
+		if msg.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// messagesHandler serve the JSON API of the captured messages:
+// GET /api/v1/messages, GET and DELETE /api/v1/messages/<id>,
+// GET /api/v1/messages/<id>/raw and DELETE /api/v1/messages
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/messages"), "/")
+	id := strings.TrimSuffix(path, "/raw")
+	switch {
+	case r.Method == "GET" && path == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(captured.list())
+	case r.Method == "GET":
+		msg := captured.get(id)
+		if msg == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if id != path {
+			w.Header().Set("Content-Type", "message/rfc822")
+			fmt.Fprint(w, msg.Raw)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+	case r.Method == "DELETE" && id == path:
+		if !captured.remove(id) && id != "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Sorry, only GET and DELETE methods are supported.")
+	}
+}
+
+var captureTemplate = template.Must(template.New("capture").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Captured mail</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ddd; padding: 0.4em; text-align: left; }
+pre { background: #f6f6f6; padding: 1em; white-space: pre-wrap; }
+form { display: inline; }
+</style>
+</head>
+<body>
+{{if .Message}}{{with .Message}}
+<p><a href="/capture/">&larr; All messages</a></p>
+<h2>{{.Subject}}</h2>
+<p>From {{.From}} to {{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}, {{.Created.Format "2006-01-02 15:04:05"}}</p>
+<p><a href="/capture/{{.ID}}/raw">Source</a>
+<form method="post" action="/capture/"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="delete" value="{{.ID}}"><button>Delete</button></form></p>
+<pre>{{.Raw}}</pre>
+{{end}}{{else}}
+<h2>Captured mail</h2>
+<form method="post" action="/capture/"><input type="hidden" name="csrf" value="{{.CSRF}}"><input type="hidden" name="delete" value="*"><button>Delete all</button></form>
+<table>
+<tr><th>Time</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+{{range .Messages}}<tr>
+<td>{{.Created.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.From}}</td>
+<td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td>
+<td><a href="/capture/{{.ID}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a></td>
+<td>{{.Size}}</td>
+</tr>{{else}}<tr><td colspan="5">No messages</td></tr>{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+var (
+	// captureCSRF is the token of the forms of the capture pages
+	captureCSRF     string
+	captureCSRFOnce sync.Once
+)
+
+// csrfToken return the random token of the forms,
+// the pages of other sites can't read it
+func csrfToken() string {
+	captureCSRFOnce.Do(func() {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		captureCSRF = hex.EncodeToString(b)
+	})
+	return captureCSRF
+}
+
+// uiAuthorized check the -httpToken of the capture pages given as
+// the password of HTTP basic authentication, as browsers can't send
+// the Token header. The pages are disabled without -httpToken and
+// the tokens of the configuration file are refused.
+func uiAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if httpToken == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Capture pages are disabled without -httpToken")
+		return false
+	}
+	if _, password, ok := r.BasicAuth(); ok &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(httpToken)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="Captured mail", charset="UTF-8"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprint(w, "Unauthorized")
+	return false
+}
+
+// captureUIHandler serve the web pages of the captured messages
+// with the message source at /capture/<id>/raw
+func captureUIHandler(w http.ResponseWriter, r *http.Request) {
+	if !uiAuthorized(w, r) {
+		return
+	}
+	if r.Method == "POST" {
+		if subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(csrfToken())) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Invalid form token")
+			return
+		}
+		id := r.FormValue("delete")
+		if id == "*" {
+			id = ""
+		}
+		captured.remove(id)
+		http.Redirect(w, r, "/capture/", http.StatusSeeOther)
+		return
+	}
+	data := struct {
+		Messages []capturedMessage
+		Message  *capturedMessage
+		CSRF     string
+	}{CSRF: csrfToken()}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/capture"), "/")
+	if id := strings.TrimSuffix(path, "/raw"); id != "" {
+		if data.Message = captured.get(id); data.Message == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if id != path {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, data.Message.Raw)
+			return
+		}
+	} else {
+		data.Messages = captured.list()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	captureTemplate.Execute(w, data)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// browse send the request of the capture pages with the password
+func browse(method, path, password string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if password != "" {
+		r.SetBasicAuth("developer", password)
+	}
+	w := httptest.NewRecorder()
+	captureUIHandler(w, r)
+	return w
+}
+
+func TestCaptureUI(t *testing.T) {
+	store := testHTTP(t, nil)
+	for i := 0; i < 2; i++ {
+		if w := post("", nil); w.Code != http.StatusOK {
+			t.Fatal("Expected captured message got", w.Code, w.Body)
+		}
+	}
+
+	if w := browse("GET", "/capture/", "", nil); w.Code != http.StatusForbidden {
+		t.Error("Expected pages disabled without -httpToken got", w.Code, w.Body)
+	}
+
+	httpToken = "admin"
+	w := browse("GET", "/capture/", "", nil)
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Error("Expected basic authentication request got", w.Code, w.Header())
+	}
+	if w := browse("GET", "/capture/", "wrong", nil); w.Code != http.StatusUnauthorized {
+		t.Error("Expected unauthorized wrong password got", w.Code)
+	}
+	if w := browse("GET", "/capture/1", "admin", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), csrfToken()) {
+		t.Error("Expected message page with form token got", w.Code, w.Body)
+	}
+	if w := browse("GET", "/capture/1/raw", "admin", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Subject: Test") {
+		t.Error("Expected message source got", w.Code, w.Body)
+	}
+
+	// The form of other site has no token
+	for _, token := range []string{"", "forged"} {
+		if w := browse("POST", "/capture/", "admin", url.Values{"delete": {"*"}, "csrf": {token}}); w.Code != http.StatusForbidden {
+			t.Errorf("Expected refused form with token %q got %d", token, w.Code)
+		}
+	}
+	if messages := store.list(); len(messages) != 2 {
+		t.Fatal("Expected messages kept got", len(messages))
+	}
+	if w := browse("POST", "/capture/", "admin", url.Values{"delete": {"1"}, "csrf": {csrfToken()}}); w.Code != http.StatusSeeOther {
+		t.Error("Expected deleted message got", w.Code, w.Body)
+	}
+	if messages := store.list(); len(messages) != 1 || messages[0].ID != "2" {
+		t.Error("Expected message 2 kept got", messages)
+	}
+}
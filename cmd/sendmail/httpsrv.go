@@ -1,23 +1,78 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/audit"
 	log "github.com/sirupsen/logrus"
 )
 
+// authenticate check the token of request, it returns the limits of
+// the tokens of the configuration file and nil for -httpToken token
+// or when no tokens are set
+func authenticate(w http.ResponseWriter, r *http.Request) (*sendmail.HTTPToken, bool) {
+	token := r.Header.Get("Token")
+	if httpToken == "" && httpTokens.empty() || httpToken != "" && token == httpToken {
+		return nil, true
+	}
+	if limits, ok := httpTokens.lookup(token); ok {
+		return &limits, true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	log.Errorf("Attempt to unauthorized request with token %s", token)
+	fmt.Fprint(w, "Unauthorized")
+	return nil, false
+}
+
+// authorized check the token of request to the administration
+// endpoints, they are disabled without -httpToken and the tokens
+// of the configuration file are refused
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if httpToken == "" {
+		w.WriteHeader(http.StatusForbidden)
+		log.Errorf("Attempt to request %s without -httpToken", r.URL.Path)
+		fmt.Fprint(w, "Administration endpoints are disabled without -httpToken")
+		return false
+	}
+	limits, ok := authenticate(w, r)
+	if ok && limits != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Errorf("Attempt to unauthorized request with token of %s", limits.Name)
+		fmt.Fprint(w, "Unauthorized")
+		return false
+	}
+	return ok
+}
+
 func handler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		if httpToken != "" && r.Header.Get("Token") != httpToken {
-			w.WriteHeader(http.StatusUnauthorized)
-			log.Errorf("Attempt to unauthorized send with token %s", r.Header.Get("Token"))
-			fmt.Fprint(w, "Unauthorized")
+		limits, ok := authenticate(w, r)
+		if !ok {
 			return
 		}
+		if key := r.Header.Get("Idempotency-Key"); key != "" && idempotency != nil {
+			// The keys of the services never collide
+			if limits != nil {
+				key = limits.Name + "\x00" + key
+			}
+			entry, replay := idempotency.begin(key)
+			if replay {
+				log.Infof("Replay response to request with idempotency key %s", r.Header.Get("Idempotency-Key"))
+				entry.replay(w)
+				return
+			}
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer idempotency.finish(key, entry, rec)
+			w = rec
+		}
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -27,30 +82,95 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Query().Get("to") != "" {
 			recipients = strings.Split(r.URL.Query().Get("to"), ",")
 		}
-		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
-			Sender:     r.URL.Query().Get("from"),
-			Recipients: recipients,
-			Subject:    r.URL.Query().Get("subject"),
-			Body:       body,
-		})
+		config := deliveryConfig()
+		config.Sender = r.URL.Query().Get("from")
+		config.Recipients = recipients
+		config.Subject = r.URL.Query().Get("subject")
+		config.Body = body
+		if r.URL.Query().Get("priority") != "" {
+			config.Priority, err = sendmail.ParsePriority(r.URL.Query().Get("priority"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+		}
+		envelope, err := sendmail.NewEnvelope(&config)
+		var accepted bool
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err)
 		} else {
-			senderDomain := sendmail.GetDomainFromAddress(envelope.Header["From"][0])
-			if len(senderDomains) > 0 && !senderDomains.Contains(senderDomain) {
+			senderDomain := sendmail.GetDomainFromAddress(envelope.GetSender())
+			if !enforceSender(&envelope) {
 				w.WriteHeader(http.StatusUnauthorized)
 				log.Errorf("Attempt to unauthorized send with domain %s", senderDomain)
 				fmt.Fprint(w, "Unauthorized sender domain")
 				return
 			}
-			errs, err := envelope.Send()
+			if limits != nil {
+				switch {
+				case !limits.AllowSender(envelope.GetSender()):
+					w.WriteHeader(http.StatusUnauthorized)
+					log.Errorf("Attempt to unauthorized send of %s with domain %s", limits.Name, senderDomain)
+					fmt.Fprint(w, "Unauthorized sender domain")
+					return
+				case limits.MaxRecipients > 0 && len(envelope.Recipients) > limits.MaxRecipients:
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "Too many recipients, the limit is %d", limits.MaxRecipients)
+					return
+				case !httpTokens.reserve(r.Header.Get("Token"), limits.DailyQuota):
+					w.WriteHeader(http.StatusTooManyRequests)
+					log.Warnf("Daily quota of %s is exceeded", limits.Name)
+					fmt.Fprint(w, "Daily quota exceeded")
+					return
+				}
+				// The refused message doesn't count
+				defer func() {
+					if !accepted {
+						httpTokens.release(r.Header.Get("Token"))
+					}
+				}()
+			}
+			received := sendmail.Received{Protocol: "HTTP", RemoteIP: remoteIP(r.RemoteAddr)}
+			if r.TLS != nil {
+				received.Protocol, received.TLS = "HTTPS", r.TLS
+			}
+			if err := receive(&envelope, received); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, err)
+				return
+			}
+			messageID, err := envelope.SetMessageID()
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprint(w, err)
 				return
 			}
-			for result := range errs {
+			w.Header().Set("Message-Id", messageID)
+			errs, err := envelope.Send()
+			accepted = err == nil
+			if err != nil {
+				var refused *sendmail.RefusedError
+				var loop *sendmail.LoopError
+				switch {
+				case errors.As(err, &loop):
+					// The permanent refusal like 554 of SMTP mode
+					log.Warn(err)
+					w.WriteHeader(http.StatusForbidden)
+				case !errors.As(err, &refused):
+					w.WriteHeader(http.StatusInternalServerError)
+				case refused.Temporary():
+					log.Warn(err)
+					w.WriteHeader(http.StatusServiceUnavailable)
+				default:
+					log.Warn(err)
+					w.WriteHeader(http.StatusForbidden)
+				}
+				fmt.Fprint(w, err)
+				return
+			}
+			for result := range record(errs) {
 				switch {
 				case result.Level > sendmail.WarnLevel:
 					log.WithFields(getLogFields(result.Fields)).Info(result.Message)
@@ -70,9 +190,110 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// verifyHandler return the verdict of address validation as JSON
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Sorry, only GET method are supported.")
+		return
+	}
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Missing address parameter")
+		return
+	}
+	verdict, err := sendmail.ValidateAddress(r.Context(), address, verifyOptions())
+	if err != nil {
+		log.Warnf("Failed to verify %s: %s", address, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verdict)
+}
+
+// deliveriesHandler return the records of the audit log matching
+// the query parameters as JSON
+func deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Sorry, only GET method are supported.")
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	if auditLog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Audit log is disabled")
+		return
+	}
+	params := r.URL.Query()
+	query := audit.Query{
+		MessageID: params.Get("message_id"),
+		Sender:    params.Get("sender"),
+		Recipient: params.Get("recipient"),
+		Status:    params.Get("status"),
+	}
+	var err error
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Invalid %s parameter: %s", name, err)
+				return
+			}
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid limit parameter: %s", err)
+			return
+		}
+	}
+	deliveries, err := auditLog.Find(query)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []audit.Delivery{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
 func startHTTP(bindAddr string) {
+	if idempotencyWindow > 0 {
+		idempotency = newIdempotencyCache(idempotencyWindow)
+	}
 	http.HandleFunc("/", handler)
+	http.HandleFunc("/api/v1/verify", verifyHandler)
+	http.HandleFunc("/api/v1/deliveries", deliveriesHandler)
+	http.HandleFunc("/api/v1/reload", reloadHandler)
+	http.HandleFunc("/api/v1/queue", queueHandler)
+	http.HandleFunc("/api/v1/queue/", queueHandler)
+	if captured != nil {
+		http.HandleFunc("/api/v1/messages", messagesHandler)
+		http.HandleFunc("/api/v1/messages/", messagesHandler)
+		http.HandleFunc("/capture/", captureUIHandler)
+	}
 
-	log.Info("Starting HTTP server at ", bindAddr)
-	log.Fatal(http.ListenAndServe(bindAddr, nil))
+	l, err := listen(bindAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen HTTP: %s", err)
+	}
+	log.Info("Starting HTTP server at ", l.Addr())
+	var h http.Handler = http.DefaultServeMux
+	if accessLog != nil {
+		h = accessHandler(h)
+	}
+	log.Fatal(http.Serve(l, h))
 }
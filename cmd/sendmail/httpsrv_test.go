@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+// testHTTP set the HTTP mode with the capture transport and the tokens
+// of the configuration file, the settings are restored after the test
+func testHTTP(t *testing.T, tokens map[string]sendmail.HTTPToken) *captureStore {
+	dir, err := ioutil.TempDir("", "sendmail-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "sendmail.yaml")
+	if err := ioutil.WriteFile(config, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	savedConfig, savedCaptured, savedToken, savedTokens, savedIdempotency := configFile, captured, httpToken, httpTokens, idempotency
+	t.Cleanup(func() {
+		configFile, captured, httpToken, httpTokens, idempotency = savedConfig, savedCaptured, savedToken, savedTokens, savedIdempotency
+		os.RemoveAll(dir)
+	})
+	configFile = config
+	captured = &captureStore{}
+	httpToken = ""
+	httpTokens = &tokenRegistry{}
+	httpTokens.set(tokens)
+	idempotency = newIdempotencyCache(time.Hour)
+	return captured
+}
+
+// post the message with the token and the headers to the handler
+func post(token string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/?from=sender@example.com&to=user@example.com", strings.NewReader("Subject: Test\r\n\r\nTEST"))
+	r.Header.Set("Token", token)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestIdempotency(t *testing.T) {
+	store := testHTTP(t, map[string]sendmail.HTTPToken{
+		"secret1": {Name: "billing"},
+		"secret2": {Name: "shop"},
+	})
+
+	key := map[string]string{"Idempotency-Key": "order-1"}
+	first := post("secret1", key)
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("Expected sent message got", first.Code, first.Body)
+	}
+	// The same key of other service is another message
+	if w := post("secret2", key); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected sent message of other token got", w.Code, w.Header())
+	}
+	w := post("secret1", key)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected replayed response got", w.Code, w.Header())
+	}
+	if w.Header().Get("Message-Id") != first.Header().Get("Message-Id") {
+		t.Errorf("Expected Message-Id %s got %s", first.Header().Get("Message-Id"), w.Header().Get("Message-Id"))
+	}
+	if messages := store.list(); len(messages) != 2 {
+		t.Error("Expected 2 messages got", len(messages))
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := testHTTP(t, map[string]sendmail.HTTPToken{
+		"secret1": {Name: "billing", SenderDomains: []string{"example.com"}, DailyQuota: 2},
+		"secret2": {Name: "shop", SenderDomains: []string{"shop.example.com"}},
+	})
+	httpToken = "admin"
+
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"unknown", http.StatusUnauthorized},
+		{"admin", http.StatusOK},
+		{"secret1", http.StatusOK},
+		{"secret1", http.StatusOK},
+		// The daily quota of 2 messages is exhausted
+		{"secret1", http.StatusTooManyRequests},
+		// The sender domain is not allowed
+		{"secret2", http.StatusUnauthorized},
+	} {
+		if w := post(tc.token, nil); w.Code != tc.code {
+			t.Errorf("Token %q: expected status %d got %d: %s", tc.token, tc.code, w.Code, w.Body)
+		}
+	}
+	if messages := store.list(); len(messages) != 3 {
+		t.Error("Expected 3 messages got", len(messages))
+	}
+
+	// The reload keeps the count of the day
+	httpTokens.set(map[string]sendmail.HTTPToken{"secret1": {Name: "billing", DailyQuota: 3}})
+	if w := post("secret1", nil); w.Code != http.StatusOK {
+		t.Error("Expected sent message got", w.Code, w.Body)
+	}
+	if w := post("secret1", nil); w.Code != http.StatusTooManyRequests {
+		t.Error("Expected exhausted quota after reload got", w.Code, w.Body)
+	}
+
+	// The tokens of the configuration file are refused by the administration endpoints
+	for token, code := range map[string]int{"admin": http.StatusOK, "secret1": http.StatusUnauthorized} {
+		r := httptest.NewRequest("GET", "/api/v1/queue", nil)
+		r.Header.Set("Token", token)
+		w := httptest.NewRecorder()
+		if authorized(w, r) != (code == http.StatusOK) || code != http.StatusOK && w.Code != code {
+			t.Errorf("Token %q: expected status %d of administration got %d", token, code, w.Code)
+		}
+	}
+}
+
+func TestQuotaRefused(t *testing.T) {
+	store := testHTTP(t, map[string]sendmail.HTTPToken{"secret": {Name: "billing", DailyQuota: 1}})
+	defer func(saved []sendmail.Middleware) { middleware = saved }(middleware)
+	middleware = []sendmail.Middleware{func(ctx context.Context, e *sendmail.Envelope) error {
+		return errors.New("blocked")
+	}}
+
+	if w := post("secret", nil); w.Code != http.StatusForbidden {
+		t.Error("Expected refused message got", w.Code, w.Body)
+	}
+	if messages := store.list(); len(messages) != 0 {
+		t.Error("Expected no message got", len(messages))
+	}
+
+	// The refused message doesn't count in the daily quota
+	middleware = nil
+	if w := post("secret", nil); w.Code != http.StatusOK {
+		t.Error("Expected sent message got", w.Code, w.Body)
+	}
+	if w := post("secret", nil); w.Code != http.StatusTooManyRequests {
+		t.Error("Expected exhausted quota got", w.Code, w.Body)
+	}
+}
+
+func TestLoopRefused(t *testing.T) {
+	store := testHTTP(t, nil)
+	defer func(saved int) { maxHops = saved }(maxHops)
+	maxHops = 2
+
+	body := "Received: from a.example.com by b.example.com; Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"Received: from c.example.com by a.example.com; Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"Subject: Test\r\n\r\nTEST"
+	r := httptest.NewRequest("POST", "/?from=sender@example.com&to=user@example.com", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected permanent refusal of loop got", w.Code, w.Body)
+	}
+	if messages := store.list(); len(messages) != 0 {
+		t.Error("Expected no message got", len(messages))
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotentResponse is the response to the request with Idempotency-Key
+type idempotentResponse struct {
+	created   time.Time
+	done      chan struct{}
+	status    int
+	body      []byte
+	messageID string
+}
+
+// idempotencyCache remember successful responses for the window
+type idempotencyCache struct {
+	window  time.Duration
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		entries: make(map[string]*idempotentResponse),
+	}
+}
+
+// begin return the response of the key, replay is true when the key
+// was already seen and the response must be waited for and repeated
+func (c *idempotencyCache) begin(key string) (response *idempotentResponse, replay bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.Sub(entry.created) > c.window {
+			delete(c.entries, k)
+		}
+	}
+	if entry, ok := c.entries[key]; ok {
+		return entry, true
+	}
+	entry := &idempotentResponse{created: now, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, false
+}
+
+// finish store the recorded response, failed requests are forgotten
+// to allow the retry
+func (c *idempotencyCache) finish(key string, entry *idempotentResponse, rec *responseRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.status = rec.status
+	entry.body = rec.body.Bytes()
+	entry.messageID = rec.Header().Get("Message-Id")
+	if entry.status >= 300 {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+}
+
+// replay write the original response
+func (entry *idempotentResponse) replay(w http.ResponseWriter) {
+	<-entry.done
+	if entry.messageID != "" {
+		w.Header().Set("Message-Id", entry.messageID)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// responseRecorder copy the response written to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
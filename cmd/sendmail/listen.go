@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// systemdListeners are the sockets passed by systemd by their names
+	systemdListeners     []systemdListener
+	systemdListenersErr  error
+	systemdListenersOnce sync.Once
+)
+
+// systemdListener is the socket passed by systemd
+type systemdListener struct {
+	name     string
+	listener net.Listener
+}
+
+// listen return the listener of the bind address:
+// unix:/path or the absolute path of Unix socket,
+// systemd:name of the socket passed by systemd (LISTEN_FDS)
+// with FileDescriptorName or its number from 0, TCP address otherwise
+func listen(bindAddr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(bindAddr, "systemd:"):
+		return systemdListen(strings.TrimPrefix(bindAddr, "systemd:"))
+	case strings.HasPrefix(bindAddr, "unix:"):
+		return unixListen(strings.TrimPrefix(bindAddr, "unix:"))
+	case strings.HasPrefix(bindAddr, "/"):
+		return unixListen(bindAddr)
+	}
+	return net.Listen("tcp", bindAddr)
+}
+
+// loopback reports whether the bind address is reachable
+// from the host only: Unix socket or loopback TCP address
+func loopback(bindAddr string) bool {
+	switch {
+	case strings.HasPrefix(bindAddr, "systemd:"):
+		return false
+	case strings.HasPrefix(bindAddr, "unix:"), strings.HasPrefix(bindAddr, "/"):
+		return true
+	}
+	host, _, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// unixListen listen on the Unix socket, the stale socket is removed
+func unixListen(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// systemdListen return the socket passed by systemd by name or number
+func systemdListen(name string) (net.Listener, error) {
+	systemdListenersOnce.Do(func() {
+		systemdListeners, systemdListenersErr = systemdSockets()
+	})
+	if systemdListenersErr != nil {
+		return nil, systemdListenersErr
+	}
+	for _, l := range systemdListeners {
+		if l.name == name {
+			return l.listener, nil
+		}
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(systemdListeners) {
+		return systemdListeners[i].listener, nil
+	}
+	return nil, fmt.Errorf("socket %q is not passed by systemd", name)
+}
+
+// systemdSockets return the sockets of socket activation protocol,
+// the environment is cleared so the child processes don't inherit them
+func systemdSockets() ([]systemdListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets are passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("no sockets are passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// The passed sockets start after stdin, stdout and stderr
+	const firstFD = 3
+	listeners := make([]systemdListener, count)
+	for i := range listeners {
+		file := os.NewFile(uintptr(firstFD+i), "systemd socket")
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d: %s", i, err)
+		}
+		listeners[i].listener = l
+		if i < len(names) {
+			listeners[i].name = names[i]
+		}
+	}
+	return listeners, nil
+}
@@ -4,15 +4,38 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/audit"
+	"github.com/n0madic/sendmail/queuestore"
+	"github.com/n0madic/sendmail/suppressionstore"
 	log "github.com/sirupsen/logrus"
 )
 
+type arrayFlags []string
+
+func (a *arrayFlags) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *arrayFlags) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
 type arrayDomains []string
 
 func (d *arrayDomains) String() string {
@@ -34,40 +57,303 @@ func (d *arrayDomains) Contains(str string) bool {
 }
 
 var (
-	httpMode      bool
-	httpBind      string
-	httpToken     string
-	ignored       bool
-	ignoreDot     bool
-	sender        string
-	senderDomains arrayDomains
-	smtpMode      bool
-	smtpBind      string
-	subject       string
-	verbose       bool
+	accessLog         *accessLogger
+	accessLogFile     string
+	accessLogFormat   string
+	addressFamily     string
+	archive           *sendmail.Archive
+	archiveAddress    string
+	archiveDir        string
+	archiveDomains    arrayDomains
+	attachments       arrayFlags
+	auditDB           string
+	auditLog          *audit.Log
+	auditRetention    time.Duration
+	captureMode       bool
+	captureLimit      int
+	captured          *captureStore
+	checkDomain       string
+	clamdAddress      string
+	concurrency       int
+	configFile        string
+	contentType       string
+	deferQueue        *sendmail.Queue
+	dkimSelector      string
+	dmarcCheck        string
+	dryRun            bool
+	dryRunRcpt        bool
+	excludeArgs       bool
+	extractRcpts      bool
+	htmlBody          bool
+	htmlFile          string
+	httpMode          bool
+	httpBind          string
+	httpToken         string
+	idempotency       *idempotencyCache
+	idempotencyWindow time.Duration
+	ignoreDot         bool
+	individualCopies  bool
+	inFile            string
+	logFormat         string
+	logTarget         string
+	maildirDir        string
+	maxHops           int
+	maxRecipients     int
+	mboxFile          string
+	mergeConcurrency  int
+	mergeFile         string
+	middleware        []sendmail.Middleware
+	mxCacheSize       int
+	mxCacheTTL        time.Duration
+	mxCacheDNS        bool
+	priority          string
+	quarantineDir     string
+	noImplicitMX      bool
+	preserveHeaders   bool
+	queueDir          string
+	queueInterval     time.Duration
+	queueOnly         bool
+	queueRun          bool
+	queueStore        string
+	rateLimiter       *sendmail.RateLimiter
+	requireTLS        bool
+	resumeFile        string
+	sender            string
+	senderName        string
+	sendingIP         string
+	addressPolicy     sendmail.AddressFamily
+	resolver          sendmail.Resolver
+	rewrite           *sendmail.RewriteRules
+	senderDomains     arrayDomains
+	senderPolicy      string
+	senderRewrite     string
+	smtpMode          bool
+	smtpBind          string
+	spamFilterURL     string
+	spamRejectScore   float64
+	syslogFacility    string
+	templateFile      string
+	subject           string
+	suppressFile      string
+	suppression       sendmail.SuppressionList
+	tlsReporter       *sendmail.TLSReporter
+	tlsReportOrg      string
+	tlsReportMail     string
+	transcript        string
+	verbose           bool
+	verify            bool
+	virusAction       string
 )
 
 func main() {
-	flag.BoolVar(&ignored, "t", true, "Extract recipients from message headers. IGNORED")
+	flag.BoolVar(&extractRcpts, "t", false, "Extract recipients from message headers. Addresses given as arguments are added to them.")
+	flag.BoolVar(&excludeArgs, "excludeRecipients", false, "With -t, exclude addresses given as arguments from the recipients instead of adding them.")
 	flag.BoolVar(&ignoreDot, "i", false, "When reading a message from standard input, don't treat a line with only a . character as the end of input.")
 	flag.BoolVar(&verbose, "v", false, "Enable verbose logging for debugging purposes.")
+	flag.StringVar(&logTarget, "log", "", "Log destination: stderr or syslog (stderr if not set in the configuration file).")
+	flag.StringVar(&logFormat, "logFormat", "", "Log format: text or json with all fields of deliveries (text if not set in the configuration file).")
+	flag.StringVar(&syslogFacility, "syslogFacility", "", "Facility of syslog messages (mail if not set in the configuration file).")
+	flag.BoolVar(&queueOnly, "odq", false, "Queue the message for later delivery without attempting immediate delivery.")
+	flag.BoolVar(&queueRun, "q", false, "Process the queued messages and exit.")
+	flag.StringVar(&priority, "priority", "", "Priority class of the message in the queue: transactional, normal or bulk (from headers by default).")
+	flag.StringVar(&queueDir, "queueDir", sendmail.DefaultQueueDir, "Directory for queued messages.")
+	flag.StringVar(&queueStore, "queueStore", "", "Queue store shared by the instances: sqlite:/path/queue.db or redis://host:6379/0 (-queueDir if not set in the configuration file).")
+	flag.DurationVar(&queueInterval, "queueInterval", 0, "Interval of queue processing in HTTP/SMTP server mode (0 to disable).")
 	flag.StringVar(&sender, "f", "", "Set the envelope sender address.")
+	flag.StringVar(&sender, "r", "", "Alias for -f (obsolete).")
+	flag.StringVar(&senderName, "F", "", "Set the full name of the sender.")
+	flag.BoolVar(&ignoreDot, "oi", false, "Same as -i.")
+	flag.StringVar(&inFile, "infile", "", "Read the message from the file instead of standard input.")
+	flag.StringVar(&inFile, "body-file", "", "Alias for -infile.")
 	flag.StringVar(&subject, "s", "", "Specify subject on command line.")
+	flag.Var(&attachments, "a", "Attach the file to the message. Can be repeated many times.")
+	flag.StringVar(&contentType, "content-type", "", "Set the content type of the message body read from standard input.")
+	flag.BoolVar(&htmlBody, "html", false, "Mark the message body as HTML (same as -content-type 'text/html; charset=utf-8').")
+	flag.StringVar(&htmlFile, "html-file", "", "Add HTML version of the message from the file, standard input is the plain text version.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Check the delivery and print the SMTP transcript without sending the message.")
+	flag.BoolVar(&dryRunRcpt, "dry-run-rcpt", false, "With -dry-run, also probe the sender and recipients with MAIL and RCPT commands.")
+	flag.BoolVar(&verify, "verify", false, "Verify deliverability of the addresses given as arguments with MX lookup and RCPT callout.")
+	flag.StringVar(&checkDomain, "check-domain", "", "Check the sending setup of the domain: PTR of -sendingIP or outgoing address, SPF, DKIM key of -dkimSelector and DMARC.")
+	flag.StringVar(&dkimSelector, "dkimSelector", "", "DKIM selector of the signing key checked by -check-domain.")
+	flag.BoolVar(&preserveHeaders, "preserveHeaders", false, "Keep the headers of the message byte for byte in the original order (e.g. DKIM signed messages).")
+	flag.StringVar(&mboxFile, "mbox", "", "Send every message of the mbox file to the recipients of arguments or headers.")
+	flag.StringVar(&maildirDir, "maildir", "", "Send every message of the maildir to the recipients of arguments or headers.")
+	flag.StringVar(&resumeFile, "resumeFile", "", "File of the messages sent from -mbox or -maildir, they are skipped when resumed.")
+	flag.StringVar(&mergeFile, "merge", "", "Send a message of -template for every row of the CSV file, the header row names the fields.")
+	flag.StringVar(&templateFile, "template", "", "Template of the message with headers for -merge (Go text/template).")
+	flag.IntVar(&mergeConcurrency, "mergeConcurrency", 4, "Number of parallel deliveries of -merge messages.")
+	flag.StringVar(&transcript, "X", "", "Append a transcript of the SMTP dialogue to the log file.")
+
+	flag.StringVar(&addressFamily, "addressFamily", "prefer-ipv6", "Address family policy of connections: prefer-ipv6, prefer-ipv4, ipv4-only or ipv6-only.")
+	flag.StringVar(&dmarcCheck, "dmarcCheck", "", "Check the message passes DMARC policy reject of the sender domain: warn or refuse (empty to disable).")
+	flag.StringVar(&sendingIP, "sendingIP", "", "Public IP address of outgoing connections for SPF evaluation of the DMARC check.")
+	flag.StringVar(&suppressFile, "suppressionFile", "", "File of addresses and domains never mailed or sqlite:/path/suppression.db, unknown users are added to it.")
+	flag.IntVar(&concurrency, "concurrency", sendmail.DefaultConcurrency, "Number of parallel deliveries to domains of recipients of a message.")
+	flag.BoolVar(&noImplicitMX, "noImplicitMX", false, "Don't deliver to A/AAAA records of domains without MX records.")
+	flag.BoolVar(&individualCopies, "individualCopies", false, "Deliver separate copy of a message to every recipient with To header of the recipient.")
+	flag.IntVar(&maxHops, "maxHops", sendmail.DefaultMaxHops, "Refuse messages with more Received headers as a mail loop.")
+	flag.IntVar(&maxRecipients, "maxRecipients", 0, "Deliver a message to at most that many recipients per SMTP transaction (0 for the limit of the server).")
+	flag.BoolVar(&requireTLS, "requireTLS", false, "Deliver messages only over verified TLS to servers supporting REQUIRETLS (RFC 8689).")
+	flag.StringVar(&archiveDir, "archiveDir", "", "Directory of date partitioned copies of the sent messages (empty to disable).")
+	flag.StringVar(&archiveAddress, "archiveAddress", "", "Address receiving a blind copy of the sent messages (empty to disable).")
+	flag.Var(&archiveDomains, "archiveSenderDomain", "Archive only the messages of the sender domain (otherwise all domains). Can be repeated many times.")
+	flag.StringVar(&auditDB, "auditDB", "", "SQLite database of delivery records queryable with /api/v1/deliveries (empty to disable).")
+	flag.DurationVar(&auditRetention, "auditRetention", audit.DefaultRetention, "Retention of delivery records in the audit database.")
+	flag.StringVar(&clamdAddress, "clamd", "", "Scan messages with clamd at Unix socket path or TCP host:port before delivery (empty to disable).")
+	flag.StringVar(&virusAction, "virusAction", "", "Action on infected messages: reject or quarantine (reject if not set in the configuration file).")
+	flag.StringVar(&quarantineDir, "quarantineDir", "", "Directory of the quarantined infected messages.")
+	flag.StringVar(&spamFilterURL, "spamFilter", "", "Check messages with rspamd (http://localhost:11333) or spamd (spamd://localhost:783) before delivery (empty to disable).")
+	flag.Float64Var(&spamRejectScore, "spamRejectScore", 0, "Reject spam of spamd with the score over the value, otherwise mark it (0 to never reject).")
+	flag.StringVar(&configFile, "config", "", "Configuration file merged over the system and user files (or SENDMAIL_CONFIG env).")
 
 	flag.BoolVar(&httpMode, "http", false, "Enable HTTP server mode.")
-	flag.StringVar(&httpBind, "httpBind", "localhost:8080", "TCP address to HTTP listen on.")
-	flag.StringVar(&httpToken, "httpToken", "", "Use authorization token to receive mail (Token: header).")
+	flag.StringVar(&httpBind, "httpBind", "localhost:8080", "TCP address, Unix socket (unix:/path) or systemd socket (systemd:name) to HTTP listen on.")
+	flag.StringVar(&httpToken, "httpToken", "", "Use authorization token to receive mail (Token: header), the only token of the administration endpoints, disabled without it.")
+	flag.StringVar(&accessLogFile, "accessLog", "", "Access log file of HTTP requests and SMTP transactions, - for standard output (empty to disable).")
+	flag.StringVar(&accessLogFormat, "accessLogFormat", accessFormatCommon, "Format of the access log: common or json.")
+	flag.DurationVar(&idempotencyWindow, "idempotencyWindow", 24*time.Hour, "Window of HTTP submissions deduplication by Idempotency-Key header (0 to disable).")
 	flag.BoolVar(&smtpMode, "smtp", false, "Enable SMTP server mode.")
-	flag.StringVar(&smtpBind, "smtpBind", "localhost:25", "TCP or Unix address to SMTP listen on.")
+	flag.BoolVar(&captureMode, "capture", false, "Enable HTTP and SMTP servers capturing mail without delivery for development, browse it at /capture/ of HTTP server.")
+	flag.IntVar(&captureLimit, "captureLimit", 1000, "Number of messages kept in capture mode, the oldest are dropped.")
+	flag.IntVar(&mxCacheSize, "mxCache", 1000, "Number of domains in MX records cache of server mode (0 to disable).")
+	flag.DurationVar(&mxCacheTTL, "mxCacheTTL", 5*time.Minute, "Time the MX records are cached, unless -mxCacheDNS.")
+	flag.BoolVar(&mxCacheDNS, "mxCacheDNS", false, "Query the nameservers of /etc/resolv.conf directly to cache MX records for their DNS TTL.")
+	flag.StringVar(&smtpBind, "smtpBind", "localhost:25", "TCP address, Unix socket (unix:/path) or systemd socket (systemd:name) to SMTP listen on.")
+	flag.StringVar(&tlsReportOrg, "tlsReportOrg", "", "Organization name of daily SMTP TLS reports (RFC 8460) sent in server mode (empty to disable).")
+	flag.StringVar(&tlsReportMail, "tlsReportMail", "", "Contact address of SMTP TLS reports, also used as their sender.")
 	flag.Var(&senderDomains, "senderDomain", "Domain of the sender from which mail is allowed (otherwise all domains). Can be repeated many times.")
+	flag.StringVar(&senderPolicy, "senderPolicy", senderPolicyReject, "Policy of the senders of other domains than -senderDomain: reject or rewrite to -senderRewrite address.")
+	flag.StringVar(&senderRewrite, "senderRewrite", "", "Sender address of the rewrite policy, the original is kept in X-Original-From header.")
 
 	flag.Parse()
 
-	if !verbose {
+	setupLog()
+	// Structured log is for ingestion of all deliveries
+	if !verbose && logFormat != sendmail.LogFormatJSON {
 		log.SetLevel(log.WarnLevel)
 	}
 
+	family, err := sendmail.ParseAddressFamily(addressFamily)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addressPolicy = family
+
+	switch dmarcCheck {
+	case "", sendmail.DMARCCheckWarn, sendmail.DMARCCheckRefuse:
+	default:
+		log.Fatalf("Unknown DMARC check mode %q, expected warn or refuse", dmarcCheck)
+	}
+	switch senderPolicy {
+	case senderPolicyReject:
+	case senderPolicyRewrite:
+		if _, err := mail.ParseAddress(senderRewrite); err != nil {
+			log.Fatalf("Invalid sender rewrite address %q: %s", senderRewrite, err)
+		}
+	default:
+		log.Fatalf("Unknown sender policy %q, expected reject or rewrite", senderPolicy)
+	}
+	if sendingIP != "" && net.ParseIP(sendingIP) == nil {
+		log.Fatalf("Invalid sending IP %q", sendingIP)
+	}
+	if suppressFile != "" {
+		list, err := suppressionstore.Open(suppressFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		suppression = list
+	}
+	// Invalid configuration is reported by the delivery
+	fileConfig, _ := sendmail.LoadConfig(configFile)
+	if err := fileOptions(fileConfig); err != nil {
+		log.Fatal(err)
+	}
+	if queueStore == "" && fileConfig != nil {
+		queueStore = fileConfig.QueueStore
+	}
+	if auditDB != "" && !verify {
+		auditLog, err = audit.Open(auditDB, auditRetention)
+		if err != nil {
+			log.Fatalf("Failed to open audit database: %s", err)
+		}
+	}
+
+	if captureMode {
+		// Captured mail is never relayed, queued mail as well
+		httpMode, smtpMode = true, true
+		queueInterval = 0
+		captured = &captureStore{limit: captureLimit}
+	}
+
+	if httpMode || smtpMode || queueRun {
+		config, err := sendmail.LoadConfig(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := serverOptions(config); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if queueRun {
+		runQueue()
+		return
+	}
+
+	if verify {
+		runVerify(flag.Args())
+		return
+	}
+
+	if checkDomain != "" {
+		runCheckDomain(checkDomain)
+		return
+	}
+
+	if mergeFile != "" {
+		if templateFile == "" {
+			log.Fatal("Template of -merge is not set")
+		}
+		runMerge()
+		return
+	}
+
+	if mboxFile != "" || maildirDir != "" {
+		runBulk()
+		return
+	}
+
 	if httpMode || smtpMode {
+		if mxCacheSize > 0 {
+			var lookup sendmail.Resolver = net.DefaultResolver
+			if mxCacheDNS {
+				lookup = sendmail.NewDNSResolver()
+			}
+			cache := sendmail.NewCachingResolver(lookup, mxCacheSize)
+			cache.DefaultTTL = mxCacheTTL
+			resolver = cache
+		}
+		if tlsReportOrg != "" {
+			reporter := sendmail.NewTLSReporter(tlsReportOrg, tlsReportMail)
+			reporter.Config = deliveryConfig()
+			reporter.Config.Sender = tlsReportMail
+			tlsReporter = reporter
+			go runTLSReports(reporter)
+		}
+		if queueInterval > 0 {
+			go func() {
+				for {
+					runQueue()
+					time.Sleep(queueInterval)
+				}
+			}()
+		}
+		if accessLogFile != "" {
+			if accessLog, err = openAccessLog(accessLogFile, accessLogFormat); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go reloadOnHangup()
 		if httpMode {
 			go startHTTP(httpBind)
 		}
@@ -76,50 +362,111 @@ func main() {
 		}
 		select {}
 	} else {
-		stat, _ := os.Stdin.Stat()
-		if (stat.Mode() & os.ModeCharDevice) != 0 {
-			log.Fatal("no stdin input")
+		body, err := readMessage()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(body) == 0 {
+			log.Fatal("Empty message body")
 		}
 
-		var body []byte
-		bio := bufio.NewReader(os.Stdin)
-		for {
-			line, err := bio.ReadBytes('\n')
-			if err == io.EOF {
-				break
-			}
+		var transcriptLog io.Writer
+		if transcript != "" {
+			logFile, err := os.OpenFile(transcript, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 			if err != nil {
-				log.Fatal(err)
+				log.Fatalf("Failed to open transcript log: %s", err)
 			}
-			if !ignoreDot && bytes.Equal(bytes.Trim(line, "\n"), []byte(".")) {
-				break
+			defer logFile.Close()
+			transcriptLog = logFile
+		}
+		if dryRun {
+			// The transcript is the result of dry run
+			if transcriptLog != nil {
+				transcriptLog = io.MultiWriter(transcriptLog, os.Stdout)
+			} else {
+				transcriptLog = os.Stdout
 			}
-			body = append(body, line...)
 		}
-		if len(body) == 0 {
-			log.Fatal("Empty message body")
+
+		if htmlBody {
+			contentType = "text/html; charset=utf-8"
+		}
+		var html []byte
+		if htmlFile != "" {
+			var err error
+			html, err = ioutil.ReadFile(htmlFile)
+			if err != nil {
+				log.Fatalf("Failed to read HTML file: %s", err)
+			}
 		}
 
-		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
-			Sender:     sender,
-			Recipients: flag.Args(),
-			Subject:    subject,
-			Body:       body,
-		})
+		config := deliveryConfig()
+		config.Sender = sender
+		config.SenderName = senderName
+		config.Recipients = flag.Args()
+		config.Subject = subject
+		config.Body = body
+		config.Transcript = transcriptLog
+		config.ContentType = contentType
+		config.HTMLBody = html
+		config.Attachments = attachments
+		config.ExtractRecipients = extractRcpts
+		config.ExcludeRecipients = excludeArgs
+		if priority != "" {
+			config.Priority, err = sendmail.ParsePriority(priority)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		envelope, err := sendmail.NewEnvelope(&config)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if err := receive(&envelope, sendmail.Received{Protocol: "local"}); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := envelope.SetMessageID(); err != nil {
+			log.Fatal(err)
+		}
 
 		senderDomain := sendmail.GetDomainFromAddress(envelope.GetSender())
-		if len(senderDomains) > 0 && !senderDomains.Contains(senderDomain) {
+		if !enforceSender(&envelope) {
 			log.Fatalf("Attempt to unauthorized send with domain %s", senderDomain)
 		}
 
-		errs, err := envelope.Send()
+		if queueOnly {
+			queue, err := newQueue()
+			if err != nil {
+				log.Fatalf("Failed to open queue: %s", err)
+			}
+			if err := envelope.Process(context.Background()); err != nil {
+				log.Fatal(err)
+			}
+			if len(envelope.Recipients) == 0 {
+				log.Warn("Message is held by processing and not queued")
+				return
+			}
+			if err := archive.Store(&envelope); err != nil {
+				log.Fatalf("Failed to archive: %s", err)
+			}
+			id, err := queue.Enqueue(&envelope)
+			if err != nil {
+				log.Fatalf("Failed to queue: %s", err)
+			}
+			log.Infof("Message queued as %s", id)
+			return
+		}
+
+		var errs <-chan sendmail.Result
+		if dryRun {
+			errs, err = envelope.DryRun(dryRunRcpt)
+		} else {
+			errs, err = envelope.Send()
+		}
 		if err != nil {
 			log.Fatalf("Failed to send: %s", err)
 		}
-		for result := range errs {
+		for result := range record(errs) {
 			switch {
 			case result.Level > sendmail.WarnLevel:
 				log.WithFields(getLogFields(result.Fields)).Info(result.Message)
@@ -132,10 +479,412 @@ func main() {
 	}
 }
 
+// readMessage return the message of the input file or standard input
+func readMessage() ([]byte, error) {
+	if inFile != "" {
+		body, err := ioutil.ReadFile(inFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read message file: %s", err)
+		}
+		return body, nil
+	}
+
+	stat, _ := os.Stdin.Stat()
+	if (stat.Mode() & os.ModeCharDevice) != 0 {
+		return nil, errors.New("no stdin input")
+	}
+
+	return readBody(os.Stdin)
+}
+
+// readBody read the message until EOF or the line with a single dot
+// (unless -i is set), the last line may lack the line break
+func readBody(r io.Reader) ([]byte, error) {
+	var body []byte
+	bio := bufio.NewReader(r)
+	for {
+		line, err := bio.ReadBytes('\n')
+		if err == io.EOF {
+			// The last line without line break
+			body = append(body, line...)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ignoreDot && bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(".")) {
+			break
+		}
+		body = append(body, line...)
+	}
+	return body, nil
+}
+
+// runQueue attempt delivery of all queued messages
+func runQueue() {
+	queue, err := openQueue()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	logQueueResults(queue.Run())
+}
+
+var (
+	// sharedStore is the queue store of -queueStore or -queueDir opened once
+	sharedStore   sendmail.QueueStore
+	sharedStoreMu sync.Mutex
+	// sharedQueue is the queue of the queue runner and the
+	// administration API, replaced by the reload
+	sharedQueue *sendmail.Queue
+)
+
+// newQueue return the queue of -queueStore or -queueDir,
+// the queues of the process share one store
+func newQueue() (*sendmail.Queue, error) {
+	sharedStoreMu.Lock()
+	defer sharedStoreMu.Unlock()
+	if sharedStore == nil {
+		var store sendmail.QueueStore
+		var err error
+		if queueStore == "" {
+			store, err = sendmail.NewDirQueueStore(queueDir)
+		} else {
+			store, err = queuestore.Open(queueStore)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sharedStore = store
+	}
+	return &sendmail.Queue{Store: sharedStore}, nil
+}
+
+// configQueue return the queue with the delivery options
+// and the retry policy of the configuration file
+func configQueue(config *sendmail.FileConfig) (*sendmail.Queue, error) {
+	queue, err := newQueue()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open queue: %s", err)
+	}
+	queue.Config = deliveryConfig()
+	queue.RetryPolicy = config.Retry
+	queue.Concurrency = config.QueueConcurrency
+	return queue, nil
+}
+
+// openQueue return the queue shared by the queue runner
+// and the administration API, so a retry requested by the API
+// and the runner never deliver the same message twice
+func openQueue() (*sendmail.Queue, error) {
+	optionsMu.RLock()
+	queue := sharedQueue
+	optionsMu.RUnlock()
+	if queue != nil {
+		return queue, nil
+	}
+	config, err := sendmail.LoadConfig(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config: %s", err)
+	}
+	if queue, err = configQueue(config); err != nil {
+		return nil, err
+	}
+	optionsMu.Lock()
+	defer optionsMu.Unlock()
+	if sharedQueue == nil {
+		sharedQueue = queue
+	}
+	return sharedQueue, nil
+}
+
+// logQueueResults log the results of queue deliveries
+func logQueueResults(results <-chan sendmail.Result) {
+	for result := range record(results) {
+		switch {
+		case result.Level > sendmail.WarnLevel:
+			log.WithFields(getLogFields(result.Fields)).Info(result.Message)
+		default:
+			log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
+		}
+	}
+}
+
+// runVerify print the verdicts of addresses, exit with error if any is invalid
+func runVerify(addresses []string) {
+	if len(addresses) == 0 {
+		log.Fatal("No addresses to verify")
+	}
+	invalid := false
+	for _, address := range addresses {
+		verdict, err := sendmail.ValidateAddress(context.Background(), address, verifyOptions())
+		if err != nil {
+			log.Fatalf("Failed to verify %s: %s", address, err)
+		}
+		status := "valid"
+		if !verdict.Valid {
+			status = "invalid: " + verdict.Reason
+			invalid = true
+		} else if verdict.Callout == sendmail.CalloutUnknown {
+			status = "valid, mailbox unknown: " + verdict.Reason
+		}
+		fmt.Printf("%s: %s\n", verdict.Address, status)
+	}
+	if invalid {
+		os.Exit(1)
+	}
+}
+
+// runCheckDomain print the report of the sending setup of the domain,
+// the exit status is 1 if there are problems
+func runCheckDomain(domain string) {
+	report, err := sendmail.CheckDomain(context.Background(), domain, &sendmail.CheckDomainOptions{
+		Resolver:     resolver,
+		SendingIP:    net.ParseIP(sendingIP),
+		DKIMSelector: dkimSelector,
+	})
+	if err != nil {
+		log.Fatalf("Failed to check %s: %s", domain, err)
+	}
+	if logFormat == sendmail.LogFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		ptr := "none"
+		if len(report.PTR) > 0 {
+			ptr = strings.Join(report.PTR, ", ")
+			if !report.PTRMatch {
+				ptr += " (doesn't match)"
+			}
+		}
+		dkim := "not checked"
+		if report.DKIMSelector != "" {
+			dkim = report.DKIMSelector + ": no key"
+			if report.DKIMKey {
+				dkim = report.DKIMSelector + ": key found"
+			}
+		}
+		dmarc := report.DMARCPolicy
+		if dmarc == "" {
+			dmarc = "none"
+		}
+		spf := report.SPF
+		if report.SPFRecord != "" {
+			spf += " (" + report.SPFRecord + ")"
+		}
+		fmt.Printf("Domain: %s\nIP:     %s\nPTR:    %s\nSPF:    %s\nDKIM:   %s\nDMARC:  %s\n",
+			report.Domain, report.IP, ptr, spf, dkim, dmarc)
+		for _, problem := range report.Problems {
+			fmt.Printf("Problem: %s\n", problem)
+		}
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+// verifyOptions return the options of address verification
+func verifyOptions() *sendmail.ValidateOptions {
+	return &sendmail.ValidateOptions{
+		Resolver:          resolver,
+		DisableImplicitMX: noImplicitMX,
+		Callout:           true,
+		Sender:            sender,
+		AddressFamily:     addressPolicy,
+	}
+}
+
+// runTLSReports send the TLS reports at the end of every UTC day
+func runTLSReports(reporter *sendmail.TLSReporter) {
+	for {
+		now := time.Now().UTC()
+		time.Sleep(now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now))
+		for result := range reporter.Report() {
+			switch {
+			case result.Level > sendmail.WarnLevel:
+				log.WithFields(getLogFields(result.Fields)).Info(result.Message)
+			default:
+				log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
+			}
+		}
+	}
+}
+
+// Policies of the senders of other domains than -senderDomain
+const (
+	senderPolicyReject  = "reject"
+	senderPolicyRewrite = "rewrite"
+)
+
+// enforceSender apply the sender domain policy to the envelope, it reports
+// whether the sender is allowed or it was rewritten to -senderRewrite address
+func enforceSender(e *sendmail.Envelope) bool {
+	sender := e.GetSender()
+	if len(senderDomains) == 0 || senderDomains.Contains(sendmail.GetDomainFromAddress(sender)) {
+		return true
+	}
+	if senderPolicy != senderPolicyRewrite {
+		return false
+	}
+	log.Warnf("Rewrite unauthorized sender %s to %s", sender, senderRewrite)
+	if from := e.Header["From"]; len(from) > 0 {
+		e.Header["X-Original-From"] = from
+	}
+	e.Header["From"] = []string{senderRewrite}
+	return true
+}
+
+// record the results in the audit log if it's enabled
+func record(results <-chan sendmail.Result) <-chan sendmail.Result {
+	if auditLog == nil || dryRun {
+		return results
+	}
+	return auditLog.Record(results)
+}
+
+// deliveryConfig return the delivery options shared by all modes
+func deliveryConfig() sendmail.Config {
+	optionsMu.RLock()
+	defer optionsMu.RUnlock()
+	config := sendmail.Config{
+		ConfigFile:        configFile,
+		Resolver:          resolver,
+		DisableImplicitMX: noImplicitMX,
+		AddressFamily:     addressPolicy,
+		TLSReporter:       tlsReporter,
+		DMARCCheck:        dmarcCheck,
+		SendingIP:         net.ParseIP(sendingIP),
+		Suppression:       suppression,
+		RateLimiter:       rateLimiter,
+		DeferQueue:        deferQueue,
+		Concurrency:       concurrency,
+		Archive:           archive,
+		Rewrite:           rewrite,
+		Middleware:        middleware,
+		PreserveHeaders:   preserveHeaders,
+		RequireTLS:        requireTLS,
+		MaxHops:           maxHops,
+		MaxRecipients:     maxRecipients,
+		IndividualCopies:  individualCopies,
+	}
+	if captured != nil {
+		config.Transport = captured
+	}
+	return config
+}
+
+// fileSettings are the options of the flags and the configuration file
+// replaced by the reload
+type fileSettings struct {
+	archive    *sendmail.Archive
+	rewrite    *sendmail.RewriteRules
+	middleware []sendmail.Middleware
+}
+
+// newFileSettings return the archive, the virus scanner and the spam filter
+// of the flags over the configuration file and the rewrite rules
+// of the configuration file, config is nil if it's invalid
+func newFileSettings(config *sendmail.FileConfig) (*fileSettings, error) {
+	a := sendmail.Archive{Dir: archiveDir, Address: archiveAddress, SenderDomains: archiveDomains}
+	v := sendmail.VirusScanner{Address: clamdAddress, Action: virusAction, QuarantineDir: quarantineDir}
+	f := sendmail.SpamFilter{URL: spamFilterURL, RejectScore: spamRejectScore}
+	settings := new(fileSettings)
+	if config != nil {
+		a = a.Or(config.Archive)
+		v = v.Or(config.VirusScanner)
+		f = f.Or(config.SpamFilter)
+		settings.rewrite = &config.Rewrite
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	if a.Enabled() {
+		settings.archive = &a
+	}
+	if v.Enabled() {
+		settings.middleware = append(settings.middleware, v.Check)
+	}
+	if f.Enabled() {
+		settings.middleware = append(settings.middleware, f.Check)
+	}
+	return settings, nil
+}
+
+// set the options, optionsMu must be locked
+func (s *fileSettings) set() {
+	archive = s.archive
+	rewrite = s.rewrite
+	middleware = s.middleware
+}
+
+// fileOptions set the options of the flags and the configuration file
+func fileOptions(config *sendmail.FileConfig) error {
+	settings, err := newFileSettings(config)
+	if err != nil {
+		return err
+	}
+	optionsMu.Lock()
+	defer optionsMu.Unlock()
+	settings.set()
+	return nil
+}
+
+// setupLog direct the log to the destination of the flags or the configuration file
+func setupLog() {
+	if logTarget == "" || syslogFacility == "" || logFormat == "" {
+		// Invalid configuration is reported by the delivery
+		if config, err := sendmail.LoadConfig(configFile); err == nil {
+			if logTarget == "" {
+				logTarget = config.Log
+			}
+			if syslogFacility == "" {
+				syslogFacility = config.SyslogFacility
+			}
+			if logFormat == "" {
+				logFormat = config.LogFormat
+			}
+		}
+	}
+	switch logFormat {
+	case "", sendmail.LogFormatText:
+		if logTarget == sendmail.LogSyslog {
+			// Syslog adds the time itself
+			log.SetFormatter(&log.TextFormatter{DisableTimestamp: true, DisableColors: true})
+		}
+	case sendmail.LogFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{DisableHTMLEscape: true})
+	default:
+		log.Fatalf("Unknown log format %q, expected text or json", logFormat)
+	}
+	switch logTarget {
+	case "", sendmail.LogStderr:
+	case sendmail.LogSyslog:
+		if syslogFacility == "" {
+			syslogFacility = "mail"
+		}
+		if err := useSyslog(syslogFacility); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown log %q, expected stderr or syslog", logTarget)
+	}
+}
+
 func getLogFields(fields sendmail.Fields) log.Fields {
 	logFields := log.Fields{}
-	if verbose {
+	if verbose || logFormat == sendmail.LogFormatJSON {
 		for k, v := range fields {
+			if d, ok := v.(time.Duration); ok && logFormat == sendmail.LogFormatJSON {
+				// Seconds are easier to aggregate than nanoseconds
+				v = d.Seconds()
+			}
 			logFields[k] = v
 		}
 	}
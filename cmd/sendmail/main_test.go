@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadBody(t *testing.T) {
+	defer func(saved bool) { ignoreDot = saved }(ignoreDot)
+	for _, tc := range []struct {
+		input     string
+		ignoreDot bool
+		expected  string
+	}{
+		{"Subject: test\n\nbody\n", false, "Subject: test\n\nbody\n"},
+		// The last line without line break is kept
+		{"Subject: test\n\nlast line", false, "Subject: test\n\nlast line"},
+		{"Subject: test\r\n\r\nlast line", false, "Subject: test\r\n\r\nlast line"},
+		{"body\n.\nafter dot\n", false, "body\n"},
+		{"body\n.\r\nafter dot", false, "body\n"},
+		{"body\n.\nafter dot", true, "body\n.\nafter dot"},
+		{"", false, ""},
+	} {
+		ignoreDot = tc.ignoreDot
+		body, err := readBody(strings.NewReader(tc.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.expected {
+			t.Errorf("Input %q: expected %q got %q", tc.input, tc.expected, body)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runMerge send the message of the template rendered with every row
+// of the CSV file, the columns of the header row are the template
+// fields. It exits with error if any message failed.
+func runMerge() {
+	tmpl, err := template.New(filepath.Base(templateFile)).Option("missingkey=error").ParseFiles(templateFile)
+	if err != nil {
+		log.Fatalf("Failed to parse template: %s", err)
+	}
+	file, err := os.Open(mergeFile)
+	if err != nil {
+		log.Fatalf("Failed to open merge data: %s", err)
+	}
+	defer file.Close()
+
+	sent, failed, err := merge(tmpl, file, sendBulkMessage)
+	if err != nil {
+		log.Error(err)
+	}
+	log.WithFields(log.Fields{
+		"sent":   sent,
+		"failed": failed,
+	}).Warnf("Sent %d of %d messages", sent, sent+failed)
+	if failed > 0 || err != nil {
+		os.Exit(1)
+	}
+}
+
+// merge call send for the template rendered with every row of the CSV
+// data concurrently. The malformed rows are reported as failed, the error
+// of reading stops the dispatching after the sends in progress.
+func merge(tmpl *template.Template, r io.Reader, send func(bulkMessage) bool) (sent, failed int64, err error) {
+	reader := csv.NewReader(r)
+	columns, err := reader.Read()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to read merge data: %s", err)
+	}
+
+	limit := mergeConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+	budget := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for row := 1; ; row++ {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(readErr, &parseErr) {
+				err = fmt.Errorf("Failed to read merge data: %s", readErr)
+				break
+			}
+			log.WithFields(log.Fields{"message": row}).Errorf("Malformed merge data: %s", readErr)
+			atomic.AddInt64(&failed, 1)
+			continue
+		}
+		data := make(map[string]string, len(columns))
+		for i, column := range columns {
+			data[column] = record[i]
+		}
+		body := new(bytes.Buffer)
+		if err := tmpl.Execute(body, data); err != nil {
+			log.WithFields(log.Fields{"message": row}).Error(err)
+			atomic.AddInt64(&failed, 1)
+			continue
+		}
+		budget <- struct{}{}
+		wg.Add(1)
+		go func(msg bulkMessage) {
+			defer wg.Done()
+			defer func() { <-budget }()
+			if send(msg) {
+				atomic.AddInt64(&sent, 1)
+			} else {
+				atomic.AddInt64(&failed, 1)
+			}
+		}(bulkMessage{key: strconv.Itoa(row), body: body.Bytes()})
+	}
+	wg.Wait()
+	return sent, failed, err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+)
+
+// errReader fails reading after the data.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestMerge(t *testing.T) {
+	defer func(saved int) { mergeConcurrency = saved }(mergeConcurrency)
+	mergeConcurrency = 2
+	tmpl := template.Must(template.New("merge").Option("missingkey=error").Parse("To: {{.email}}\nSubject: Hi {{.name}}\n\nTEST"))
+
+	for _, tc := range []struct {
+		name         string
+		data         io.Reader
+		sent, failed int64
+		keys         []string
+		expectedErr  bool
+	}{
+		{
+			name: "valid",
+			data: strings.NewReader("email,name\na@localhost,A\nb@localhost,B\n"),
+			sent: 2, keys: []string{"1", "2"},
+		},
+		{
+			name:   "malformed rows",
+			data:   strings.NewReader("email,name\na@localhost,A\nb@localhost\nc@localhost,C\"\nd@localhost,D\n"),
+			sent:   2,
+			failed: 2,
+			keys:   []string{"1", "4"},
+		},
+		{
+			name:   "failed send",
+			data:   strings.NewReader("email,name\na@localhost,A\nfail@localhost,F\n"),
+			sent:   1,
+			failed: 1,
+			keys:   []string{"1", "2"},
+		},
+		{
+			name:        "read error",
+			data:        io.MultiReader(strings.NewReader("email,name\na@localhost,A\nb@localhost,B\n"), errReader{}),
+			sent:        2,
+			keys:        []string{"1", "2"},
+			expectedErr: true,
+		},
+		{
+			name:        "no header",
+			data:        strings.NewReader(""),
+			expectedErr: true,
+		},
+	} {
+		var mu sync.Mutex
+		var keys []string
+		sent, failed, err := merge(tmpl, tc.data, func(msg bulkMessage) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			keys = append(keys, msg.key)
+			return !strings.Contains(string(msg.body), "fail@")
+		})
+		if (err != nil) != tc.expectedErr {
+			t.Errorf("%s: expected error %v got %v", tc.name, tc.expectedErr, err)
+		}
+		if sent != tc.sent || failed != tc.failed {
+			t.Errorf("%s: expected sent %d and failed %d got %d and %d", tc.name, tc.sent, tc.failed, sent, failed)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != strings.Join(tc.keys, ",") {
+			t.Errorf("%s: expected messages %v got %v", tc.name, tc.keys, keys)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+// queuedMessage is the entry of the queue administration API
+type queuedMessage struct {
+	*sendmail.QueueEntry
+	Queued  bool        `json:"queued"`
+	Headers mail.Header `json:"headers,omitempty"`
+}
+
+// queueHandler serve the queue administration API:
+// GET /api/v1/queue, GET and DELETE /api/v1/queue/<id>,
+// POST /api/v1/queue/<id>/retry and POST /api/v1/queue/<id>/reroute?relay=host:port
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	queue, err := openQueue()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/queue"), "/")
+	id, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		id, action = path[:i], path[i+1:]
+	}
+
+	var response interface{}
+	switch {
+	case r.Method == "GET" && path == "":
+		entries, err := queue.List()
+		var invalid *sendmail.QueueEntriesError
+		if errors.As(err, &invalid) {
+			log.Error(err)
+		} else if err != nil {
+			queueError(w, err)
+			return
+		}
+		if entries == nil {
+			entries = []*sendmail.QueueEntry{}
+		}
+		response = entries
+	case r.Method == "GET" && action == "":
+		entry, err := queue.Entry(id)
+		if err != nil {
+			queueError(w, err)
+			return
+		}
+		msg := &queuedMessage{QueueEntry: entry, Queued: true}
+		if data, err := queue.Message(id); err == nil {
+			if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+				msg.Headers = m.Header
+			}
+		}
+		response = msg
+	case r.Method == "DELETE" && action == "":
+		if err := queue.Remove(id); err != nil {
+			queueError(w, err)
+			return
+		}
+		log.Warnf("Queued message %s removed", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case r.Method == "POST" && action == "retry":
+		entry, err := queue.Entry(id)
+		if err != nil {
+			queueError(w, err)
+			return
+		}
+		results, err := queue.Retry(id)
+		if err != nil {
+			queueError(w, err)
+			return
+		}
+		logQueueResults(results)
+		msg := &queuedMessage{QueueEntry: entry}
+		if entry, err := queue.Entry(id); err == nil {
+			msg.QueueEntry, msg.Queued = entry, true
+		}
+		response = msg
+	case r.Method == "POST" && action == "reroute":
+		entry, err := queue.Reroute(id, r.FormValue("relay"))
+		if err != nil {
+			queueError(w, err)
+			return
+		}
+		log.Warnf("Queued message %s rerouted to %q", id, entry.Relay)
+		response = &queuedMessage{QueueEntry: entry, Queued: true}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Sorry, only GET, POST and DELETE methods are supported.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// queueError reply Not Found for unknown messages
+// and Conflict for messages being delivered
+func queueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Message not found")
+		return
+	}
+	var busy *sendmail.QueueBusyError
+	if errors.As(err, &busy) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, err)
+}
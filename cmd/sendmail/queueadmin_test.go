@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+// testQueue set the queue directory of the administration API,
+// the queue is restored after the test
+func testQueue(t *testing.T) *sendmail.Queue {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDir, savedStore := queueDir, queueStore
+	t.Cleanup(func() {
+		queueDir, queueStore = savedDir, savedStore
+		sharedQueue, sharedStore = nil, nil
+		os.RemoveAll(dir)
+	})
+	queueDir, queueStore = dir, ""
+	sharedQueue, sharedStore = nil, nil
+	queue, err := openQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+// enqueue the message to the recipient
+func enqueue(t *testing.T, queue *sendmail.Queue, recipient string) string {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@example.com",
+		Recipients: []string{recipient},
+		Body:       []byte("Subject: Test\r\n\r\nTEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// administer send the request to the queue administration API
+func administer(method, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Token", "admin")
+	w := httptest.NewRecorder()
+	queueHandler(w, r)
+	return w
+}
+
+func TestQueueHandler(t *testing.T) {
+	store := testHTTP(t, nil)
+	httpToken = "admin"
+	queue := testQueue(t)
+	retried := enqueue(t, queue, "retried@example.com")
+	removed := enqueue(t, queue, "removed@example.com")
+
+	w := administer("GET", "/api/v1/queue")
+	var entries []*sendmail.QueueEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil || len(entries) != 2 {
+		t.Fatal("Expected 2 queued messages got", w.Code, err, entries)
+	}
+
+	w = administer("POST", "/api/v1/queue/"+retried+"/retry")
+	var msg queuedMessage
+	if err := json.NewDecoder(w.Body).Decode(&msg); err != nil || w.Code != http.StatusOK {
+		t.Fatal("Expected retried message got", w.Code, err)
+	}
+	if msg.Queued {
+		t.Error("Expected delivered message removed from queue")
+	}
+	if messages := store.list(); len(messages) != 1 || messages[0].To[0] != "retried@example.com" {
+		t.Error("Expected message to retried@example.com got", messages)
+	}
+
+	// The message being delivered can't be changed
+	spool := &sendmail.DirQueueStore{Dir: queueDir}
+	if claimed, err := spool.Claim(removed, time.Now().Add(time.Hour)); err != nil || !claimed {
+		t.Fatal("Expected claimed message got", claimed, err)
+	}
+	for _, request := range [][2]string{
+		{"DELETE", "/api/v1/queue/" + removed},
+		{"POST", "/api/v1/queue/" + removed + "/retry"},
+		{"POST", "/api/v1/queue/" + removed + "/reroute?relay=relay.example.com:25"},
+	} {
+		if w := administer(request[0], request[1]); w.Code != http.StatusConflict {
+			t.Errorf("%s %s: expected conflict got %d", request[0], request[1], w.Code)
+		}
+	}
+	spool.Release(removed)
+
+	if w := administer("DELETE", "/api/v1/queue/"+removed); w.Code != http.StatusNoContent {
+		t.Error("Expected removed message got", w.Code, w.Body)
+	}
+	for _, id := range []string{retried, removed} {
+		if w := administer("GET", "/api/v1/queue/"+id); w.Code != http.StatusNotFound {
+			t.Errorf("Expected message %s not found got %d", id, w.Code)
+		}
+		if w := administer("POST", "/api/v1/queue/"+id+"/retry"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected retry of message %s not found got %d", id, w.Code)
+		}
+	}
+	if messages := store.list(); len(messages) != 1 {
+		t.Error("Expected only retried message delivered got", len(messages))
+	}
+}
+
+func TestAdministrationWithoutToken(t *testing.T) {
+	testHTTP(t, nil)
+	queue := testQueue(t)
+	id := enqueue(t, queue, "user@example.com")
+
+	for _, tc := range []struct {
+		method, path string
+		handler      http.HandlerFunc
+	}{
+		{"GET", "/api/v1/queue", queueHandler},
+		{"GET", "/api/v1/queue/" + id, queueHandler},
+		{"POST", "/api/v1/queue/" + id + "/reroute?relay=relay.example.com:25", queueHandler},
+		{"DELETE", "/api/v1/queue/" + id, queueHandler},
+		{"POST", "/api/v1/reload", reloadHandler},
+		{"GET", "/api/v1/deliveries", deliveriesHandler},
+		{"GET", "/api/v1/messages", messagesHandler},
+	} {
+		// Any token is refused without -httpToken
+		for _, token := range []string{"", "admin"} {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			r.Header.Set("Token", token)
+			w := httptest.NewRecorder()
+			tc.handler(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s: expected forbidden without -httpToken got %d", tc.method, tc.path, w.Code)
+			}
+		}
+	}
+	if entries, err := queue.List(); err != nil || len(entries) != 1 || entries[0].Recipients[0] != "user@example.com" {
+		t.Error("Expected queued message kept got", entries, err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+
+	"github.com/n0madic/sendmail"
+)
+
+// receive stamp the Received header of the accepted message
+func receive(envelope *sendmail.Envelope, received sendmail.Received) error {
+	if len(envelope.Recipients) == 1 {
+		received.For = envelope.Recipients[0]
+	}
+	_, err := envelope.AddReceived(received)
+	return err
+}
+
+// remoteIP return the IP address of the client, nil for Unix sockets
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
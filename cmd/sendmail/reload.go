@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// optionsMu guards the options of the configuration file
+	// replaced by the reload
+	optionsMu    sync.RWMutex
+	domainLimits map[string]sendmail.DomainLimit
+)
+
+// serverSettings are the domain limits of the configuration file
+// with their rate limiter and the queue of the deferred messages
+type serverSettings struct {
+	changed     bool
+	limits      map[string]sendmail.DomainLimit
+	rateLimiter *sendmail.RateLimiter
+	deferQueue  *sendmail.Queue
+}
+
+// newServerSettings return the domain limits of the configuration file,
+// the state of unchanged limits is kept
+func newServerSettings(config *sendmail.FileConfig) (*serverSettings, error) {
+	optionsMu.RLock()
+	settings := &serverSettings{
+		changed:     !reflect.DeepEqual(config.DomainLimits, domainLimits),
+		limits:      config.DomainLimits,
+		rateLimiter: rateLimiter,
+		deferQueue:  deferQueue,
+	}
+	optionsMu.RUnlock()
+	if !settings.changed {
+		return settings, nil
+	}
+	if len(config.DomainLimits) > 0 && settings.deferQueue == nil {
+		queue, err := newQueue()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open queue: %s", err)
+		}
+		settings.deferQueue = queue
+	}
+	settings.rateLimiter = nil
+	if len(config.DomainLimits) > 0 {
+		settings.rateLimiter = sendmail.NewRateLimiter(config.DomainLimits)
+	}
+	return settings, nil
+}
+
+// set the options, optionsMu must be locked
+func (s *serverSettings) set() {
+	if !s.changed {
+		return
+	}
+	deferQueue = s.deferQueue
+	rateLimiter = s.rateLimiter
+	domainLimits = s.limits
+}
+
+// serverOptions set the domain limits, the HTTP tokens and the queue
+// of the configuration file
+func serverOptions(config *sendmail.FileConfig) error {
+	settings, err := newServerSettings(config)
+	if err != nil {
+		return err
+	}
+	optionsMu.Lock()
+	settings.set()
+	optionsMu.Unlock()
+	httpTokens.set(config.HTTPTokens)
+	return refreshQueue(config)
+}
+
+// refreshQueue replace the shared queue once it's opened with the queue
+// of the delivery options and the retry policy of the configuration file
+func refreshQueue(config *sendmail.FileConfig) error {
+	optionsMu.RLock()
+	running := sharedQueue != nil
+	optionsMu.RUnlock()
+	if !running {
+		return nil
+	}
+	queue, err := configQueue(config)
+	if err != nil {
+		return err
+	}
+	optionsMu.Lock()
+	sharedQueue = queue
+	optionsMu.Unlock()
+	return nil
+}
+
+// checkTokens refuse the configuration removing all tokens of the HTTP API
+// listening on the network, the API would be open to everyone
+func checkTokens(config *sendmail.FileConfig) error {
+	if !httpMode || httpToken != "" || len(config.HTTPTokens) > 0 || httpTokens.empty() || loopback(httpBind) {
+		return nil
+	}
+	return fmt.Errorf("http_tokens: refused to remove all tokens of HTTP API at %s", httpBind)
+}
+
+// reload apply the configuration file to the running servers,
+// the invalid configuration is refused and the current is kept.
+// All options are validated before any of them is replaced.
+// The relays and the retry policy are read by every delivery.
+func reload() error {
+	config, err := sendmail.LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if err := checkTokens(config); err != nil {
+		return err
+	}
+	files, err := newFileSettings(config)
+	if err != nil {
+		return err
+	}
+	server, err := newServerSettings(config)
+	if err != nil {
+		return err
+	}
+	optionsMu.Lock()
+	files.set()
+	server.set()
+	optionsMu.Unlock()
+	httpTokens.set(config.HTTPTokens)
+	return refreshQueue(config)
+}
+
+// reloadOnHangup reload the configuration and reopen the access log on SIGHUP
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := accessLog.reopen(); err != nil {
+			log.Error(err)
+		}
+		if err := reload(); err != nil {
+			log.Errorf("Failed to reload configuration: %s", err)
+			continue
+		}
+		log.Warn("Configuration reloaded")
+	}
+}
+
+// reloadHandler reload the configuration on POST request
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Sorry, only POST method are supported.")
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	if err := reload(); err != nil {
+		log.Errorf("Failed to reload configuration: %s", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+	log.Warn("Configuration reloaded")
+	fmt.Fprint(w, "Configuration reloaded")
+}
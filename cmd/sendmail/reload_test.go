@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+// testReload set the options replaced by the reload,
+// they are restored after the test
+func testReload(t *testing.T, tokens map[string]sendmail.HTTPToken) {
+	testHTTP(t, tokens)
+	savedMode, savedBind, savedDir, savedStore := httpMode, httpBind, queueDir, queueStore
+	savedArchive, savedRewrite, savedMiddleware := archive, rewrite, middleware
+	savedLimits, savedLimiter, savedDefer := domainLimits, rateLimiter, deferQueue
+	t.Cleanup(func() {
+		httpMode, httpBind, queueDir, queueStore = savedMode, savedBind, savedDir, savedStore
+		archive, rewrite, middleware = savedArchive, savedRewrite, savedMiddleware
+		domainLimits, rateLimiter, deferQueue = savedLimits, savedLimiter, savedDefer
+		sharedQueue, sharedStore = nil, nil
+	})
+	archive, rewrite, middleware = nil, nil, nil
+	domainLimits, rateLimiter, deferQueue = nil, nil, nil
+	sharedQueue, sharedStore = nil, nil
+}
+
+func TestReloadAtomic(t *testing.T) {
+	testReload(t, nil)
+	dir := filepath.Dir(configFile)
+
+	// The queue of the domain limits can't be opened in the file
+	queueDir, queueStore = configFile, ""
+	config := "archive:\n  dir: " + dir + "\ndomain_limits:\n  example.com:\n    rate: 10\n"
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reload(); err == nil {
+		t.Fatal("Expected error of queue")
+	}
+	if archive != nil || rateLimiter != nil {
+		t.Error("Expected options unchanged by refused reload got", archive, rateLimiter)
+	}
+
+	queueDir = filepath.Join(dir, "queue")
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	if archive == nil || archive.Dir != dir || rateLimiter == nil || deferQueue == nil {
+		t.Error("Expected options of reloaded configuration got", archive, rateLimiter, deferQueue)
+	}
+}
+
+func TestReloadTokens(t *testing.T) {
+	testReload(t, map[string]sendmail.HTTPToken{"secret": {Name: "billing"}})
+	httpMode = true
+
+	for bind, refused := range map[string]bool{
+		":8080":          true,
+		"192.0.2.1:8080": true,
+		"systemd:http":   true,
+		"localhost:8080": false,
+		"127.0.0.1:8080": false,
+		"[::1]:8080":     false,
+		"unix:/run/mail": false,
+	} {
+		httpBind = bind
+		httpTokens.set(map[string]sendmail.HTTPToken{"secret": {Name: "billing"}})
+		err := reload()
+		if (err != nil) != refused {
+			t.Errorf("%s: expected refused %v got %v", bind, refused, err)
+		}
+		if _, kept := httpTokens.lookup("secret"); kept != refused {
+			t.Errorf("%s: expected token kept %v", bind, refused)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,28 +18,55 @@ type Backend struct{}
 
 // Login handles a login command with username and password.
 func (bkd *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	return &Session{}, nil
+	return &Session{state: state, authenticated: true, username: username}, nil
 }
 
 // AnonymousLogin allowed
 func (bkd *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return &Session{}, nil
+	return &Session{state: state}, nil
 }
 
 // A Session is returned after successful login.
 type Session struct {
 	From string
 	To   []string
+
+	state         *smtp.ConnectionState
+	authenticated bool
+	username      string
+	started       time.Time
+}
+
+// received return the trace of the session
+func (s *Session) received() sendmail.Received {
+	received := sendmail.Received{Protocol: "ESMTP"}
+	if s.state == nil {
+		return received
+	}
+	received.From = s.state.Hostname
+	if s.state.RemoteAddr != nil {
+		received.RemoteIP = remoteIP(s.state.RemoteAddr.String())
+	}
+	if s.state.TLS.HandshakeComplete {
+		received.TLS = &s.state.TLS
+		received.Protocol += "S"
+	}
+	if s.authenticated {
+		received.Protocol += "A"
+	}
+	return received
 }
 
 // Mail save sender
 func (s *Session) Mail(from string, opts smtp.MailOptions) error {
+	s.From, s.To, s.started = from, nil, time.Now()
 	senderDomain := sendmail.GetDomainFromAddress(from)
-	if len(senderDomains) > 0 && !senderDomains.Contains(senderDomain) {
+	if len(senderDomains) > 0 && !senderDomains.Contains(senderDomain) && senderPolicy != senderPolicyRewrite {
 		log.Errorf("Attempt to unauthorized send with domain %s", senderDomain)
-		return fmt.Errorf("unauthorized sender domain %s", senderDomain)
+		err := fmt.Errorf("unauthorized sender domain %s", senderDomain)
+		s.logAccess(err, 451, 0, "")
+		return err
 	}
-	s.From = from
 	return nil
 }
 
@@ -49,25 +77,41 @@ func (s *Session) Rcpt(to string) error {
 }
 
 // Data receives the message body and sends it
-func (s *Session) Data(r io.Reader) error {
-	body, err := ioutil.ReadAll(r)
+func (s *Session) Data(r io.Reader) (err error) {
+	var body []byte
+	var messageID string
+	defer func() {
+		s.logAccess(err, 554, int64(len(body)), messageID)
+	}()
+	body, err = ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
-		Sender:     s.From,
-		Recipients: s.To,
-		Body:       body,
-	})
+	config := deliveryConfig()
+	config.Sender = s.From
+	config.NullSender = s.From == ""
+	config.Recipients = s.To
+	config.Body = body
+	envelope, err := sendmail.NewEnvelope(&config)
 	if err != nil {
 		return err
 	}
-	envelope.Send()
+	if !enforceSender(&envelope) {
+		senderDomain := sendmail.GetDomainFromAddress(envelope.GetSender())
+		log.Errorf("Attempt to unauthorized send with domain %s", senderDomain)
+		return fmt.Errorf("unauthorized sender domain %s", senderDomain)
+	}
+	if err := receive(&envelope, s.received()); err != nil {
+		return err
+	}
+	if messageID, err = envelope.SetMessageID(); err != nil {
+		return err
+	}
 	errs, err := envelope.Send()
 	if err != nil {
-		return err
+		return refusal(err)
 	}
-	for result := range errs {
+	for result := range record(errs) {
 		switch {
 		case result.Level > sendmail.WarnLevel:
 			log.WithFields(getLogFields(result.Fields)).Info(result.Message)
@@ -81,6 +125,41 @@ func (s *Session) Data(r io.Reader) error {
 	return nil
 }
 
+// refusal return the SMTP reply of the mail loop and the middleware
+// refusal, the middleware may choose it with *smtp.SMTPError
+func refusal(err error) error {
+	var loop *sendmail.LoopError
+	if errors.As(err, &loop) {
+		log.Warn(err)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+			Message:      err.Error(),
+		}
+	}
+	var refused *sendmail.RefusedError
+	if !errors.As(err, &refused) {
+		return err
+	}
+	log.Warn(err)
+	var reply *smtp.SMTPError
+	if errors.As(refused.Err, &reply) {
+		return reply
+	}
+	if refused.Temporary() {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      err.Error(),
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      err.Error(),
+	}
+}
+
 // Reset session
 func (s *Session) Reset() {}
 
@@ -103,6 +182,10 @@ func startSMTP(bindAddr string) {
 	s.MaxRecipients = 50
 	s.AllowInsecureAuth = true
 
-	log.Info("Starting SMTP server at ", s.Addr)
-	log.Fatal(s.ListenAndServe())
+	l, err := listen(bindAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen SMTP: %s", err)
+	}
+	log.Info("Starting SMTP server at ", l.Addr())
+	log.Fatal(s.Serve(l))
 }
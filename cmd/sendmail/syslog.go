@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	logsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// syslogFacilities by name
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"mail":   syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// useSyslog send the log to the local syslog daemon with the facility,
+// priorities follow the log levels
+func useSyslog(facility string) error {
+	priority, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	hook, err := logsyslog.NewSyslogHook("", "", priority|syslog.LOG_INFO, "sendmail")
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %s", err)
+	}
+	log.AddHook(hook)
+	log.SetOutput(ioutil.Discard)
+	return nil
+}
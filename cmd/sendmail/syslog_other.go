@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// useSyslog is not available on the platform
+func useSyslog(facility string) error {
+	return errors.New("syslog is not supported on " + runtime.GOOS)
+}
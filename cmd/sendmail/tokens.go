@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+// tokenQuota counts the messages of the token in the day
+type tokenQuota struct {
+	day  string
+	sent int
+}
+
+// tokenRegistry is the HTTP tokens of the configuration file
+// with the daily quotas of the messages, the counts are kept
+// in memory only and start over on restart
+type tokenRegistry struct {
+	mu     sync.Mutex
+	tokens map[string]sendmail.HTTPToken
+	quotas map[string]*tokenQuota
+}
+
+var httpTokens = &tokenRegistry{}
+
+// set the tokens, the counted messages are kept
+func (t *tokenRegistry) set(tokens map[string]sendmail.HTTPToken) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = tokens
+}
+
+// empty reports whether no tokens are configured
+func (t *tokenRegistry) empty() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tokens) == 0
+}
+
+// lookup return the limits of the token
+func (t *tokenRegistry) lookup(token string) (sendmail.HTTPToken, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limits, ok := t.tokens[token]
+	return limits, ok && token != ""
+}
+
+// reserve count the message of the token,
+// false if the daily quota (UTC day) is exhausted
+func (t *tokenRegistry) reserve(token string, quota int) bool {
+	if quota == 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.quotas == nil {
+		t.quotas = make(map[string]*tokenQuota)
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+	q, ok := t.quotas[token]
+	if !ok || q.day != day {
+		q = &tokenQuota{day: day}
+		t.quotas[token] = q
+	}
+	if q.sent >= quota {
+		return false
+	}
+	q.sent++
+	return true
+}
+
+// release give back the reserved message of the token,
+// the message was refused before it was sent
+func (t *tokenRegistry) release(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	day := time.Now().UTC().Format("2006-01-02")
+	if q, ok := t.quotas[token]; ok && q.day == day && q.sent > 0 {
+		q.sent--
+	}
+}
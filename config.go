@@ -0,0 +1,446 @@
+package sendmail
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultConfigFile is the system wide configuration file.
+const DefaultConfigFile = "/etc/go-sendmail.yaml"
+
+// TLS modes of relay connection.
+const (
+	// TLSOpportunistic use STARTTLS when the server offers it (default).
+	TLSOpportunistic = ""
+	// TLSStartTLS require STARTTLS.
+	TLSStartTLS = "starttls"
+	// TLSImplicit connect with TLS from the start (SMTPS).
+	TLSImplicit = "smtps"
+	// TLSNone never use TLS.
+	TLSNone = "none"
+)
+
+// Log destinations of the command.
+const (
+	// LogStderr write the log to standard error (default).
+	LogStderr = "stderr"
+	// LogSyslog send the log to the local syslog daemon.
+	LogSyslog = "syslog"
+)
+
+// Log formats of the command.
+const (
+	// LogFormatText is the human readable format (default).
+	LogFormatText = "text"
+	// LogFormatJSON emit a JSON object per line with all result fields.
+	LogFormatJSON = "json"
+)
+
+// Timeouts of the SMTP session stages, zero means not set.
+type Timeouts struct {
+	// Dial limits the connection to the server.
+	Dial time.Duration `yaml:"dial,omitempty"`
+	// Hello limits the wait for the greeting and the EHLO reply.
+	Hello time.Duration `yaml:"hello,omitempty"`
+	// StartTLS limits the STARTTLS command and the TLS handshake.
+	StartTLS time.Duration `yaml:"starttls,omitempty"`
+	// Auth limits every step of the authentication.
+	Auth time.Duration `yaml:"auth,omitempty"`
+	// Mail limits the MAIL, RCPT, DATA, RSET and QUIT commands.
+	Mail time.Duration `yaml:"mail,omitempty"`
+	// Data limits the transfer of the message and the wait for its acceptance.
+	Data time.Duration `yaml:"data,omitempty"`
+}
+
+// DefaultTimeouts follow the minimums of RFC 5321 section 4.5.3.2.
+var DefaultTimeouts = Timeouts{
+	Dial:     time.Minute,
+	Hello:    5 * time.Minute,
+	StartTLS: 2 * time.Minute,
+	Auth:     5 * time.Minute,
+	Mail:     5 * time.Minute,
+	Data:     10 * time.Minute,
+}
+
+// Or return the timeouts with the stages not set taken from d.
+func (t Timeouts) Or(d Timeouts) Timeouts {
+	or := func(a, b time.Duration) time.Duration {
+		if a == 0 {
+			return b
+		}
+		return a
+	}
+	return Timeouts{
+		Dial:     or(t.Dial, d.Dial),
+		Hello:    or(t.Hello, d.Hello),
+		StartTLS: or(t.StartTLS, d.StartTLS),
+		Auth:     or(t.Auth, d.Auth),
+		Mail:     or(t.Mail, d.Mail),
+		Data:     or(t.Data, d.Data),
+	}
+}
+
+// Validate check the timeouts are not negative.
+func (t Timeouts) Validate() error {
+	for stage, timeout := range map[string]time.Duration{
+		"dial":     t.Dial,
+		"hello":    t.Hello,
+		"starttls": t.StartTLS,
+		"auth":     t.Auth,
+		"mail":     t.Mail,
+		"data":     t.Data,
+	} {
+		if timeout < 0 {
+			return fmt.Errorf("invalid %s timeout %s", stage, timeout)
+		}
+	}
+	return nil
+}
+
+// uniformTimeouts return the same timeout for every stage.
+func uniformTimeouts(d time.Duration) Timeouts {
+	return Timeouts{d, d, d, d, d, d}
+}
+
+// FileConfig is the content of the configuration file.
+type FileConfig struct {
+	RelayHost      string        `yaml:"relay_host,omitempty"`
+	RelayPort      int           `yaml:"relay_port,omitempty"`
+	RelayLogin     string        `yaml:"relay_login,omitempty"`
+	RelayPassword  string        `yaml:"relay_password,omitempty"`
+	RelayTLS       string        `yaml:"relay_tls,omitempty"`
+	RelayTLSVerify bool          `yaml:"relay_tls_verify,omitempty"`
+	RelayTLSPins   []string      `yaml:"relay_tls_pins,omitempty"`
+	RelayAuth      string        `yaml:"relay_auth,omitempty"`
+	RelayHelo      string        `yaml:"relay_helo,omitempty"`
+	RelayTimeout   time.Duration `yaml:"relay_timeout,omitempty"`
+	// Timeouts of the SMTP session stages of all deliveries.
+	Timeouts Timeouts `yaml:"timeouts,omitempty"`
+	// MaxRecipients of one mail transaction, 0 for the limit of the server.
+	MaxRecipients int `yaml:"max_recipients,omitempty"`
+	// Log destination of the command: stderr (default) or syslog.
+	Log string `yaml:"log,omitempty"`
+	// SyslogFacility of the syslog messages, mail by default.
+	SyslogFacility string `yaml:"syslog_facility,omitempty"`
+	// LogFormat of the command log: text (default) or json.
+	LogFormat string `yaml:"log_format,omitempty"`
+	// Retry policy of the queued messages.
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+	// QueueConcurrency is the number of parallel queue deliveries
+	// per priority class.
+	QueueConcurrency map[Priority]int `yaml:"queue_concurrency,omitempty"`
+	// QueueStore shared by the instances: sqlite:/path/queue.db or
+	// redis://host:6379/0, the queue directory by default.
+	QueueStore string `yaml:"queue_store,omitempty"`
+	// DomainLimits of direct deliveries by destination domain,
+	// "*" is the limit of every other domain.
+	DomainLimits map[string]DomainLimit `yaml:"domain_limits,omitempty"`
+	// SenderRelays select the relay by the domain of sender.
+	SenderRelays map[string]RelayConfig `yaml:"sender_relays,omitempty"`
+	// Archive of the sent messages.
+	Archive Archive `yaml:"archive,omitempty"`
+	// Rewrite rules of the addresses (masquerading).
+	Rewrite RewriteRules `yaml:"rewrite,omitempty"`
+	// SpamFilter checks the messages before the delivery.
+	SpamFilter SpamFilter `yaml:"spam_filter,omitempty"`
+	// VirusScanner scans the messages before the delivery.
+	VirusScanner VirusScanner `yaml:"virus_scanner,omitempty"`
+	// TLSPolicies of direct deliveries by destination domain,
+	// "*" is the policy of every other domain.
+	TLSPolicies map[string]TLSPolicy `yaml:"tls_policies,omitempty"`
+	// HTTPTokens of the HTTP mode of the command with their limits.
+	HTTPTokens map[string]HTTPToken `yaml:"http_tokens,omitempty"`
+}
+
+// HTTPToken is the credential of the service submitting mail
+// in the HTTP mode of the command. It's declared with the other options
+// of the command like Log, as LoadConfig refuses unknown keys of the file.
+type HTTPToken struct {
+	// Name of the service in the log.
+	Name string `yaml:"name,omitempty"`
+	// SenderDomains the service may send from, all domains if empty.
+	SenderDomains []string `yaml:"sender_domains,omitempty"`
+	// DailyQuota of the messages (UTC day), 0 for unlimited.
+	// The command counts them in memory: the count is kept
+	// on reload and starts over on restart.
+	DailyQuota int `yaml:"daily_quota,omitempty"`
+	// MaxRecipients of a message, 0 for unlimited.
+	MaxRecipients int `yaml:"max_recipients,omitempty"`
+}
+
+// Validate check the token limits.
+func (t HTTPToken) Validate() error {
+	if t.DailyQuota < 0 || t.MaxRecipients < 0 {
+		return fmt.Errorf("invalid daily quota %d, max recipients %d", t.DailyQuota, t.MaxRecipients)
+	}
+	return nil
+}
+
+// AllowSender reports whether the service may send from the address.
+func (t HTTPToken) AllowSender(sender string) bool {
+	if len(t.SenderDomains) == 0 {
+		return true
+	}
+	domain := GetDomainFromAddress(sender)
+	for _, d := range t.SenderDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// RelayConfig of the external mail server.
+type RelayConfig struct {
+	// Transport is the name of the registered transport, smtp by default.
+	Transport string `yaml:"transport,omitempty"`
+	// Host name with optional port.
+	Host string `yaml:"host,omitempty"`
+	// Port overrides the default: 465 for smtps, 25 otherwise.
+	Port     int    `yaml:"port,omitempty"`
+	Login    string `yaml:"login,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// TLS mode: starttls, smtps, none or empty for opportunistic STARTTLS.
+	TLS string `yaml:"tls,omitempty"`
+	// TLSVerify require valid certificate of the server.
+	TLSVerify bool `yaml:"tls_verify,omitempty"`
+	// TLSPins are the accepted certificates of the server instead of
+	// CA verification: sha256/<base64> hashes of the public key (SPKI)
+	// or hex SHA-256 fingerprints of the certificate.
+	TLSPins []string `yaml:"tls_pins,omitempty"`
+	// Auth mechanism: plain (default), login or cram-md5.
+	Auth string `yaml:"auth,omitempty"`
+	// Helo is the name sent in EHLO, the hostname by default.
+	Helo string `yaml:"helo,omitempty"`
+	// Timeout of connection and every command.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Timeouts of the stages, they take precedence over Timeout.
+	Timeouts Timeouts `yaml:"timeouts,omitempty"`
+	// Endpoint URL of the API of HTTP transports.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// APIKey of mailgun and sendgrid transports, server token of postmark.
+	APIKey string `yaml:"api_key,omitempty"`
+	// Domain of the mailgun account, the sender domain by default.
+	Domain string `yaml:"domain,omitempty"`
+	// Region of the ses transport.
+	Region string `yaml:"region,omitempty"`
+	// AccessKeyID and SecretAccessKey of the ses transport credentials.
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+}
+
+// Address return host:port of the relay.
+func (r RelayConfig) Address() string {
+	if _, _, err := net.SplitHostPort(r.Host); err == nil {
+		return r.Host
+	}
+	port := r.Port
+	if port == 0 {
+		port = 25
+		if r.TLS == TLSImplicit {
+			port = 465
+		}
+	}
+	return net.JoinHostPort(r.Host, strconv.Itoa(port))
+}
+
+// Validate check the relay options.
+func (r RelayConfig) Validate() error {
+	if r.Transport != "" && !strings.EqualFold(r.Transport, TransportSMTP) {
+		// The options of other transports are checked by their factories
+		_, err := transportFactory(r.Transport)
+		return err
+	}
+	if r.Host == "" {
+		return errors.New("relay host is not set")
+	}
+	if _, _, err := net.SplitHostPort(r.Host); err == nil && r.Port != 0 {
+		return fmt.Errorf("relay port is set both in host %s and port %d", r.Host, r.Port)
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("invalid relay port %d", r.Port)
+	}
+	switch r.TLS {
+	case TLSOpportunistic, TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return fmt.Errorf("unknown relay TLS mode %q, expected starttls, smtps or none", r.TLS)
+	}
+	if len(r.TLSPins) > 0 && r.TLS == TLSNone {
+		return errors.New("relay TLS pins are set without TLS")
+	}
+	for _, pin := range r.TLSPins {
+		if _, _, err := parseTLSPin(pin); err != nil {
+			return err
+		}
+	}
+	switch strings.ToLower(r.Auth) {
+	case "", "plain", "login", "cram-md5":
+	default:
+		return fmt.Errorf("unknown relay auth mechanism %q, expected plain, login or cram-md5", r.Auth)
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("invalid relay timeout %s", r.Timeout)
+	}
+	return r.Timeouts.Validate()
+}
+
+// Relay return the relay for the sender address,
+// empty Host and Transport means direct delivery.
+func (c *FileConfig) Relay(sender string) RelayConfig {
+	domain := strings.ToLower(GetDomainFromAddress(sender))
+	for relayDomain, relay := range c.SenderRelays {
+		if strings.ToLower(relayDomain) == domain {
+			return relay
+		}
+	}
+	return RelayConfig{
+		Host:      c.RelayHost,
+		Port:      c.RelayPort,
+		Login:     c.RelayLogin,
+		Password:  c.RelayPassword,
+		TLS:       c.RelayTLS,
+		TLSVerify: c.RelayTLSVerify,
+		TLSPins:   c.RelayTLSPins,
+		Auth:      c.RelayAuth,
+		Helo:      c.RelayHelo,
+		Timeout:   c.RelayTimeout,
+	}
+}
+
+// Validate check the configured relays.
+func (c *FileConfig) Validate() error {
+	if err := c.Timeouts.Validate(); err != nil {
+		return err
+	}
+	if c.MaxRecipients < 0 {
+		return fmt.Errorf("invalid max_recipients %d", c.MaxRecipients)
+	}
+	switch c.Log {
+	case "", LogStderr, LogSyslog:
+	default:
+		return fmt.Errorf("unknown log %q, expected stderr or syslog", c.Log)
+	}
+	switch c.LogFormat {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", c.LogFormat)
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return err
+	}
+	for priority, limit := range c.QueueConcurrency {
+		if _, err := ParsePriority(string(priority)); err != nil || priority == "" {
+			return fmt.Errorf("queue_concurrency: unknown priority %q", priority)
+		}
+		if limit < 0 {
+			return fmt.Errorf("queue_concurrency: invalid limit %d of %s", limit, priority)
+		}
+	}
+	if c.RelayHost != "" {
+		if err := c.Relay("").Validate(); err != nil {
+			return err
+		}
+	}
+	for domain, limit := range c.DomainLimits {
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("domain_limits %s: %s", domain, err)
+		}
+	}
+	for domain, relay := range c.SenderRelays {
+		if err := relay.Validate(); err != nil {
+			return fmt.Errorf("sender_relays %s: %s", domain, err)
+		}
+	}
+	for domain, policy := range c.TLSPolicies {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("tls_policies %s: %s", domain, err)
+		}
+	}
+	for token, t := range c.HTTPTokens {
+		if token == "" {
+			return errors.New("http_tokens: empty token")
+		}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("http_tokens of %q: %s", t.Name, err)
+		}
+	}
+	if err := c.Archive.Validate(); err != nil {
+		return err
+	}
+	if err := c.SpamFilter.Validate(); err != nil {
+		return err
+	}
+	if err := c.VirusScanner.Validate(); err != nil {
+		return err
+	}
+	return c.Rewrite.Validate()
+}
+
+// ConfigFiles return the configuration files in the order they are merged:
+// the system file, the user file and the file given explicitly
+// or with SENDMAIL_CONFIG environment variable.
+func ConfigFiles(path string) []string {
+	files := []string{DefaultConfigFile}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		files = append(files, filepath.Join(configHome, "go-sendmail.yaml"))
+	}
+	if path == "" {
+		path = os.Getenv("SENDMAIL_CONFIG")
+	}
+	if path != "" {
+		files = append(files, path)
+	}
+	return files
+}
+
+// LoadConfig read and merge the configuration files, values of the later
+// files override the former. Missing files are skipped as not configured,
+// except the explicitly given file which must exist.
+// The default relay falls back to SENDMAIL_SMART_* environment variables.
+func LoadConfig(path string) (*FileConfig, error) {
+	config := new(FileConfig)
+	files := ConfigFiles(path)
+	explicit := path != "" || os.Getenv("SENDMAIL_CONFIG") != ""
+	for i, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) && !(explicit && i == len(files)-1) {
+				continue
+			}
+			return nil, fmt.Errorf("Failed to read config file: %s", err)
+		}
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("Error while parsing config file %s: %s", file, err)
+		}
+	}
+
+	if config.RelayHost == "" {
+		config.RelayHost = os.Getenv("SENDMAIL_SMART_HOST")
+	}
+	if config.RelayLogin == "" {
+		config.RelayLogin = os.Getenv("SENDMAIL_SMART_LOGIN")
+	}
+	if config.RelayPassword == "" {
+		config.RelayPassword = os.Getenv("SENDMAIL_SMART_PASSWORD")
+	}
+	config.TLSPolicies = lowerDomains(config.TLSPolicies)
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %s", err)
+	}
+	return config, nil
+}
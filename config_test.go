@@ -0,0 +1,146 @@
+package sendmail_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	userConfig := filepath.Join(dir, "go-sendmail.yaml")
+	err = ioutil.WriteFile(userConfig, []byte("relay_host: user.example.com:25\nrelay_login: user\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicitConfig := filepath.Join(dir, "explicit.yaml")
+	err = ioutil.WriteFile(explicitConfig, []byte("relay_host: explicit.example.com:25\ntls_policies:\n  Example.COM: require\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := sendmail.LoadConfig(explicitConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RelayHost != "explicit.example.com:25" {
+		t.Error("Expected explicit.example.com:25 got", config.RelayHost)
+	}
+	if config.RelayLogin != "user" {
+		t.Error("Expected user got", config.RelayLogin)
+	}
+	if config.TLSPolicies["example.com"] != sendmail.TLSPolicyRequire {
+		t.Error("Expected require policy of example.com got", config.TLSPolicies)
+	}
+
+	_, err = sendmail.LoadConfig(filepath.Join(dir, "missing.yaml"))
+	if err == nil {
+		t.Error("Expected error for missing explicit config file")
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	if _, err := os.Stat(sendmail.DefaultConfigFile); err == nil {
+		t.Skip("system config file exists")
+	}
+	config, err := sendmail.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RelayHost != "" {
+		t.Error("Expected empty relay host got", config.RelayHost)
+	}
+}
+
+func TestConfigRelay(t *testing.T) {
+	config := &sendmail.FileConfig{
+		RelayHost: "default.example.com:25",
+		SenderRelays: map[string]sendmail.RelayConfig{
+			"foo.com": {Host: "smtp.foo.com:587", Login: "foo"},
+		},
+	}
+
+	relay := config.Relay("user@Foo.com")
+	if relay.Host != "smtp.foo.com:587" || relay.Login != "foo" {
+		t.Error("Expected relay smtp.foo.com:587 got", relay)
+	}
+	relay = config.Relay("user@bar.com")
+	if relay.Host != "default.example.com:25" {
+		t.Error("Expected relay default.example.com:25 got", relay)
+	}
+}
+
+func TestRelayConfigValidate(t *testing.T) {
+	relay := sendmail.RelayConfig{Host: "smtp.example.com", TLS: sendmail.TLSImplicit}
+	if err := relay.Validate(); err != nil {
+		t.Error(err)
+	}
+	if relay.Address() != "smtp.example.com:465" {
+		t.Error("Expected smtp.example.com:465 got", relay.Address())
+	}
+
+	for _, relay := range []sendmail.RelayConfig{
+		{Host: "smtp.example.com", TLS: "ssl"},
+		{Host: "smtp.example.com", Auth: "digest-md5"},
+		{Host: "smtp.example.com:25", Port: 587},
+		{Host: "smtp.example.com", Timeouts: sendmail.Timeouts{Data: -time.Second}},
+	} {
+		if err := relay.Validate(); err == nil {
+			t.Error("Expected validation error for", relay)
+		}
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	file, err := ioutil.TempFile("", "sendmail-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("relay_hots: smtp.example.com\n")
+	file.Close()
+
+	_, err = sendmail.LoadConfig(file.Name())
+	if err == nil || !strings.Contains(err.Error(), "relay_hots") {
+		t.Error("Expected error about unknown key got", err)
+	}
+}
+
+func TestHTTPToken(t *testing.T) {
+	token := sendmail.HTTPToken{Name: "billing", SenderDomains: []string{"example.com"}}
+	if !token.AllowSender("billing@Example.com") || token.AllowSender("billing@example.org") {
+		t.Error("Expected only example.com senders allowed")
+	}
+	if !(sendmail.HTTPToken{}).AllowSender("any@example.org") {
+		t.Error("Expected all senders allowed without domains")
+	}
+
+	config := &sendmail.FileConfig{HTTPTokens: map[string]sendmail.HTTPToken{
+		"secret": {Name: "billing", DailyQuota: -1},
+	}}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected validation error of negative quota")
+	}
+}
@@ -0,0 +1,116 @@
+package sendmail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// sendCopies deliver the individual copy of the message to every
+// recipient, Concurrency copies are delivered in parallel.
+func (e *Envelope) sendCopies(ctx context.Context, t Transport) <-chan Result {
+	results := make(chan Result, len(e.Recipients))
+	body, err := ioutil.ReadAll(e.Body)
+	if err != nil {
+		results <- Result{FatalLevel, err, "Individual copy", nil}
+		close(results)
+		return results
+	}
+	e.Body = bytes.NewReader(body)
+
+	workers := e.Concurrency
+	if workers <= 0 {
+		workers = DefaultConcurrency
+	}
+	budget := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, recipient := range e.Recipients {
+		budget <- struct{}{}
+		wg.Add(1)
+		go func(recipient string) {
+			defer wg.Done()
+			defer func() { <-budget }()
+			c, err := e.individualCopy(recipient, body)
+			if err != nil {
+				results <- Result{ErrorLevel, err, "Individual copy", Fields{
+					"sender":     e.GetSender(),
+					"recipients": recipient,
+				}}
+				return
+			}
+			for result := range c.deferToQueue(c.suppressUnknown(c.sendTransport(ctx, t))) {
+				results <- result
+			}
+		}(recipient)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// individualCopy return the envelope of the recipient with the message
+// addressed only to it, the subject and the body are rendered with
+// the fields of the recipient if RecipientFields are set.
+func (e *Envelope) individualCopy(recipient string, body []byte) (*Envelope, error) {
+	header := make(mail.Header, len(e.Header))
+	for key, values := range e.Header {
+		header[key] = append([]string(nil), values...)
+	}
+	header["To"] = []string{recipient}
+	delete(header, "Cc")
+
+	if e.RecipientFields != nil {
+		fields, ok := e.RecipientFields[recipient]
+		for address := range e.RecipientFields {
+			if !ok && strings.EqualFold(address, recipient) {
+				fields, ok = e.RecipientFields[address]
+			}
+		}
+		if subject := header.Get("Subject"); subject != "" {
+			decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+			if err != nil {
+				decoded = subject
+			}
+			rendered, err := renderFields("subject", []byte(decoded), fields)
+			if err != nil {
+				return nil, err
+			}
+			subject = string(rendered)
+			if needsEncoding(subject) {
+				subject = mime.BEncoding.Encode("UTF-8", subject)
+			}
+			header["Subject"] = []string{subject}
+		}
+		rendered, err := renderFields("body", body, fields)
+		if err != nil {
+			return nil, err
+		}
+		body = rendered
+	}
+
+	c := *e
+	c.Message = &mail.Message{Header: header, Body: bytes.NewReader(body)}
+	c.Recipients = []string{recipient}
+	return &c, nil
+}
+
+// renderFields execute the text as template of the fields.
+func renderFields(name string, text []byte, fields map[string]string) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template of %s: %s", name, err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(buf, fields); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
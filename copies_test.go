@@ -0,0 +1,90 @@
+package sendmail_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/sendmailtest"
+)
+
+func TestIndividualCopies(t *testing.T) {
+	transport := sendmailtest.NewTransport()
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@example.com",
+		Recipients: []string{"alice@example.com", "bob@example.com", "carol@example.com"},
+		Subject:    "Привет, {{.name}}",
+		Body:       []byte("Cc: team@example.com\r\n\r\nYour code is {{.code}}\r\n"),
+		Transport:  transport,
+
+		IndividualCopies: true,
+		RecipientFields: map[string]map[string]string{
+			"alice@example.com": {"name": "Alice", "code": "1"},
+			"Bob@Example.com":   {"name": "Bob", "code": "2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	for result := range results {
+		if result.Level < sendmail.WarnLevel {
+			failed = append(failed, result.Fields["recipients"].(string))
+		}
+	}
+	// carol has no fields
+	if len(failed) != 1 || failed[0] != "carol@example.com" {
+		t.Error("Expected failed copy of carol got", failed)
+	}
+
+	sendmailtest.AssertCount(t, transport, 2)
+	for _, tc := range []struct{ recipient, subject, body string }{
+		{"alice@example.com", "Привет, Alice", "Your code is 1"},
+		{"bob@example.com", "Привет, Bob", "Your code is 2"},
+	} {
+		m := sendmailtest.AssertSentTo(t, transport, tc.recipient)
+		if m == nil {
+			continue
+		}
+		sendmailtest.AssertHeader(t, m, "To", tc.recipient)
+		sendmailtest.AssertHeader(t, m, "Subject", tc.subject)
+		sendmailtest.AssertBodyContains(t, m, tc.body)
+		if len(m.To) != 1 || m.Header.Get("Cc") != "" {
+			t.Errorf("Expected the only recipient of %s got %v, Cc %q", tc.recipient, m.To, m.Header.Get("Cc"))
+		}
+	}
+}
+
+func TestIndividualCopiesRejected(t *testing.T) {
+	transport := sendmailtest.NewTransport()
+	transport.Reject("bad@example.com")
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:           "sender@example.com",
+		Recipients:       []string{"good@example.com", "bad@example.com"},
+		Body:             []byte("TEST"),
+		Transport:        transport,
+		IndividualCopies: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected error
+	for result := range results {
+		if result.Level < sendmail.WarnLevel {
+			rejected = result.Error
+		}
+	}
+	if rejected == nil || !strings.Contains(rejected.Error(), "bad@example.com") {
+		t.Error("Expected rejection of bad@example.com got", rejected)
+	}
+	sendmailtest.AssertCount(t, transport, 1)
+	sendmailtest.AssertHeader(t, sendmailtest.AssertSentTo(t, transport, "good@example.com"), "To", "good@example.com")
+}
@@ -0,0 +1,176 @@
+package sendmail
+
+import (
+	"context"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Modes of the DMARC check before delivery.
+const (
+	// DMARCCheckWarn report the message failing DMARC as a warning.
+	DMARCCheckWarn = "warn"
+	// DMARCCheckRefuse refuse to send the message failing DMARC.
+	DMARCCheckRefuse = "refuse"
+)
+
+// DMARCError reports the message rejected by DMARC policy of From domain:
+// it has neither aligned DKIM signature nor SPF-aligned envelope sender.
+type DMARCError struct {
+	Domain string
+	Reason string
+}
+
+func (e *DMARCError) Error() string {
+	return "message would be rejected by DMARC policy of " + e.Domain + ": " + e.Reason
+}
+
+// dmarcRecord is the parsed DMARC policy (RFC 7489 section 6.3).
+type dmarcRecord struct {
+	policy          string
+	subdomainPolicy string
+	adkim           string
+	aspf            string
+}
+
+// parseDMARC parse the record, ok is false for invalid records.
+func parseDMARC(record string) (*dmarcRecord, bool) {
+	tags := parseTags(record)
+	if tags["v"] != "DMARC1" || tags["p"] == "" {
+		return nil, false
+	}
+	r := &dmarcRecord{
+		policy:          strings.ToLower(tags["p"]),
+		subdomainPolicy: strings.ToLower(tags["sp"]),
+		adkim:           strings.ToLower(tags["adkim"]),
+		aspf:            strings.ToLower(tags["aspf"]),
+	}
+	if r.subdomainPolicy == "" {
+		r.subdomainPolicy = r.policy
+	}
+	return r, true
+}
+
+// parseTags parse "tag=value; tag=value" list of DMARC and DKIM.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, field := range strings.Split(s, ";") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+		}
+	}
+	return tags
+}
+
+// lookupDMARC return the policy applied to domain, looking up
+// the organizational domain when the domain has no record.
+// The policy is empty when no record is published.
+func lookupDMARC(ctx context.Context, resolver Resolver, domain string) (string, *dmarcRecord, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	org := organizationalDomain(domain)
+	for _, name := range []string{domain, org} {
+		txt, err := resolver.LookupTXT(ctx, "_dmarc."+name)
+		if err != nil && !isNotFound(err) {
+			return "", nil, err
+		}
+		for _, record := range txt {
+			if r, ok := parseDMARC(record); ok {
+				if name != domain {
+					return r.subdomainPolicy, r, nil
+				}
+				return r.policy, r, nil
+			}
+		}
+		if org == domain {
+			break
+		}
+	}
+	return "", nil, nil
+}
+
+// organizationalDomain return the organizational domain
+// of the Public Suffix List, the domain itself for a public suffix.
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// aligned compare the domains in strict ("s") or relaxed mode.
+func aligned(mode, a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if mode == "s" {
+		return a == b
+	}
+	return organizationalDomain(a) == organizationalDomain(b)
+}
+
+// CheckDMARC check the message would pass DMARC policy "reject" of From
+// domain: it must have DKIM-Signature aligned with From domain or
+// the envelope sender aligned with it and authorized by SPF.
+// The SPF record is evaluated for SendingIP, without it the published
+// record is assumed to authorize the sending server.
+// It returns *DMARCError when the message would be rejected.
+func (e *Envelope) CheckDMARC() error {
+	from, err := e.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return err
+	}
+	domain := GetDomainFromAddress(from[0].Address)
+	ctx := context.Background()
+	policy, record, err := lookupDMARC(ctx, e.resolver(), domain)
+	if err != nil || policy != "reject" {
+		return err
+	}
+
+	for _, signature := range e.Header["Dkim-Signature"] {
+		if d := parseTags(signature)["d"]; d != "" && aligned(record.adkim, d, domain) {
+			return nil
+		}
+	}
+
+	sender := GetDomainFromAddress(e.GetSender())
+	if !aligned(record.aspf, sender, domain) {
+		return &DMARCError{domain, "no aligned DKIM signature and envelope sender " + sender + " is not aligned"}
+	}
+	if e.SendingIP == nil {
+		spf, err := lookupSPF(ctx, e.resolver(), sender)
+		if err != nil {
+			return err
+		}
+		if spf == "" {
+			return &DMARCError{domain, "no aligned DKIM signature and no SPF record of " + sender}
+		}
+		return nil
+	}
+	result, err := checkSPF(ctx, e.resolver(), e.SendingIP, sender)
+	if result == SPFTempError {
+		return err
+	}
+	if result != SPFPass {
+		return &DMARCError{domain, "no aligned DKIM signature and SPF " + result + " for " + e.SendingIP.String()}
+	}
+	return nil
+}
+
+// checkDMARC run the configured DMARC check before delivery, the error
+// is returned in refuse mode, otherwise it is reported as warning.
+func (e *Envelope) checkDMARC() (*Result, error) {
+	if e.DMARCCheck == "" {
+		return nil, nil
+	}
+	err := e.CheckDMARC()
+	if err == nil {
+		return nil, nil
+	}
+	if _, ok := err.(*DMARCError); ok && e.DMARCCheck == DMARCCheckRefuse {
+		return nil, err
+	}
+	return &Result{WarnLevel, err, "DMARC", Fields{
+		"sender": e.GetSender(),
+	}}, nil
+}
@@ -0,0 +1,152 @@
+package sendmail_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	test.StartSMTP()
+
+	resolver := &fakeResolver{
+		ip: map[string][]net.IPAddr{
+			"localhost":    {{IP: net.ParseIP("127.0.0.1")}},
+			"mx.localhost": {{IP: net.ParseIP("192.0.2.25")}},
+		},
+		mx: map[string][]*net.MX{
+			"spf.localhost": {{Host: "mx.localhost", Pref: 10}},
+		},
+		txt: map[string][]string{
+			"_dmarc.localhost": {"v=DMARC1; p=reject; adkim=s"},
+			"spf.localhost":    {"v=spf1 ip4:10.0.0.0/8 mx -all"},
+		},
+	}
+
+	for _, check := range []struct {
+		body      string
+		sendingIP string
+		spf       bool
+		refused   bool
+	}{
+		{body: "From: sender@localhost\r\n\r\nTEST", refused: true},
+		{body: "From: sender@localhost\r\nDKIM-Signature: v=1; a=rsa-sha256; d=localhost; s=mail\r\n\r\nTEST"},
+		{body: "From: sender@localhost\r\nDKIM-Signature: v=1; d=other.localhost; s=mail\r\n\r\nTEST", refused: true},
+		{body: "From: sender@localhost\r\n\r\nTEST", spf: true},
+		{body: "From: sender@localhost\r\n\r\nTEST", spf: true, sendingIP: "10.1.2.3"},
+		{body: "From: sender@localhost\r\n\r\nTEST", spf: true, sendingIP: "192.0.2.25"},
+		{body: "From: sender@localhost\r\n\r\nTEST", spf: true, sendingIP: "192.0.2.26", refused: true},
+	} {
+		resolver.txt["localhost"] = nil
+		if check.spf {
+			resolver.txt["localhost"] = []string{"v=spf1 include:spf.localhost -all"}
+		}
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Recipients: []string{"recipient@localhost"},
+			Body:       []byte(check.body),
+			SmartHost:  "localhost:" + test.PortSMTP,
+			Resolver:   resolver,
+			DMARCCheck: sendmail.DMARCCheckRefuse,
+			SendingIP:  net.ParseIP(check.sendingIP),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs, err := envelope.Send()
+		if _, ok := err.(*sendmail.DMARCError); ok != check.refused {
+			t.Errorf("Expected refused %v for %q from %s got %v", check.refused, check.body, check.sendingIP, err)
+		}
+		if err != nil {
+			continue
+		}
+		for result := range errs {
+			if result.Level < sendmail.InfoLevel {
+				t.Error(result.Error)
+			}
+		}
+	}
+}
+
+func TestCheckDMARCWarn(t *testing.T) {
+	test.StartSMTP()
+
+	config := testConfigs[0].initial
+	config.SmartHost = "localhost:" + test.PortSMTP
+	config.DMARCCheck = sendmail.DMARCCheckWarn
+	config.Resolver = &fakeResolver{
+		ip: map[string][]net.IPAddr{
+			"localhost": {{IP: net.ParseIP("127.0.0.1")}},
+		},
+		txt: map[string][]string{
+			"_dmarc.localhost": {"v=DMARC1; p=reject"},
+		},
+	}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	warned, sent := false, false
+	for result := range errs {
+		switch result.Level {
+		case sendmail.WarnLevel:
+			_, warned = result.Error.(*sendmail.DMARCError)
+		case sendmail.InfoLevel:
+			sent = true
+		default:
+			t.Error(result.Error)
+		}
+	}
+	if !warned || !sent {
+		t.Errorf("Expected DMARC warning %v and delivery %v", warned, sent)
+	}
+}
+
+func TestCheckDMARCPublicSuffix(t *testing.T) {
+	test.StartSMTP()
+
+	resolver := &fakeResolver{
+		ip: map[string][]net.IPAddr{
+			"localhost": {{IP: net.ParseIP("127.0.0.1")}},
+		},
+		txt: map[string][]string{
+			"_dmarc.example.co.uk": {"v=DMARC1; p=reject"},
+		},
+	}
+
+	// The organizational domain is below the public suffix co.uk
+	for _, check := range []struct {
+		body    string
+		refused bool
+	}{
+		{body: "From: sender@mail.example.co.uk\r\n\r\nTEST", refused: true},
+		{body: "From: sender@mail.example.co.uk\r\nDKIM-Signature: v=1; d=example.co.uk; s=mail\r\n\r\nTEST"},
+		{body: "From: sender@mail.example.co.uk\r\nDKIM-Signature: v=1; d=other.co.uk; s=mail\r\n\r\nTEST", refused: true},
+	} {
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Recipients: []string{"recipient@localhost"},
+			Body:       []byte(check.body),
+			Resolver:   resolver,
+			SmartHost:  "localhost:" + test.PortSMTP,
+			DMARCCheck: sendmail.DMARCCheckRefuse,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs, err := envelope.Send()
+		if _, ok := err.(*sendmail.DMARCError); ok != check.refused {
+			t.Errorf("Expected refused %v for %q got %v", check.refused, check.body, err)
+		}
+		if err != nil {
+			continue
+		}
+		// The test server doesn't know the sender, only the check matters
+		for range errs {
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package sendmail
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TTLResolver is a resolver which reports the TTL of MX records.
+type TTLResolver interface {
+	LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error)
+}
+
+// DNSResolver queries the nameservers directly for MX records to learn
+// their TTL, other lookups are passed to the embedded Resolver.
+// Only the nameserver lines of resolv.conf are used, the names
+// are queried as fully qualified.
+type DNSResolver struct {
+	Resolver
+	// Servers (host:port) to query, from /etc/resolv.conf by default.
+	Servers []string
+	// Timeout of a query to one server.
+	Timeout time.Duration
+}
+
+// NewDNSResolver return resolver using the system nameservers.
+func NewDNSResolver() *DNSResolver {
+	return &DNSResolver{
+		Resolver: net.DefaultResolver,
+		Servers:  systemNameservers("/etc/resolv.conf"),
+		Timeout:  5 * time.Second,
+	}
+}
+
+// LookupMX returns the DNS MX records for the given domain name sorted by preference.
+func (r *DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mx, _, err := r.LookupMXTTL(ctx, name)
+	return mx, err
+}
+
+// LookupMXTTL returns the DNS MX records with the minimal TTL of them.
+func (r *DNSResolver) LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error) {
+	fqdn := strings.TrimSuffix(name, ".") + "."
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	var msg *dnsmessage.Message
+	lastErr := errors.New("no nameservers in resolv.conf")
+	for _, server := range r.Servers {
+		msg, err = r.exchange(ctx, server, qname, dnsmessage.TypeMX)
+		if err == nil {
+			break
+		}
+		lastErr = err
+	}
+	if msg == nil {
+		return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+	}
+
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server misbehaving: " + msg.RCode.String(), Name: name, IsTemporary: true}
+	}
+
+	// The records of the name are owned by the target of its CNAME chain
+	owner, ttl := qname, ^uint32(0)
+	for hops := 0; hops < maxCNAMEHops; hops++ {
+		cname := findCNAME(msg.Answers, owner)
+		if cname == nil {
+			break
+		}
+		if cname.Header.TTL < ttl {
+			ttl = cname.Header.TTL
+		}
+		owner = cname.Body.(*dnsmessage.CNAMEResource).CNAME
+	}
+	var records []*net.MX
+	for _, answer := range msg.Answers {
+		mx, ok := answer.Body.(*dnsmessage.MXResource)
+		if !ok || !strings.EqualFold(answer.Header.Name.String(), owner.String()) {
+			continue
+		}
+		if answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		records = append(records, &net.MX{Host: mx.MX.String(), Pref: mx.Pref})
+	}
+	if len(records) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	return records, time.Duration(ttl) * time.Second, nil
+}
+
+// maxCNAMEHops is the longest CNAME chain followed in the answer.
+const maxCNAMEHops = 8
+
+// findCNAME return the CNAME record of the name in the answer, nil if none.
+func findCNAME(answers []dnsmessage.Resource, name dnsmessage.Name) *dnsmessage.Resource {
+	for i, answer := range answers {
+		if _, ok := answer.Body.(*dnsmessage.CNAMEResource); ok && strings.EqualFold(answer.Header.Name.String(), name.String()) {
+			return &answers[i]
+		}
+	}
+	return nil
+}
+
+// udpSize is the size of UDP replies advertised with EDNS0.
+const udpSize = 1232
+
+// exchange send the query over UDP and repeat it over TCP when truncated.
+func (r *DNSResolver) exchange(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	id := make([]byte, 2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	var opt dnsmessage.Resource
+	if err := opt.Header.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	opt.Body = &dnsmessage.OPTResource{}
+	query.Additionals = append(query.Additionals, opt)
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		msg, err := r.roundTrip(ctx, network, server, packed, &query)
+		if err != nil {
+			return nil, err
+		}
+		if !msg.Truncated {
+			return msg, nil
+		}
+	}
+	return nil, errors.New("truncated DNS reply")
+}
+
+// roundTrip send the packed query and return its reply, the UDP
+// replies not matching the ID and the question are ignored as spoofed.
+func (r *DNSResolver) roundTrip(ctx context.Context, network, server string, packed []byte, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		reply := make([]byte, udpSize)
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				return nil, err
+			}
+			msg := new(dnsmessage.Message)
+			if msg.Unpack(reply[:n]) == nil && answers(query, msg) {
+				return msg, nil
+			}
+		}
+	}
+
+	packet := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(packet, uint16(len(packed)))
+	copy(packet[2:], packed)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	msg := new(dnsmessage.Message)
+	if err := msg.Unpack(reply); err != nil {
+		return nil, err
+	}
+	if !answers(query, msg) {
+		return nil, errors.New("mismatched DNS reply")
+	}
+	return msg, nil
+}
+
+// answers check the message is the reply to the query by its ID and question.
+func answers(query, msg *dnsmessage.Message) bool {
+	if !msg.Response || msg.ID != query.ID || len(msg.Questions) != 1 {
+		return false
+	}
+	q, a := query.Questions[0], msg.Questions[0]
+	return q.Type == a.Type && q.Class == a.Class && strings.EqualFold(q.Name.String(), a.Name.String())
+}
+
+// systemNameservers read nameservers from resolv.conf.
+func systemNameservers(filename string) []string {
+	var servers []string
+	file, err := os.Open(filename)
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 1 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	return servers
+}
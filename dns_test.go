@@ -0,0 +1,227 @@
+package sendmail_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mxReply return the reply with MX records to the query.
+func mxReply(query *dnsmessage.Message) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true},
+		Questions: query.Questions,
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 600},
+				Body:   &dnsmessage.MXResource{Pref: 20, MX: dnsmessage.MustNewName("mx2.example.com.")},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mx1.example.com.")},
+			},
+		},
+	}
+}
+
+// serveDNS answers MX queries of one UDP request, the reply is preceded
+// by spoofed replies or replaced by the truncated one.
+func serveDNS(t *testing.T, conn net.PacketConn, truncated bool) {
+	buf := make([]byte, 512)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	var query dnsmessage.Message
+	if err := query.Unpack(buf[:n]); err != nil {
+		t.Error(err)
+		return
+	}
+	edns := false
+	for _, additional := range query.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT && additional.Header.Class >= 1232 {
+			edns = true
+		}
+	}
+	if !edns {
+		t.Error("Expected EDNS0 with UDP size 1232 in query", query.Additionals)
+	}
+
+	var replies []*dnsmessage.Message
+	if truncated {
+		replies = append(replies, &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, Truncated: true},
+			Questions: query.Questions,
+		})
+	} else {
+		spoofed := mxReply(&query)
+		spoofed.ID++
+		other := mxReply(&query)
+		other.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.org."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET}}
+		replies = append(replies, spoofed, other, mxReply(&query))
+	}
+	for _, reply := range replies {
+		packed, err := reply.Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteTo(packed, addr)
+	}
+}
+
+// serveDNSTCP answers queries of one TCP connection with the reply.
+func serveDNSTCP(t *testing.T, l net.Listener, reply func(*dnsmessage.Message) *dnsmessage.Message) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		t.Error(err)
+		return
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	var query dnsmessage.Message
+	if err := query.Unpack(buf); err != nil {
+		t.Error(err)
+		return
+	}
+	packed, err := reply(&query).Pack()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	binary.BigEndian.PutUint16(length, uint16(len(packed)))
+	conn.Write(append(length, packed...))
+}
+
+func assertMX(t *testing.T, resolver *sendmail.DNSResolver) {
+	mx, ttl, err := resolver.LookupMXTTL(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mx) != 2 || mx[0].Host != "mx1.example.com." || mx[1].Host != "mx2.example.com." {
+		t.Error("Unexpected MX records", mx)
+	}
+	if ttl != 300*time.Second {
+		t.Error("Expected TTL 5m0s got", ttl)
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveDNS(t, conn, false)
+
+	resolver := sendmail.NewDNSResolver()
+	resolver.Servers = []string{conn.LocalAddr().String()}
+	assertMX(t, resolver)
+}
+
+// lookupTCP look up the MX records of example.com
+// at the TCP server with the reply.
+func lookupTCP(t *testing.T, reply func(*dnsmessage.Message) *dnsmessage.Message) ([]*net.MX, time.Duration, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Skip("UDP port of the TCP listener is busy:", err)
+	}
+	defer conn.Close()
+	go serveDNS(t, conn, true)
+	go serveDNSTCP(t, l, reply)
+
+	resolver := sendmail.NewDNSResolver()
+	resolver.Servers = []string{l.Addr().String()}
+	return resolver.LookupMXTTL(context.Background(), "example.com")
+}
+
+func TestDNSResolverTruncated(t *testing.T) {
+	mx, ttl, err := lookupTCP(t, mxReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mx) != 2 || ttl != 300*time.Second {
+		t.Error("Expected MX records of TCP reply got", mx, ttl)
+	}
+
+	// The reply truncated over TCP as well is refused
+	_, _, err = lookupTCP(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		reply := mxReply(query)
+		reply.Truncated = true
+		return reply
+	})
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTemporary {
+		t.Error("Expected temporary error of truncated reply got", err)
+	}
+}
+
+func TestDNSResolverCNAME(t *testing.T) {
+	mx, ttl, err := lookupTCP(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		reply := mxReply(query)
+		target := dnsmessage.MustNewName("mx.example.org.")
+		for i := range reply.Answers {
+			reply.Answers[i].Header.Name = target
+		}
+		reply.Answers = append([]dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("mail.example.net."), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 900},
+				Body:   &dnsmessage.CNAMEResource{CNAME: target},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("mail.example.net.")},
+			},
+			// The records of other names are ignored
+			{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.net."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.MXResource{Pref: 1, MX: dnsmessage.MustNewName("evil.example.net.")},
+			},
+		}, reply.Answers...)
+		return reply
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mx) != 2 || mx[0].Host != "mx1.example.com." || mx[1].Host != "mx2.example.com." {
+		t.Error("Unexpected MX records of the CNAME chain", mx)
+	}
+	// The shortest TTL of the chain
+	if ttl != 120*time.Second {
+		t.Error("Expected TTL 2m0s got", ttl)
+	}
+}
+
+func TestDNSResolverOwnerMismatch(t *testing.T) {
+	_, _, err := lookupTCP(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		reply := mxReply(query)
+		for i := range reply.Answers {
+			reply.Answers[i].Header.Name = dnsmessage.MustNewName("example.org.")
+		}
+		return reply
+	})
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Error("Expected not found error of records of other name got", err)
+	}
+}
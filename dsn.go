@@ -0,0 +1,148 @@
+package sendmail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// deliveryFailure is the recipient the message is never delivered to.
+type deliveryFailure struct {
+	Recipient string
+	// Status is the enhanced status code (RFC 3463) used if the error
+	// is not the SMTP reply with one.
+	Status string
+	Err    error
+}
+
+// enhancedCodeRe matches the enhanced status code of the SMTP reply text.
+var enhancedCodeRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\b`)
+
+// status return the enhanced status code of the failure.
+func (f deliveryFailure) status() string {
+	var protoErr *textproto.Error
+	if errors.As(f.Err, &protoErr) {
+		if m := enhancedCodeRe.FindStringSubmatch(protoErr.Msg); m != nil && m[1][0] == byte('0'+protoErr.Code/100) {
+			return m[1]
+		}
+		if protoErr.Code >= 500 {
+			return "5.0.0"
+		}
+	}
+	return f.Status
+}
+
+// diagnostic return the SMTP reply of the failure, empty if none.
+func (f deliveryFailure) diagnostic() string {
+	var protoErr *textproto.Error
+	if !errors.As(f.Err, &protoErr) {
+		return ""
+	}
+	return fmt.Sprintf("smtp; %d %s", protoErr.Code, strings.Join(strings.Fields(protoErr.Msg), " "))
+}
+
+// dsnMessage generate the delivery status notification (RFC 3464)
+// of the failed recipients of the queued message.
+func dsnMessage(entry *QueueEntry, message []byte, failures []deliveryFailure, now time.Time) ([]byte, error) {
+	hostname := localHostname()
+
+	body := bytes.NewBuffer(nil)
+	writer := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", hostname)
+	fmt.Fprint(part, "Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _, failure := range failures {
+		fmt.Fprintf(part, "<%s>: %s\r\n", failure.Recipient, strings.Join(strings.Fields(failure.Err.Error()), " "))
+	}
+
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Type", "message/delivery-status")
+	part, err = writer.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", hostname)
+	fmt.Fprintf(part, "Arrival-Date: %s\r\n", entry.Created.Format(time.RFC1123Z))
+	for _, failure := range failures {
+		fmt.Fprintf(part, "\r\nFinal-Recipient: rfc822; %s\r\n", failure.Recipient)
+		fmt.Fprint(part, "Action: failed\r\n")
+		fmt.Fprintf(part, "Status: %s\r\n", failure.status())
+		if diagnostic := failure.diagnostic(); diagnostic != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: %s\r\n", diagnostic)
+		}
+		fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/rfc822-headers")
+	part, err = writer.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	if end := bytes.Index(message, []byte("\r\n\r\n")); end >= 0 {
+		message = message[:end+2]
+	}
+	part.Write(message)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		return nil, err
+	}
+	msg := bytes.NewBuffer(nil)
+	fmt.Fprintf(msg, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(msg, "To: %s\r\n", entry.Sender)
+	fmt.Fprint(msg, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Message-Id: <%s@%s>\r\n", id, hostname)
+	fmt.Fprint(msg, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprint(msg, "Mime-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/report", map[string]string{
+		"report-type": "delivery-status",
+		"boundary":    writer.Boundary(),
+	}))
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// bounce queue the delivery status notification of the failed recipients
+// to the sender of the entry. The notification has the null reverse-path,
+// so the messages with the null reverse-path are never notified.
+// It returns the queue ID of the notification, empty if none is sent.
+func (q *Queue) bounce(entry *QueueEntry, message []byte, failures []deliveryFailure) (string, error) {
+	if entry.Sender == "" || len(failures) == 0 {
+		return "", nil
+	}
+	now := time.Now()
+	dsn, err := dsnMessage(entry, message, failures, now)
+	if err != nil {
+		return "", err
+	}
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	notification := &QueueEntry{
+		ID:         id,
+		Recipients: []string{entry.Sender},
+		Priority:   PriorityTransactional,
+		Created:    now,
+	}
+	if err := q.store().Add(notification, dsn); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,8 @@
+package sendmail
+
+// SignV4 export the request signer for the known-answer tests.
+var SignV4 = signV4
+
+// IsUserUnknown export the classification of the rejections
+// added to the suppression list.
+var IsUserUnknown = isUserUnknown
@@ -3,7 +3,11 @@ module github.com/n0madic/sendmail
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.4
 	github.com/emersion/go-smtp v0.15.0
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 	gopkg.in/yaml.v2 v2.4.0
+	modernc.org/sqlite v1.17.3
 )
@@ -0,0 +1,76 @@
+package sendmail
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Middleware processes the message before the delivery, e.g. checks
+// a policy, adds headers or rewrites the content. The returned error
+// refuses the message.
+type Middleware func(ctx context.Context, e *Envelope) error
+
+var (
+	middlewaresMu sync.RWMutex
+	middlewares   []Middleware
+)
+
+// RegisterMiddleware add the middlewares to the chain invoked for every
+// message sent, after the middlewares registered before. Compiled-in
+// plugins register them in init functions.
+func RegisterMiddleware(m ...Middleware) {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	middlewares = append(middlewares, m...)
+}
+
+// RefusedError is the refusal of the message by the middleware.
+type RefusedError struct {
+	Err error
+}
+
+func (e *RefusedError) Error() string {
+	return "message refused: " + e.Err.Error()
+}
+
+// Unwrap return the error of the middleware.
+func (e *RefusedError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the message may be accepted later,
+// the error of the middleware implements Temporary() bool then.
+func (e *RefusedError) Temporary() bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(e.Err, &temporary) && temporary.Temporary()
+}
+
+// temporaryError is the failure of the middleware worth retrying,
+// e.g. the filter service is unavailable.
+type temporaryError struct {
+	error
+}
+
+func (temporaryError) Temporary() bool {
+	return true
+}
+
+// Process invoke the registered middlewares and then the middlewares
+// of the envelope, the first error stops the chain. It is called by Send,
+// the message is processed only once.
+func (e *Envelope) Process(ctx context.Context) error {
+	if e.processed {
+		return nil
+	}
+	middlewaresMu.RLock()
+	chain := append([]Middleware(nil), middlewares...)
+	middlewaresMu.RUnlock()
+	for _, m := range append(chain, e.Middleware...) {
+		if err := m(ctx, e); err != nil {
+			return &RefusedError{err}
+		}
+	}
+	e.processed = true
+	return nil
+}
@@ -0,0 +1,75 @@
+package sendmail_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	sendmail.RegisterMiddleware(func(ctx context.Context, e *sendmail.Envelope) error {
+		if e.Header.Get("X-Middleware-Test") == "" {
+			return nil
+		}
+		order = append(order, "registered")
+		if e.Header.Get("X-Middleware-Test") == "refuse" {
+			return errors.New("policy violation")
+		}
+		return nil
+	})
+	stamp := func(ctx context.Context, e *sendmail.Envelope) error {
+		order = append(order, "envelope")
+		e.Header["X-Stamp"] = []string{"processed"}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		header  string
+		refused bool
+	}{
+		{"pass", false},
+		{"refuse", true},
+	} {
+		order = nil
+		transport := &fakeTransport{}
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Sender:     "sender@localhost",
+			Recipients: []string{"user@example.com"},
+			Body:       []byte("X-Middleware-Test: " + tc.header + "\n\nTEST"),
+			Transport:  transport,
+			Middleware: []sendmail.Middleware{stamp},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := envelope.Send()
+		if tc.refused {
+			var refused *sendmail.RefusedError
+			if !errors.As(err, &refused) {
+				t.Fatal("Expected refusal got", err)
+			}
+			if len(order) != 1 || len(transport.delivered) > 0 {
+				t.Error("Expected no processing and delivery after refusal got", order, transport.delivered)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range results {
+		}
+		if len(order) != 2 || order[0] != "registered" || order[1] != "envelope" {
+			t.Error("Expected registered and envelope middlewares in order got", order)
+		}
+		if envelope.Header.Get("X-Stamp") != "processed" || len(transport.delivered) != 1 {
+			t.Error("Expected delivery of the processed message")
+		}
+		// The message is processed once
+		if err := envelope.Process(context.Background()); err != nil || len(order) != 2 {
+			t.Error("Unexpected second processing", order, err)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package sendmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultContentType of the message without Content-Type header
+const defaultContentType = "text/plain; charset=utf-8"
+
+// addAlternative convert the message to multipart/alternative with
+// the original body as plain text version and the HTML version.
+func addAlternative(msg *mail.Message, html []byte) error {
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writer := multipart.NewWriter(buf)
+
+	part, err := writer.CreatePart(bodyHeader(msg))
+	if err != nil {
+		return err
+	}
+	part.Write(body)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err = writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write(html)
+	if err := qp.Close(); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	setMultipart(msg, "multipart/alternative", writer.Boundary(), buf)
+	return nil
+}
+
+// attachFiles convert the message to multipart/mixed with the original body
+// as the first part and the files as attachments.
+func attachFiles(msg *mail.Message, files []string) error {
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writer := multipart.NewWriter(buf)
+
+	part, err := writer.CreatePart(bodyHeader(msg))
+	if err != nil {
+		return err
+	}
+	part.Write(body)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := writeAttachment(writer, filepath.Base(file), data); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	setMultipart(msg, "multipart/mixed", writer.Boundary(), buf)
+	return nil
+}
+
+// bodyHeader return MIME header of the message body for use as a part.
+func bodyHeader(msg *mail.Message) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", msg.Header.Get("Content-Type"))
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", defaultContentType)
+	}
+	if encoding := msg.Header.Get("Content-Transfer-Encoding"); encoding != "" {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	return header
+}
+
+// setMultipart replace the message body with multipart content.
+func setMultipart(msg *mail.Message, mediaType, boundary string, body io.Reader) {
+	msg.Header["Mime-Version"] = []string{"1.0"}
+	msg.Header["Content-Type"] = []string{mime.FormatMediaType(mediaType, map[string]string{
+		"boundary": boundary,
+	})}
+	delete(msg.Header, "Content-Transfer-Encoding")
+	msg.Body = body
+}
+
+// writeAttachment add base64 encoded part with the file content.
+func writeAttachment(writer *multipart.Writer, filename string, data []byte) error {
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filename,
+	}))
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return writeBase64(part, data)
+}
+
+// writeBase64 encode data with line length limit of RFC 2045.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := w.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := w.Write([]byte(encoded + "\r\n"))
+	return err
+}
+
+// messageContent is the decoded message for APIs without raw MIME input.
+type messageContent struct {
+	text        string
+	html        string
+	attachments []attachment
+}
+
+// attachment of the decoded message.
+type attachment struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// parseContent decode the text and HTML versions and the attachments
+// of the message body.
+func parseContent(msg *mail.Message) (*messageContent, error) {
+	content := new(messageContent)
+	err := content.addPart(textproto.MIMEHeader(msg.Header), msg.Body)
+	return content, err
+}
+
+// addPart add the part to the content, multipart parts are walked.
+func (c *messageContent) addPart(header textproto.MIMEHeader, body io.Reader) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := c.addPart(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	switch {
+	case disposition != "attachment" && filename == "" && mediaType == "text/plain" && c.text == "":
+		c.text = string(data)
+	case disposition != "attachment" && filename == "" && mediaType == "text/html" && c.html == "":
+		c.html = string(data)
+	default:
+		if filename == "" {
+			filename = "attachment"
+		}
+		c.attachments = append(c.attachments, attachment{filename, mediaType, data})
+	}
+	return nil
+}
+
+// addressHeaders are the headers of address lists.
+var addressHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc"}
+
+// structuredHeaders are not encoded, the encoded words are not allowed
+// in their values.
+var structuredHeaders = map[string]bool{
+	"Message-Id":             true,
+	"In-Reply-To":            true,
+	"References":             true,
+	"Received":               true,
+	"Return-Path":            true,
+	"Dkim-Signature":         true,
+	"Authentication-Results": true,
+}
+
+// needsEncoding reports whether the value has non-ASCII or control characters.
+func needsEncoding(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c > '~' {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeHeader encode the non-ASCII header values with RFC 2047
+// encoded words, only the display names of address lists are encoded.
+func encodeHeader(header mail.Header) {
+	for key, values := range header {
+		if structuredHeaders[key] || strings.HasPrefix(key, "Content-") {
+			continue
+		}
+		for i, value := range values {
+			if !needsEncoding(value) {
+				continue
+			}
+			if isAddressHeader(key) {
+				// The addresses themselves must stay intact
+				if list, err := mail.ParseAddressList(value); err == nil {
+					addresses := make([]string, 0, len(list))
+					for _, address := range list {
+						addresses = append(addresses, address.String())
+					}
+					values[i] = strings.Join(addresses, ", ")
+				}
+				continue
+			}
+			values[i] = mime.BEncoding.Encode("UTF-8", value)
+		}
+	}
+}
+
+// foldHeader return the header line folded at the whitespace to
+// 78 characters where possible (RFC 5322 section 2.2.3), the address
+// lists are also folded after the commas. The line which can't be
+// folded to 998 characters is an error.
+func foldHeader(key, value string) (string, error) {
+	line := key + ": " + value
+	if len(line) <= 78 {
+		return line, nil
+	}
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t'
+	}
+	commas := isAddressHeader(key)
+	var segments []string
+	start := 0
+	for i := 1; i < len(line); i++ {
+		if (isSpace(line[i]) && !isSpace(line[i-1])) || (commas && line[i-1] == ',' && !isSpace(line[i])) {
+			segments = append(segments, line[start:i])
+			start = i
+		}
+	}
+	segments = append(segments, line[start:])
+
+	var buf strings.Builder
+	length := 0
+	for i, segment := range segments {
+		if i > 0 && length+len(segment) > 78 {
+			buf.WriteString("\r\n")
+			length = 0
+			if !isSpace(segment[0]) {
+				buf.WriteByte(' ')
+				length++
+			}
+		}
+		buf.WriteString(segment)
+		length += len(segment)
+		if length > 998 {
+			return "", fmt.Errorf("header %s line exceeds 998 characters", key)
+		}
+	}
+	return buf.String(), nil
+}
+
+// isAddressHeader reports whether the header is an address list.
+func isAddressHeader(key string) bool {
+	for _, header := range addressHeaders {
+		if header == key {
+			return true
+		}
+	}
+	return false
+}
+
+// isTraceHeader reports whether the header is a trace field
+// written on the top of the header (RFC 5321).
+func isTraceHeader(key string) bool {
+	return key == "Return-Path" || key == "Received"
+}
+
+// sortHeaderKeys sort the keys with the trace fields first.
+func sortHeaderKeys(keys []string) {
+	sort.Strings(keys)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return isTraceHeader(keys[i]) && !isTraceHeader(keys[j])
+	})
+}
+
+// writeHeader write the folded header lines, the values of address
+// lists are joined as the field may appear once, the others are
+// written as separate fields like Received chains.
+func writeHeader(buf *bytes.Buffer, key string, values []string) error {
+	if err := checkHeader(key, values...); err != nil {
+		return err
+	}
+	if isAddressHeader(key) {
+		values = []string{strings.Join(values, ",")}
+	}
+	for _, value := range values {
+		line, err := foldHeader(key, value)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	return nil
+}
+
+// rawHeader is the original header block of the message.
+type rawHeader struct {
+	fields   []rawField
+	original mail.Header
+}
+
+// rawField is the header field with its continuation lines.
+type rawField struct {
+	key  string
+	data []byte
+}
+
+// newRawHeader split the header block of the message to fields,
+// header is the parsed header copied as the original values.
+func newRawHeader(message []byte, header mail.Header) *rawHeader {
+	raw := &rawHeader{original: make(mail.Header, len(header))}
+	for key, values := range header {
+		raw.original[key] = append([]string(nil), values...)
+	}
+	for len(message) > 0 {
+		end := bytes.IndexByte(message, '\n') + 1
+		if end == 0 {
+			end = len(message)
+		}
+		line := message[:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(raw.fields) > 0 {
+			last := &raw.fields[len(raw.fields)-1]
+			last.data = append(last.data, line...)
+		} else {
+			key := string(line)
+			if i := strings.IndexByte(key, ':'); i >= 0 {
+				key = key[:i]
+			}
+			raw.fields = append(raw.fields, rawField{
+				key:  textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key)),
+				data: append([]byte(nil), line...),
+			})
+		}
+		message = message[end:]
+	}
+	return raw
+}
+
+// unchanged reports whether the header has the original values of the key.
+func (r *rawHeader) unchanged(header mail.Header, key string) bool {
+	values, ok := header[key]
+	original, found := r.original[key]
+	if ok != found || len(values) != len(original) {
+		return false
+	}
+	for i := range values {
+		if values[i] != original[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// prepended return the values of the trace field prepended
+// to the original values, nil if it's changed otherwise.
+func (r *rawHeader) prepended(header mail.Header, key string) []string {
+	values, original := header[key], r.original[key]
+	if !isTraceHeader(key) || len(original) == 0 || len(values) <= len(original) {
+		return nil
+	}
+	n := len(values) - len(original)
+	if !r.unchanged(mail.Header{key: values[n:]}, key) {
+		return nil
+	}
+	return values[:n]
+}
+
+// changed return the headers with values other than the original.
+func (r *rawHeader) changed(header mail.Header) mail.Header {
+	changed := make(mail.Header)
+	for key, values := range header {
+		if !r.unchanged(header, key) {
+			changed[key] = values
+		}
+	}
+	return changed
+}
+
+// write the header keeping the unchanged fields byte for byte in the
+// original order. The changed fields are written in place of the first
+// original field, the added fields and the values prepended to the
+// trace fields before the original block.
+func (r *rawHeader) write(buf *bytes.Buffer, header mail.Header) error {
+	var added []string
+	prepended := make(mail.Header)
+	for key := range header {
+		if _, ok := r.original[key]; !ok {
+			added = append(added, key)
+		} else if values := r.prepended(header, key); values != nil {
+			added = append(added, key)
+			prepended[key] = values
+		}
+	}
+	sortHeaderKeys(added)
+	for _, key := range added {
+		values, ok := prepended[key]
+		if !ok {
+			values = header[key]
+		}
+		if err := writeHeader(buf, key, values); err != nil {
+			return err
+		}
+	}
+	written := make(map[string]bool)
+	for _, field := range r.fields {
+		values, ok := header[field.key]
+		switch {
+		case r.unchanged(header, field.key) || prepended[field.key] != nil:
+			buf.Write(normalizeCRLF(field.data))
+		case !ok || written[field.key]:
+			// Removed or already written
+		default:
+			if err := writeHeader(buf, field.key, values); err != nil {
+				return err
+			}
+			written[field.key] = true
+		}
+	}
+	return nil
+}
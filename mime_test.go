@@ -0,0 +1,109 @@
+package sendmail_test
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-mime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "report.txt")
+	if err := ioutil.WriteFile(file, []byte("REPORT"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:      "sender@localhost",
+		Recipients:  []string{"recipient@localhost"},
+		Body:        []byte("TEST"),
+		Attachments: []string{file},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(envelope.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatal("Expected multipart/mixed got", mediaType)
+	}
+	reader := multipart.NewReader(envelope.Body, params["boundary"])
+
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(part)
+	if string(body) != "TEST\r\n" {
+		t.Errorf("Expected TEST got %q", body)
+	}
+
+	part, err = reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != "report.txt" {
+		t.Error("Expected report.txt got", part.FileName())
+	}
+	// multipart.Reader decodes quoted-printable only, check base64 payload
+	body, _ = ioutil.ReadAll(part)
+	if string(body) != "UkVQT1JU\r\n" {
+		t.Errorf("Expected UkVQT1JU got %q", body)
+	}
+}
+
+func TestHTMLBody(t *testing.T) {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"recipient@localhost"},
+		Body:       []byte("TEST"),
+		HTMLBody:   []byte("<b>TEST</b>"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(envelope.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatal("Expected multipart/alternative got", mediaType)
+	}
+	reader := multipart.NewReader(envelope.Body, params["boundary"])
+
+	for _, expected := range []string{"text/plain; charset=utf-8", "text/html; charset=utf-8"} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != expected {
+			t.Error("Expected", expected, "got", part.Header.Get("Content-Type"))
+		}
+	}
+
+	envelope, err = sendmail.NewEnvelope(&sendmail.Config{
+		Sender:      "sender@localhost",
+		Recipients:  []string{"recipient@localhost"},
+		Body:        []byte("<b>TEST</b>"),
+		ContentType: "text/html; charset=utf-8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Error("Expected text/html got", envelope.Header.Get("Content-Type"))
+	}
+}
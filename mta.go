@@ -1,101 +1,215 @@
 package sendmail
 
 import (
+	"context"
 	"errors"
 	"net"
-	"net/smtp"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// NullMXError reports the domain which does not accept mail,
+// it publishes null MX record (RFC 7505).
+type NullMXError struct {
+	Domain string
+}
+
+func (e *NullMXError) Error() string {
+	return "domain " + e.Domain + " does not accept mail (null MX)"
+}
+
+// isNullMX check for the single MX record with "." host.
+func isNullMX(records []*net.MX) bool {
+	return len(records) == 1 && (records[0].Host == "." || records[0].Host == "")
+}
+
+// Routes of the direct delivery reported in "route" field of results.
+const (
+	routeMX         = "mx"
+	routeImplicitMX = "implicit_mx"
+)
+
+// lookupHosts return the mail servers of domain ordered by preference
+// and the route used. When the domain has no MX records, the domain itself
+// is the implicit MX (RFC 5321 section 5.1) unless it is disabled.
+// The error of MX lookup is returned along with the hosts of implicit MX.
+func (e *Envelope) lookupHosts(ctx context.Context, domain string) ([]string, string, error) {
+	var hostList []string
+	mxrecords, err := e.resolver().LookupMX(ctx, domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound || e.DisableImplicitMX {
+			return nil, routeMX, err
+		}
+		// Fallback to A/AAAA records
+		if _, ipErr := e.resolver().LookupIPAddr(ctx, domain); ipErr != nil {
+			return nil, routeMX, err
+		}
+		return []string{domain}, routeImplicitMX, err
+	}
+	if isNullMX(mxrecords) {
+		return nil, routeMX, &NullMXError{domain}
+	}
+	for _, mx := range mxrecords {
+		hostList = append(hostList, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hostList, routeMX, nil
+}
+
+// DefaultConcurrency is the number of parallel deliveries to domains
+// of one message when Config.Concurrency is not set.
+const DefaultConcurrency = 10
+
 // SendLikeMTA message delivery directly, like Mail Transfer Agent.
+// Domains of recipients are delivered in parallel by Concurrency workers.
 func (e *Envelope) SendLikeMTA() <-chan Result {
-	var successCount = new(int32)
+	return e.sendLikeMTA(context.Background())
+}
+
+func (e *Envelope) sendLikeMTA(ctx context.Context) <-chan Result {
+	var successCount, deferredCount int32
 	mapDomains := make(map[string][]string)
 	results := make(chan Result, len(e.Recipients))
 	generatedBody, err := e.GenerateMessage()
 	if err != nil {
 		results <- Result{FatalLevel, err, "Generate message", nil}
-	} else {
-		for _, recipient := range e.Recipients {
-			domain := GetDomainFromAddress(recipient)
-			mapDomains[domain] = append(mapDomains[domain], recipient)
-		}
+		close(results)
+		return results
+	}
+	for _, recipient := range e.Recipients {
+		domain := GetDomainFromAddress(recipient)
+		mapDomains[domain] = append(mapDomains[domain], recipient)
+	}
 
-		for domain, addresses := range mapDomains {
-			rcpts := strings.Join(addresses, ",")
-			wg.Add(1)
-			go func(domain string, addresses []string) {
-				defer wg.Done()
-				var hostList []string
-				mxrecords, err := net.LookupMX(domain)
-				if err != nil {
-					results <- Result{WarnLevel, err, "LookupMX", Fields{
-						"sender":     e.Header.Get("From"),
-						"domain":     domain,
-						"recipients": rcpts,
-					}}
-					// Fallback to A records
-					ips, err := net.LookupIP(domain)
-					if err != nil {
-						results <- Result{WarnLevel, err, "LookupIP", Fields{
-							"sender":     e.Header.Get("From"),
-							"domain":     domain,
-							"recipients": rcpts,
-						}}
-					} else {
-						for _, ip := range ips {
-							host := strings.TrimSuffix(ip.String(), ".")
-							hostList = append(hostList, host)
-						}
-					}
-				} else {
-					for _, mx := range mxrecords {
-						host := strings.TrimSuffix(mx.Host, ".")
-						hostList = append(hostList, host)
-					}
-				}
-				if len(hostList) == 0 {
-					results <- Result{ErrorLevel, errors.New("MX not found"), "Lookup", Fields{
-						"sender":     e.Header.Get("From"),
-						"domain":     domain,
-						"recipients": rcpts,
-					}}
-				} else {
-					for _, host := range hostList {
-						fields := Fields{
-							"sender":     e.Header.Get("From"),
-							"mx":         host,
-							"recipients": rcpts,
-						}
-						err := smtp.SendMail(host+":"+e.PortSMTP, nil,
-							e.Header.Get("From"),
-							addresses,
-							generatedBody)
-						if err == nil {
-							results <- Result{InfoLevel, nil, "Send mail OK", fields}
-							atomic.AddInt32(successCount, 1)
-							return
-						}
-						results <- Result{WarnLevel, err, "", fields}
-					}
+	workers := e.Concurrency
+	if workers <= 0 {
+		workers = DefaultConcurrency
+	}
+	if workers > len(mapDomains) {
+		workers = len(mapDomains)
+	}
+	domains := make(chan string, len(mapDomains))
+	for domain := range mapDomains {
+		domains <- domain
+	}
+	close(domains)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range domains {
+				switch e.deliverDomain(ctx, domain, mapDomains[domain], generatedBody, results) {
+				case deliverySent:
+					atomic.AddInt32(&successCount, 1)
+				case deliveryDeferred:
+					atomic.AddInt32(&deferredCount, 1)
 				}
-			}(domain, addresses)
-		}
+			}
+		}()
 	}
 	go func() {
 		wg.Wait()
 		fields := Fields{
-			"sender":  e.Header.Get("From"),
-			"success": *successCount,
-			"total":   int32(len(mapDomains)),
+			"sender":   e.Header.Get("From"),
+			"success":  successCount,
+			"deferred": deferredCount,
+			"total":    int32(len(mapDomains)),
 		}
-		if *successCount == 0 {
+		// Deferred domains are not failed
+		if successCount == 0 && deferredCount == 0 {
 			results <- Result{ErrorLevel, errors.New("failed to deliver to all recipients"), "", fields}
-		} else if *successCount != int32(len(mapDomains)) {
+		} else if successCount+deferredCount != int32(len(mapDomains)) {
 			results <- Result{ErrorLevel, errors.New("failed to deliver to some recipients"), "", fields}
 		}
 		close(results)
 	}()
 	return results
 }
+
+// Outcomes of the delivery to domain.
+const (
+	deliveryFailed = iota
+	deliverySent
+	deliveryDeferred
+)
+
+// deliverDomain send the message to the recipients of domain
+// trying its mail servers in order of preference.
+func (e *Envelope) deliverDomain(ctx context.Context, domain string, addresses []string, body []byte, results chan<- Result) int {
+	rcpts := strings.Join(addresses, ",")
+	if e.RateLimiter != nil && !e.dryRun {
+		release, err := e.RateLimiter.Acquire(domain)
+		if err != nil {
+			results <- Result{WarnLevel, err, "Deferred", Fields{
+				"sender":     e.Header.Get("From"),
+				"domain":     domain,
+				"recipients": rcpts,
+			}}
+			return deliveryDeferred
+		}
+		defer release()
+	}
+	hostList, route, err := e.lookupHosts(ctx, domain)
+	if err != nil {
+		level := ErrorLevel
+		if route == routeImplicitMX {
+			level = WarnLevel
+		}
+		results <- Result{level, err, "LookupMX", Fields{
+			"sender":     e.Header.Get("From"),
+			"domain":     domain,
+			"recipients": rcpts,
+		}}
+		if level == ErrorLevel {
+			return deliveryFailed
+		}
+	}
+	if len(hostList) == 0 {
+		results <- Result{ErrorLevel, errors.New("MX not found"), "Lookup", Fields{
+			"sender":     e.Header.Get("From"),
+			"domain":     domain,
+			"recipients": rcpts,
+		}}
+		return deliveryFailed
+	}
+	policy := e.tlsPolicy(domain)
+	for _, host := range hostList {
+		fields := Fields{
+			"sender":     e.Header.Get("From"),
+			"mx":         host,
+			"route":      route,
+			"recipients": rcpts,
+		}
+		if policy != TLSPolicyOpportunistic {
+			fields["tls_policy"] = string(policy)
+		}
+		tlsMode, tlsConfig := policy.session(host)
+		start := time.Now()
+		sent, err := e.sendMail(ctx, net.JoinHostPort(host, e.PortSMTP), sessionOptions{
+			tlsConfig:  tlsConfig,
+			tlsMode:    tlsMode,
+			requireTLS: e.RequireTLS,
+			timeouts:   e.timeouts(),
+			tlsReport:  e.tlsReport(domain, host),
+			resolver:   e.resolver(),
+			family:     e.AddressFamily,
+		},
+			e.reversePath(),
+			addresses,
+			body)
+		for _, chunk := range sent {
+			results <- Result{InfoLevel, nil, e.successMessage(), e.attemptFields(chunkFields(fields, chunk), start, nil)}
+			addresses = addresses[len(chunk):]
+		}
+		if err == nil || len(addresses) == 0 {
+			return deliverySent
+		}
+		// The next server gets the undelivered recipients only
+		fields["recipients"] = strings.Join(addresses, ",")
+		results <- Result{WarnLevel, err, "", e.attemptFields(fields, start, err)}
+	}
+	return deliveryFailed
+}
@@ -1,14 +1,20 @@
 package sendmail_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/n0madic/sendmail"
 	"github.com/n0madic/sendmail/test"
 )
 
 func TestSendLikeMTA(t *testing.T) {
-	go test.StartSMTP()
+	test.StartSMTP()
 
 	for _, config := range testConfigs {
 		envelope, err := sendmail.NewEnvelope(&config.initial)
@@ -24,3 +30,113 @@ func TestSendLikeMTA(t *testing.T) {
 		}
 	}
 }
+
+func TestNullMX(t *testing.T) {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"user@nullmx.test"},
+		Body:       []byte("TEST"),
+		Resolver: &fakeResolver{mx: map[string][]*net.MX{
+			"nullmx.test": {{Host: ".", Pref: 0}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nullMX *sendmail.NullMXError
+	for result := range envelope.SendLikeMTA() {
+		errors.As(result.Error, &nullMX)
+	}
+	if nullMX == nil || nullMX.Domain != "nullmx.test" {
+		t.Error("Expected NullMXError for nullmx.test")
+	}
+}
+
+func TestImplicitMX(t *testing.T) {
+	test.StartSMTP()
+
+	config := testConfigs[0].initial
+	config.Resolver = &fakeResolver{ip: map[string][]net.IPAddr{
+		"localhost": {{IP: net.ParseIP("127.0.0.1")}},
+	}}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := ""
+	for result := range envelope.SendLikeMTA() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+		if result.Level == sendmail.InfoLevel {
+			route, _ = result.Fields["route"].(string)
+		}
+	}
+	if route != "implicit_mx" {
+		t.Error("Expected implicit_mx route got", route)
+	}
+
+	config.DisableImplicitMX = true
+	envelope, err = sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := false
+	for result := range envelope.SendLikeMTA() {
+		if result.Level == sendmail.InfoLevel {
+			delivered = true
+		}
+	}
+	if delivered {
+		t.Error("Expected no delivery with disabled implicit MX")
+	}
+}
+
+// slowResolver count the parallel MX lookups.
+type slowResolver struct {
+	fakeResolver
+	active, max int32
+}
+
+func (r *slowResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	active := atomic.AddInt32(&r.active, 1)
+	defer atomic.AddInt32(&r.active, -1)
+	for {
+		max := atomic.LoadInt32(&r.max)
+		if active <= max || atomic.CompareAndSwapInt32(&r.max, max, active) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return r.fakeResolver.LookupMX(ctx, name)
+}
+
+func TestConcurrency(t *testing.T) {
+	resolver := &slowResolver{}
+	var recipients []string
+	for i := 0; i < 20; i++ {
+		recipients = append(recipients, fmt.Sprintf("user@domain%d.test", i))
+	}
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:      "sender@localhost",
+		Recipients:  recipients,
+		Body:        []byte("TEST"),
+		Resolver:    resolver,
+		Concurrency: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int32
+	for result := range envelope.SendLikeMTA() {
+		if n, ok := result.Fields["total"].(int32); ok {
+			total = n
+		}
+	}
+	if total != 20 {
+		t.Error("Expected 20 domains got", total)
+	}
+	if resolver.max != 3 {
+		t.Error("Expected 3 parallel deliveries got", resolver.max)
+	}
+}
@@ -0,0 +1,157 @@
+package sendmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CheckDomainOptions of the deliverability preflight.
+type CheckDomainOptions struct {
+	// Resolver for DNS lookups, DefaultResolver if nil.
+	Resolver Resolver
+	// SendingIP is the public address of outgoing connections,
+	// the local address of the default route if nil.
+	SendingIP net.IP
+	// DKIMSelector of the signing key, DKIM is not checked if empty.
+	DKIMSelector string
+}
+
+// DomainReport is the result of the deliverability preflight.
+type DomainReport struct {
+	// Domain of the senders.
+	Domain string `json:"domain"`
+	// IP is the address of outgoing connections.
+	IP string `json:"ip"`
+	// PTR names of the IP.
+	PTR []string `json:"ptr,omitempty"`
+	// PTRMatch the PTR name resolves back to the IP (FCrDNS).
+	PTRMatch bool `json:"ptr_match"`
+	// SPFRecord of the domain, empty if there is none.
+	SPFRecord string `json:"spf_record,omitempty"`
+	// SPF result of the IP.
+	SPF string `json:"spf"`
+	// DKIMSelector and the presence of its public key.
+	DKIMSelector string `json:"dkim_selector,omitempty"`
+	DKIMKey      bool   `json:"dkim_key,omitempty"`
+	// DMARCPolicy applied to the domain, empty if there is none.
+	DMARCPolicy string `json:"dmarc_policy,omitempty"`
+	// Problems found by the checks.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// OK reports whether no problems are found.
+func (r *DomainReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *DomainReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// CheckDomain inspect the sending setup of the domain: the reverse DNS
+// of the outgoing address, the SPF coverage of it, the DKIM key of
+// the selector and the DMARC policy. The DNS failures are reported
+// as problems, the error is returned when the outgoing address is unknown.
+func CheckDomain(ctx context.Context, domain string, opts *CheckDomainOptions) (*DomainReport, error) {
+	if opts == nil {
+		opts = &CheckDomainOptions{}
+	}
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return nil, errors.New("empty domain")
+	}
+	ip := opts.SendingIP
+	if ip == nil {
+		var err error
+		if ip, err = outboundIP(); err != nil {
+			return nil, fmt.Errorf("failed to find outgoing address: %s", err)
+		}
+	}
+	report := &DomainReport{Domain: domain, IP: ip.String(), DKIMSelector: opts.DKIMSelector}
+
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	switch {
+	case err != nil && !isNotFound(err):
+		report.problem("PTR lookup of %s: %s", ip, err)
+	case len(names) == 0:
+		report.problem("no PTR record of %s", ip)
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		report.PTR = append(report.PTR, name)
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				report.PTRMatch = true
+			}
+		}
+	}
+	if len(names) > 0 && !report.PTRMatch {
+		report.problem("PTR name %s doesn't resolve to %s", report.PTR[0], ip)
+	}
+
+	if report.SPFRecord, err = lookupSPF(ctx, resolver, domain); err != nil {
+		report.problem("SPF lookup of %s: %s", domain, err)
+	} else {
+		report.SPF, err = checkSPF(ctx, resolver, ip, domain)
+		switch {
+		case err != nil:
+			report.problem("SPF evaluation of %s: %s", domain, err)
+		case report.SPF == SPFNone:
+			report.problem("no SPF record of %s", domain)
+		case report.SPF != SPFPass:
+			report.problem("SPF result of %s is %s", ip, report.SPF)
+		}
+	}
+
+	if opts.DKIMSelector != "" {
+		name := opts.DKIMSelector + "._domainkey." + domain
+		txt, err := resolver.LookupTXT(ctx, name)
+		revoked := false
+		for _, record := range txt {
+			if key, ok := parseTags(record)["p"]; ok {
+				report.DKIMKey, revoked = key != "", key == ""
+				break
+			}
+		}
+		switch {
+		case err != nil && !isNotFound(err):
+			report.problem("DKIM lookup of %s: %s", name, err)
+		case revoked:
+			report.problem("DKIM key %s is revoked", name)
+		case !report.DKIMKey:
+			report.problem("no DKIM key at %s", name)
+		}
+	}
+
+	policy, _, err := lookupDMARC(ctx, resolver, domain)
+	switch {
+	case err != nil:
+		report.problem("DMARC lookup of %s: %s", domain, err)
+	case policy == "":
+		report.problem("no DMARC policy of %s", domain)
+	}
+	report.DMARCPolicy = policy
+	return report, nil
+}
+
+// outboundIP return the local address of the default route,
+// no packets are sent.
+func outboundIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "192.0.2.1:25")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
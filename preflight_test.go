@@ -0,0 +1,85 @@
+package sendmail_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestCheckDomain(t *testing.T) {
+	resolver := &fakeResolver{
+		ip: map[string][]net.IPAddr{
+			"mail.example.com": {{IP: net.ParseIP("192.0.2.1")}},
+		},
+		txt: map[string][]string{
+			"example.com":                  {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"s1._domainkey.example.com":    {"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQC"},
+			"old._domainkey.example.com":   {"v=DKIM1; p="},
+			"_dmarc.example.com":           {"v=DMARC1; p=reject"},
+			"other.org":                    {"v=spf1 -all"},
+			"s1._domainkey.mail.other.org": {"v=spf1"},
+			"_dmarc.other.org":             {"v=DMARC1; p=none"},
+		},
+		ptr: map[string][]string{
+			"192.0.2.1": {"mail.example.com."},
+			"192.0.2.2": {"mail.example.com."},
+		},
+	}
+
+	report, err := sendmail.CheckDomain(context.Background(), "example.com", &sendmail.CheckDomainOptions{
+		Resolver:     resolver,
+		SendingIP:    net.ParseIP("192.0.2.1"),
+		DKIMSelector: "s1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &sendmail.DomainReport{
+		Domain:       "example.com",
+		IP:           "192.0.2.1",
+		PTR:          []string{"mail.example.com"},
+		PTRMatch:     true,
+		SPFRecord:    "v=spf1 ip4:192.0.2.0/24 -all",
+		SPF:          sendmail.SPFPass,
+		DKIMSelector: "s1",
+		DKIMKey:      true,
+		DMARCPolicy:  "reject",
+	}
+	if !reflect.DeepEqual(report, expected) || !report.OK() {
+		t.Errorf("Expected %+v got %+v", expected, report)
+	}
+
+	for _, tc := range []struct {
+		domain, ip, selector string
+		problems             []string
+	}{
+		{"example.com", "192.0.2.2", "old", []string{
+			"PTR name mail.example.com doesn't resolve to 192.0.2.2",
+			"DKIM key old._domainkey.example.com is revoked",
+		}},
+		{"mail.other.org", "198.51.100.1", "s1", []string{
+			"no PTR record of 198.51.100.1",
+			"no SPF record of mail.other.org",
+			"no DKIM key at s1._domainkey.mail.other.org",
+		}},
+		{"other.org", "198.51.100.1", "", []string{
+			"no PTR record of 198.51.100.1",
+			"SPF result of 198.51.100.1 is fail",
+		}},
+	} {
+		report, err := sendmail.CheckDomain(context.Background(), tc.domain, &sendmail.CheckDomainOptions{
+			Resolver:     resolver,
+			SendingIP:    net.ParseIP(tc.ip),
+			DKIMSelector: tc.selector,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report.Problems, tc.problems) {
+			t.Errorf("%s from %s: expected problems %q got %q", tc.domain, tc.ip, tc.problems, report.Problems)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package sendmail
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority class of the message in the queue.
+type Priority string
+
+// Priority classes, in the order of delivery.
+const (
+	// PriorityTransactional messages are triggered by user actions,
+	// e.g. password resets.
+	PriorityTransactional Priority = "transactional"
+	// PriorityNormal is the default class.
+	PriorityNormal Priority = "normal"
+	// PriorityBulk messages are newsletters and other mass mailings.
+	PriorityBulk Priority = "bulk"
+)
+
+// priorities in the order of delivery
+var priorities = []Priority{PriorityTransactional, PriorityNormal, PriorityBulk}
+
+// DefaultQueueConcurrency is the number of parallel deliveries per class.
+var DefaultQueueConcurrency = map[Priority]int{
+	PriorityTransactional: 4,
+	PriorityNormal:        2,
+	PriorityBulk:          1,
+}
+
+// ParsePriority parse the class name, empty is PriorityNormal.
+func ParsePriority(s string) (Priority, error) {
+	switch p := Priority(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return PriorityNormal, nil
+	case PriorityTransactional, PriorityNormal, PriorityBulk:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown priority %q, expected transactional, normal or bulk", s)
+}
+
+// rank of the priority, lower is delivered first
+func (p Priority) rank() int {
+	for i, priority := range priorities {
+		if p == priority {
+			return i
+		}
+	}
+	return 1
+}
+
+// headerPriority derive the class from Precedence, X-Priority
+// and Priority headers (RFC 2076), PriorityNormal by default.
+func headerPriority(header map[string][]string) Priority {
+	get := func(key string) string {
+		if values := header[key]; len(values) > 0 {
+			return strings.ToLower(strings.TrimSpace(values[0]))
+		}
+		return ""
+	}
+	switch get("Precedence") {
+	case "bulk", "list", "junk":
+		return PriorityBulk
+	}
+	switch get("Priority") {
+	case "urgent":
+		return PriorityTransactional
+	case "non-urgent":
+		return PriorityBulk
+	}
+	switch xPriority := get("X-Priority"); {
+	case strings.HasPrefix(xPriority, "1"), strings.HasPrefix(xPriority, "2"):
+		return PriorityTransactional
+	case strings.HasPrefix(xPriority, "4"), strings.HasPrefix(xPriority, "5"):
+		return PriorityBulk
+	}
+	return PriorityNormal
+}
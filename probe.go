@@ -0,0 +1,213 @@
+package sendmail
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProbeOptions of the server probe.
+type ProbeOptions struct {
+	// Resolver for DNS lookups, DefaultResolver if nil.
+	Resolver Resolver
+	// AddressFamily policy of the connection.
+	AddressFamily AddressFamily
+	// Timeouts of the session stages, DefaultTimeouts for not set.
+	Timeouts Timeouts
+	// Helo is the name sent in EHLO, the hostname by default.
+	Helo string
+	// ImplicitTLS connect with TLS from the start (port 465),
+	// otherwise STARTTLS is used when the server offers it.
+	ImplicitTLS bool
+}
+
+// ServerProfile is the capabilities of SMTP server advertised in EHLO.
+type ServerProfile struct {
+	// Host of the server.
+	Host string `json:"host"`
+	// Address is the IP address and port connected.
+	Address string `json:"address,omitempty"`
+	// Greeting of the server.
+	Greeting string `json:"greeting,omitempty"`
+	// ESMTP the server accepted EHLO, otherwise only HELO.
+	ESMTP bool `json:"esmtp"`
+	// Extensions advertised in EHLO with their parameters,
+	// the ones advertised after STARTTLS when it is negotiated.
+	Extensions map[string]string `json:"extensions,omitempty"`
+	// MaxSize of the messages (SIZE), 0 if not limited.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// AuthMechanisms of AUTH extension.
+	AuthMechanisms []string `json:"auth_mechanisms,omitempty"`
+	// StartTLS the server offers STARTTLS.
+	StartTLS bool `json:"starttls"`
+	// TLS of the session, nil without TLS.
+	TLS *TLSProfile `json:"tls,omitempty"`
+	// Error of the probe of ProbeMX, the probes of other hosts go on.
+	Error string `json:"error,omitempty"`
+}
+
+// TLSProfile is the TLS session and the certificate of the server.
+type TLSProfile struct {
+	Version     string    `json:"version"`
+	CipherSuite string    `json:"cipher_suite"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	// Pin is the SPKI hash of the certificate in the form of RelayConfig.TLSPins.
+	Pin string `json:"pin"`
+	// Verified the certificate is valid for the host by the system roots.
+	Verified    bool   `json:"verified"`
+	VerifyError string `json:"verify_error,omitempty"`
+}
+
+// Probe connect to the SMTP server at host or host:port (25 by default)
+// and return its capabilities, no mail is sent. The certificate
+// is inspected even if it is not valid.
+func Probe(ctx context.Context, host string, opts *ProbeOptions) (*ServerProfile, error) {
+	if opts == nil {
+		opts = &ProbeOptions{}
+	}
+	addr := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		addr = net.JoinHostPort(host, "25")
+	}
+	tlsMode := TLSOpportunistic
+	if opts.ImplicitTLS {
+		tlsMode = TLSImplicit
+	}
+	return probe(ctx, addr, sessionOptions{
+		tlsConfig: &tls.Config{ServerName: host, InsecureSkipVerify: true},
+		tlsMode:   tlsMode,
+		helo:      opts.Helo,
+		timeouts:  opts.Timeouts.Or(DefaultTimeouts),
+		resolver:  opts.Resolver,
+		family:    opts.AddressFamily,
+	})
+}
+
+// ProbeMX return the capabilities of the mail servers of domain ordered
+// by preference. The failed probes are reported in the Error of the
+// profiles, the error is returned when the servers can't be found.
+func (e *Envelope) ProbeMX(domain string) ([]*ServerProfile, error) {
+	return e.probeMX(context.Background(), domain)
+}
+
+func (e *Envelope) probeMX(ctx context.Context, domain string) ([]*ServerProfile, error) {
+	hosts, _, err := e.lookupHosts(ctx, domain)
+	if len(hosts) == 0 {
+		if err == nil {
+			err = errors.New("MX not found")
+		}
+		return nil, err
+	}
+	port := e.PortSMTP
+	if port == "" {
+		port = "25"
+	}
+	profiles := make([]*ServerProfile, len(hosts))
+	for i, host := range hosts {
+		profile, err := probe(ctx, net.JoinHostPort(host, port), sessionOptions{
+			tlsConfig: &tls.Config{ServerName: host, InsecureSkipVerify: true},
+			tlsMode:   TLSOpportunistic,
+			timeouts:  e.timeouts(),
+			resolver:  e.resolver(),
+			family:    e.AddressFamily,
+		})
+		if err != nil {
+			profile.Error = err.Error()
+		}
+		profiles[i] = profile
+	}
+	return profiles, nil
+}
+
+// probe return the profile of the server at addr, the profile
+// is partially filled on error.
+func probe(ctx context.Context, addr string, opts sessionOptions) (*ServerProfile, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	profile := &ServerProfile{Host: host}
+	c, err := dialClient(ctx, addr, opts, nil)
+	if err != nil {
+		return profile, err
+	}
+	defer c.close()
+	defer c.watch(ctx)()
+	profile.Address = c.conn.RemoteAddr().String()
+	profile.Greeting = c.greeting
+	if err := c.hello(); err != nil {
+		return profile, err
+	}
+	if ok, _ := c.extension("STARTTLS"); ok && !c.tls {
+		profile.StartTLS = true
+		if err := c.startTLS(opts.tlsConfig); err != nil {
+			profile.readExtensions(c)
+			return profile, fmt.Errorf("STARTTLS: %s", err)
+		}
+	}
+	profile.readExtensions(c)
+	if conn, ok := c.conn.(*tls.Conn); ok {
+		profile.TLS = newTLSProfile(host, conn.ConnectionState())
+	}
+	c.quit()
+	return profile, nil
+}
+
+// readExtensions fill the profile with the extensions of the session.
+func (p *ServerProfile) readExtensions(c *client) {
+	p.ESMTP = c.ext != nil
+	p.Extensions = make(map[string]string, len(c.ext))
+	for ext, param := range c.ext {
+		p.Extensions[ext] = param
+	}
+	if size, err := strconv.ParseInt(c.ext["SIZE"], 10, 64); err == nil {
+		p.MaxSize = size
+	}
+	if mechanisms, ok := c.ext["AUTH"]; ok {
+		p.AuthMechanisms = strings.Fields(strings.ToUpper(mechanisms))
+		sort.Strings(p.AuthMechanisms)
+	}
+}
+
+// newTLSProfile describe the session and verify the certificate for the host.
+func newTLSProfile(host string, state tls.ConnectionState) *TLSProfile {
+	profile := &TLSProfile{CipherSuite: tls.CipherSuiteName(state.CipherSuite)}
+	var ok bool
+	if profile.Version, ok = tlsVersions[state.Version]; !ok {
+		profile.Version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	if len(state.PeerCertificates) == 0 {
+		profile.VerifyError = "server sent no certificate"
+		return profile
+	}
+	cert := state.PeerCertificates[0]
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	profile.Subject = cert.Subject.String()
+	profile.Issuer = cert.Issuer.String()
+	profile.DNSNames = cert.DNSNames
+	profile.NotBefore = cert.NotBefore
+	profile.NotAfter = cert.NotAfter
+	profile.Pin = "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	if err != nil {
+		profile.VerifyError = err.Error()
+	}
+	profile.Verified = err == nil
+	return profile
+}
@@ -0,0 +1,98 @@
+package sendmail_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/sendmailtest"
+)
+
+func TestProbe(t *testing.T) {
+	server, err := sendmailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	profile, err := sendmail.Probe(context.Background(), server.Addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !profile.ESMTP || profile.StartTLS || profile.TLS != nil || profile.Greeting == "" {
+		t.Errorf("Unexpected profile %+v", profile)
+	}
+	if len(profile.AuthMechanisms) == 0 || profile.AuthMechanisms[0] != "PLAIN" {
+		t.Error("Expected AUTH PLAIN got", profile.AuthMechanisms)
+	}
+	if _, ok := profile.Extensions["PIPELINING"]; !ok {
+		t.Error("Expected PIPELINING extension got", profile.Extensions)
+	}
+
+	addr, cert := tlsProxy(t, server.Addr())
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	profile, err = sendmail.Probe(context.Background(), addr, &sendmail.ProbeOptions{ImplicitTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.TLS == nil {
+		t.Fatal("Expected TLS profile")
+	}
+	if pin := "sha256/" + base64.StdEncoding.EncodeToString(spki[:]); profile.TLS.Pin != pin {
+		t.Errorf("Expected pin %s got %s", pin, profile.TLS.Pin)
+	}
+	// The test certificate is not trusted
+	if profile.TLS.Verified || profile.TLS.VerifyError == "" {
+		t.Errorf("Unexpected verification of %+v", profile.TLS)
+	}
+
+	if _, err := sendmail.Probe(context.Background(), "127.0.0.1:1", nil); err == nil {
+		t.Error("Expected error of closed port")
+	}
+}
+
+func TestProbeMX(t *testing.T) {
+	server, err := sendmailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Addr())
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@example.org",
+		Recipients: []string{"user@example.com"},
+		Body:       []byte("TEST"),
+		PortSMTP:   port,
+		Resolver: &fakeResolver{
+			mx: map[string][]*net.MX{"example.com": {
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 20},
+			}},
+			ip: map[string][]net.IPAddr{"mx1.example.com": {{IP: net.ParseIP("127.0.0.1")}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := envelope.ProbeMX("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Fatal("Expected 2 profiles got", len(profiles))
+	}
+	if profiles[0].Host != "mx1.example.com" || profiles[0].Error != "" || !profiles[0].ESMTP {
+		t.Errorf("Unexpected profile %+v", profiles[0])
+	}
+	if profiles[1].Host != "mx2.example.com" || profiles[1].Error == "" {
+		t.Errorf("Expected error of unresolved host got %+v", profiles[1])
+	}
+
+	if _, err := envelope.ProbeMX("example.org"); err == nil {
+		t.Error("Expected error of domain without servers")
+	}
+}
@@ -0,0 +1,395 @@
+package sendmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// Names of the transports of mail provider HTTP APIs.
+const (
+	TransportMailgun  = "mailgun"
+	TransportSendGrid = "sendgrid"
+	TransportPostmark = "postmark"
+)
+
+func init() {
+	RegisterTransport(TransportMailgun, func(relay RelayConfig) (Transport, error) {
+		if relay.APIKey == "" {
+			return nil, errors.New("mailgun: api key is not set")
+		}
+		return &MailgunTransport{APIKey: relay.APIKey, Domain: relay.Domain, Endpoint: relay.Endpoint}, nil
+	})
+	RegisterTransport(TransportSendGrid, func(relay RelayConfig) (Transport, error) {
+		if relay.APIKey == "" {
+			return nil, errors.New("sendgrid: api key is not set")
+		}
+		return &SendGridTransport{APIKey: relay.APIKey, Endpoint: relay.Endpoint}, nil
+	})
+	RegisterTransport(TransportPostmark, func(relay RelayConfig) (Transport, error) {
+		if relay.APIKey == "" {
+			return nil, errors.New("postmark: api key is not set")
+		}
+		return &PostmarkTransport{ServerToken: relay.APIKey, Endpoint: relay.Endpoint}, nil
+	})
+}
+
+// MailgunTransport submits the raw message to Mailgun messages.mime API.
+type MailgunTransport struct {
+	APIKey string
+	// Domain of the Mailgun account, the sender domain if empty.
+	Domain string
+	// Endpoint URL of the API, https://api.mailgun.net/v3 by default
+	// (https://api.eu.mailgun.net/v3 for EU region).
+	Endpoint string
+	// HTTPClient for the API requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Deliver the message with Mailgun API.
+func (t *MailgunTransport) Deliver(ctx context.Context, e *Envelope) ([]RecipientResult, error) {
+	msg, err := e.GenerateMessage()
+	if err != nil {
+		return nil, err
+	}
+	domain := t.Domain
+	if domain == "" {
+		domain = GetDomainFromAddress(e.GetSender())
+	}
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.mailgun.net/v3"
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for _, rcpt := range e.Recipients {
+		writer.WriteField("to", rcpt)
+	}
+	part, err := writer.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(msg)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(endpoint, "/")+"/"+domain+"/messages.mime", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.SetBasicAuth("api", t.APIKey)
+	return e.sendAPI(t.HTTPClient, req, TransportMailgun)
+}
+
+// SendGridTransport submits the message decoded from MIME to SendGrid v3 API.
+type SendGridTransport struct {
+	APIKey string
+	// Endpoint URL of the API, https://api.sendgrid.com/v3/mail/send by default.
+	Endpoint string
+	// HTTPClient for the API requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+type sendgridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendgridPersonalization struct {
+	To []sendgridAddress `json:"to"`
+	Cc []sendgridAddress `json:"cc,omitempty"`
+}
+
+type sendgridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendgridAttachment struct {
+	Content  string `json:"content"`
+	Type     string `json:"type,omitempty"`
+	Filename string `json:"filename"`
+}
+
+type sendgridMail struct {
+	Personalizations []sendgridPersonalization `json:"personalizations"`
+	From             sendgridAddress           `json:"from"`
+	ReplyTo          *sendgridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject,omitempty"`
+	Content          []sendgridContent         `json:"content,omitempty"`
+	Attachments      []sendgridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+// Deliver the message with SendGrid API. The hidden recipients get
+// separate personalizations to keep them out of To and Cc.
+func (t *SendGridTransport) Deliver(ctx context.Context, e *Envelope) ([]RecipientResult, error) {
+	msg, err := e.apiMessage()
+	if err != nil {
+		return nil, err
+	}
+	address := func(list []string) []sendgridAddress {
+		var addresses []sendgridAddress
+		for _, addr := range list {
+			addresses = append(addresses, sendgridAddress{Email: addr})
+		}
+		return addresses
+	}
+	request := sendgridMail{
+		From:    sendgridAddress{msg.from.Address, msg.from.Name},
+		Subject: msg.subject,
+		Headers: msg.headers,
+	}
+	if len(msg.to) > 0 || len(msg.cc) > 0 {
+		request.Personalizations = append(request.Personalizations, sendgridPersonalization{address(msg.to), address(msg.cc)})
+	}
+	for _, rcpt := range msg.bcc {
+		request.Personalizations = append(request.Personalizations, sendgridPersonalization{To: address([]string{rcpt})})
+	}
+	if msg.replyTo != nil {
+		request.ReplyTo = &sendgridAddress{msg.replyTo.Address, msg.replyTo.Name}
+	}
+	if msg.content.text != "" || msg.content.html == "" {
+		request.Content = append(request.Content, sendgridContent{"text/plain", msg.content.text})
+	}
+	if msg.content.html != "" {
+		request.Content = append(request.Content, sendgridContent{"text/html", msg.content.html})
+	}
+	for _, a := range msg.content.attachments {
+		request.Attachments = append(request.Attachments, sendgridAttachment{
+			base64.StdEncoding.EncodeToString(a.data), a.contentType, a.filename,
+		})
+	}
+
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.sendgrid.com/v3/mail/send"
+	}
+	req, err := newJSONRequest(ctx, endpoint, request)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.APIKey)
+	return e.sendAPI(t.HTTPClient, req, TransportSendGrid)
+}
+
+// PostmarkTransport submits the message decoded from MIME to Postmark API.
+type PostmarkTransport struct {
+	ServerToken string
+	// MessageStream of the server, the default transactional stream if empty.
+	MessageStream string
+	// Endpoint URL of the API, https://api.postmarkapp.com/email by default.
+	Endpoint string
+	// HTTPClient for the API requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+type postmarkHeader struct {
+	Name  string
+	Value string
+}
+
+type postmarkAttachment struct {
+	Name        string
+	Content     string
+	ContentType string
+}
+
+type postmarkMessage struct {
+	From          string
+	To            string
+	Cc            string               `json:",omitempty"`
+	Bcc           string               `json:",omitempty"`
+	ReplyTo       string               `json:",omitempty"`
+	Subject       string               `json:",omitempty"`
+	TextBody      string               `json:",omitempty"`
+	HTMLBody      string               `json:"HtmlBody,omitempty"`
+	Headers       []postmarkHeader     `json:",omitempty"`
+	Attachments   []postmarkAttachment `json:",omitempty"`
+	MessageStream string               `json:",omitempty"`
+}
+
+// Deliver the message with Postmark API.
+func (t *PostmarkTransport) Deliver(ctx context.Context, e *Envelope) ([]RecipientResult, error) {
+	msg, err := e.apiMessage()
+	if err != nil {
+		return nil, err
+	}
+	to, bcc := msg.to, msg.bcc
+	if len(to) == 0 && len(bcc) > 0 {
+		// Postmark requires To, the single recipient sees only itself
+		to, bcc = bcc[:1], bcc[1:]
+	}
+	message := postmarkMessage{
+		From:          msg.from.String(),
+		To:            strings.Join(to, ","),
+		Cc:            strings.Join(msg.cc, ","),
+		Bcc:           strings.Join(bcc, ","),
+		Subject:       msg.subject,
+		TextBody:      msg.content.text,
+		HTMLBody:      msg.content.html,
+		MessageStream: t.MessageStream,
+	}
+	if msg.replyTo != nil {
+		message.ReplyTo = msg.replyTo.String()
+	}
+	for name, value := range msg.headers {
+		message.Headers = append(message.Headers, postmarkHeader{name, value})
+	}
+	for _, a := range msg.content.attachments {
+		message.Attachments = append(message.Attachments, postmarkAttachment{
+			a.filename, base64.StdEncoding.EncodeToString(a.data), a.contentType,
+		})
+	}
+
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.postmarkapp.com/email"
+	}
+	req, err := newJSONRequest(ctx, endpoint, message)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Postmark-Server-Token", t.ServerToken)
+	return e.sendAPI(t.HTTPClient, req, TransportPostmark)
+}
+
+// apiMessage is the message decoded for the provider APIs
+// without raw MIME input.
+type apiMessage struct {
+	from    *mail.Address
+	replyTo *mail.Address
+	// to and cc are the recipients listed in the headers,
+	// bcc are the other recipients of the envelope.
+	to, cc, bcc []string
+	subject     string
+	headers     map[string]string
+	content     *messageContent
+}
+
+// apiReservedHeaders are passed in the fields of the API requests.
+var apiReservedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Subject": true,
+	"Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true,
+	"Date": true, "Dkim-Signature": true, "Received": true,
+}
+
+// apiMessage decode the generated message.
+func (e *Envelope) apiMessage() (*apiMessage, error) {
+	raw, err := e.GenerateMessage()
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	msg := &apiMessage{headers: make(map[string]string)}
+	msg.from, err = mail.ParseAddress(parsed.Header.Get("From"))
+	if err != nil {
+		msg.from = &mail.Address{Address: e.GetSender()}
+	}
+	if replyTo, err := parsed.Header.AddressList("Reply-To"); err == nil && len(replyTo) > 0 {
+		msg.replyTo = replyTo[0]
+	}
+	decoder := new(mime.WordDecoder)
+	msg.subject, err = decoder.DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		msg.subject = parsed.Header.Get("Subject")
+	}
+	for name, values := range parsed.Header {
+		if !apiReservedHeaders[name] {
+			msg.headers[name] = strings.Join(values, ",")
+		}
+	}
+
+	listed := func(field string) map[string]bool {
+		addresses := make(map[string]bool)
+		if list, err := parsed.Header.AddressList(field); err == nil {
+			for _, addr := range list {
+				addresses[strings.ToLower(addr.Address)] = true
+			}
+		}
+		return addresses
+	}
+	to, cc := listed("To"), listed("Cc")
+	for _, rcpt := range e.Recipients {
+		switch {
+		case to[strings.ToLower(rcpt)]:
+			msg.to = append(msg.to, rcpt)
+		case cc[strings.ToLower(rcpt)]:
+			msg.cc = append(msg.cc, rcpt)
+		default:
+			msg.bcc = append(msg.bcc, rcpt)
+		}
+	}
+
+	msg.content, err = parseContent(parsed)
+	return msg, err
+}
+
+// newJSONRequest return POST request with the JSON encoded body.
+func newJSONRequest(ctx context.Context, endpoint string, body interface{}) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// sendAPI send the request of the provider API, the message refused
+// by the provider is reported for all recipients.
+func (e *Envelope) sendAPI(client *http.Client, req *http.Request, provider string) ([]RecipientResult, error) {
+	if e.dryRun {
+		return recipientResults(e.Recipients, req.URL.Host, nil), nil
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		// Mailgun and Postmark report the message, SendGrid the list of errors
+		var apiErr struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		json.Unmarshal(data, &apiErr)
+		if apiErr.Message == "" && len(apiErr.Errors) > 0 {
+			apiErr.Message = apiErr.Errors[0].Message
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = resp.Status
+		}
+		err = fmt.Errorf("%s: %s", provider, apiErr.Message)
+	}
+	return recipientResults(e.Recipients, req.URL.Host, err), nil
+}
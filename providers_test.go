@@ -0,0 +1,112 @@
+package sendmail_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestProviderTransports(t *testing.T) {
+	requests := make(map[string]*http.Request)
+	bodies := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			r.ParseMultipartForm(1 << 20)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests[r.URL.Path] = r
+		bodies[r.URL.Path] = string(body)
+		if strings.Contains(r.URL.Path, "refused") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":[{"message":"The from address does not match a verified Sender Identity."}]}`))
+		}
+	}))
+	defer server.Close()
+
+	config := &sendmail.Config{
+		Sender:     "sender@example.com",
+		Recipients: []string{"hidden@example.com"},
+		Body:       []byte("To: user@example.com\r\nSubject: subject\r\n\r\nTEXT"),
+		HTMLBody:   []byte("<b>HTML</b>"),
+
+		ExtractRecipients: true,
+	}
+	send := func(transport sendmail.Transport) []sendmail.Result {
+		config.Transport = transport
+		envelope, err := sendmail.NewEnvelope(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := envelope.Send()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []sendmail.Result
+		for result := range results {
+			list = append(list, result)
+		}
+		return list
+	}
+
+	for _, result := range send(&sendmail.MailgunTransport{APIKey: "key", Endpoint: server.URL}) {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+	mailgun := requests["/example.com/messages.mime"]
+	if mailgun == nil {
+		t.Fatal("Expected request to Mailgun messages.mime")
+	}
+	if user, key, _ := mailgun.BasicAuth(); user != "api" || key != "key" {
+		t.Error("Unexpected Mailgun auth", user, key)
+	}
+	if to := mailgun.MultipartForm.Value["to"]; len(to) != 2 {
+		t.Error("Expected 2 Mailgun recipients got", to)
+	}
+
+	sendgrid := "/v3/mail/send"
+	send(&sendmail.SendGridTransport{APIKey: "key", Endpoint: server.URL + sendgrid})
+	var mail struct {
+		Personalizations []struct {
+			To []struct{ Email string }
+		}
+		Subject string
+		Content []struct{ Type, Value string }
+	}
+	if err := json.Unmarshal([]byte(bodies[sendgrid]), &mail); err != nil {
+		t.Fatal(err)
+	}
+	if len(mail.Personalizations) != 2 || mail.Personalizations[1].To[0].Email != "hidden@example.com" {
+		t.Error("Expected separate personalization of hidden recipient got", bodies[sendgrid])
+	}
+	if mail.Subject != "subject" || len(mail.Content) != 2 || mail.Content[1].Value != "<b>HTML</b>" {
+		t.Error("Unexpected SendGrid content", bodies[sendgrid])
+	}
+	if requests[sendgrid].Header.Get("Authorization") != "Bearer key" {
+		t.Error("Unexpected SendGrid auth", requests[sendgrid].Header.Get("Authorization"))
+	}
+
+	postmark := "/email"
+	send(&sendmail.PostmarkTransport{ServerToken: "token", Endpoint: server.URL + postmark})
+	var message map[string]interface{}
+	if err := json.Unmarshal([]byte(bodies[postmark]), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message["To"] != "user@example.com" || message["Bcc"] != "hidden@example.com" ||
+		message["TextBody"] != "TEXT" || message["HtmlBody"] != "<b>HTML</b>" {
+		t.Error("Unexpected Postmark message", bodies[postmark])
+	}
+	if requests[postmark].Header.Get("X-Postmark-Server-Token") != "token" {
+		t.Error("Expected Postmark server token")
+	}
+
+	refused := send(&sendmail.SendGridTransport{APIKey: "key", Endpoint: server.URL + "/refused"})
+	if len(refused) == 0 || !strings.Contains(refused[0].Error.Error(), "verified Sender Identity") {
+		t.Error("Expected SendGrid error message got", refused)
+	}
+}
@@ -0,0 +1,672 @@
+package sendmail
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultQueueDir is the spool directory used when none is specified.
+const DefaultQueueDir = "/var/spool/go-sendmail"
+
+// QueueEntry describes a message waiting in the queue.
+type QueueEntry struct {
+	ID string `json:"id"`
+	// Sender is the reverse-path of the message, empty for the null
+	// reverse-path of the delivery status notifications.
+	Sender     string    `json:"sender"`
+	Recipients []string  `json:"recipients"`
+	Priority   Priority  `json:"priority,omitempty"`
+	Created    time.Time `json:"created"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error,omitempty"`
+	// NextAttempt is the time before which the entry is not delivered.
+	NextAttempt time.Time `json:"next_attempt"`
+	// Relay is host:port of the smarthost the message is rerouted to,
+	// the message is routed as usual if empty.
+	Relay string `json:"relay,omitempty"`
+	// RequireTLS is the REQUIRETLS option of the message (RFC 8689).
+	RequireTLS bool `json:"require_tls,omitempty"`
+}
+
+// RetryPolicy of the queued messages, zero fields are taken
+// from DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts before the message is bounced, 0 for unlimited.
+	MaxAttempts int `yaml:"max_attempts,omitempty"`
+	// InitialDelay after the first failed attempt.
+	InitialDelay time.Duration `yaml:"initial_delay,omitempty"`
+	// Multiplier of the delay after every next failed attempt.
+	Multiplier float64 `yaml:"multiplier,omitempty"`
+	// MaxDelay between the attempts.
+	MaxDelay time.Duration `yaml:"max_delay,omitempty"`
+	// MaxAge of the message before it is bounced.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+}
+
+// DefaultRetryPolicy retries with exponential backoff for five days.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: 5 * time.Minute,
+	Multiplier:   2,
+	MaxDelay:     4 * time.Hour,
+	MaxAge:       5 * 24 * time.Hour,
+}
+
+// Or return the policy with the fields not set taken from d.
+func (p RetryPolicy) Or(d RetryPolicy) RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.InitialDelay == 0 {
+		p.InitialDelay = d.InitialDelay
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = d.Multiplier
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = d.MaxDelay
+	}
+	if p.MaxAge == 0 {
+		p.MaxAge = d.MaxAge
+	}
+	return p
+}
+
+// Validate check the policy values.
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.MaxAttempts < 0:
+		return fmt.Errorf("invalid retry max attempts %d", p.MaxAttempts)
+	case p.InitialDelay < 0:
+		return fmt.Errorf("invalid retry initial delay %s", p.InitialDelay)
+	case p.Multiplier != 0 && p.Multiplier < 1:
+		return fmt.Errorf("invalid retry multiplier %g, expected at least 1", p.Multiplier)
+	case p.MaxDelay < 0:
+		return fmt.Errorf("invalid retry max delay %s", p.MaxDelay)
+	case p.MaxAge < 0:
+		return fmt.Errorf("invalid retry max age %s", p.MaxAge)
+	}
+	return nil
+}
+
+// Delay return the wait after the number of failed attempts.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempts-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// retryDelay return the delay of the next attempt, the retry hint
+// of the server (e.g. greylisting) replaces the backoff up to MaxDelay.
+func (p RetryPolicy) retryDelay(attempts int, hint time.Duration) time.Duration {
+	if hint <= 0 {
+		return p.Delay(attempts)
+	}
+	if p.MaxDelay > 0 && hint > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return hint
+}
+
+// expired reports whether the entry must not be retried anymore.
+func (p RetryPolicy) expired(entry *QueueEntry, now time.Time) bool {
+	if p.MaxAttempts > 0 && entry.Attempts >= p.MaxAttempts {
+		return true
+	}
+	return p.MaxAge > 0 && now.Sub(entry.Created) >= p.MaxAge
+}
+
+// QueueStore is the storage of the queued messages, the instances
+// sharing the store share the queue. The missing entries are reported
+// with errors matching os.ErrNotExist.
+type QueueStore interface {
+	// Add store the new entry with the message.
+	Add(entry *QueueEntry, message []byte) error
+	// Save update the stored entry.
+	Save(entry *QueueEntry) error
+	// Load return the entry by ID.
+	Load(id string) (*QueueEntry, error)
+	// Message return the message of the entry.
+	Message(id string) ([]byte, error)
+	// Entries return all stored entries in any order, the unreadable
+	// entries may be skipped and reported with QueueEntriesError.
+	Entries() ([]*QueueEntry, error)
+	// Remove delete the entry with its message.
+	Remove(id string) error
+	// Claim lock the entry for the delivery until the time, it reports
+	// false if the entry is claimed by another instance or removed.
+	Claim(id string, until time.Time) (bool, error)
+	// Release unlock the entry claimed by this instance.
+	Release(id string) error
+}
+
+// QueueEntriesError is returned with the readable entries of the store
+// for the skipped unreadable ones.
+type QueueEntriesError struct {
+	Errs []error
+}
+
+func (e *QueueEntriesError) Error() string {
+	messages := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// queueClaim is the time an entry is locked for its delivery,
+// the claim of the crashed instance expires after it.
+const queueClaim = time.Hour
+
+// Queue of messages waiting for delivery, stored in the filesystem
+// spool of Dir unless Store is set.
+type Queue struct {
+	Dir string
+	// Store of the messages shared by the instances, DirQueueStore of Dir if nil.
+	Store QueueStore
+	// Config is the base configuration of the envelopes delivered
+	// from the queue, sender, recipients and body are taken from entries.
+	Config Config
+	// RetryPolicy of failed deliveries.
+	RetryPolicy RetryPolicy
+	// Concurrency is the number of parallel deliveries per priority
+	// class, DefaultQueueConcurrency for not set.
+	Concurrency map[Priority]int
+
+	spool     *DirQueueStore
+	spoolOnce sync.Once
+}
+
+// NewQueue return queue stored in the directory, creating it if needed.
+func NewQueue(dir string) (*Queue, error) {
+	spool, err := NewDirQueueStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{Dir: spool.Dir, spool: spool}, nil
+}
+
+// store return the store of the messages.
+func (q *Queue) store() QueueStore {
+	if q.Store != nil {
+		return q.Store
+	}
+	q.spoolOnce.Do(func() {
+		if q.spool == nil {
+			q.spool = &DirQueueStore{Dir: q.Dir}
+		}
+	})
+	return q.spool
+}
+
+// Enqueue spool the message without attempting delivery.
+// It returns the queue ID of the message.
+func (q *Queue) Enqueue(e *Envelope) (string, error) {
+	return q.Defer(e, time.Time{})
+}
+
+// Defer spool the message for delivery not before the time.
+// It returns the queue ID of the message.
+func (q *Queue) Defer(e *Envelope, until time.Time) (string, error) {
+	message, err := e.GenerateMessage()
+	if err != nil {
+		return "", err
+	}
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	entry := &QueueEntry{
+		ID:         id,
+		Sender:     e.reversePath(),
+		Recipients: e.Recipients,
+		Priority:   e.Priority,
+		Created:    time.Now(),
+		RequireTLS: e.RequireTLS,
+
+		NextAttempt: until,
+	}
+
+	if err := q.store().Add(entry, message); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// List return all queued entries by priority, oldest first.
+// The readable entries are returned with QueueEntriesError
+// for the unreadable ones.
+func (q *Queue) List() ([]*QueueEntry, error) {
+	entries, err := q.store().Entries()
+	var invalid *QueueEntriesError
+	if err != nil && !errors.As(err, &invalid) {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if ri, rj := entries[i].Priority.rank(), entries[j].Priority.rank(); ri != rj {
+			return ri < rj
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, err
+}
+
+// Entry return queued entry by ID.
+func (q *Queue) Entry(id string) (*QueueEntry, error) {
+	return q.store().Load(id)
+}
+
+// Message return the spooled message of entry.
+func (q *Queue) Message(id string) ([]byte, error) {
+	return q.store().Message(id)
+}
+
+// QueueBusyError is returned for the change of the queued message
+// being delivered.
+type QueueBusyError struct {
+	ID string
+}
+
+func (e *QueueBusyError) Error() string {
+	return "queued message " + e.ID + " is being delivered"
+}
+
+// claim lock the queued message for the change, it returns
+// QueueBusyError if the message is being delivered.
+func (q *Queue) claim(id string) error {
+	claimed, err := q.store().Claim(id, time.Now().Add(queueClaim))
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		if _, err := q.Entry(id); err != nil {
+			return err
+		}
+		return &QueueBusyError{id}
+	}
+	return nil
+}
+
+// Remove delete message from the queue, unless it is being delivered.
+func (q *Queue) Remove(id string) error {
+	if err := q.claim(id); err != nil {
+		return err
+	}
+	if err := q.store().Remove(id); err != nil {
+		q.store().Release(id)
+		return err
+	}
+	return nil
+}
+
+// Retry attempt delivery of the queued message now, regardless of
+// its next attempt time. It returns channel for results of send,
+// closed after the attempt.
+func (q *Queue) Retry(id string) (<-chan Result, error) {
+	if err := q.claim(id); err != nil {
+		return nil, err
+	}
+	entry, err := q.Entry(id)
+	if err != nil {
+		q.store().Release(id)
+		return nil, err
+	}
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		defer q.store().Release(id)
+		q.deliver(entry, results)
+	}()
+	return results, nil
+}
+
+// Reroute deliver the queued message through the smarthost
+// at host:port, empty relay restores the usual route.
+// The message is due for delivery at the next queue run,
+// it can't be rerouted while it is being delivered.
+func (q *Queue) Reroute(id, relay string) (*QueueEntry, error) {
+	if relay != "" {
+		if _, _, err := net.SplitHostPort(relay); err != nil {
+			return nil, fmt.Errorf("invalid relay %q: %s", relay, err)
+		}
+	}
+	if err := q.claim(id); err != nil {
+		return nil, err
+	}
+	defer q.store().Release(id)
+	entry, err := q.store().Load(id)
+	if err != nil {
+		return nil, err
+	}
+	entry.Relay = relay
+	entry.NextAttempt = time.Time{}
+	if err := q.store().Save(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Run attempt delivery of every queued message due for delivery.
+// Higher priority messages are started first, every priority class
+// is delivered in parallel within its Concurrency budget. The entries
+// are claimed for the delivery, so the instances sharing the store
+// never deliver the same message.
+// Delivered recipients are removed from the entries, fully delivered
+// messages are removed from the queue. Failed messages are retried
+// according to RetryPolicy and bounced when it is exhausted, the
+// recipients rejected with 5xx reply are bounced at once. The sender
+// of the bounced recipients is sent the delivery status notification.
+// It returns channel for results of send, closed after the queue run.
+func (q *Queue) Run() <-chan Result {
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		entries, err := q.List()
+		var invalid *QueueEntriesError
+		if errors.As(err, &invalid) {
+			// The other entries are delivered
+			results <- Result{ErrorLevel, err, "Queue", Fields{"queue": q.Dir}}
+		} else if err != nil {
+			results <- Result{FatalLevel, err, "Queue", Fields{"queue": q.Dir}}
+			return
+		}
+		classes := make(map[Priority][]*QueueEntry)
+		now := time.Now()
+		for _, entry := range entries {
+			if entry.NextAttempt.After(now) {
+				continue
+			}
+			priority := entry.Priority
+			if _, ok := DefaultQueueConcurrency[priority]; !ok {
+				priority = PriorityNormal
+			}
+			classes[priority] = append(classes[priority], entry)
+		}
+		// Every class has its own dispatcher, so bulk messages
+		// never hold up transactional ones
+		var wg sync.WaitGroup
+		for _, priority := range priorities {
+			limit := q.Concurrency[priority]
+			if limit <= 0 {
+				limit = DefaultQueueConcurrency[priority]
+			}
+			wg.Add(1)
+			go func(entries []*QueueEntry, budget chan struct{}) {
+				defer wg.Done()
+				var class sync.WaitGroup
+				for _, entry := range entries {
+					budget <- struct{}{}
+					class.Add(1)
+					go func(entry *QueueEntry) {
+						defer class.Done()
+						defer func() { <-budget }()
+						claimed, err := q.store().Claim(entry.ID, time.Now().Add(queueClaim))
+						if err != nil {
+							results <- Result{ErrorLevel, err, "Queue", Fields{"queue_id": entry.ID}}
+						}
+						if !claimed {
+							return
+						}
+						defer q.store().Release(entry.ID)
+						// The listed entry is stale if another instance
+						// delivered it before the claim
+						current, err := q.store().Load(entry.ID)
+						if errors.Is(err, os.ErrNotExist) {
+							return
+						}
+						if err != nil {
+							results <- Result{ErrorLevel, err, "Queue", Fields{"queue_id": entry.ID}}
+							return
+						}
+						if current.NextAttempt.After(time.Now()) {
+							return
+						}
+						q.deliver(current, results)
+					}(entry)
+				}
+				class.Wait()
+			}(classes[priority], make(chan struct{}, limit))
+		}
+		wg.Wait()
+	}()
+	return results
+}
+
+func (q *Queue) deliver(entry *QueueEntry, results chan<- Result) {
+	fields := Fields{
+		"queue_id":   entry.ID,
+		"sender":     entry.Sender,
+		"recipients": strings.Join(entry.Recipients, ","),
+	}
+	message, err := q.Message(entry.ID)
+	if err != nil {
+		results <- Result{ErrorLevel, err, "Queue", fields}
+		return
+	}
+	config := q.Config
+	config.Sender = ""
+	config.NullSender = entry.Sender == ""
+	config.Recipients = entry.Recipients
+	config.Body = message
+	config.RequireTLS = config.RequireTLS || entry.RequireTLS
+	if entry.Relay != "" {
+		config.SmartHost = entry.Relay
+		config.SmartHostAuth = nil
+		config.Transport = nil
+	}
+	// The queue retries deferred recipients itself
+	config.DeferQueue = nil
+	// The message was archived, rewritten and processed when it was accepted
+	config.Archive = nil
+	config.Rewrite = nil
+	envelope, err := NewEnvelope(&config)
+	if err != nil {
+		results <- Result{ErrorLevel, err, "Queue", fields}
+		return
+	}
+	envelope.processed = true
+	if id := envelope.Header.Get("Message-Id"); id != "" {
+		fields["message_id"] = id
+	}
+	errs, err := envelope.Send()
+	var loop *LoopError
+	if errors.As(err, &loop) {
+		// The looping message is never delivered
+		results <- Result{ErrorLevel, err, "Bounce", fields}
+		var failures []deliveryFailure
+		for _, rcpt := range entry.Recipients {
+			failures = append(failures, deliveryFailure{rcpt, "5.4.6", err})
+		}
+		q.notify(entry, message, failures, results)
+		if err := q.store().Remove(entry.ID); err != nil {
+			results <- Result{ErrorLevel, err, "Queue", fields}
+		}
+		return
+	}
+	if err != nil {
+		results <- Result{ErrorLevel, err, "Queue", fields}
+		return
+	}
+
+	delivered := make(map[string]bool)
+	rejected := make(map[string]error)
+	var lastErr error
+	var deferredFor, retryAfter time.Duration
+	var deferredOnly bool
+	// The results are held until the next attempt is known
+	var held []Result
+	for result := range errs {
+		if result.Fields == nil {
+			result.Fields = Fields{}
+		}
+		result.Fields["queue_id"] = entry.ID
+		if hint, ok := result.Fields["retry_after"].(time.Duration); ok && hint > retryAfter {
+			retryAfter = hint
+		}
+		refused := rejectedRecipients(result)
+		for _, rcpt := range refused {
+			rejected[rcpt] = result.Error
+		}
+		var suppressed *SuppressedError
+		var deferred *DeferredError
+		switch {
+		case errors.As(result.Error, &suppressed):
+			delivered[suppressed.Recipient] = true
+		case errors.As(result.Error, &deferred):
+			deferredOnly = true
+			if deferred.RetryAfter > deferredFor {
+				deferredFor = deferred.RetryAfter
+			}
+		case result.Level > WarnLevel:
+			if rcpts, ok := result.Fields["recipients"].(string); ok {
+				for _, rcpt := range strings.Split(rcpts, ",") {
+					delivered[rcpt] = true
+				}
+			}
+		case result.Level < WarnLevel && len(refused) == 0:
+			lastErr = result.Error
+		}
+		held = append(held, result)
+	}
+
+	// The recipients rejected with 5xx reply are never retried
+	var pending []string
+	var failures []deliveryFailure
+	for _, rcpt := range entry.Recipients {
+		switch {
+		case delivered[rcpt]:
+		case rejected[rcpt] != nil:
+			failures = append(failures, deliveryFailure{rcpt, "5.0.0", rejected[rcpt]})
+		default:
+			pending = append(pending, rcpt)
+		}
+	}
+	var bounced []string
+	for _, failure := range failures {
+		bounced = append(bounced, failure.Recipient)
+	}
+
+	var expired error
+	if len(pending) > 0 {
+		entry.Recipients = pending
+		if deferredOnly && lastErr == nil {
+			// Deferred by rate limit is not a failed attempt
+			entry.NextAttempt = time.Now().Add(deferredFor)
+		} else {
+			entry.Attempts++
+			if lastErr != nil {
+				entry.LastError = lastErr.Error()
+			}
+			policy := q.RetryPolicy.Or(DefaultRetryPolicy)
+			now := time.Now()
+			if policy.expired(entry, now) {
+				expired = fmt.Errorf("giving up after %d attempts: %s", entry.Attempts, entry.LastError)
+				cause := lastErr
+				if cause == nil {
+					cause = errors.New(entry.LastError)
+				}
+				for _, rcpt := range pending {
+					failures = append(failures, deliveryFailure{rcpt, "4.4.7", cause})
+				}
+			} else {
+				entry.NextAttempt = now.Add(policy.retryDelay(entry.Attempts, retryAfter))
+			}
+		}
+	}
+	for _, result := range held {
+		if !entry.NextAttempt.IsZero() && result.Level <= WarnLevel && pendingResult(result, delivered) {
+			result.Fields["next_attempt"] = entry.NextAttempt
+		}
+		results <- result
+	}
+
+	if len(bounced) > 0 {
+		rejectedFields := Fields{}
+		for key, value := range fields {
+			rejectedFields[key] = value
+		}
+		rejectedFields["recipients"] = strings.Join(bounced, ",")
+		results <- Result{ErrorLevel, errors.New("permanently rejected"), "Bounce", rejectedFields}
+	}
+	if expired != nil {
+		fields["recipients"] = strings.Join(pending, ",")
+		fields["attempts"] = entry.Attempts
+		results <- Result{ErrorLevel, expired, "Bounce", fields}
+	}
+	q.notify(entry, message, failures, results)
+	if len(pending) == 0 || expired != nil {
+		if err := q.store().Remove(entry.ID); err != nil {
+			results <- Result{ErrorLevel, err, "Queue", fields}
+		}
+		return
+	}
+	if err := q.store().Save(entry); err != nil {
+		results <- Result{ErrorLevel, err, "Queue", fields}
+	}
+}
+
+// notify queue the delivery status notification of the failures
+// and report it.
+func (q *Queue) notify(entry *QueueEntry, message []byte, failures []deliveryFailure, results chan<- Result) {
+	id, err := q.bounce(entry, message, failures)
+	if err != nil {
+		results <- Result{ErrorLevel, err, "Delivery status notification", Fields{"queue_id": entry.ID}}
+		return
+	}
+	if id != "" {
+		results <- Result{InfoLevel, nil, "Delivery status notification queued", Fields{
+			"queue_id": entry.ID,
+			"dsn_id":   id,
+			"sender":   entry.Sender,
+		}}
+	}
+}
+
+// rejectedRecipients return the recipients of the failed result
+// rejected with 5xx reply, the rejection of one recipient concerns
+// only it.
+func rejectedRecipients(result Result) []string {
+	if result.Level > WarnLevel || replyCode(result.Error) < 500 {
+		return nil
+	}
+	var rcptErr *RecipientError
+	if errors.As(result.Error, &rcptErr) {
+		return []string{rcptErr.Recipient}
+	}
+	rcpts, _ := result.Fields["recipients"].(string)
+	if rcpts == "" {
+		return nil
+	}
+	return strings.Split(rcpts, ",")
+}
+
+// pendingResult reports whether the result concerns the recipients
+// not delivered yet.
+func pendingResult(result Result, delivered map[string]bool) bool {
+	rcpts, _ := result.Fields["recipients"].(string)
+	for _, rcpt := range strings.Split(rcpts, ",") {
+		if rcpt != "" && !delivered[rcpt] {
+			return true
+		}
+	}
+	return false
+}
+
+// newQueueID generate time ordered unique identifier.
+func newQueueID() (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x%s", time.Now().UnixNano(), hex.EncodeToString(random)), nil
+}
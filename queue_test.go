@@ -0,0 +1,599 @@
+package sendmail_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/sendmailtest"
+)
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != id {
+		t.Fatal("Expected queued entry", id, "got", entries)
+	}
+	if entries[0].Sender != "sender@localhost" {
+		t.Error("Expected sender@localhost got", entries[0].Sender)
+	}
+	if !reflect.DeepEqual(entries[0].Recipients, []string{"recipient@localhost"}) {
+		t.Error("Expected [recipient@localhost] got", entries[0].Recipients)
+	}
+
+	message, err := queue.Message(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(message, []byte("\r\n\r\nTEST\r\n")) {
+		t.Errorf("Unexpected queued message:\n%s", message)
+	}
+
+	if err := queue.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Error("Expected empty queue got", entries)
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing listens on the address of closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Config.SmartHost = listener.Addr().String()
+	queue.RetryPolicy = sendmail.RetryPolicy{MaxAttempts: 2, InitialDelay: time.Hour}
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() (bounced bool) {
+		for result := range queue.Run() {
+			if result.Message == "Bounce" {
+				bounced = true
+			}
+		}
+		return
+	}
+
+	if run() {
+		t.Fatal("Unexpected bounce after the first attempt")
+	}
+	entry, err := queue.Entry(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Attempts != 1 || entry.LastError == "" {
+		t.Error("Expected failed attempt got", entry)
+	}
+	if delay := time.Until(entry.NextAttempt); delay < 59*time.Minute || delay > time.Hour {
+		t.Error("Expected next attempt in an hour got", delay)
+	}
+
+	// The entry is not due yet
+	run()
+	if entry, _ = queue.Entry(id); entry.Attempts != 1 {
+		t.Error("Expected entry skipped before the next attempt got", entry.Attempts)
+	}
+
+	queue.RetryPolicy.InitialDelay = time.Nanosecond
+	queue.Remove(id)
+	if _, err := queue.Enqueue(&envelope); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	time.Sleep(time.Millisecond)
+	if !run() {
+		t.Error("Expected bounce after the last attempt")
+	}
+	// Only the delivery status notification to the sender is left
+	entries, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Sender != "" || !reflect.DeepEqual(entries[0].Recipients, []string{"sender@localhost"}) {
+		t.Fatal("Expected bounced message replaced with notification got", entries)
+	}
+	dsn, err := queue.Message(entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Final-Recipient: rfc822; recipient@localhost", "Action: failed", "Status: 4.4.7"} {
+		if !bytes.Contains(dsn, []byte(expected)) {
+			t.Errorf("Expected %q in notification:\n%s", expected, dsn)
+		}
+	}
+}
+
+func TestQueueReroute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	server, err := sendmailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Config.SmartHost = listener.Addr().String()
+	queue.RetryPolicy = sendmail.RetryPolicy{InitialDelay: time.Hour}
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range queue.Run() {
+	}
+
+	if _, err := queue.Reroute(id, "localhost"); err == nil {
+		t.Error("Expected error of relay without port")
+	}
+
+	// The message being delivered by another process is kept as is
+	other := &sendmail.DirQueueStore{Dir: dir}
+	if claimed, err := other.Claim(id, time.Now().Add(time.Hour)); err != nil || !claimed {
+		t.Fatal("Expected claimed entry got", claimed, err)
+	}
+	var busy *sendmail.QueueBusyError
+	if _, err := queue.Reroute(id, server.Addr()); !errors.As(err, &busy) {
+		t.Error("Expected reroute of busy message refused got", err)
+	}
+	if err := queue.Remove(id); !errors.As(err, &busy) {
+		t.Error("Expected removal of busy message refused got", err)
+	}
+	if err := other.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := queue.Reroute(id, server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Relay != server.Addr() || !entry.NextAttempt.IsZero() {
+		t.Error("Expected rerouted entry due now got", entry)
+	}
+
+	results, err := queue.Retry(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range results {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+	if _, err := queue.Entry(id); err == nil {
+		t.Error("Expected delivered message removed")
+	}
+	sendmailtest.AssertSentTo(t, server, "recipient@localhost")
+	if _, err := queue.Retry(id); err == nil {
+		t.Error("Expected error of retry of removed message")
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := sendmail.RetryPolicy{InitialDelay: time.Minute, MaxDelay: 5 * time.Minute}.Or(sendmail.DefaultRetryPolicy)
+	for attempts, expected := range map[int]time.Duration{
+		1: time.Minute,
+		2: 2 * time.Minute,
+		3: 4 * time.Minute,
+		4: 5 * time.Minute,
+	} {
+		if delay := policy.Delay(attempts); delay != expected {
+			t.Errorf("Expected delay %s after %d attempts got %s", expected, attempts, delay)
+		}
+	}
+}
+
+// deferringServer is SMTP server deferring every recipient with the reply.
+func deferringServer(t *testing.T, reply string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			text := textproto.NewConn(conn)
+			text.PrintfLine("220 localhost ESMTP")
+			for {
+				line, err := text.ReadLine()
+				if err != nil {
+					break
+				}
+				switch {
+				case strings.HasPrefix(line, "RCPT"):
+					text.PrintfLine("%s", reply)
+				case line == "QUIT":
+					text.PrintfLine("221 Bye")
+				default:
+					text.PrintfLine("250 OK")
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestQueueRetryHint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		reply string
+		delay time.Duration
+	}{
+		{"451 4.7.1 Greylisted, please try again in 120 seconds", 2 * time.Minute},
+		{"450 4.2.0 Greylisted, see http://postgrey.schweikert.ch/help/localhost.html", 5 * time.Minute},
+		{"421 4.3.0 Retry-After: 600", 10 * time.Minute},
+		// The hint is limited by the policy
+		{"451 4.7.1 Try again in 3 hours", 2 * time.Hour},
+		{"451 4.7.1 Please retry delivery in 10 minutes", 10 * time.Minute},
+		// No hint, the backoff of the policy applies
+		{"451 4.3.0 Try again later", time.Hour},
+		{"451 4.3.0 Try again in 5m", time.Hour},
+		{"421 4.4.2 Connection timed out after 30 seconds", time.Hour},
+		// Replies of the providers
+		{"421 4.7.0 Try again later, closing connection. (EHLO) a1si123456ejb.42 - gsmtp", time.Hour},
+		{"450 4.2.1 The user you are trying to contact is receiving mail too quickly. Please resend your message at a later time. If the user is able to receive mail at that time, your message will be delivered. For more information, go to https://support.google.com/mail/?p=ReceivingRate a1si123456ejb.42 - gsmtp", time.Hour},
+		{"421 4.7.0 [TSS04] Messages from 203.0.113.5 temporarily deferred due to unexpected volume or user complaints - 4.16.55.1; see https://postmaster.yahooinc.com/error-codes", time.Hour},
+		{"451 4.7.500 Server busy. Please try again later from [203.0.113.5]. (S77714) [BN8NAM11FT045.eop-nam11.prod.protection.outlook.com]", time.Hour},
+	} {
+		queue, err := sendmail.NewQueue(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue.Config.SmartHost = deferringServer(t, tc.reply)
+		queue.RetryPolicy = sendmail.RetryPolicy{InitialDelay: time.Hour, MaxDelay: 2 * time.Hour}
+		envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := queue.Enqueue(&envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var next time.Time
+		for result := range queue.Run() {
+			if result.Level == sendmail.ErrorLevel && result.Fields["recipients"] != nil {
+				next, _ = result.Fields["next_attempt"].(time.Time)
+			}
+		}
+		entry, err := queue.Entry(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delay := time.Until(entry.NextAttempt); delay > tc.delay || delay < tc.delay-time.Minute {
+			t.Errorf("%s: expected next attempt in %s got %s", tc.reply, tc.delay, delay)
+		}
+		if !next.Equal(entry.NextAttempt) {
+			t.Errorf("%s: expected next attempt %s in result got %v", tc.reply, entry.NextAttempt, next)
+		}
+		queue.Remove(id)
+	}
+}
+
+func TestQueueBounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The permanent failure is never retried, whatever the reply says
+	server := deferringServer(t, "550 5.1.1 Retry in 5 minutes won't help")
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Config.SmartHost = server
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bounced string
+	for result := range queue.Run() {
+		if result.Message == "Bounce" {
+			bounced, _ = result.Fields["recipients"].(string)
+		}
+	}
+	if bounced != "recipient@localhost" {
+		t.Error("Expected bounce of recipient@localhost got", bounced)
+	}
+	if _, err := queue.Entry(id); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected bounced message removed got", err)
+	}
+	entries, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Sender != "" || !reflect.DeepEqual(entries[0].Recipients, []string{"sender@localhost"}) {
+		t.Fatal("Expected notification to sender@localhost got", entries)
+	}
+	dsn, err := queue.Message(entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"From: Mail Delivery System <MAILER-DAEMON@",
+		"To: sender@localhost\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"report-type=delivery-status",
+		"Content-Type: message/delivery-status\r\n",
+		"Final-Recipient: rfc822; recipient@localhost\r\n",
+		"Status: 5.1.1\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 Retry in 5 minutes won't help\r\n",
+		"Content-Type: text/rfc822-headers\r\n",
+		"Subject: subject\r\n",
+	} {
+		if !bytes.Contains(dsn, []byte(expected)) {
+			t.Errorf("Expected %q in notification:\n%s", expected, dsn)
+		}
+	}
+
+	// The notification is sent with the null reverse-path
+	// and its failure is never notified
+	capture, err := sendmailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+	queue.Config.SmartHost = capture.Addr()
+	capture.Reject("sender@localhost")
+	for range queue.Run() {
+	}
+	if entries, _ := queue.List(); len(entries) != 0 {
+		t.Error("Expected rejected notification removed got", entries)
+	}
+
+	capture.Reject()
+	notification, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "MAILER-DAEMON@localhost",
+		NullSender: true,
+		Recipients: []string{"sender@localhost"},
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue(&notification); err != nil {
+		t.Fatal(err)
+	}
+	for range queue.Run() {
+	}
+	if m := sendmailtest.AssertSentTo(t, capture, "sender@localhost"); m.From != "" {
+		t.Errorf("Expected null reverse-path got %q", m.From)
+	}
+}
+
+func TestQueueLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &fakeTransport{}
+	queue.Config.Transport = transport
+	hostname, _ := os.Hostname()
+	stamp := "Received: from client by " + hostname + " (go-sendmail) with ESMTP id A; Mon, 1 Jan 2024 10:00:00 +0000\r\n"
+	enqueue := func(nullSender bool) {
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Sender:     "sender@example.com",
+			NullSender: nullSender,
+			Recipients: []string{"user@example.com"},
+			Body:       []byte(stamp + stamp + "Subject: loop\r\n\r\nTEST\r\n"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := queue.Enqueue(&envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enqueue(false)
+	bounced := false
+	for result := range queue.Run() {
+		if result.Message == "Bounce" {
+			bounced = true
+		}
+	}
+	if !bounced || len(transport.delivered) > 0 {
+		t.Errorf("Expected bounce of loop got delivery to %v", transport.delivered)
+	}
+	entries, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Sender != "" || !reflect.DeepEqual(entries[0].Recipients, []string{"sender@example.com"}) {
+		t.Fatal("Expected notification to sender@example.com got", entries)
+	}
+	dsn, err := queue.Message(entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dsn, []byte("Final-Recipient: rfc822; user@example.com\r\nAction: failed\r\nStatus: 5.4.6\r\n")) {
+		t.Errorf("Expected status 5.4.6 of user@example.com in notification:\n%s", dsn)
+	}
+	queue.Remove(entries[0].ID)
+
+	// The loop of the notification is never notified
+	enqueue(true)
+	for range queue.Run() {
+	}
+	if entries, _ := queue.List(); len(entries) != 0 {
+		t.Error("Expected no notification of null sender got", entries)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		"From: sender@localhost\r\nTo: recipient@localhost\r\nPrecedence: bulk\r\n\r\nTEST",
+		"From: sender@localhost\r\nTo: recipient@localhost\r\n\r\nTEST",
+		"From: sender@localhost\r\nTo: recipient@localhost\r\nX-Priority: 1 (Highest)\r\n\r\nTEST",
+	} {
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := queue.Enqueue(&envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sendmail.Priority{sendmail.PriorityTransactional, sendmail.PriorityNormal, sendmail.PriorityBulk}
+	for i, entry := range entries {
+		if entry.Priority != expected[i] {
+			t.Errorf("Expected %s at position %d got %s", expected[i], i, entry.Priority)
+		}
+	}
+
+	if _, err := sendmail.ParsePriority("urgent"); err == nil {
+		t.Error("Expected error for unknown priority")
+	}
+}
+
+// failingStore is the spool failing to load the entries
+type failingStore struct {
+	*sendmail.DirQueueStore
+}
+
+func (failingStore) Load(id string) (*sendmail.QueueEntry, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestQueueRunLoadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := sendmail.NewDirQueueStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Store = failingStore{spool}
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed bool
+	for result := range queue.Run() {
+		if result.Level == sendmail.ErrorLevel && result.Fields["queue_id"] == id {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Error("Expected error of the queued message", id)
+	}
+	if entries, err := spool.Entries(); err != nil || len(entries) != 1 || entries[0].Attempts != 0 {
+		t.Error("Expected entry kept without attempt got", entries, err)
+	}
+}
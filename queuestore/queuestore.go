@@ -0,0 +1,51 @@
+// Package queuestore stores the queue of sendmail in SQLite database
+// or Redis, so the daemon instances of several processes or hosts
+// share one queue.
+package queuestore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/n0madic/sendmail"
+)
+
+// Open return the store of the specification: sqlite:/path/queue.db,
+// redis://[[user]:password@]host[:port][/db] (rediss:// with TLS)
+// or the directory of the filesystem spool.
+func Open(spec string) (sendmail.QueueStore, error) {
+	switch {
+	case strings.HasPrefix(spec, "sqlite:"):
+		return OpenSQLite(strings.TrimPrefix(spec, "sqlite:"))
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return OpenRedis(spec)
+	case strings.Contains(spec, "://"):
+		return nil, fmt.Errorf("unknown queue store %q, expected sqlite:, redis:// or directory", spec)
+	}
+	return sendmail.NewDirQueueStore(spec)
+}
+
+// notFoundError reports the missing entry, it matches os.ErrNotExist.
+type notFoundError struct {
+	id string
+}
+
+func (e *notFoundError) Error() string {
+	return "queued message " + e.id + " not found"
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// newOwner return the unique name of the store claiming the entries.
+func newOwner() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
@@ -0,0 +1,159 @@
+package queuestore_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/queuestore"
+	"github.com/n0madic/sendmail/sendmailtest"
+)
+
+// testStore check the behaviour common to all stores, other is
+// the store of another instance sharing the queue and wait lets
+// the time of the store pass.
+func testStore(t *testing.T, store, other sendmail.QueueStore, wait func(time.Duration)) {
+	entry := &sendmail.QueueEntry{
+		ID:         "0123abcd",
+		Sender:     "sender@localhost",
+		Recipients: []string{"recipient@localhost"},
+		Created:    time.Now().Round(0),
+	}
+	if err := store.Add(entry, []byte("TEST")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := other.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != entry.ID || !entries[0].Created.Equal(entry.Created) {
+		t.Fatal("Expected the added entry got", entries)
+	}
+	message, err := other.Message(entry.ID)
+	if err != nil || string(message) != "TEST" {
+		t.Errorf("Expected TEST message got %q %v", message, err)
+	}
+
+	entry.Attempts = 1
+	if err := store.Save(entry); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := other.Load(entry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Attempts != 1 {
+		t.Error("Expected saved attempts got", loaded.Attempts)
+	}
+
+	claim := func(s sendmail.QueueStore, until time.Time, expected bool) {
+		t.Helper()
+		claimed, err := s.Claim(entry.ID, until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != expected {
+			t.Errorf("Expected claimed %v got %v", expected, claimed)
+		}
+	}
+	hour := time.Now().Add(time.Hour)
+	claim(store, hour, true)
+	claim(other, hour, false)
+	// The claim of other store is kept
+	if err := other.Release(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	claim(other, hour, false)
+	if err := store.Release(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	claim(other, time.Now().Add(time.Millisecond), true)
+	wait(10 * time.Millisecond)
+	// The expired claim is taken over
+	claim(store, hour, true)
+
+	if err := other.Remove(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	claim(store, hour, false)
+	for _, err := range []error{
+		other.Remove(entry.ID),
+		store.Save(entry),
+		func() error { _, err := store.Load(entry.ID); return err }(),
+		func() error { _, err := store.Message(entry.ID); return err }(),
+	} {
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Error("Expected not found error got", err)
+		}
+	}
+	if entries, _ := store.Entries(); len(entries) != 0 {
+		t.Error("Expected empty store got", entries)
+	}
+}
+
+// testQueue deliver the queued message of the store.
+func testQueue(t *testing.T, store sendmail.QueueStore) {
+	server, err := sendmailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	queue := &sendmail.Queue{Store: store}
+	queue.Config.SmartHost = server.Addr()
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"recipient@localhost"},
+		Body:       []byte("Subject: queued\r\n\r\nTEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue(&envelope); err != nil {
+		t.Fatal(err)
+	}
+	for result := range queue.Run() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+	msg := sendmailtest.AssertSentTo(t, server, "recipient@localhost")
+	sendmailtest.AssertHeader(t, msg, "Subject", "queued")
+	if entries, _ := queue.List(); len(entries) != 0 {
+		t.Error("Expected delivered message removed got", entries)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queuestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := queuestore.Open(filepath.Join(dir, "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*sendmail.DirQueueStore); !ok {
+		t.Errorf("Expected DirQueueStore got %T", store)
+	}
+	store, err = queuestore.Open("sqlite:" + filepath.Join(dir, "queue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*queuestore.SQLite); !ok {
+		t.Errorf("Expected SQLite got %T", store)
+	}
+	store.(*queuestore.SQLite).Close()
+	if _, err := queuestore.Open("mysql://localhost/queue"); err == nil {
+		t.Error("Expected error of unknown store")
+	}
+	if _, err := queuestore.Open("redis://localhost:6379/one"); err == nil {
+		t.Error("Expected error of invalid Redis database")
+	}
+}
@@ -0,0 +1,198 @@
+package queuestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/n0madic/sendmail"
+)
+
+// DefaultRedisPrefix of the keys of the queue.
+const DefaultRedisPrefix = "sendmail:queue:"
+
+// redisTimeout of the connection and the commands.
+const redisTimeout = 10 * time.Second
+
+// claimScript set the claim of the stored entry unless it is claimed.
+var claimScript = redis.NewScript(`if redis.call("EXISTS", KEYS[1]) == 0 then return 0 end if redis.call("SET", KEYS[2], ARGV[1], "NX", "PX", ARGV[2]) then return 1 end return 0`)
+
+// releaseScript delete the claim only of its owner.
+var releaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+// Redis is the queue store in Redis, the hosts of the cluster may share it.
+// The entries are the keys <prefix>entry:<id> with JSON and <prefix>msg:<id>
+// with the message, their IDs are the set <prefix>ids and the claims
+// are the keys <prefix>lock:<id> expiring with the claim.
+type Redis struct {
+	client *redis.Client
+	prefix string
+	owner  string
+}
+
+// OpenRedis connect to Redis at the URL redis://[[user]:password@]host[:port][/db],
+// rediss:// connects with TLS and the prefix parameter sets the prefix of the keys.
+func OpenRedis(rawurl string) (*Redis, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %s", err)
+	}
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+	prefix := DefaultRedisPrefix
+	query := u.Query()
+	if p := query.Get("prefix"); p != "" {
+		prefix = p
+	}
+	// The other parameters are the options of the client
+	query.Del("prefix")
+	u.RawQuery = query.Encode()
+	options, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %s", err)
+	}
+	options.DialTimeout = redisTimeout
+	options.ReadTimeout = redisTimeout
+	options.WriteTimeout = redisTimeout
+	r := &Redis{
+		client: redis.NewClient(options),
+		prefix: prefix,
+		owner:  owner,
+	}
+	if err := r.client.Ping(context.Background()).Err(); err != nil {
+		r.client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %s", err)
+	}
+	return r, nil
+}
+
+// Close the connections.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// Add store the new entry with the message.
+func (r *Redis) Add(entry *sendmail.QueueEntry, message []byte) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.key("msg:", entry.ID), message, 0)
+		pipe.Set(ctx, r.key("entry:", entry.ID), data, 0)
+		pipe.SAdd(ctx, r.prefix+"ids", entry.ID)
+		return nil
+	})
+	return err
+}
+
+// Save update the stored entry.
+func (r *Redis) Save(entry *sendmail.QueueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	saved, err := r.client.SetXX(context.Background(), r.key("entry:", entry.ID), data, 0).Result()
+	if err == nil && !saved {
+		return &notFoundError{entry.ID}
+	}
+	return err
+}
+
+// Load return the entry by ID.
+func (r *Redis) Load(id string) (*sendmail.QueueEntry, error) {
+	data, err := r.client.Get(context.Background(), r.key("entry:", id)).Bytes()
+	if err == redis.Nil {
+		return nil, &notFoundError{id}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalEntry(id, data)
+}
+
+// Message return the message of the entry.
+func (r *Redis) Message(id string) ([]byte, error) {
+	message, err := r.client.Get(context.Background(), r.key("msg:", id)).Bytes()
+	if err == redis.Nil {
+		return nil, &notFoundError{id}
+	}
+	return message, err
+}
+
+// Entries return all stored entries.
+func (r *Redis) Entries() ([]*sendmail.QueueEntry, error) {
+	ctx := context.Background()
+	ids, err := r.client.SMembers(ctx, r.prefix+"ids").Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, r.key("entry:", id))
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*sendmail.QueueEntry
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			// Removed meanwhile
+			continue
+		}
+		entry, err := unmarshalEntry(ids[i], []byte(data))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Remove delete the entry with its message and its claim.
+func (r *Redis) Remove(id string) error {
+	ctx := context.Background()
+	var removed *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.SRem(ctx, r.prefix+"ids", id)
+		pipe.Del(ctx, r.key("entry:", id), r.key("msg:", id), r.key("lock:", id))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed.Val() == 0 {
+		return &notFoundError{id}
+	}
+	return nil
+}
+
+// Claim lock the entry for the delivery until the time with the key
+// expiring with the claim.
+func (r *Redis) Claim(id string, until time.Time) (bool, error) {
+	ttl := time.Until(until)
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	claimed, err := claimScript.Run(context.Background(), r.client,
+		[]string{r.key("entry:", id), r.key("lock:", id)}, r.owner, ttl.Milliseconds()).Int()
+	return claimed == 1, err
+}
+
+// Release unlock the entry claimed by this store.
+func (r *Redis) Release(id string) error {
+	return releaseScript.Run(context.Background(), r.client, []string{r.key("lock:", id)}, r.owner).Err()
+}
+
+func (r *Redis) key(kind, id string) string {
+	return r.prefix + kind + id
+}
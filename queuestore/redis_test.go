@@ -0,0 +1,69 @@
+package queuestore_test
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/queuestore"
+)
+
+func TestRedis(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	store, err := queuestore.OpenRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	other, err := queuestore.OpenRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	testStore(t, store, other, server.FastForward)
+	testQueue(t, store)
+	for _, key := range server.Keys() {
+		t.Error("Unexpected key left", key)
+	}
+
+	if _, err := queuestore.OpenRedis("redis://127.0.0.1:1"); err == nil {
+		t.Error("Expected error of connection")
+	}
+	if _, err := queuestore.OpenRedis("redis://" + server.Addr() + "?unknown=1"); err == nil {
+		t.Error("Expected error of unknown parameter")
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.RequireAuth("secret")
+
+	if _, err := queuestore.OpenRedis("redis://" + server.Addr()); err == nil {
+		t.Error("Expected error of authentication")
+	}
+	store, err := queuestore.OpenRedis("redis://:secret@" + server.Addr() + "/2?prefix=test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Add(&sendmail.QueueEntry{ID: "0123abcd"}, []byte("TEST")); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := server.DB(2).Members("test:ids"); err != nil || len(members) != 1 || members[0] != "0123abcd" {
+		t.Errorf("Expected entry in database 2 with prefix got %v %v", members, err)
+	}
+	if message, err := server.DB(2).Get("test:msg:0123abcd"); err != nil || message != "TEST" {
+		t.Errorf("Expected TEST message got %q %v", message, err)
+	}
+}
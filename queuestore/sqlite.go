@@ -0,0 +1,164 @@
+package queuestore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	// SQLite driver
+	_ "modernc.org/sqlite"
+
+	"github.com/n0madic/sendmail"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS queue (
+	id TEXT PRIMARY KEY,
+	entry TEXT NOT NULL,
+	message BLOB NOT NULL,
+	claimed_by TEXT NOT NULL DEFAULT '',
+	claimed_until INTEGER NOT NULL DEFAULT 0
+);
+`
+
+// SQLite is the queue store in SQLite database,
+// the processes of one host may share it.
+type SQLite struct {
+	db    *sql.DB
+	owner string
+}
+
+// OpenSQLite open the database, creating it if needed.
+func OpenSQLite(path string) (*SQLite, error) {
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{db: db, owner: owner}, nil
+}
+
+// Close the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// Add store the new entry with the message.
+func (s *SQLite) Add(entry *sendmail.QueueEntry, message []byte) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO queue (id, entry, message) VALUES (?, ?, ?)`, entry.ID, string(data), message)
+	return err
+}
+
+// Save update the stored entry.
+func (s *SQLite) Save(entry *sendmail.QueueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE queue SET entry = ? WHERE id = ?`, string(data), entry.ID)
+	return affected(res, err, entry.ID)
+}
+
+// Load return the entry by ID.
+func (s *SQLite) Load(id string) (*sendmail.QueueEntry, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT entry FROM queue WHERE id = ?`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, &notFoundError{id}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalEntry(id, []byte(data))
+}
+
+// Message return the message of the entry.
+func (s *SQLite) Message(id string) ([]byte, error) {
+	var message []byte
+	err := s.db.QueryRow(`SELECT message FROM queue WHERE id = ?`, id).Scan(&message)
+	if err == sql.ErrNoRows {
+		return nil, &notFoundError{id}
+	}
+	return message, err
+}
+
+// Entries return all stored entries.
+func (s *SQLite) Entries() ([]*sendmail.QueueEntry, error) {
+	rows, err := s.db.Query(`SELECT id, entry FROM queue`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*sendmail.QueueEntry
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		entry, err := unmarshalEntry(id, []byte(data))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Remove delete the entry with its message.
+func (s *SQLite) Remove(id string) error {
+	res, err := s.db.Exec(`DELETE FROM queue WHERE id = ?`, id)
+	return affected(res, err, id)
+}
+
+// Claim lock the entry for the delivery until the time,
+// the expired claim is taken over.
+func (s *SQLite) Claim(id string, until time.Time) (bool, error) {
+	res, err := s.db.Exec(`UPDATE queue SET claimed_by = ?, claimed_until = ?
+		WHERE id = ? AND claimed_until < ?`, s.owner, until.UnixNano(), id, time.Now().UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Release unlock the entry claimed by this store.
+func (s *SQLite) Release(id string) error {
+	_, err := s.db.Exec(`UPDATE queue SET claimed_by = '', claimed_until = 0
+		WHERE id = ? AND claimed_by = ?`, id, s.owner)
+	return err
+}
+
+// affected return the not found error if no row is changed.
+func affected(res sql.Result, err error, id string) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return &notFoundError{id}
+	}
+	return err
+}
+
+func unmarshalEntry(id string, data []byte) (*sendmail.QueueEntry, error) {
+	entry := new(sendmail.QueueEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("invalid queue entry %s: %s", id, err)
+	}
+	return entry, nil
+}
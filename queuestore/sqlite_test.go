@@ -0,0 +1,34 @@
+package queuestore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail/queuestore"
+)
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queuestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue.db")
+	store, err := queuestore.OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	other, err := queuestore.OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	testStore(t, store, other, time.Sleep)
+	testQueue(t, store)
+}
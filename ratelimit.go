@@ -0,0 +1,156 @@
+package sendmail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainLimit of the deliveries to the destination domain.
+type DomainLimit struct {
+	// Rate is the number of messages per Per, 0 for unlimited.
+	Rate int `yaml:"rate,omitempty"`
+	// Per is the period of Rate, one minute by default.
+	Per time.Duration `yaml:"per,omitempty"`
+	// MaxConnections is the number of parallel deliveries, 0 for unlimited.
+	MaxConnections int `yaml:"max_connections,omitempty"`
+}
+
+// Validate check the limit values.
+func (l DomainLimit) Validate() error {
+	if l.Rate < 0 || l.Per < 0 || l.MaxConnections < 0 {
+		return fmt.Errorf("invalid limit rate %d per %s, max connections %d", l.Rate, l.Per, l.MaxConnections)
+	}
+	return nil
+}
+
+// DeferredError reports the delivery to the domain postponed by its limit.
+type DeferredError struct {
+	Domain     string
+	RetryAfter time.Duration
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("delivery to %s deferred by rate limit for %s", e.Domain, e.RetryAfter)
+}
+
+// RateLimiter limits the direct deliveries per destination domain.
+// Limits are matched by the domain name, "*" is the limit of other domains.
+type RateLimiter struct {
+	limits map[string]DomainLimit
+	mu     sync.Mutex
+	state  map[string]*domainState
+}
+
+// domainState of the deliveries to domain.
+type domainState struct {
+	sent   []time.Time
+	active int
+}
+
+// NewRateLimiter return limiter of deliveries with the limits by domain.
+func NewRateLimiter(limits map[string]DomainLimit) *RateLimiter {
+	r := &RateLimiter{
+		limits: make(map[string]DomainLimit),
+		state:  make(map[string]*domainState),
+	}
+	for domain, limit := range limits {
+		if limit.Per == 0 {
+			limit.Per = time.Minute
+		}
+		r.limits[strings.ToLower(domain)] = limit
+	}
+	return r
+}
+
+// Acquire a delivery to the domain. It returns the function to call when
+// the delivery is finished or DeferredError if the limit is reached.
+func (r *RateLimiter) Acquire(domain string) (func(), error) {
+	domain = strings.ToLower(domain)
+	limit, ok := r.limits[domain]
+	if !ok {
+		if limit, ok = r.limits["*"]; !ok {
+			return func() {}, nil
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, ok := r.state[domain]
+	if !ok {
+		state = new(domainState)
+		r.state[domain] = state
+	}
+	now := time.Now()
+	if limit.Rate > 0 {
+		// Forget the deliveries out of the window
+		i := 0
+		for i < len(state.sent) && now.Sub(state.sent[i]) >= limit.Per {
+			i++
+		}
+		state.sent = state.sent[i:]
+		if len(state.sent) >= limit.Rate {
+			return nil, &DeferredError{domain, state.sent[0].Add(limit.Per).Sub(now)}
+		}
+	}
+	if limit.MaxConnections > 0 && state.active >= limit.MaxConnections {
+		// There is no way to know when connections are released
+		return nil, &DeferredError{domain, limit.Per / time.Duration(limit.MaxConnections)}
+	}
+	if limit.Rate > 0 {
+		state.sent = append(state.sent, now)
+	}
+	state.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			state.active--
+			r.mu.Unlock()
+		})
+	}, nil
+}
+
+// deferToQueue spool the recipients deferred by the rate limiter to DeferQueue.
+func (e *Envelope) deferToQueue(results <-chan Result) <-chan Result {
+	if e.DeferQueue == nil || e.RateLimiter == nil {
+		return results
+	}
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		var recipients []string
+		var retryAfter time.Duration
+		for result := range results {
+			var deferred *DeferredError
+			if errors.As(result.Error, &deferred) {
+				if rcpts, ok := result.Fields["recipients"].(string); ok {
+					recipients = append(recipients, strings.Split(rcpts, ",")...)
+				}
+				if deferred.RetryAfter > retryAfter {
+					retryAfter = deferred.RetryAfter
+				}
+			}
+			out <- result
+		}
+		if len(recipients) == 0 {
+			return
+		}
+		envelope := *e
+		envelope.Recipients = recipients
+		fields := Fields{
+			"sender":     e.GetSender(),
+			"recipients": strings.Join(recipients, ","),
+		}
+		id, err := e.DeferQueue.Defer(&envelope, time.Now().Add(retryAfter))
+		if err != nil {
+			out <- Result{ErrorLevel, err, "Queue", fields}
+			return
+		}
+		fields["queue_id"] = id
+		out <- Result{InfoLevel, nil, "Deferred to queue", fields}
+	}()
+	return out
+}
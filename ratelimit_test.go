@@ -0,0 +1,109 @@
+package sendmail_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := sendmail.NewRateLimiter(map[string]sendmail.DomainLimit{
+		"rate.test": {Rate: 2, Per: time.Hour},
+		"conn.test": {MaxConnections: 1},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Acquire("rate.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := limiter.Acquire("Rate.Test")
+	deferred, ok := err.(*sendmail.DeferredError)
+	if !ok || deferred.RetryAfter <= 59*time.Minute {
+		t.Error("Expected deferral for an hour got", err)
+	}
+
+	release, err := limiter.Acquire("conn.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire("conn.test"); err == nil {
+		t.Error("Expected deferral over max connections")
+	}
+	release()
+	if _, err := limiter.Acquire("conn.test"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := limiter.Acquire("unlimited.test"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimitDeferToQueue(t *testing.T) {
+	test.StartSMTP()
+
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfigs[0].initial
+	config.Resolver = &fakeResolver{
+		ip: map[string][]net.IPAddr{
+			"localhost": {{IP: net.ParseIP("127.0.0.1")}},
+		},
+	}
+	config.RateLimiter = sendmail.NewRateLimiter(map[string]sendmail.DomainLimit{
+		"localhost": {Rate: 1, Per: time.Hour},
+	})
+	config.DeferQueue = queue
+
+	for i, expected := range []string{"Send mail OK", "Deferred to queue"} {
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs, err := envelope.Send()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var messages []string
+		for result := range errs {
+			if result.Level < sendmail.WarnLevel {
+				t.Error(i, result.Error)
+			}
+			if result.Level == sendmail.InfoLevel {
+				messages = append(messages, result.Message)
+			}
+		}
+		if len(messages) != 1 || messages[0] != expected {
+			t.Errorf("Expected %q of message %d got %q", expected, i, messages)
+		}
+	}
+
+	entries, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || time.Until(entries[0].NextAttempt) < 59*time.Minute {
+		t.Fatal("Expected deferred entry got", entries)
+	}
+	message, err := queue.Message(entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message) == 0 || string(message[len(message)-6:]) != "TEST\r\n" {
+		t.Errorf("Unexpected deferred message:\n%s", message)
+	}
+}
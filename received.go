@@ -0,0 +1,161 @@
+package sendmail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultMaxHops is the default limit of Received headers.
+const DefaultMaxHops = 30
+
+// LoopError reports the message exceeding the hop limit
+// or received by this host before.
+type LoopError struct {
+	Hops  int
+	Limit int
+	// Host is the name of this host in the previous Received header.
+	Host string
+}
+
+func (e *LoopError) Error() string {
+	if e.Host != "" {
+		return "mail loop: message was already received by " + e.Host
+	}
+	return fmt.Sprintf("mail loop: too many hops (%d, limit %d)", e.Hops, e.Limit)
+}
+
+// Received is the trace of the message acceptance stamped
+// in Received header (RFC 5321).
+type Received struct {
+	// From is the name given by the client in HELO/EHLO.
+	From string
+	// RemoteHost is the name of the client, looked up by RemoteIP if empty.
+	RemoteHost string
+	// RemoteIP is the address of the client, nil for local submission.
+	RemoteIP net.IP
+	// By is the name of the receiving host, the hostname by default.
+	By string
+	// Protocol of the acceptance: ESMTP, ESMTPS, ESMTPA, ESMTPSA,
+	// HTTP, HTTPS or local.
+	Protocol string
+	// TLS is the connection state of the client, nil without TLS.
+	TLS *tls.ConnectionState
+	// ID of the message, new queue ID if empty.
+	ID string
+	// For is the recipient of the message with the only recipient.
+	For string
+	// Time of the acceptance, now if zero.
+	Time time.Time
+}
+
+// tlsVersions names the TLS versions of Received header.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// String return the value of Received header.
+func (r Received) String() string {
+	var parts []string
+	if r.From != "" || r.RemoteIP != nil {
+		from := "from " + r.From
+		if r.From == "" {
+			from += "unknown"
+		}
+		if r.RemoteIP != nil {
+			host := r.RemoteHost
+			if host == "" {
+				host = "unknown"
+			}
+			from += fmt.Sprintf(" (%s [%s])", host, r.RemoteIP)
+		}
+		parts = append(parts, from)
+	}
+	if r.TLS != nil {
+		version, ok := tlsVersions[r.TLS.Version]
+		if !ok {
+			version = fmt.Sprintf("0x%04x", r.TLS.Version)
+		}
+		parts = append(parts, fmt.Sprintf("(using %s with cipher %s)", version, tls.CipherSuiteName(r.TLS.CipherSuite)))
+	}
+	parts = append(parts, "by "+r.By+" (go-sendmail)")
+	if r.Protocol != "" {
+		parts = append(parts, "with "+r.Protocol)
+	}
+	if r.ID != "" {
+		parts = append(parts, "id "+r.ID)
+	}
+	if r.For != "" {
+		parts = append(parts, "for <"+r.For+">")
+	}
+	return strings.Join(parts, " ") + "; " + r.Time.Format(time.RFC1123Z)
+}
+
+// AddReceived prepend the Received header of the acceptance.
+// It returns the ID of the message in the header.
+func (e *Envelope) AddReceived(r Received) (string, error) {
+	if r.ID == "" {
+		id, err := newQueueID()
+		if err != nil {
+			return "", err
+		}
+		r.ID = id
+	}
+	if r.By == "" {
+		r.By = localHostname()
+	}
+	if r.RemoteHost == "" && r.RemoteIP != nil && !r.RemoteIP.IsLoopback() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if names, err := e.resolver().LookupAddr(ctx, r.RemoteIP.String()); err == nil && len(names) > 0 {
+			r.RemoteHost = strings.TrimSuffix(names[0], ".")
+		}
+		cancel()
+	} else if r.RemoteHost == "" && r.RemoteIP != nil {
+		r.RemoteHost = "localhost"
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	e.Header["Received"] = append([]string{r.String()}, e.Header["Received"]...)
+	return r.ID, nil
+}
+
+// localHostname return the hostname of Received headers.
+func localHostname() string {
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
+
+// checkLoop refuse the message with more Received headers than
+// the limit or received by this host twice.
+func (e *Envelope) checkLoop() error {
+	received := e.Header["Received"]
+	limit := e.MaxHops
+	if limit == 0 {
+		limit = DefaultMaxHops
+	}
+	if len(received) > limit {
+		return &LoopError{Hops: len(received), Limit: limit}
+	}
+	host := localHostname()
+	stamp := " by " + host + " (go-sendmail)"
+	count := 0
+	for _, value := range received {
+		if strings.Contains(" "+strings.Join(strings.Fields(value), " "), stamp) {
+			count++
+		}
+	}
+	if count > 1 {
+		return &LoopError{Hops: len(received), Limit: limit, Host: host}
+	}
+	return nil
+}
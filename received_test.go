@@ -0,0 +1,117 @@
+package sendmail_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestReceived(t *testing.T) {
+	received := sendmail.Received{
+		From:       "client.example.com",
+		RemoteHost: "mail.example.com",
+		RemoteIP:   net.ParseIP("192.0.2.1"),
+		By:         "mx.example.org",
+		Protocol:   "ESMTPS",
+		TLS:        &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+		ID:         "ABCDEF",
+		For:        "user@example.org",
+		Time:       time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+	}
+	expected := "from client.example.com (mail.example.com [192.0.2.1]) " +
+		"(using TLSv1.3 with cipher TLS_AES_128_GCM_SHA256) by mx.example.org (go-sendmail) " +
+		"with ESMTPS id ABCDEF for <user@example.org>; Mon, 01 Jan 2024 10:00:00 +0000"
+	if received.String() != expected {
+		t.Errorf("Expected %q got %q", expected, received.String())
+	}
+
+	local := sendmail.Received{By: "host", Protocol: "local", ID: "ABCDEF", Time: received.Time}
+	if local.String() != "by host (go-sendmail) with local id ABCDEF; Mon, 01 Jan 2024 10:00:00 +0000" {
+		t.Error("Unexpected local Received", local.String())
+	}
+}
+
+func TestAddReceived(t *testing.T) {
+	header := "Received: from a.example.com by b.example.com; Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"From: sender@localhost\r\n" +
+		"To: recipient@localhost\r\n"
+	for _, preserve := range []bool{false, true} {
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Body:              []byte(header + "\r\nTEST\r\n"),
+			ExtractRecipients: true,
+			PreserveHeaders:   preserve,
+			Resolver:          &fakeResolver{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := envelope.AddReceived(sendmail.Received{
+			From:     "client",
+			RemoteIP: net.ParseIP("192.0.2.1"),
+			By:       "b.example.com",
+			Protocol: "ESMTP",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := envelope.GenerateMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := "Received: from client (unknown [192.0.2.1]) by b.example.com (go-sendmail)\r\n with ESMTP id " + id + "; "
+		if !strings.HasPrefix(string(message), prefix) {
+			t.Errorf("Preserve %v: expected prefix %q got:\n%s", preserve, prefix, message)
+		}
+		if strings.Count(string(message), "Received: ") != 2 ||
+			!strings.Contains(string(message), "\r\nReceived: from a.example.com by b.example.com;") {
+			t.Errorf("Preserve %v: expected the original Received:\n%s", preserve, message)
+		}
+	}
+}
+
+func TestLoop(t *testing.T) {
+	hostname, _ := os.Hostname()
+	stamp := "Received: from client by " + hostname + " (go-sendmail) with ESMTP id A; Mon, 1 Jan 2024 10:00:00 +0000\r\n"
+	other := "Received: from a.example.com by b.example.com; Mon, 1 Jan 2024 10:00:00 +0000\r\n"
+	for _, tc := range []struct {
+		header  string
+		maxHops int
+		loop    bool
+	}{
+		{stamp + other, 0, false},
+		{stamp + other + stamp, 0, true},
+		{strings.Repeat(other, sendmail.DefaultMaxHops+1), 0, true},
+		{strings.Repeat(other, 3), 2, true},
+		{strings.Repeat(other, 3), 3, false},
+	} {
+		transport := &fakeTransport{}
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Sender:     "sender@example.com",
+			Recipients: []string{"user@example.com"},
+			Body:       []byte(tc.header + "\r\nTEST\r\n"),
+			Transport:  transport,
+			MaxHops:    tc.maxHops,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := envelope.Send()
+		var loop *sendmail.LoopError
+		if errors.As(err, &loop) != tc.loop {
+			t.Errorf("Expected loop %v got %v", tc.loop, err)
+		}
+		if results != nil {
+			for range results {
+			}
+		}
+		if tc.loop == (len(transport.delivered) > 0) {
+			t.Errorf("Unexpected delivery %v of loop %v", transport.delivered, tc.loop)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package sendmail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver looks up DNS records for the delivery.
+// It is implemented by *net.Resolver, so caching, DoH/DoT
+// or fake resolvers can be plugged in.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// DefaultResolver is used when the envelope has no resolver.
+var DefaultResolver Resolver = net.DefaultResolver
+
+// resolver return the resolver of envelope.
+func (e *Envelope) resolver() Resolver {
+	if e.Resolver != nil {
+		return e.Resolver
+	}
+	return DefaultResolver
+}
+
+// AddressFamily policy of the connections to servers.
+type AddressFamily int
+
+const (
+	// PreferIPv6 try IPv6 addresses first, then IPv4 (default).
+	PreferIPv6 AddressFamily = iota
+	// PreferIPv4 try IPv4 addresses first, then IPv6.
+	PreferIPv4
+	// IPv4Only connect over IPv4 only.
+	IPv4Only
+	// IPv6Only connect over IPv6 only.
+	IPv6Only
+)
+
+var addressFamilyNames = map[AddressFamily]string{
+	PreferIPv6: "prefer-ipv6",
+	PreferIPv4: "prefer-ipv4",
+	IPv4Only:   "ipv4-only",
+	IPv6Only:   "ipv6-only",
+}
+
+func (f AddressFamily) String() string {
+	return addressFamilyNames[f]
+}
+
+// ParseAddressFamily parse policy name: prefer-ipv6, prefer-ipv4, ipv4-only or ipv6-only.
+func ParseAddressFamily(name string) (AddressFamily, error) {
+	for family, familyName := range addressFamilyNames {
+		if strings.EqualFold(name, familyName) {
+			return family, nil
+		}
+	}
+	return PreferIPv6, fmt.Errorf("unknown address family %q", name)
+}
+
+// order filter the addresses by the policy and interleave the families,
+// starting with the preferred one (RFC 8305 section 4).
+func (f AddressFamily) order(ips []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch f {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	}
+	first, second := v6, v4
+	if f == PreferIPv4 {
+		first, second = v4, v6
+	}
+	var ordered []net.IPAddr
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// fallbackDelay before the next connection attempt is started in parallel.
+const fallbackDelay = 300 * time.Millisecond
+
+// dialResolved resolve host with the resolver and connect to its addresses
+// of allowed family, Happy Eyeballs style: the next address is tried
+// in parallel when the previous attempt hangs for fallbackDelay.
+func dialResolved(ctx context.Context, dialer *net.Dialer, resolver Resolver, family AddressFamily, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IPAddr{{IP: ip}}
+	} else {
+		ips, err = resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ips = family.order(ips)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address of %s", family, host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		target := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", target)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	var lastErr error
+	for next < len(ips) || pending > 0 {
+		if pending == 0 {
+			start()
+		}
+		var fallback <-chan time.Time
+		if next < len(ips) {
+			fallback = time.After(fallbackDelay)
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close the connections of attempts still in progress
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			lastErr = result.err
+		case <-fallback:
+			start()
+		}
+	}
+	return nil, lastErr
+}
+
+// CachingResolver caches MX lookups of the embedded Resolver.
+// The TTL of records is honored when the resolver implements TTLResolver,
+// DefaultTTL is used otherwise.
+type CachingResolver struct {
+	Resolver
+	// MaxEntries bounds the number of cached domains.
+	MaxEntries int
+	// DefaultTTL of records with unknown TTL.
+	DefaultTTL time.Duration
+
+	mu sync.Mutex
+	mx map[string]mxCacheEntry
+}
+
+type mxCacheEntry struct {
+	records []*net.MX
+	expires time.Time
+}
+
+// NewCachingResolver return resolver caching MX records up to maxEntries domains.
+func NewCachingResolver(resolver Resolver, maxEntries int) *CachingResolver {
+	return &CachingResolver{
+		Resolver:   resolver,
+		MaxEntries: maxEntries,
+		DefaultTTL: 5 * time.Minute,
+		mx:         make(map[string]mxCacheEntry),
+	}
+}
+
+// LookupMX returns the cached MX records or looks them up.
+func (c *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.mx[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.records, nil
+	}
+
+	var records []*net.MX
+	var err error
+	ttl := c.DefaultTTL
+	if ttlResolver, ok := c.Resolver.(TTLResolver); ok {
+		records, ttl, err = ttlResolver.LookupMXTTL(ctx, name)
+	} else {
+		records, err = c.Resolver.LookupMX(ctx, name)
+	}
+	if err != nil || ttl <= 0 {
+		return records, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mx == nil {
+		c.mx = make(map[string]mxCacheEntry)
+	}
+	if c.MaxEntries > 0 && len(c.mx) >= c.MaxEntries {
+		c.evict(now)
+	}
+	c.mx[key] = mxCacheEntry{records, now.Add(ttl)}
+	return records, nil
+}
+
+// evict remove expired entries, or the one expiring first if none expired.
+func (c *CachingResolver) evict(now time.Time) {
+	var oldest string
+	for key, entry := range c.mx {
+		if !now.Before(entry.expires) {
+			delete(c.mx, key)
+			continue
+		}
+		if oldest == "" || entry.expires.Before(c.mx[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(c.mx) >= c.MaxEntries && oldest != "" {
+		delete(c.mx, oldest)
+	}
+}
@@ -0,0 +1,175 @@
+package sendmail_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+// fakeResolver serves MX, A, TXT and PTR records from maps.
+type fakeResolver struct {
+	mx  map[string][]*net.MX
+	ip  map[string][]net.IPAddr
+	txt map[string][]string
+	ptr map[string][]string
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip, ok := r.ip[host]; ok {
+		return ip, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if ptr, ok := r.ptr[addr]; ok {
+		return ptr, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestResolver(t *testing.T) {
+	test.StartSMTP()
+
+	config := testConfigs[0].initial
+	config.Resolver = &fakeResolver{
+		mx: map[string][]*net.MX{
+			"localhost": {{Host: "mx.test.", Pref: 10}},
+		},
+		ip: map[string][]net.IPAddr{
+			"mx.test": {{IP: net.ParseIP("127.0.0.1")}},
+		},
+	}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := false
+	for result := range envelope.SendLikeMTA() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+		if result.Level == sendmail.InfoLevel && result.Fields["mx"] == "mx.test" {
+			delivered = true
+		}
+	}
+	if !delivered {
+		t.Error("Expected delivery through mx.test")
+	}
+}
+
+// countingResolver counts MX lookups and reports fixed TTL.
+type countingResolver struct {
+	fakeResolver
+	ttl     time.Duration
+	lookups int
+}
+
+func (r *countingResolver) LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error) {
+	r.lookups++
+	mx, err := r.LookupMX(ctx, name)
+	return mx, r.ttl, err
+}
+
+func TestCachingResolver(t *testing.T) {
+	inner := &countingResolver{
+		fakeResolver: fakeResolver{mx: map[string][]*net.MX{
+			"one.test": {{Host: "mx.one.test."}},
+			"two.test": {{Host: "mx.two.test."}},
+		}},
+		ttl: time.Hour,
+	}
+	resolver := sendmail.NewCachingResolver(inner, 1)
+
+	for i := 0; i < 3; i++ {
+		mx, err := resolver.LookupMX(context.Background(), "one.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mx[0].Host != "mx.one.test." {
+			t.Error("Expected mx.one.test. got", mx[0].Host)
+		}
+	}
+	if inner.lookups != 1 {
+		t.Error("Expected 1 lookup got", inner.lookups)
+	}
+
+	// The cache is bounded to one domain
+	resolver.LookupMX(context.Background(), "two.test")
+	resolver.LookupMX(context.Background(), "one.test")
+	if inner.lookups != 3 {
+		t.Error("Expected 3 lookups got", inner.lookups)
+	}
+
+	// Zero TTL is not cached
+	inner.ttl = 0
+	resolver = sendmail.NewCachingResolver(inner, 10)
+	resolver.LookupMX(context.Background(), "one.test")
+	resolver.LookupMX(context.Background(), "one.test")
+	if inner.lookups != 5 {
+		t.Error("Expected 5 lookups got", inner.lookups)
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	test.StartSMTP()
+
+	family, err := sendmail.ParseAddressFamily("ipv6-only")
+	if err != nil || family != sendmail.IPv6Only {
+		t.Error("Expected ipv6-only got", family, err)
+	}
+	if _, err := sendmail.ParseAddressFamily("ipv5"); err == nil {
+		t.Error("Expected error for unknown address family")
+	}
+
+	// IPv6 address of the test server is unreachable, fallback to IPv4
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"localhost": {{Host: "mx.test.", Pref: 10}},
+		},
+		ip: map[string][]net.IPAddr{
+			"mx.test": {{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("::1")}},
+		},
+	}
+	for family, expected := range map[sendmail.AddressFamily]bool{
+		sendmail.PreferIPv6: true,
+		sendmail.PreferIPv4: true,
+		sendmail.IPv4Only:   true,
+		sendmail.IPv6Only:   false,
+	} {
+		config := testConfigs[0].initial
+		config.Resolver = resolver
+		config.AddressFamily = family
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delivered := false
+		for result := range envelope.SendLikeMTA() {
+			if result.Level == sendmail.InfoLevel {
+				delivered = true
+			}
+		}
+		if delivered != expected {
+			t.Errorf("Expected delivery %v with %s", expected, family)
+		}
+	}
+}
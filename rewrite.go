@@ -0,0 +1,159 @@
+package sendmail
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// RewriteRules of the addresses applied to the envelope and the
+// headers of the message before delivery (masquerading).
+type RewriteRules struct {
+	// Domain is appended to the bare local parts, e.g. root.
+	Domain string `yaml:"domain,omitempty"`
+	// Addresses replace the address or every address of @domain key.
+	// The @domain value only replaces the domain of the address.
+	Addresses map[string]string `yaml:"addresses,omitempty"`
+	// From is the fixed From header of the messages of the sender
+	// or every sender of @domain key, matched after the rewriting.
+	From map[string]string `yaml:"from,omitempty"`
+}
+
+// Validate check the domain and the addresses of the rules.
+func (r RewriteRules) Validate() error {
+	if strings.Contains(r.Domain, "@") {
+		return fmt.Errorf("invalid rewrite domain %q", r.Domain)
+	}
+	check := func(address string) error {
+		if strings.HasPrefix(address, "@") && len(address) > 1 && !strings.Contains(address[1:], "@") {
+			return nil
+		}
+		_, err := mail.ParseAddress(address)
+		return err
+	}
+	for from, to := range r.Addresses {
+		if err := check(from); err != nil {
+			return fmt.Errorf("invalid rewrite address %q: %s", from, err)
+		}
+		if err := check(to); err != nil {
+			return fmt.Errorf("invalid rewrite of %s to %q: %s", from, to, err)
+		}
+	}
+	for sender, from := range r.From {
+		if err := check(sender); err != nil {
+			return fmt.Errorf("invalid rewrite sender %q: %s", sender, err)
+		}
+		if _, err := mail.ParseAddress(from); err != nil {
+			return fmt.Errorf("invalid rewrite From of %s %q: %s", sender, from, err)
+		}
+	}
+	return nil
+}
+
+// Address return the rewritten address.
+func (r *RewriteRules) Address(address string) string {
+	if r == nil {
+		return address
+	}
+	address = r.qualify(address)
+	to, ok := lookupAddress(r.Addresses, address)
+	if !ok {
+		return address
+	}
+	if strings.HasPrefix(to, "@") {
+		return strings.SplitN(address, "@", 2)[0] + to
+	}
+	// The replacement may be given with name
+	if parsed, err := mail.ParseAddress(to); err == nil {
+		return parsed.Address
+	}
+	return to
+}
+
+// from return the fixed From header of the sender, empty if none.
+func (r *RewriteRules) from(sender string) string {
+	if r == nil {
+		return ""
+	}
+	from, _ := lookupAddress(r.From, sender)
+	return from
+}
+
+// list return the address list with the addresses rewritten,
+// it's unchanged if nothing is rewritten or it can't be parsed.
+func (r *RewriteRules) list(value string) string {
+	if r == nil {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		// Quoted names may contain commas
+		if !strings.Contains(part, `"`) {
+			parts[i] = r.qualify(part)
+		}
+	}
+	value = strings.Join(parts, ",")
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return value
+	}
+	changed := false
+	for _, address := range list {
+		if to := r.Address(address.Address); to != address.Address {
+			address.Address = to
+			changed = true
+		}
+	}
+	if !changed {
+		return value
+	}
+	parts = parts[:0]
+	for _, address := range list {
+		parts = append(parts, address.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rewriteHeader rewrite the address headers of the message.
+func (r *RewriteRules) rewriteHeader(header mail.Header) {
+	if r == nil {
+		return
+	}
+	for _, key := range addressHeaders {
+		for i, value := range header[key] {
+			header[key][i] = r.list(value)
+		}
+	}
+}
+
+// qualify append the domain to the bare local part, the address
+// may have the name in angle brackets or the comment.
+func (r *RewriteRules) qualify(address string) string {
+	if r.Domain == "" || strings.Contains(address, "@") || strings.TrimSpace(address) == "" {
+		return address
+	}
+	if i := strings.LastIndex(address, ">"); i >= 0 {
+		return address[:i] + "@" + r.Domain + address[i:]
+	}
+	if i := strings.Index(address, "("); i >= 0 {
+		return strings.TrimSpace(address[:i]) + "@" + r.Domain + " " + address[i:]
+	}
+	return strings.TrimSpace(address) + "@" + r.Domain
+}
+
+// lookupAddress find the value of the address or its @domain,
+// the keys are case insensitive.
+func lookupAddress(rules map[string]string, address string) (string, bool) {
+	domain := "@" + GetDomainFromAddress(address)
+	var value string
+	found := false
+	for key, v := range rules {
+		if strings.EqualFold(key, address) {
+			return v, true
+		}
+		if domain != "@" && strings.EqualFold(key, domain) {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
@@ -0,0 +1,78 @@
+package sendmail_test
+
+import (
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestRewrite(t *testing.T) {
+	rules := &sendmail.RewriteRules{
+		Domain: "host.internal",
+		Addresses: map[string]string{
+			"root@host.internal": "Alerts <alerts@example.com>",
+			"@host.internal":     "@example.com",
+		},
+		From: map[string]string{
+			"@example.com": "Backups <backup@example.com>",
+		},
+	}
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]string{
+		"root":               "alerts@example.com",
+		"ROOT@host.internal": "alerts@example.com",
+		"cron":               "cron@example.com",
+		"user@example.org":   "user@example.org",
+	} {
+		if rewritten := rules.Address(address); rewritten != expected {
+			t.Errorf("Expected %s rewritten to %s got %s", address, expected, rewritten)
+		}
+	}
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Body:              []byte("From: root (Cron Daemon)\r\nTo: root, user@example.org\r\nCc: Admin <admin>\r\nSubject: Cron\r\n\r\nTEST"),
+		ExtractRecipients: true,
+		Rewrite:           &sendmail.RewriteRules{Domain: rules.Domain, Addresses: rules.Addresses},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender := envelope.GetSender(); sender != "alerts@example.com" {
+		t.Error("Expected sender alerts@example.com got", sender)
+	}
+	expected := []string{"alerts@example.com", "user@example.org", "admin@example.com"}
+	if len(envelope.Recipients) != len(expected) {
+		t.Fatal("Expected recipients", expected, "got", envelope.Recipients)
+	}
+	for i, rcpt := range expected {
+		if envelope.Recipients[i] != rcpt {
+			t.Error("Expected recipients", expected, "got", envelope.Recipients)
+		}
+	}
+
+	config := sendmail.Config{
+		Sender:     "www-data",
+		Recipients: []string{"root"},
+		Body:       []byte("TEST"),
+		Rewrite:    rules,
+	}
+	envelope, err = sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Sender != "www-data" || config.Recipients[0] != "root" {
+		t.Error("Expected unchanged config got", config.Sender, config.Recipients)
+	}
+	if from := envelope.Header.Get("From"); from != "Backups <backup@example.com>" {
+		t.Error("Expected fixed From got", from)
+	}
+	if len(envelope.Recipients) != 1 || envelope.Recipients[0] != "alerts@example.com" {
+		t.Error("Expected recipient alerts@example.com got", envelope.Recipients)
+	}
+
+	if err := (sendmail.RewriteRules{Addresses: map[string]string{"root": "@"}}).Validate(); err == nil {
+		t.Error("Expected error of invalid rewrite rule")
+	}
+}
@@ -3,22 +3,19 @@ package sendmail
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/mail"
+	"net/smtp"
+	"net/textproto"
 	"os"
 	"os/user"
-	"sort"
 	"strings"
-	"sync"
-
-	"gopkg.in/yaml.v2"
-)
-
-var (
-	wg sync.WaitGroup
 )
 
 // Config of envelope
@@ -28,6 +25,105 @@ type Config struct {
 	Subject    string
 	Body       []byte
 	PortSMTP   string
+	// SenderName is the full name of sender used in generated From header.
+	SenderName string
+	// Transcript receives the SMTP dialogue of the deliveries.
+	Transcript io.Writer
+	// ConfigFile is merged over the system and user configuration files.
+	ConfigFile string
+	// SmartHost (host:port) to relay the message through,
+	// the configuration files are not read when it is set.
+	SmartHost string
+	// SmartHostAuth is the optional authentication for SmartHost.
+	SmartHostAuth smtp.Auth
+	// Resolver for DNS lookups, DefaultResolver if nil.
+	Resolver Resolver
+	// DisableImplicitMX disable delivery to A/AAAA records
+	// of the domain without MX records.
+	DisableImplicitMX bool
+	// AddressFamily policy of connections to servers.
+	AddressFamily AddressFamily
+	// Timeouts of the SMTP session stages, DefaultTimeouts for not set.
+	Timeouts Timeouts
+	// NullSender transmit the message with the null reverse-path
+	// (RFC 5321 section 4.5.5) like the delivery status notifications,
+	// the failures of such message are never notified.
+	NullSender bool
+	// TLSReporter records the TLS negotiations of direct deliveries.
+	TLSReporter *TLSReporter
+	// DMARCCheck mode: DMARCCheckWarn, DMARCCheckRefuse or empty to disable.
+	DMARCCheck string
+	// SendingIP is the address of outgoing connections for SPF evaluation.
+	SendingIP net.IP
+	// Suppression list of recipients skipped by Send, the recipients
+	// rejected as unknown users are added to it.
+	Suppression SuppressionList
+	// Priority class of the message in the queue, derived from
+	// Precedence, Priority and X-Priority headers if empty.
+	Priority Priority
+	// RateLimiter defers the direct deliveries exceeding the limits
+	// of destination domains.
+	RateLimiter *RateLimiter
+	// DeferQueue receives the recipients deferred by RateLimiter,
+	// they are only reported if it is nil.
+	DeferQueue *Queue
+	// Concurrency is the number of parallel deliveries to domains of
+	// recipients, DefaultConcurrency if 0.
+	Concurrency int
+	// Transport delivers the message instead of the smarthost or
+	// the relays and direct delivery of the configuration files.
+	Transport Transport
+	// Archive keeps a copy of the sent messages.
+	Archive *Archive
+	// Rewrite rules of the sender, the recipients and the address headers.
+	Rewrite *RewriteRules
+	// Middleware processes the message after the registered middlewares.
+	Middleware []Middleware
+	// TLSPolicies of the direct deliveries by destination domain,
+	// "*" is the policy of every other domain. They are taken from
+	// the configuration files if nil.
+	TLSPolicies map[string]TLSPolicy
+	// RequireTLS transmit the message only over verified TLS to servers
+	// supporting REQUIRETLS extension (RFC 8689), every next hop is
+	// demanded the same. Only SMTP relays and direct delivery support it.
+	RequireTLS bool
+	// MaxHops is the limit of Received headers of the message,
+	// DefaultMaxHops if 0. The message received by this host
+	// twice is refused as a loop as well.
+	MaxHops int
+	// MaxRecipients of one mail transaction, the larger recipient lists
+	// are delivered in several transactions. The limits advertised by
+	// the server (LIMITS extension, RFC 9422) apply as well, 0 for no
+	// other limit.
+	MaxRecipients int
+	// IndividualCopies deliver separate copy of the message to every
+	// recipient with To header of the recipient instead of one shared
+	// message, Cc header is removed.
+	IndividualCopies bool
+	// RecipientFields are the merge fields of the individual copies by
+	// recipient address. The subject and the body of the copies are
+	// rendered as Go text/template of the fields, encoded body parts
+	// are not rendered.
+	RecipientFields map[string]map[string]string
+	// Headers are added to the message replacing the same headers,
+	// they are overridden by Sender and Subject.
+	Headers map[string][]string
+	// PreserveHeaders keep the header block of the message read from Body
+	// byte for byte in the original order, so the DKIM signatures and
+	// Received chains stay intact. Only the changed headers are rewritten.
+	PreserveHeaders bool
+	// ContentType of the message body, e.g. "text/html; charset=utf-8".
+	ContentType string
+	// HTMLBody is added as HTML alternative to the plain text Body.
+	HTMLBody []byte
+	// Attachments is a list of files attached to the message.
+	Attachments []string
+	// ExtractRecipients take recipients from To, Cc and Bcc headers,
+	// Recipients are added to them.
+	ExtractRecipients bool
+	// ExcludeRecipients remove Recipients from the extracted list
+	// instead of adding them (used with ExtractRecipients).
+	ExcludeRecipients bool
 }
 
 // Envelope of message
@@ -35,10 +131,75 @@ type Envelope struct {
 	*mail.Message
 	Recipients []string
 	PortSMTP   string
+	Transcript io.Writer
+	ConfigFile string
+
+	SmartHost     string
+	SmartHostAuth smtp.Auth
+	Resolver      Resolver
+
+	DisableImplicitMX bool
+	AddressFamily     AddressFamily
+	Timeouts          Timeouts
+	NullSender        bool
+	TLSReporter       *TLSReporter
+	DMARCCheck        string
+	SendingIP         net.IP
+	Suppression       SuppressionList
+	Priority          Priority
+	RateLimiter       *RateLimiter
+	DeferQueue        *Queue
+	Concurrency       int
+	Transport         Transport
+	Archive           *Archive
+	Middleware        []Middleware
+	TLSPolicies       map[string]TLSPolicy
+	RequireTLS        bool
+	MaxHops           int
+	MaxRecipients     int
+	IndividualCopies  bool
+	RecipientFields   map[string]map[string]string
+
+	raw             *rawHeader
+	processed       bool
+	held            []Result
+	dryRun          bool
+	probeRecipients bool
 }
 
 // NewEnvelope return new message envelope
 func NewEnvelope(config *Config) (Envelope, error) {
+	// The values must not smuggle extra headers
+	if err := checkHeader("From", config.Sender, config.SenderName); err != nil {
+		return Envelope{}, err
+	}
+	if err := checkHeader("To", config.Recipients...); err != nil {
+		return Envelope{}, err
+	}
+	if err := checkHeader("Content-Type", config.ContentType); err != nil {
+		return Envelope{}, err
+	}
+	for name, values := range config.Headers {
+		if err := checkHeader(name, values...); err != nil {
+			return Envelope{}, err
+		}
+	}
+
+	if config.Rewrite != nil {
+		// The configuration of the caller is reused for other envelopes
+		copied := *config
+		config = &copied
+		if config.Sender != "" {
+			config.Sender = config.Rewrite.Address(config.Sender)
+		}
+		rewritten := make([]string, 0, len(config.Recipients))
+		for _, rcpt := range config.Recipients {
+			rewritten = append(rewritten, config.Rewrite.list(rcpt))
+		}
+		config.Recipients = rewritten
+	}
+
+	var raw *rawHeader
 	msg, err := mail.ReadMessage(bytes.NewReader(config.Body))
 	if err != nil {
 		if len(config.Recipients) > 0 {
@@ -47,14 +208,27 @@ func NewEnvelope(config *Config) (Envelope, error) {
 		if err != nil {
 			return Envelope{}, err
 		}
+	} else if config.PreserveHeaders {
+		raw = newRawHeader(config.Body, msg.Header)
 	}
+	for name, values := range config.Headers {
+		msg.Header[textproto.CanonicalMIMEHeaderKey(name)] = append([]string(nil), values...)
+	}
+	config.Rewrite.rewriteHeader(msg.Header)
 
 	if config.PortSMTP == "" {
 		config.PortSMTP = "25"
 	}
 
+	from := func(address string) string {
+		if config.SenderName == "" {
+			return address
+		}
+		return (&mail.Address{Name: config.SenderName, Address: address}).String()
+	}
+
 	if config.Sender != "" {
-		msg.Header["From"] = []string{config.Sender}
+		msg.Header["From"] = []string{from(config.Sender)}
 	} else {
 		sender, _ := msg.Header.AddressList("From")
 		if len(sender) > 0 {
@@ -65,27 +239,56 @@ func NewEnvelope(config *Config) (Envelope, error) {
 			if err == nil {
 				hostname, err := os.Hostname()
 				if err == nil {
-					config.Sender = user.Username + "@" + hostname
-					msg.Header["From"] = []string{config.Sender}
+					config.Sender = config.Rewrite.Address(user.Username + "@" + hostname)
+					msg.Header["From"] = []string{from(config.Sender)}
 				}
 			}
 		}
 	}
+	if from := config.Rewrite.from(config.Sender); from != "" {
+		msg.Header["From"] = []string{from}
+	}
+
+	if config.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(config.ContentType); err != nil {
+			return Envelope{}, fmt.Errorf("invalid content type: %s", err)
+		}
+		msg.Header["Mime-Version"] = []string{"1.0"}
+		msg.Header["Content-Type"] = []string{config.ContentType}
+	}
+
+	if len(config.HTMLBody) > 0 {
+		if err := addAlternative(msg, config.HTMLBody); err != nil {
+			return Envelope{}, err
+		}
+	}
+
+	if len(config.Attachments) > 0 {
+		if err := attachFiles(msg, config.Attachments); err != nil {
+			return Envelope{}, err
+		}
+	}
 
 	if config.Subject != "" {
-		msg.Header["Subject"] = []string{"=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(config.Subject))}
+		msg.Header["Subject"] = []string{mime.BEncoding.Encode("UTF-8", config.Subject)}
+	}
+	if raw != nil {
+		// The original values are kept as is
+		encodeHeader(raw.changed(msg.Header))
+	} else {
+		encodeHeader(msg.Header)
 	}
 
 	var recipients []string
 
-	if len(config.Recipients) > 0 {
+	if len(config.Recipients) > 0 && !config.ExtractRecipients {
 		recipient, err := mail.ParseAddressList(strings.Join(config.Recipients, ","))
 		if err == nil {
 			recipients = AddressListToSlice(recipient)
 		}
 	} else {
 		recipientsList, err := msg.Header.AddressList("To")
-		if err != nil {
+		if err != nil && err != mail.ErrHeaderNotPresent {
 			return Envelope{}, err
 		}
 		rcpt := func(field string) []*mail.Address {
@@ -97,13 +300,69 @@ func NewEnvelope(config *Config) (Envelope, error) {
 		recipientsList = append(recipientsList, rcpt("Cc")...)
 		recipientsList = append(recipientsList, rcpt("Bcc")...)
 		recipients = AddressListToSlice(recipientsList)
+		// Blind copies must not be visible to the recipients
+		delete(msg.Header, "Bcc")
+
+		if len(config.Recipients) > 0 {
+			list, err := mail.ParseAddressList(strings.Join(config.Recipients, ","))
+			if err != nil {
+				return Envelope{}, err
+			}
+			if config.ExcludeRecipients {
+				recipients = excludeAddresses(recipients, AddressListToSlice(list))
+			} else {
+				recipients = append(recipients, AddressListToSlice(list)...)
+			}
+		}
+		recipients = uniqueAddresses(recipients)
 	}
 
 	if len(recipients) == 0 {
 		return Envelope{}, errors.New("no recipients listed")
 	}
 
-	return Envelope{msg, recipients, config.PortSMTP}, nil
+	envelope := Envelope{
+		Message:    msg,
+		Recipients: recipients,
+		PortSMTP:   config.PortSMTP,
+		ConfigFile: config.ConfigFile,
+
+		SmartHost:     config.SmartHost,
+		SmartHostAuth: config.SmartHostAuth,
+		Resolver:      config.Resolver,
+
+		DisableImplicitMX: config.DisableImplicitMX,
+		AddressFamily:     config.AddressFamily,
+		Timeouts:          config.Timeouts,
+		NullSender:        config.NullSender,
+		TLSReporter:       config.TLSReporter,
+		DMARCCheck:        config.DMARCCheck,
+		SendingIP:         config.SendingIP,
+		Suppression:       config.Suppression,
+		Priority:          config.Priority,
+		RateLimiter:       config.RateLimiter,
+		DeferQueue:        config.DeferQueue,
+		Concurrency:       config.Concurrency,
+		Transport:         config.Transport,
+		Archive:           config.Archive,
+		Middleware:        config.Middleware,
+		TLSPolicies:       lowerDomains(config.TLSPolicies),
+		RequireTLS:        config.RequireTLS,
+		MaxHops:           config.MaxHops,
+		MaxRecipients:     config.MaxRecipients,
+		IndividualCopies:  config.IndividualCopies,
+		RecipientFields:   config.RecipientFields,
+
+		raw: raw,
+	}
+	if envelope.Priority == "" {
+		envelope.Priority = headerPriority(msg.Header)
+	}
+	if config.Transcript != nil {
+		envelope.Transcript = &syncWriter{w: config.Transcript}
+	}
+
+	return envelope, nil
 }
 
 func (e *Envelope) GetSender() string {
@@ -116,45 +375,184 @@ func (e *Envelope) GetSender() string {
 	return ""
 }
 
+// reversePath return the address of MAIL FROM command,
+// empty for the null reverse-path.
+func (e *Envelope) reversePath() string {
+	if e.NullSender {
+		return ""
+	}
+	return e.GetSender()
+}
+
+// SetMessageID add generated Message-Id header if the message has none.
+// It returns the message ID.
+func (e *Envelope) SetMessageID() (string, error) {
+	if id := e.Header.Get("Message-Id"); id != "" {
+		return id, nil
+	}
+	unique, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	domain := GetDomainFromAddress(e.GetSender())
+	if domain == "" {
+		domain = "localhost"
+		if hostname, err := os.Hostname(); err == nil {
+			domain = hostname
+		}
+	}
+	id := "<" + unique + "@" + domain + ">"
+	e.Header["Message-Id"] = []string{id}
+	return id, nil
+}
+
 // Send message.
 // It returns channel for results of send.
 // After the end of sending channel are closed.
 func (e *Envelope) Send() (<-chan Result, error) {
-	var relayConfig struct {
-		RelayHost     string `yaml:"relay_host,omitempty"`
-		RelayLogin    string `yaml:"relay_login,omitempty"`
-		RelayPassword string `yaml:"relay_password,omitempty"`
+	if err := e.checkLoop(); err != nil {
+		return nil, err
+	}
+	if err := e.Process(context.Background()); err != nil {
+		return nil, err
+	}
+
+	// The recipients held by the middlewares
+	prefix := append([]Result(nil), e.held...)
+	warning, err := e.checkDMARC()
+	if err != nil {
+		return nil, err
+	}
+	if warning != nil {
+		prefix = append(prefix, *warning)
 	}
 
-	data, err := ioutil.ReadFile("/etc/go-sendmail.yaml")
+	suppressed, err := e.suppressRecipients()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read config file: %s", err)
+		return nil, err
+	}
+	prefix = append(prefix, suppressed...)
+	if len(e.Recipients) == 0 {
+		return e.withMessageID(withResults(prefix, nil)), nil
 	}
 
-	err = yaml.Unmarshal([]byte(data), &relayConfig)
+	if !e.dryRun {
+		if err := e.Archive.Store(e); err != nil {
+			return nil, fmt.Errorf("failed to archive: %s", err)
+		}
+	}
+
+	transport, err := e.route()
 	if err != nil {
-		return nil, fmt.Errorf("Error while parsing config file: %s", err)
+		return nil, err
+	}
+	if e.IndividualCopies {
+		return e.withMessageID(withResults(prefix, e.sendCopies(context.Background(), transport))), nil
+	}
+	results := e.sendTransport(context.Background(), transport)
+	return e.withMessageID(withResults(prefix, e.deferToQueue(e.suppressUnknown(results)))), nil
+}
+
+// withMessageID add the message ID to the fields of the results.
+func (e *Envelope) withMessageID(results <-chan Result) <-chan Result {
+	id := e.Header.Get("Message-Id")
+	if id == "" {
+		return results
+	}
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		for result := range results {
+			if result.Fields != nil && result.Fields["message_id"] == nil {
+				result.Fields["message_id"] = id
+			}
+			out <- result
+		}
+	}()
+	return out
+}
+
+// route return the transport of the message: the envelope transport,
+// the smarthost, the configured relay or direct delivery.
+func (e *Envelope) route() (Transport, error) {
+	if e.Transport != nil {
+		return e.Transport, nil
+	}
+	if e.SmartHost != "" {
+		return &SmarthostTransport{
+			Relay: RelayConfig{Host: e.SmartHost},
+			Auth:  e.SmartHostAuth,
+		}, nil
 	}
 
-	if relayConfig.RelayHost == "" {
-		relayConfig.RelayHost = os.Getenv("SENDMAIL_SMART_HOST")
+	config, err := LoadConfig(e.ConfigFile)
+	if err != nil {
+		return nil, err
 	}
-	if relayConfig.RelayLogin == "" {
-		relayConfig.RelayLogin = os.Getenv("SENDMAIL_SMART_LOGIN")
+	e.Timeouts = e.Timeouts.Or(config.Timeouts)
+	if e.TLSPolicies == nil {
+		e.TLSPolicies = config.TLSPolicies
 	}
-	if relayConfig.RelayPassword == "" {
-		relayConfig.RelayPassword = os.Getenv("SENDMAIL_SMART_PASSWORD")
+	if e.MaxRecipients == 0 {
+		e.MaxRecipients = config.MaxRecipients
 	}
 
-	if relayConfig.RelayHost != "" {
-		return e.SendSmarthost(
-			relayConfig.RelayHost,
-			relayConfig.RelayLogin,
-			relayConfig.RelayPassword,
-		), nil
+	relay := config.Relay(e.GetSender())
+	if relay.Host != "" || relay.Transport != "" {
+		if e.RequireTLS && relay.Transport != "" && !strings.EqualFold(relay.Transport, TransportSMTP) {
+			return nil, fmt.Errorf("REQUIRETLS is not supported by %s transport", relay.Transport)
+		}
+		return relay.NewTransport()
+	}
+
+	return MXTransport{}, nil
+}
+
+// withResults return channel of the prefix results followed by
+// the results, nil results channel is treated as closed.
+func withResults(prefix []Result, results <-chan Result) <-chan Result {
+	if len(prefix) == 0 && results != nil {
+		return results
+	}
+	out := make(chan Result, len(prefix))
+	for _, result := range prefix {
+		out <- result
+	}
+	if results == nil {
+		close(out)
+		return out
 	}
+	go func() {
+		defer close(out)
+		for result := range results {
+			out <- result
+		}
+	}()
+	return out
+}
+
+// DryRun check the delivery like Send without transferring the message.
+// It resolves the servers, connects, negotiates STARTTLS and authentication,
+// then ends the session before DATA. With probeRecipients the sender and
+// recipients are also checked with MAIL and RCPT commands.
+// Use Config.Transcript to see the dialogue.
+func (e *Envelope) DryRun(probeRecipients bool) (<-chan Result, error) {
+	e.dryRun = true
+	e.probeRecipients = probeRecipients
+	return e.Send()
+}
 
-	return e.SendLikeMTA(), nil
+// timeouts of the session stages with defaults.
+func (e *Envelope) timeouts() Timeouts {
+	return e.Timeouts.Or(DefaultTimeouts)
+}
+
+// successMessage of the delivery result
+func (e *Envelope) successMessage() string {
+	if e.dryRun {
+		return "Dry run OK"
+	}
+	return "Send mail OK"
 }
 
 // GenerateMessage create body from mail.Message
@@ -164,21 +562,33 @@ func (e *Envelope) GenerateMessage() ([]byte, error) {
 	}
 
 	buf := bytes.NewBuffer(nil)
-	keys := make([]string, 0, len(e.Header))
-	for key := range e.Header {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
+	if e.raw != nil {
+		if err := e.raw.write(buf, e.Header); err != nil {
+			return nil, err
+		}
+	} else {
+		keys := make([]string, 0, len(e.Header))
+		for key := range e.Header {
+			keys = append(keys, key)
+		}
+		sortHeaderKeys(keys)
 
-	for _, key := range keys {
-		buf.WriteString(key + ": " + strings.Join(e.Header[key], ",") + "\r\n")
+		for _, key := range keys {
+			if err := writeHeader(buf, key, e.Header[key]); err != nil {
+				return nil, err
+			}
+		}
 	}
 	buf.WriteString("\r\n")
 
-	_, err := buf.ReadFrom(e.Body)
+	// Keep the body for the next generation
+	body, err := ioutil.ReadAll(e.Body)
 	if err != nil {
 		return nil, err
 	}
+	e.Body = bytes.NewReader(body)
+	// Strict servers reject bare LF and CR
+	buf.Write(normalizeCRLF(body))
 
 	if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
 		buf.WriteString("\r\n")
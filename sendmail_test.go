@@ -2,7 +2,9 @@ package sendmail_test
 
 import (
 	"bytes"
-	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/mail"
 	"reflect"
 	"strings"
 	"testing"
@@ -70,17 +72,12 @@ func TestNewEnvelope(t *testing.T) {
 			t.Error("Expected", config.expected.Recipients, "got", envelope.Header["To"])
 		}
 
-		subject := []byte(envelope.Header["Subject"][0])
-		if bytes.Contains(subject, []byte("=?UTF-8?B?")) {
-			subject, err = base64.StdEncoding.DecodeString(
-				strings.Replace(envelope.Header["Subject"][0], "=?UTF-8?B?", "", 1),
-			)
-			if err != nil {
-				t.Error(err)
-				return
-			}
+		subject, err := new(mime.WordDecoder).DecodeHeader(envelope.Header["Subject"][0])
+		if err != nil {
+			t.Error(err)
+			return
 		}
-		if string(subject) != config.expected.Subject {
+		if subject != config.expected.Subject {
 			t.Error("Expected", config.expected.Subject, "got", subject)
 		}
 
@@ -93,7 +90,7 @@ func TestNewEnvelope(t *testing.T) {
 }
 
 func TestGenerateMessage(t *testing.T) {
-	expectedMessage := "From: sender@localhost\r\nSubject: =?UTF-8?B?c3ViamVjdA==\r\nTo: recipient@localhost\r\n\r\nTEST\r\n"
+	expectedMessage := "From: sender@localhost\r\nSubject: subject\r\nTo: recipient@localhost\r\n\r\nTEST\r\n"
 
 	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
 	if err != nil {
@@ -109,3 +106,295 @@ func TestGenerateMessage(t *testing.T) {
 		t.Errorf("EXPECTED:\n%s\nGOT:\n%s", expectedMessage, message)
 	}
 }
+
+func TestExtractRecipients(t *testing.T) {
+	body := []byte("From: sender@localhost\nTo: one@localhost\nCc: two@localhost\nBcc: three@localhost\n\nTEST")
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Recipients:        []string{"four@localhost"},
+		Body:              body,
+		ExtractRecipients: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"one@localhost", "two@localhost", "three@localhost", "four@localhost"}
+	if !reflect.DeepEqual(envelope.Recipients, expected) {
+		t.Error("Expected", expected, "got", envelope.Recipients)
+	}
+	if _, ok := envelope.Header["Bcc"]; ok {
+		t.Error("Expected Bcc header to be removed")
+	}
+
+	envelope, err = sendmail.NewEnvelope(&sendmail.Config{
+		Recipients:        []string{"two@localhost"},
+		Body:              body,
+		ExtractRecipients: true,
+		ExcludeRecipients: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"one@localhost", "three@localhost"}
+	if !reflect.DeepEqual(envelope.Recipients, expected) {
+		t.Error("Expected", expected, "got", envelope.Recipients)
+	}
+}
+
+func TestSenderName(t *testing.T) {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		SenderName: "Cron Daemon",
+		Recipients: []string{"recipient@localhost"},
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `"Cron Daemon" <sender@localhost>`
+	if envelope.Header.Get("From") != expected {
+		t.Error("Expected", expected, "got", envelope.Header.Get("From"))
+	}
+	if envelope.GetSender() != "sender@localhost" {
+		t.Error("Expected sender@localhost got", envelope.GetSender())
+	}
+}
+
+func TestSetMessageID(t *testing.T) {
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := envelope.SetMessageID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@localhost>") {
+		t.Error("Unexpected message ID", id)
+	}
+	if again, _ := envelope.SetMessageID(); again != id || envelope.Header.Get("Message-Id") != id {
+		t.Error("Expected the same message ID", id, "got", again)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"recipient@localhost"},
+		Body:       []byte("TEST"),
+		Headers: map[string][]string{
+			"x-mailer":   {"test"},
+			"List-Id":    {"<list.example.com>"},
+			"X-Multiple": {"one", "two"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Header.Get("X-Mailer") != "test" || len(envelope.Header["X-Multiple"]) != 2 {
+		t.Error("Expected custom headers got", envelope.Header)
+	}
+
+	for name, config := range map[string]sendmail.Config{
+		"sender":      {Sender: "sender@localhost\r\nBcc: victim@example.com"},
+		"recipient":   {Recipients: []string{"recipient@localhost\nBcc: victim@example.com"}},
+		"header":      {Headers: map[string][]string{"X-Test": {"value\r\nBcc: victim@example.com"}}},
+		"header name": {Headers: map[string][]string{"Bcc: victim@example.com\r\nX-Test": {"value"}}},
+		"colon":       {Headers: map[string][]string{"X:Test": {"value"}}},
+	} {
+		if config.Recipients == nil {
+			config.Recipients = []string{"recipient@localhost"}
+		}
+		config.Body = []byte("TEST")
+		if _, err := sendmail.NewEnvelope(&config); err == nil {
+			t.Error("Expected error of header injection with", name)
+		}
+	}
+
+	// Subject is encoded
+	envelope, err = sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"recipient@localhost"},
+		Subject:    "subject\r\nBcc: victim@example.com",
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Header["X-Test"] = []string{"value\r\nBcc: victim@example.com"}
+	if _, err := envelope.GenerateMessage(); err == nil {
+		t.Error("Expected error of header injection")
+	}
+	delete(envelope.Header, "X-Test")
+	msg, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(msg), "Bcc") {
+		t.Errorf("Unexpected Bcc header in message:\n%s", msg)
+	}
+}
+
+func TestEncodeHeaders(t *testing.T) {
+	subject := strings.Repeat("Тема письма ", 10)
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		SenderName: "Отправитель",
+		Subject:    subject,
+		Body:       []byte("To: Иван <recipient@localhost>\r\nX-Note: Заметка\r\n\r\nTEST"),
+		Headers:    map[string][]string{"X-Custom": {"Значение"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envelope.Recipients) != 1 || envelope.Recipients[0] != "recipient@localhost" {
+		t.Error("Expected recipient@localhost got", envelope.Recipients)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := new(mime.WordDecoder)
+	for key, expected := range map[string]string{
+		"Subject":  subject,
+		"X-Note":   "Заметка",
+		"X-Custom": "Значение",
+	} {
+		if decoded, err := decoder.DecodeHeader(msg.Header.Get(key)); err != nil || decoded != expected {
+			t.Errorf("Expected %s %q got %q (%v)", key, expected, decoded, err)
+		}
+	}
+	for key, expected := range map[string]string{
+		"From": "Отправитель",
+		"To":   "Иван",
+	} {
+		if address, err := msg.Header.AddressList(key); err != nil || address[0].Name != expected {
+			t.Errorf("Expected %s name %q got %v (%v)", key, expected, address, err)
+		}
+	}
+	for _, line := range strings.Split(string(message), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Expected folded line got %q", line)
+		}
+		for _, c := range line {
+			if c > 127 {
+				t.Errorf("Unexpected non-ASCII header %q", line)
+				break
+			}
+		}
+		if line == "" {
+			break
+		}
+	}
+}
+
+func TestFoldHeaders(t *testing.T) {
+	var recipients, references []string
+	for i := 0; i < 50; i++ {
+		recipients = append(recipients, fmt.Sprintf("recipient%d@localhost", i))
+		references = append(references, fmt.Sprintf("<%d.reference@localhost>", i))
+	}
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: recipients,
+		Body:       []byte("TEST"),
+		Headers:    map[string][]string{"References": {strings.Join(references, " ")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(message), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Expected folded line got %q", line)
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sendmail.AddressListToSlice(to), recipients) {
+		t.Error("Expected", recipients, "got", sendmail.AddressListToSlice(to))
+	}
+	if msg.Header.Get("References") != strings.Join(references, " ") {
+		t.Error("Unexpected References", msg.Header.Get("References"))
+	}
+
+	envelope.Header["X-Long"] = []string{strings.Repeat("x", 1000)}
+	if _, err := envelope.GenerateMessage(); err == nil {
+		t.Error("Expected error of overlong header line")
+	}
+}
+
+func TestPreserveHeaders(t *testing.T) {
+	header := "Received: from b.example.com by c.example.com;\r\n" +
+		"\tMon, 1 Jan 2024 10:00:01 +0000\r\n" +
+		"Received: from a.example.com by b.example.com; Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256; d=localhost; s=test;\r\n" +
+		"\th=from:to:subject; bh=abc=; b=def=\r\n" +
+		"subject:   Тема\r\n" +
+		"From: sender@localhost\r\n" +
+		"To: recipient@localhost\r\n" +
+		"Bcc: hidden@localhost\r\n"
+	config := sendmail.Config{
+		Body:              []byte(header + "\r\nTEST\r\n"),
+		ExtractRecipients: true,
+		PreserveHeaders:   true,
+	}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := envelope.SetMessageID(); err != nil {
+		t.Fatal(err)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Message-Id: " + envelope.Header.Get("Message-Id") + "\r\n" +
+		strings.Replace(header, "Bcc: hidden@localhost\r\n", "", 1) + "\r\nTEST\r\n"
+	if string(message) != expected {
+		t.Errorf("EXPECTED:\n%s\nGOT:\n%s", expected, message)
+	}
+
+	// The changed header is written in place
+	config.PreserveHeaders = true
+	config.Sender = "other@localhost"
+	envelope, err = sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err = envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(message), "subject:   Тема\r\nFrom: other@localhost\r\nTo: recipient@localhost\r\n\r\n") {
+		t.Errorf("Expected From in place of the original:\n%s", message)
+	}
+
+	// The fields are not joined without preservation
+	config.PreserveHeaders = false
+	envelope, err = sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err = envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(message), "Received: ") != 2 {
+		t.Errorf("Expected 2 Received fields:\n%s", message)
+	}
+}
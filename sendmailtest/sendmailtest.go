@@ -0,0 +1,354 @@
+// Package sendmailtest helps to test the mail flows of applications
+// using the sendmail package without network access. The Server captures
+// the messages received over SMTP, the Transport captures the messages
+// delivered by envelopes, both are checked with the Assert functions.
+package sendmailtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/n0madic/sendmail"
+)
+
+// Message is the captured message with its envelope.
+type Message struct {
+	From string
+	To   []string
+	// Data is the message as transferred.
+	Data []byte
+	// Header and Body of the parsed message, empty if it's malformed.
+	Header mail.Header
+	Body   string
+}
+
+func newMessage(from string, to []string, data []byte) *Message {
+	m := &Message{From: from, To: to, Data: data, Header: mail.Header{}}
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		m.Header = msg.Header
+		body, _ := ioutil.ReadAll(msg.Body)
+		m.Body = string(body)
+	}
+	return m
+}
+
+// HeaderValue return the first value of the header with
+// the RFC 2047 encoded words decoded.
+func (m *Message) HeaderValue(key string) string {
+	value := m.Header.Get(key)
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// HasRecipient reports whether the address is the envelope recipient.
+func (m *Message) HasRecipient(address string) bool {
+	for _, rcpt := range m.To {
+		if strings.EqualFold(rcpt, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Recorder captures the messages.
+type Recorder interface {
+	// Messages return the captured messages in the order of arrival.
+	Messages() []*Message
+}
+
+// capture is the list of the captured messages.
+type capture struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func (c *capture) add(m *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, m)
+}
+
+// Messages return the captured messages in the order of arrival.
+func (c *capture) Messages() []*Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Message(nil), c.messages...)
+}
+
+// Reset forget the captured messages.
+func (c *capture) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = nil
+}
+
+// RejectError is the permanent rejection of the recipient as unknown user.
+func RejectError(address string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "unknown recipient " + address,
+	}
+}
+
+// Server is the SMTP server capturing the received messages in memory.
+type Server struct {
+	capture
+	// Mail, Rcpt and Data check the sender, the recipients and the
+	// message before they are accepted, all are accepted if nil.
+	// Set them before Listen, Reject may be called later.
+	Mail func(from string) error
+	Rcpt func(to string) error
+	Data func(m *Message) error
+
+	checkMu  sync.RWMutex
+	server   *smtp.Server
+	listener net.Listener
+}
+
+// NewServer start the server on a free port of the loopback interface.
+func NewServer() (*Server, error) {
+	return NewServerAt("127.0.0.1:0")
+}
+
+// NewServerAt start the server listening on the address.
+func NewServerAt(addr string) (*Server, error) {
+	s := new(Server)
+	if err := s.Listen(addr); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Listen start the server on the address, it returns when it is listening.
+func (s *Server) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	s.server = smtp.NewServer(backend{s})
+	s.server.Domain = "localhost"
+	s.server.AllowInsecureAuth = true
+	go s.server.Serve(l)
+	return nil
+}
+
+// Addr return host:port of the server for Config.SmartHost.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stop the server.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Reject the recipients with 550 reply, the other are accepted.
+func (s *Server) Reject(addresses ...string) {
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+	s.Rcpt = func(to string) error {
+		for _, address := range addresses {
+			if strings.EqualFold(address, to) {
+				return RejectError(to)
+			}
+		}
+		return nil
+	}
+}
+
+// checks return the checks of the sender, the recipients and the message.
+func (s *Server) checks() (func(string) error, func(string) error, func(*Message) error) {
+	s.checkMu.RLock()
+	defer s.checkMu.RUnlock()
+	return s.Mail, s.Rcpt, s.Data
+}
+
+// backend of the server accepts any login.
+type backend struct {
+	server *Server
+}
+
+func (b backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return &session{server: b.server}, nil
+}
+
+func (b backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &session{server: b.server}, nil
+}
+
+// session collects the envelope of the message.
+type session struct {
+	server *Server
+	from   string
+	to     []string
+}
+
+func (s *session) Mail(from string, opts smtp.MailOptions) error {
+	if check, _, _ := s.server.checks(); check != nil {
+		if err := check(from); err != nil {
+			return err
+		}
+	}
+	s.from = from
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	if _, check, _ := s.server.checks(); check != nil {
+		if err := check(to); err != nil {
+			return err
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m := newMessage(s.from, s.to, data)
+	if _, _, check := s.server.checks(); check != nil {
+		if err := check(m); err != nil {
+			return err
+		}
+	}
+	s.server.add(m)
+	return nil
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+// Transport is the sendmail.Transport capturing the messages
+// instead of delivery.
+type Transport struct {
+	capture
+	// Rcpt checks the recipients, they are delivered if nil.
+	Rcpt func(to string) error
+}
+
+// NewTransport return the transport accepting all recipients.
+func NewTransport() *Transport {
+	return &Transport{}
+}
+
+// Reject the recipients with 550 reply, the other are accepted.
+func (t *Transport) Reject(addresses ...string) {
+	t.Rcpt = func(to string) error {
+		for _, address := range addresses {
+			if strings.EqualFold(address, to) {
+				return RejectError(to)
+			}
+		}
+		return nil
+	}
+}
+
+// Deliver capture the message for the accepted recipients.
+func (t *Transport) Deliver(ctx context.Context, e *sendmail.Envelope) ([]sendmail.RecipientResult, error) {
+	data, err := e.GenerateMessage()
+	if err != nil {
+		return nil, err
+	}
+	var accepted []string
+	results := make([]sendmail.RecipientResult, 0, len(e.Recipients))
+	for _, rcpt := range e.Recipients {
+		result := sendmail.RecipientResult{Recipient: rcpt, Server: "sendmailtest"}
+		if t.Rcpt != nil {
+			result.Err = t.Rcpt(rcpt)
+		}
+		if result.Err == nil {
+			accepted = append(accepted, rcpt)
+		}
+		results = append(results, result)
+	}
+	if len(accepted) > 0 {
+		t.add(newMessage(e.GetSender(), accepted, data))
+	}
+	return results, nil
+}
+
+// AssertCount check the number of the captured messages.
+func AssertCount(t testing.TB, r Recorder, expected int) {
+	t.Helper()
+	if messages := r.Messages(); len(messages) != expected {
+		t.Errorf("Expected %d messages got %d%s", expected, len(messages), summary(messages))
+	}
+}
+
+// AssertSentTo check a message was captured for the recipient,
+// it returns the last such message or nil.
+func AssertSentTo(t testing.TB, r Recorder, address string) *Message {
+	t.Helper()
+	messages := r.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].HasRecipient(address) {
+			return messages[i]
+		}
+	}
+	t.Errorf("Expected message to %s%s", address, summary(messages))
+	return nil
+}
+
+// AssertNotSentTo check no message was captured for the recipient.
+func AssertNotSentTo(t testing.TB, r Recorder, address string) {
+	t.Helper()
+	for _, m := range r.Messages() {
+		if m.HasRecipient(address) {
+			t.Errorf("Unexpected message to %s from %s", address, m.From)
+		}
+	}
+}
+
+// AssertHeader check the decoded value of the message header.
+func AssertHeader(t testing.TB, m *Message, key, expected string) {
+	t.Helper()
+	if m == nil {
+		return
+	}
+	if value := m.HeaderValue(key); value != expected {
+		t.Errorf("Expected %s header %q got %q", key, expected, value)
+	}
+}
+
+// AssertBodyContains check the message body contains the text.
+func AssertBodyContains(t testing.TB, m *Message, text string) {
+	t.Helper()
+	if m == nil {
+		return
+	}
+	if !strings.Contains(m.Body, text) {
+		t.Errorf("Expected %q in message body:\n%s", text, m.Body)
+	}
+}
+
+// summary of the messages for the failure report.
+func summary(messages []*Message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&b, "\n  from %s to %s: %s", m.From, strings.Join(m.To, ","), m.HeaderValue("Subject"))
+	}
+	return b.String()
+}
@@ -0,0 +1,106 @@
+package sendmailtest_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/sendmailtest"
+)
+
+// send the message and return the number of failures.
+func send(t *testing.T, config sendmail.Config, recipients ...string) int {
+	config.Sender = "sender@example.com"
+	config.Recipients = recipients
+	config.Subject = "Привет"
+	config.Body = []byte("TEST")
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for result := range results {
+		if result.Level < sendmail.WarnLevel {
+			failed++
+		}
+	}
+	return failed
+}
+
+func TestServer(t *testing.T) {
+	server, err := sendmailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Reject("unknown@example.com")
+
+	if failed := send(t, sendmail.Config{SmartHost: server.Addr()}, "user@example.com"); failed > 0 {
+		t.Error("Unexpected failures", failed)
+	}
+	if failed := send(t, sendmail.Config{SmartHost: server.Addr()}, "unknown@example.com"); failed == 0 {
+		t.Error("Expected rejection of unknown@example.com")
+	}
+
+	sendmailtest.AssertCount(t, server, 1)
+	msg := sendmailtest.AssertSentTo(t, server, "user@example.com")
+	sendmailtest.AssertHeader(t, msg, "Subject", "Привет")
+	sendmailtest.AssertBodyContains(t, msg, "TEST")
+	sendmailtest.AssertNotSentTo(t, server, "unknown@example.com")
+	if msg != nil && msg.From != "sender@example.com" {
+		t.Error("Expected sender@example.com got", msg.From)
+	}
+
+	server.Reset()
+	sendmailtest.AssertCount(t, server, 0)
+}
+
+func TestServerChecks(t *testing.T) {
+	server := &sendmailtest.Server{
+		Mail: func(from string) error {
+			if from != "sender@example.com" {
+				return errors.New("unknown sender")
+			}
+			return nil
+		},
+		Data: func(m *sendmailtest.Message) error {
+			if m.Header.Get("X-Spam") != "" {
+				return errors.New("spam")
+			}
+			return nil
+		},
+	}
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if failed := send(t, sendmail.Config{SmartHost: server.Addr()}, "user@example.com"); failed > 0 {
+		t.Error("Unexpected failures", failed)
+	}
+	config := sendmail.Config{SmartHost: server.Addr(), Headers: map[string][]string{"X-Spam": {"yes"}}}
+	if failed := send(t, config, "other@example.com"); failed == 0 {
+		t.Error("Expected rejection of spam message")
+	}
+	sendmailtest.AssertCount(t, server, 1)
+	sendmailtest.AssertNotSentTo(t, server, "other@example.com")
+}
+
+func TestTransport(t *testing.T) {
+	transport := sendmailtest.NewTransport()
+	transport.Reject("unknown@example.com")
+
+	if failed := send(t, sendmail.Config{Transport: transport}, "user@example.com", "unknown@example.com"); failed == 0 {
+		t.Error("Expected rejection of unknown@example.com")
+	}
+
+	sendmailtest.AssertCount(t, transport, 1)
+	msg := sendmailtest.AssertSentTo(t, transport, "user@example.com")
+	sendmailtest.AssertHeader(t, msg, "Subject", "Привет")
+	sendmailtest.AssertHeader(t, msg, "From", "sender@example.com")
+	sendmailtest.AssertNotSentTo(t, transport, "unknown@example.com")
+}
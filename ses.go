@@ -0,0 +1,235 @@
+package sendmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TransportSES is the name of Amazon SES transport.
+const TransportSES = "ses"
+
+func init() {
+	RegisterTransport(TransportSES, func(relay RelayConfig) (Transport, error) {
+		t := &SESTransport{
+			Region:          relay.Region,
+			AccessKeyID:     relay.AccessKeyID,
+			SecretAccessKey: relay.SecretAccessKey,
+			Endpoint:        relay.Endpoint,
+		}
+		if _, err := t.credentials(); err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
+// SESTransport submits the message with SendRawEmail action
+// of Amazon SES API over HTTPS.
+type SESTransport struct {
+	// Region of SES, AWS_REGION env if empty.
+	Region string
+	// AccessKeyID and SecretAccessKey of the credentials,
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env if empty.
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken of temporary credentials, AWS_SESSION_TOKEN env if empty.
+	SessionToken string
+	// Endpoint URL of the API, https://email.<region>.amazonaws.com by default.
+	Endpoint string
+	// HTTPClient for the API requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// sesCredentials are the options of the transport resolved
+// with the environment.
+type sesCredentials struct {
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// credentials return the options with the ones not set from the
+// environment, the transport itself is not changed as it's shared
+// by concurrent deliveries.
+func (t *SESTransport) credentials() (*sesCredentials, error) {
+	env := func(value, name string) string {
+		if value == "" {
+			return os.Getenv(name)
+		}
+		return value
+	}
+	c := &sesCredentials{
+		region:          env(t.Region, "AWS_REGION"),
+		accessKeyID:     env(t.AccessKeyID, "AWS_ACCESS_KEY_ID"),
+		secretAccessKey: env(t.SecretAccessKey, "AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    env(t.SessionToken, "AWS_SESSION_TOKEN"),
+	}
+	if c.region == "" {
+		return nil, errors.New("ses: region is not set")
+	}
+	if c.accessKeyID == "" || c.secretAccessKey == "" {
+		return nil, errors.New("ses: credentials are not set")
+	}
+	return c, nil
+}
+
+// sesError is the error response of SES API.
+type sesError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// Deliver the message with SendRawEmail, SES accepts or refuses
+// it for all recipients at once.
+func (t *SESTransport) Deliver(ctx context.Context, e *Envelope) ([]RecipientResult, error) {
+	creds, err := t.credentials()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := e.GenerateMessage()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = "https://email." + creds.region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("ses: invalid endpoint: %s", err)
+	}
+	if e.dryRun {
+		return recipientResults(e.Recipients, u.Host, nil), nil
+	}
+
+	form := url.Values{}
+	form.Set("Action", "SendRawEmail")
+	form.Set("Version", "2010-12-01")
+	form.Set("Source", e.GetSender())
+	for i, rcpt := range e.Recipients {
+		form.Set("Destinations.member."+strconv.Itoa(i+1), rcpt)
+	}
+	form.Set("RawMessage.Data", base64.StdEncoding.EncodeToString(msg))
+	body := []byte(form.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	signV4(req, body, creds.region, "ses", creds.accessKeyID, creds.secretAccessKey, time.Now())
+
+	client := t.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr sesError
+		if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			err = fmt.Errorf("ses: %s: %s", apiErr.Code, apiErr.Message)
+		} else {
+			err = fmt.Errorf("ses: %s", resp.Status)
+		}
+		return recipientResults(e.Recipients, u.Host, err), nil
+	}
+	return recipientResults(e.Recipients, u.Host, nil), nil
+}
+
+// recipientResults return the same outcome for all recipients.
+func recipientResults(recipients []string, server string, err error) []RecipientResult {
+	results := make([]RecipientResult, 0, len(recipients))
+	for _, rcpt := range recipients {
+		results = append(results, RecipientResult{rcpt, err, server})
+	}
+	return results
+}
+
+// signV4 sign the request with AWS Signature Version 4.
+// The signed headers are Host, X-Amz-Date and the set Content-Type
+// and X-Amz-Security-Token.
+func signV4(req *http.Request, body []byte, region, service, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{
+		"host":       req.URL.Host,
+		"x-amz-date": amzDate,
+	}
+	for _, name := range []string{"Content-Type", "X-Amz-Security-Token"} {
+		if value := req.Header.Get(name); value != "" {
+			headers[strings.ToLower(name)] = strings.TrimSpace(value)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
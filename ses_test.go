@@ -0,0 +1,154 @@
+package sendmail_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestSESTransport(t *testing.T) {
+	var raw string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/ses/aws4_request") {
+			t.Error("Unexpected authorization", r.Header.Get("Authorization"))
+		}
+		r.ParseForm()
+		if r.Form.Get("Action") != "SendRawEmail" || r.Form.Get("Destinations.member.1") != "user@example.com" {
+			t.Error("Unexpected request", r.Form)
+		}
+		data, _ := base64.StdEncoding.DecodeString(r.Form.Get("RawMessage.Data"))
+		raw = string(data)
+		if strings.Contains(raw, "rejected") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<ErrorResponse><Error><Code>MessageRejected</Code><Message>Email address is not verified.</Message></Error></ErrorResponse>`))
+			return
+		}
+		w.Write([]byte(`<SendRawEmailResponse><SendRawEmailResult><MessageId>0001</MessageId></SendRawEmailResult></SendRawEmailResponse>`))
+	}))
+	defer server.Close()
+
+	transport := &sendmail.SESTransport{
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		Endpoint:        server.URL,
+	}
+	for body, ok := range map[string]bool{"TEST": true, "rejected": false} {
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Sender:     "sender@example.com",
+			Recipients: []string{"user@example.com"},
+			Body:       []byte(body),
+			Transport:  transport,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := envelope.Send()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for result := range results {
+			if ok && result.Level < sendmail.WarnLevel {
+				t.Error(result.Error)
+			}
+			if !ok && (result.Level != sendmail.ErrorLevel || !strings.Contains(result.Error.Error(), "MessageRejected")) {
+				t.Error("Expected MessageRejected error got", result.Error)
+			}
+		}
+		if !strings.Contains(raw, body) {
+			t.Error("Expected raw message with body", body)
+		}
+	}
+}
+
+func TestSESTransportEnv(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=ENVKEY/") {
+			t.Error("Unexpected authorization", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`<SendRawEmailResponse/>`))
+	}))
+	defer server.Close()
+
+	for name, value := range map[string]string{
+		"AWS_REGION":            "eu-west-1",
+		"AWS_ACCESS_KEY_ID":     "ENVKEY",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	// The transport is shared by the concurrent deliveries
+	transport := &sendmail.SESTransport{Endpoint: server.URL}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+				Sender:     "sender@example.com",
+				Recipients: []string{"user@example.com"},
+				Body:       []byte("TEST"),
+				Transport:  transport,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results, err := envelope.Send()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for result := range results {
+				if result.Level < sendmail.WarnLevel {
+					t.Error(result.Error)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if transport.Region != "" || transport.AccessKeyID != "" {
+		t.Error("Expected options of transport unchanged got", transport.Region, transport.AccessKeyID)
+	}
+}
+
+// TestSignV4 check the signatures of AWS Signature Version 4 test suite.
+func TestSignV4(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name, method, contentType, body string
+		signature                       string
+	}{
+		{"get-vanilla", "GET", "", "", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"post-vanilla", "POST", "", "", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"post-x-www-form-urlencoded", "POST", "application/x-www-form-urlencoded", "Param1=value1", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+	} {
+		req, err := http.NewRequest(tc.method, "https://example.amazonaws.com/", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		sendmail.SignV4(req, []byte(tc.body), "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now)
+		if authorization := req.Header.Get("Authorization"); authorization != tc.signature {
+			t.Errorf("%s: expected %s got %s", tc.name, tc.signature, authorization)
+		}
+		if date := req.Header.Get("X-Amz-Date"); date != "20150830T123600Z" {
+			t.Errorf("%s: expected X-Amz-Date 20150830T123600Z got %s", tc.name, date)
+		}
+	}
+}
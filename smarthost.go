@@ -1,51 +1,169 @@
 package sendmail
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
 	"net/smtp"
 	"strings"
-
-	nvsmtp "github.com/n0madic/sendmail/smtp-noverify"
+	"time"
 )
 
 // SendSmarthost message delivery through an external mail server.
 func (e *Envelope) SendSmarthost(smarthost, login, password string) <-chan Result {
-	results := make(chan Result, len(e.Recipients))
-	host, _, err := net.SplitHostPort(smarthost)
+	return e.SendRelay(RelayConfig{
+		Host:     smarthost,
+		Login:    login,
+		Password: password,
+	})
+}
+
+// SendSmarthostAuth message delivery through an external mail server
+// with the authentication mechanism, nil for anonymous delivery.
+func (e *Envelope) SendSmarthostAuth(smarthost string, auth smtp.Auth) <-chan Result {
+	return e.sendRelay(context.Background(), RelayConfig{Host: smarthost}, auth)
+}
+
+// SendRelay message delivery through an external mail server
+// with the relay options.
+func (e *Envelope) SendRelay(relay RelayConfig) <-chan Result {
+	return e.sendRelay(context.Background(), relay, relay.auth())
+}
+
+// auth return the authentication with the relay login, nil without it.
+func (r RelayConfig) auth() smtp.Auth {
+	if r.Login == "" || r.Password == "" {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(r.Address())
+	switch strings.ToLower(r.Auth) {
+	case "login":
+		return LoginAuth(r.Login, r.Password, host)
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(r.Login, r.Password)
+	default:
+		return smtp.PlainAuth("", r.Login, r.Password, host)
+	}
+}
+
+// tlsConfig return the TLS configuration of the session to the relay,
+// the pinned certificates replace the CA verification.
+func (r RelayConfig) tlsConfig(host string) *tls.Config {
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: !r.TLSVerify,
+	}
+	if len(r.TLSPins) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = r.verifyPins
+	}
+	return config
+}
+
+// tlsMode return the TLS mode of the relay,
+// STARTTLS is required with the pinned certificates.
+func (r RelayConfig) tlsMode() string {
+	if len(r.TLSPins) > 0 && r.TLS == TLSOpportunistic {
+		return TLSStartTLS
+	}
+	return r.TLS
+}
+
+// verifyPins check the server certificate against the pins.
+func (r RelayConfig) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("relay sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
 	if err != nil {
+		return err
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	fingerprint := sha256.Sum256(cert.Raw)
+	for _, pin := range r.TLSPins {
+		key, hash, err := parseTLSPin(pin)
+		if err != nil {
+			return err
+		}
+		if key && bytes.Equal(hash, spki[:]) || !key && bytes.Equal(hash, fingerprint[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("relay certificate sha256/%s is not pinned",
+		base64.StdEncoding.EncodeToString(spki[:]))
+}
+
+// parseTLSPin return the hash of the pin, key is true for public key hash.
+func parseTLSPin(pin string) (key bool, hash []byte, err error) {
+	if strings.HasPrefix(pin, "sha256/") {
+		key = true
+		hash, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	} else {
+		hash, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	}
+	if err != nil || len(hash) != sha256.Size {
+		return false, nil, fmt.Errorf("invalid relay TLS pin %q, expected sha256/<base64> key hash or hex SHA-256 fingerprint", pin)
+	}
+	return key, hash, nil
+}
+
+func (e *Envelope) sendRelay(ctx context.Context, relay RelayConfig, auth smtp.Auth) <-chan Result {
+	results := make(chan Result, len(e.Recipients))
+	smarthost := relay.Address()
+	if err := relay.Validate(); err != nil {
 		results <- Result{FatalLevel, err, "Smarthost", Fields{
 			"smarthost": smarthost,
 		}}
-	} else {
-		// Set up authentication information.
-		var auth smtp.Auth
-		if login != "" && password != "" {
-			auth = smtp.PlainAuth("", login, password, host)
+		close(results)
+		return results
+	}
+	host, _, _ := net.SplitHostPort(smarthost)
+	generatedBody, err := e.GenerateMessage()
+	if err != nil {
+		results <- Result{FatalLevel, err, "Generate message", nil}
+		close(results)
+		return results
+	}
+	fields := Fields{
+		"sender":     e.GetSender(),
+		"smarthost":  smarthost,
+		"recipients": strings.Join(e.Recipients, ","),
+	}
+	opts := sessionOptions{
+		auth:       auth,
+		tlsConfig:  relay.tlsConfig(host),
+		tlsMode:    relay.tlsMode(),
+		requireTLS: e.RequireTLS,
+		helo:       relay.Helo,
+		timeouts:   relay.Timeouts.Or(uniformTimeouts(relay.Timeout)).Or(e.timeouts()),
+		resolver:   e.resolver(),
+		family:     e.AddressFamily,
+	}
+	go func() {
+		// Connect to the server, authenticate, set the sender and recipient,
+		// and send the email all in one step.
+		start := time.Now()
+		recipients := e.Recipients
+		sent, err := e.sendMail(ctx, smarthost, opts,
+			e.reversePath(),
+			recipients,
+			generatedBody)
+		for _, chunk := range sent {
+			results <- Result{InfoLevel, nil, e.successMessage(), e.attemptFields(chunkFields(fields, chunk), start, nil)}
+			recipients = recipients[len(chunk):]
 		}
-		generatedBody, err := e.GenerateMessage()
-		if err != nil {
-			results <- Result{FatalLevel, err, "Generate message", nil}
-		} else {
-			fields := Fields{
-				"sender":     e.GetSender(),
-				"smarthost":  smarthost,
-				"recipients": strings.Join(e.Recipients, ","),
-			}
-			go func() {
-				// Connect to the server, authenticate, set the sender and recipient,
-				// and send the email all in one step.
-				err := nvsmtp.SendMail(smarthost, auth,
-					e.GetSender(),
-					e.Recipients,
-					generatedBody)
-				if err == nil {
-					results <- Result{InfoLevel, nil, "Send mail OK", fields}
-				} else {
-					results <- Result{ErrorLevel, err, "", fields}
-				}
-				close(results)
-			}()
+		if err != nil && len(recipients) > 0 {
+			fields["recipients"] = strings.Join(recipients, ",")
+			results <- Result{ErrorLevel, err, "", e.attemptFields(fields, start, err)}
 		}
-	}
+		close(results)
+	}()
 	return results
 }
@@ -1,14 +1,25 @@
 package sendmail_test
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/sendmailtest"
 	"github.com/n0madic/sendmail/test"
 )
 
 func TestSendSmarthost(t *testing.T) {
-	go test.StartSMTP()
+	test.StartSMTP()
 
 	for _, config := range testConfigs {
 		envelope, err := sendmail.NewEnvelope(&config.initial)
@@ -24,3 +35,106 @@ func TestSendSmarthost(t *testing.T) {
 		}
 	}
 }
+
+func TestSendSmarthostConfig(t *testing.T) {
+	test.StartSMTP()
+
+	config := testConfigs[0].initial
+	config.SmartHost = "localhost:" + test.PortSMTP
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := envelope.SetMessageID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range errs {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+		if result.Fields["code"] != 250 || result.Fields["message_id"] != id {
+			t.Error("Expected code and message ID fields got", result.Fields)
+		}
+		if _, ok := result.Fields["duration"].(time.Duration); !ok {
+			t.Error("Expected duration field got", result.Fields)
+		}
+	}
+}
+
+// tlsProxy terminates implicit TLS in front of the SMTP server.
+func tlsProxy(t *testing.T, addr string) (string, *x509.Certificate) {
+	srv := httptest.NewTLSServer(nil)
+	config, cert := srv.TLS.Clone(), srv.Certificate()
+	srv.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(backend, conn)
+				backend.Close()
+			}()
+			go func() {
+				io.Copy(conn, backend)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), cert
+}
+
+func TestSendRelayTLSPins(t *testing.T) {
+	server, err := sendmailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	addr, cert := tlsProxy(t, server.Addr())
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	fingerprint := sha256.Sum256(cert.Raw)
+	other := sha256.Sum256([]byte("other"))
+
+	for _, tc := range []struct {
+		pin       string
+		delivered bool
+	}{
+		{"sha256/" + base64.StdEncoding.EncodeToString(spki[:]), true},
+		{strings.ToUpper(hex.EncodeToString(fingerprint[:])), true},
+		{"sha256/" + base64.StdEncoding.EncodeToString(other[:]), false},
+	} {
+		envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay := sendmail.RelayConfig{Host: addr, TLS: sendmail.TLSImplicit, TLSPins: []string{tc.pin}}
+		for result := range envelope.SendRelay(relay) {
+			if delivered := result.Level == sendmail.InfoLevel; delivered != tc.delivered {
+				t.Errorf("Pin %s: expected delivered %v got %v", tc.pin, tc.delivered, result.Error)
+			}
+		}
+	}
+
+	for _, pin := range []string{"sha256/short", "not-hex"} {
+		relay := sendmail.RelayConfig{Host: "smtp.example.com", TLSPins: []string{pin}}
+		if err := relay.Validate(); err == nil {
+			t.Error("Expected validation error of pin", pin)
+		}
+	}
+}
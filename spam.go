@@ -0,0 +1,247 @@
+package sendmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSpamTimeout limits the check of the message by the spam filter.
+const DefaultSpamTimeout = 30 * time.Second
+
+// Actions of the spam filter.
+const (
+	SpamNoAction       = "no action"
+	SpamGreylist       = "greylist"
+	SpamAddHeader      = "add header"
+	SpamRewriteSubject = "rewrite subject"
+	SpamSoftReject     = "soft reject"
+	SpamReject         = "reject"
+)
+
+// SpamFilter checks the messages with rspamd or SpamAssassin spamd before
+// the delivery. The rejected messages are refused, the spam is marked
+// with X-Spam headers.
+type SpamFilter struct {
+	// URL of rspamd worker (http://localhost:11333)
+	// or spamd (spamd://localhost:783), empty to not check.
+	URL string `yaml:"url,omitempty"`
+	// RejectScore of spamd, the spam with the higher score is rejected,
+	// otherwise it is marked. Never rejected if 0, rspamd chooses the action itself.
+	RejectScore float64 `yaml:"reject_score,omitempty"`
+	// Timeout of the check, DefaultSpamTimeout if 0.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// SpamError is the refusal of the message by the spam filter.
+type SpamError struct {
+	Action    string
+	Score     float64
+	Threshold float64
+}
+
+func (e *SpamError) Error() string {
+	return fmt.Sprintf("spam filter action %s (score %.2f / %.2f)", e.Action, e.Score, e.Threshold)
+}
+
+// Temporary reports whether the message may be accepted later (greylisting).
+func (e *SpamError) Temporary() bool {
+	return e.Action == SpamGreylist || e.Action == SpamSoftReject
+}
+
+// Enabled reports whether the messages are checked.
+func (f *SpamFilter) Enabled() bool {
+	return f != nil && f.URL != ""
+}
+
+// Or return the filter with the fields not set taken from d.
+func (f SpamFilter) Or(d SpamFilter) SpamFilter {
+	if f.URL == "" {
+		f.URL = d.URL
+	}
+	if f.RejectScore == 0 {
+		f.RejectScore = d.RejectScore
+	}
+	if f.Timeout == 0 {
+		f.Timeout = d.Timeout
+	}
+	return f
+}
+
+// Validate check the filter URL.
+func (f SpamFilter) Validate() error {
+	if f.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return fmt.Errorf("invalid spam filter URL %q: %s", f.URL, err)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "spamd":
+		return fmt.Errorf("invalid spam filter URL %q, expected http, https or spamd scheme", f.URL)
+	case u.Host == "":
+		return fmt.Errorf("invalid spam filter URL %q without host", f.URL)
+	case f.RejectScore < 0 || f.Timeout < 0:
+		return errors.New("invalid spam filter reject score or timeout")
+	}
+	return nil
+}
+
+// Check the message of the envelope, it is the middleware refusing
+// the rejected and greylisted messages. The spam is marked with
+// X-Spam and X-Spam-Score headers, rspamd may rewrite the subject.
+func (f *SpamFilter) Check(ctx context.Context, e *Envelope) error {
+	if !f.Enabled() {
+		return nil
+	}
+	message, err := e.GenerateMessage()
+	if err != nil {
+		return err
+	}
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = DefaultSpamTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var verdict *spamVerdict
+	if strings.HasPrefix(f.URL, "spamd:") {
+		verdict, err = f.spamd(ctx, message)
+	} else {
+		verdict, err = f.rspamd(ctx, e, message)
+	}
+	if err != nil {
+		return temporaryError{fmt.Errorf("spam filter failed: %s", err)}
+	}
+
+	switch verdict.Action {
+	case SpamReject, SpamSoftReject, SpamGreylist:
+		return &SpamError{verdict.Action, verdict.Score, verdict.Threshold}
+	case SpamRewriteSubject:
+		subject := verdict.Subject
+		if subject == "" {
+			subject = "*** SPAM *** " + e.Header.Get("Subject")
+		}
+		e.Header["Subject"] = []string{subject}
+		fallthrough
+	case SpamAddHeader:
+		e.Header["X-Spam"] = []string{"Yes"}
+		e.Header["X-Spam-Score"] = []string{fmt.Sprintf("%.2f / %.2f", verdict.Score, verdict.Threshold)}
+	}
+	return nil
+}
+
+// spamVerdict is the outcome of the check.
+type spamVerdict struct {
+	Action    string  `json:"action"`
+	Score     float64 `json:"score"`
+	Threshold float64 `json:"required_score"`
+	Subject   string  `json:"subject"`
+}
+
+// rspamd check the message with /checkv2 endpoint of the worker.
+func (f *SpamFilter) rspamd(ctx context.Context, e *Envelope, message []byte) (*spamVerdict, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(f.URL, "/")+"/checkv2", bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("From", e.GetSender())
+	for _, rcpt := range e.Recipients {
+		req.Header.Add("Rcpt", rcpt)
+	}
+	if id := e.Header.Get("Message-Id"); id != "" {
+		req.Header.Set("Queue-Id", id)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd status %s", resp.Status)
+	}
+	verdict := &spamVerdict{}
+	if err := json.NewDecoder(resp.Body).Decode(verdict); err != nil {
+		return nil, fmt.Errorf("invalid rspamd reply: %s", err)
+	}
+	return verdict, nil
+}
+
+// spamd check the message with CHECK command of SPAMC protocol,
+// the spam is rejected over RejectScore.
+func (f *SpamFilter) spamd(ctx context.Context, message []byte) (*spamVerdict, error) {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	fmt.Fprintf(conn, "CHECK SPAMC/1.5\r\nContent-length: %d\r\n\r\n", len(message))
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(status); len(fields) < 3 || fields[1] != "0" {
+		return nil, fmt.Errorf("spamd reply %q", strings.TrimSpace(status))
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return nil, errors.New("spamd reply without Spam header")
+		}
+		// Spam: True ; 15.0 / 5.0
+		name, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			name, value = line[:i], line[i+1:]
+		}
+		if !strings.EqualFold(name, "Spam") {
+			continue
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '/' })
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid spamd Spam header %q", value)
+		}
+		verdict := &spamVerdict{Action: SpamNoAction}
+		spam := strings.TrimSpace(parts[0])
+		if verdict.Score, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+			return nil, fmt.Errorf("invalid spamd score %q", parts[1])
+		}
+		if verdict.Threshold, err = strconv.ParseFloat(strings.TrimSpace(parts[2]), 64); err != nil {
+			return nil, fmt.Errorf("invalid spamd threshold %q", parts[2])
+		}
+		if strings.EqualFold(spam, "True") || strings.EqualFold(spam, "Yes") {
+			verdict.Action = SpamAddHeader
+			if f.RejectScore > 0 && verdict.Score >= f.RejectScore {
+				verdict.Action = SpamReject
+			}
+		}
+		return verdict, nil
+	}
+}
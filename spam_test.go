@@ -0,0 +1,135 @@
+package sendmail_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+func spamEnvelope(t *testing.T) sendmail.Envelope {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@example.com",
+		Recipients: []string{"user@example.com"},
+		Subject:    "Offer",
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+func TestSpamFilterRspamd(t *testing.T) {
+	var action string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/checkv2" || r.Header.Get("From") != "sender@example.com" ||
+			r.Header.Get("Rcpt") != "user@example.com" || !strings.Contains(string(body), "TEST") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"action":%q,"score":9.5,"required_score":15,"subject":"[SPAM] Offer"}`, action)
+	}))
+	defer server.Close()
+	filter := &sendmail.SpamFilter{URL: server.URL}
+
+	for _, tc := range []struct {
+		action    string
+		refused   bool
+		temporary bool
+		subject   string
+		marked    bool
+	}{
+		{sendmail.SpamNoAction, false, false, "Offer", false},
+		{sendmail.SpamAddHeader, false, false, "Offer", true},
+		{sendmail.SpamRewriteSubject, false, false, "[SPAM] Offer", true},
+		{sendmail.SpamGreylist, true, true, "Offer", false},
+		{sendmail.SpamSoftReject, true, true, "Offer", false},
+		{sendmail.SpamReject, true, false, "Offer", false},
+	} {
+		action = tc.action
+		envelope := spamEnvelope(t)
+		err := filter.Check(context.Background(), &envelope)
+		var spam *sendmail.SpamError
+		if errors.As(err, &spam) != tc.refused {
+			t.Errorf("Action %s: unexpected result %v", tc.action, err)
+			continue
+		}
+		if tc.refused {
+			if spam.Temporary() != tc.temporary || spam.Score != 9.5 {
+				t.Errorf("Action %s: unexpected refusal %#v", tc.action, spam)
+			}
+			continue
+		}
+		if subject := envelope.Header.Get("Subject"); subject != tc.subject {
+			t.Errorf("Action %s: expected subject %q got %q", tc.action, tc.subject, subject)
+		}
+		if marked := envelope.Header.Get("X-Spam") == "Yes"; marked != tc.marked {
+			t.Errorf("Action %s: expected X-Spam %v got %v", tc.action, tc.marked, marked)
+		}
+	}
+}
+
+func TestSpamFilterSpamd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			line, _ := reader.ReadString('\n')
+			if strings.HasPrefix(line, "CHECK SPAMC/") {
+				fmt.Fprint(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: True ; 12.0 / 5.0\r\n\r\n")
+			}
+			conn.Close()
+		}
+	}()
+
+	envelope := spamEnvelope(t)
+	filter := &sendmail.SpamFilter{URL: "spamd://" + l.Addr().String()}
+	if err := filter.Check(context.Background(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Header.Get("X-Spam") != "Yes" || envelope.Header.Get("X-Spam-Score") != "12.00 / 5.00" {
+		t.Error("Expected spam headers got", envelope.Header)
+	}
+
+	envelope = spamEnvelope(t)
+	filter.RejectScore = 10
+	var spam *sendmail.SpamError
+	if err := filter.Check(context.Background(), &envelope); !errors.As(err, &spam) || spam.Temporary() {
+		t.Error("Expected rejection got", err)
+	}
+}
+
+func TestSpamFilterUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	envelope := spamEnvelope(t)
+	envelope.Middleware = []sendmail.Middleware{(&sendmail.SpamFilter{URL: "http://" + addr}).Check}
+	_, err = envelope.Send()
+	var refused *sendmail.RefusedError
+	if !errors.As(err, &refused) || !refused.Temporary() {
+		t.Error("Expected temporary refusal got", err)
+	}
+}
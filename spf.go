@@ -0,0 +1,232 @@
+package sendmail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Results of SPF evaluation (RFC 7208 section 2.6).
+const (
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+)
+
+// spfLookupLimit is the maximum of DNS querying mechanisms (RFC 7208 section 4.6.4).
+const spfLookupLimit = 10
+
+var errSPFLookupLimit = errors.New("spf: too many DNS lookups")
+
+// lookupSPF return the SPF record of domain, empty if there is none.
+func lookupSPF(ctx context.Context, resolver Resolver, domain string) (string, error) {
+	txt, err := resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	var records []string
+	for _, record := range txt {
+		if record == "v=spf1" || strings.HasPrefix(strings.ToLower(record), "v=spf1 ") {
+			records = append(records, record)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	}
+	return "", errors.New("spf: multiple records of " + domain)
+}
+
+// checkSPF evaluate the SPF record of domain for the client ip.
+// Macros and the ptr mechanism are not supported and never match.
+func checkSPF(ctx context.Context, resolver Resolver, ip net.IP, domain string) (string, error) {
+	lookups := 0
+	return evalSPF(ctx, resolver, ip, domain, &lookups)
+}
+
+func evalSPF(ctx context.Context, resolver Resolver, ip net.IP, domain string, lookups *int) (string, error) {
+	record, err := lookupSPF(ctx, resolver, domain)
+	if err != nil {
+		if _, ok := err.(*net.DNSError); ok {
+			return SPFTempError, err
+		}
+		return SPFPermError, err
+	}
+	if record == "" {
+		return SPFNone, nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		term = strings.ToLower(term)
+		if strings.HasPrefix(term, "redirect=") {
+			redirect = strings.TrimPrefix(term, "redirect=")
+			continue
+		}
+		if strings.Contains(term, "=") {
+			// Unknown modifiers are ignored
+			continue
+		}
+		result := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = SPFFail, term[1:]
+		case '~':
+			result, term = SPFSoftFail, term[1:]
+		case '?':
+			result, term = SPFNeutral, term[1:]
+		}
+		match, err := matchSPF(ctx, resolver, ip, domain, term, lookups)
+		if err != nil {
+			if _, ok := err.(*net.DNSError); ok {
+				return SPFTempError, err
+			}
+			return SPFPermError, err
+		}
+		if match {
+			return result, nil
+		}
+	}
+	if redirect != "" {
+		if *lookups++; *lookups > spfLookupLimit {
+			return SPFPermError, errSPFLookupLimit
+		}
+		result, err := evalSPF(ctx, resolver, ip, redirect, lookups)
+		if result == SPFNone {
+			return SPFPermError, errors.New("spf: no record of redirect domain " + redirect)
+		}
+		return result, err
+	}
+	return SPFNeutral, nil
+}
+
+// matchSPF reports whether the ip matches the mechanism.
+func matchSPF(ctx context.Context, resolver Resolver, ip net.IP, domain, mechanism string, lookups *int) (bool, error) {
+	name, arg := mechanism, ""
+	if i := strings.IndexAny(mechanism, ":/"); i >= 0 {
+		name, arg = mechanism[:i], mechanism[i:]
+	}
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		cidr := strings.TrimPrefix(arg, ":")
+		if !strings.Contains(cidr, "/") {
+			if name == "ip4" {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, errors.New("spf: invalid " + mechanism)
+		}
+		return network.Contains(ip), nil
+	case "include":
+		if *lookups++; *lookups > spfLookupLimit {
+			return false, errSPFLookupLimit
+		}
+		result, err := evalSPF(ctx, resolver, ip, strings.TrimPrefix(arg, ":"), lookups)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFTempError, SPFPermError:
+			return false, err
+		case SPFNone:
+			return false, errors.New("spf: no record of included domain " + strings.TrimPrefix(arg, ":"))
+		}
+		return false, nil
+	case "a", "mx", "exists":
+		if *lookups++; *lookups > spfLookupLimit {
+			return false, errSPFLookupLimit
+		}
+		target, ip4Mask, ip6Mask, err := parseSPFTarget(domain, arg)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := resolver.LookupMX(ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, err
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return false, err
+			}
+			if name == "exists" && len(addrs) > 0 {
+				return true, nil
+			}
+			for _, addr := range addrs {
+				mask := net.CIDRMask(ip6Mask, 128)
+				if addr.IP.To4() != nil {
+					mask = net.CIDRMask(ip4Mask, 32)
+				}
+				if addr.IP.Mask(mask).Equal(ip.Mask(mask)) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "ptr":
+		return false, nil
+	}
+	return false, errors.New("spf: unknown mechanism " + mechanism)
+}
+
+// parseSPFTarget parse ":domain/ip4-cidr//ip6-cidr" argument of mechanism.
+func parseSPFTarget(domain, arg string) (string, int, int, error) {
+	target, ip4Mask, ip6Mask := domain, 32, 128
+	if strings.HasPrefix(arg, ":") {
+		arg = arg[1:]
+		i := strings.Index(arg, "/")
+		if i < 0 {
+			i = len(arg)
+		}
+		target, arg = arg[:i], arg[i:]
+	}
+	if i := strings.Index(arg, "//"); i >= 0 {
+		mask, err := strconv.Atoi(arg[i+2:])
+		if err != nil || mask > 128 {
+			return "", 0, 0, errors.New("spf: invalid ip6 cidr length " + arg)
+		}
+		ip6Mask, arg = mask, arg[:i]
+	}
+	if strings.HasPrefix(arg, "/") {
+		mask, err := strconv.Atoi(arg[1:])
+		if err != nil || mask > 32 {
+			return "", 0, 0, errors.New("spf: invalid ip4 cidr length " + arg)
+		}
+		ip4Mask = mask
+	}
+	return target, ip4Mask, ip6Mask, nil
+}
+
+// isNotFound reports whether the error is NXDOMAIN or no data answer.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
@@ -0,0 +1,206 @@
+package sendmail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirQueueStore is the filesystem spool of the queue, the default store.
+// Every message is stored as two files: <id>.msg with the generated
+// message and <id>.json with the envelope information, the claimed
+// entries have <id>.lock file. The processes of one host may share it.
+type DirQueueStore struct {
+	Dir string
+
+	owner     string
+	ownerOnce sync.Once
+}
+
+// NewDirQueueStore return the spool in the directory, creating it if needed.
+func NewDirQueueStore(dir string) (*DirQueueStore, error) {
+	if dir == "" {
+		dir = DefaultQueueDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirQueueStore{Dir: dir}, nil
+}
+
+// Add store the new entry with the message.
+func (s *DirQueueStore) Add(entry *QueueEntry, message []byte) error {
+	// The message must be in place before the entry makes it visible.
+	if err := writeFileAtomic(s.path(entry.ID, ".msg"), message); err != nil {
+		return err
+	}
+	if err := s.Save(entry); err != nil {
+		os.Remove(s.path(entry.ID, ".msg"))
+		return err
+	}
+	return nil
+}
+
+// Save update the stored entry.
+func (s *DirQueueStore) Save(entry *QueueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(entry.ID, ".json"), data)
+}
+
+// Load return the entry by ID.
+func (s *DirQueueStore) Load(id string) (*QueueEntry, error) {
+	data, err := ioutil.ReadFile(s.path(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	entry := new(QueueEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("invalid queue entry %s: %s", id, err)
+	}
+	return entry, nil
+}
+
+// Message return the message of the entry.
+func (s *DirQueueStore) Message(id string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(id, ".msg"))
+}
+
+// Entries return all stored entries, the unreadable entries are skipped
+// and reported with QueueEntriesError.
+func (s *DirQueueStore) Entries() ([]*QueueEntry, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*QueueEntry
+	var invalid QueueEntriesError
+	for _, file := range files {
+		entry, err := s.Load(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if os.IsNotExist(err) {
+			// Removed by another process meanwhile
+			continue
+		}
+		if err != nil {
+			invalid.Errs = append(invalid.Errs, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(invalid.Errs) > 0 {
+		return entries, &invalid
+	}
+	return entries, nil
+}
+
+// Remove delete the entry, its message and its claim.
+func (s *DirQueueStore) Remove(id string) error {
+	if err := os.Remove(s.path(id, ".json")); err != nil {
+		return err
+	}
+	os.Remove(s.path(id, ".lock"))
+	return os.Remove(s.path(id, ".msg"))
+}
+
+// Claim lock the entry for the delivery until the time with the lock
+// file, the expired claim of the crashed process is taken over.
+func (s *DirQueueStore) Claim(id string, until time.Time) (bool, error) {
+	if _, err := os.Stat(s.path(id, ".json")); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	lock := s.path(id, ".lock")
+	// The lock is linked in place with its content, so it is never
+	// seen partially written
+	tmp := lock + "." + s.lockOwner()
+	if err := ioutil.WriteFile(tmp, []byte(s.lockOwner()+" "+until.Format(time.RFC3339Nano)), 0600); err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(tmp, lock)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		_, expiry, err := s.readLock(id)
+		if os.IsNotExist(err) {
+			// Released meanwhile
+			continue
+		}
+		if err == nil && time.Now().Before(expiry) {
+			return false, nil
+		}
+		os.Remove(lock)
+	}
+	return false, nil
+}
+
+// Release unlock the entry claimed by this store.
+func (s *DirQueueStore) Release(id string) error {
+	owner, _, err := s.readLock(id)
+	if os.IsNotExist(err) || err == nil && owner != s.lockOwner() {
+		return nil
+	}
+	return os.Remove(s.path(id, ".lock"))
+}
+
+// readLock return the owner and the expiry of the claim.
+func (s *DirQueueStore) readLock(id string) (string, time.Time, error) {
+	data, err := ioutil.ReadFile(s.path(id, ".lock"))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", time.Time{}, fmt.Errorf("invalid queue lock of %s", id)
+	}
+	expiry, err := time.Parse(time.RFC3339Nano, fields[1])
+	return fields[0], expiry, err
+}
+
+// lockOwner return the unique name of this store in the lock files.
+func (s *DirQueueStore) lockOwner() string {
+	s.ownerOnce.Do(func() {
+		s.owner, _ = newQueueID()
+	})
+	return s.owner
+}
+
+func (s *DirQueueStore) path(id, ext string) string {
+	return filepath.Join(s.Dir, id+ext)
+}
+
+// writeFileAtomic write data to temporary file in the same directory
+// and rename it in place, the processes never share the temporary file.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package sendmail_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestDirQueueStoreClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, err := sendmail.NewDirQueueStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := &sendmail.DirQueueStore{Dir: dir}
+	entry := &sendmail.QueueEntry{ID: "0123abcd", Sender: "sender@localhost", Recipients: []string{"recipient@localhost"}}
+	if err := first.Add(entry, []byte("TEST")); err != nil {
+		t.Fatal(err)
+	}
+
+	claim := func(s *sendmail.DirQueueStore, until time.Time, expected bool) {
+		t.Helper()
+		claimed, err := s.Claim(entry.ID, until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != expected {
+			t.Errorf("Expected claimed %v got %v", expected, claimed)
+		}
+	}
+	hour := time.Now().Add(time.Hour)
+	claim(first, hour, true)
+	claim(second, hour, false)
+	// The claim of other store is kept
+	second.Release(entry.ID)
+	claim(second, hour, false)
+	first.Release(entry.ID)
+	claim(second, time.Now().Add(-time.Second), true)
+	// The expired claim is taken over
+	claim(first, hour, true)
+
+	entries, err := second.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != entry.ID {
+		t.Error("Expected the stored entry got", entries)
+	}
+	if err := second.Remove(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	claim(first, hour, false)
+	if _, err := first.Load(entry.ID); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected not found error got", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("Expected empty spool got", len(files), "files")
+	}
+}
+
+func TestQueueClaimed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Config.SmartHost = "127.0.0.1:1"
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance delivers the message
+	other := &sendmail.Queue{Store: &sendmail.DirQueueStore{Dir: dir}}
+	if claimed, err := other.Store.Claim(id, time.Now().Add(time.Hour)); err != nil || !claimed {
+		t.Fatal("Expected claim got", claimed, err)
+	}
+	for result := range queue.Run() {
+		t.Error("Unexpected result of claimed message", result)
+	}
+	if _, err := queue.Retry(id); err == nil {
+		t.Error("Expected error of retry of claimed message")
+	}
+	if entry, _ := queue.Entry(id); entry.Attempts != 0 {
+		t.Error("Expected claimed message not attempted got", entry.Attempts)
+	}
+}
+
+// hookStore runs the hook before the next claim.
+type hookStore struct {
+	*sendmail.DirQueueStore
+	hook func()
+}
+
+func (s *hookStore) Claim(id string, until time.Time) (bool, error) {
+	if hook := s.hook; hook != nil {
+		s.hook = nil
+		hook()
+	}
+	return s.DirQueueStore.Claim(id, until)
+}
+
+func TestQueueStaleEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := sendmail.NewDirQueueStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := &hookStore{DirQueueStore: store}
+	transport := &fakeTransport{}
+	queue := &sendmail.Queue{Store: shared}
+	queue.Config.Transport = transport
+	otherTransport := &fakeTransport{rejected: "second@localhost"}
+	other := &sendmail.Queue{Store: &sendmail.DirQueueStore{Dir: dir}}
+	other.Config.Transport = otherTransport
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"first@localhost", "second@localhost"},
+		Body:       []byte("Subject: stale\r\n\r\nTEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The other instance delivers to the first recipient after
+	// the queue listed the entry
+	shared.hook = func() {
+		results, err := other.Retry(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range results {
+		}
+	}
+	for result := range queue.Run() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+	if len(transport.delivered) != 0 {
+		t.Error("Expected rescheduled message skipped got", transport.delivered)
+	}
+	if !reflect.DeepEqual(otherTransport.delivered, []string{"first@localhost"}) {
+		t.Error("Expected delivery of the other instance got", otherTransport.delivered)
+	}
+
+	// The due message is delivered to the rest of recipients only
+	if _, err := other.Reroute(id, ""); err != nil {
+		t.Fatal(err)
+	}
+	for range queue.Run() {
+	}
+	if !reflect.DeepEqual(transport.delivered, []string{"second@localhost"}) {
+		t.Error("Expected delivery to the rest of recipients got", transport.delivered)
+	}
+}
+
+func TestQueueInvalidEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := sendmail.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &fakeTransport{}
+	queue.Config.Transport = transport
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := queue.List()
+	var invalid *sendmail.QueueEntriesError
+	if !errors.As(err, &invalid) || len(invalid.Errs) != 1 {
+		t.Error("Expected error of the broken entry got", err)
+	}
+	if len(entries) != 1 || entries[0].ID != id {
+		t.Fatal("Expected the readable entry got", entries)
+	}
+
+	// The broken entry doesn't hold up the queue
+	var reported bool
+	for result := range queue.Run() {
+		if errors.As(result.Error, &invalid) && result.Level == sendmail.ErrorLevel {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Error("Expected reported broken entry")
+	}
+	if !reflect.DeepEqual(transport.delivered, []string{"recipient@localhost"}) {
+		t.Error("Expected delivery of the readable entry got", transport.delivered)
+	}
+}
@@ -0,0 +1,174 @@
+package sendmail
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SuppressionList of addresses and domains that must never be mailed.
+type SuppressionList interface {
+	// Suppressed reports whether the address or its domain is listed.
+	Suppressed(address string) (bool, error)
+	// Suppress add the address or domain to the list.
+	Suppress(entry, reason string) error
+}
+
+// SuppressedError reports the recipient skipped by the suppression list.
+type SuppressedError struct {
+	Recipient string
+}
+
+func (e *SuppressedError) Error() string {
+	return "recipient " + e.Recipient + " is suppressed"
+}
+
+// FileSuppressionList is a text file with an address or a domain per line,
+// optionally followed by the reason. Empty lines and # comments are skipped.
+type FileSuppressionList struct {
+	path    string
+	mu      sync.RWMutex
+	entries map[string]bool
+}
+
+// NewFileSuppressionList load the list from file, missing file is empty list.
+func NewFileSuppressionList(path string) (*FileSuppressionList, error) {
+	l := &FileSuppressionList{path: path, entries: make(map[string]bool)}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		l.entries[suppressionKey(fields[0])] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read suppression list: %s", err)
+	}
+	return l, nil
+}
+
+// suppressionKey normalize the address or domain.
+func suppressionKey(entry string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(entry), "@"))
+}
+
+// Suppressed reports whether the address or its domain is listed.
+func (l *FileSuppressionList) Suppressed(address string) (bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	key := suppressionKey(address)
+	return l.entries[key] || l.entries[GetDomainFromAddress(key)], nil
+}
+
+// Suppress append the address or domain to the file.
+func (l *FileSuppressionList) Suppress(entry, reason string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := suppressionKey(entry)
+	if l.entries[key] {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	line := key
+	if reason = strings.Join(strings.Fields(reason), " "); reason != "" {
+		line += " " + reason
+	}
+	if _, err := fmt.Fprintln(file, line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	l.entries[key] = true
+	return nil
+}
+
+// isUserUnknown reports whether the server permanently rejected
+// the mailbox as not existing. The enhanced status code is trusted
+// if the reply has one, as the servers reject by policy with
+// "mailbox unavailable" as well.
+func isUserUnknown(protoErr *textproto.Error) bool {
+	if protoErr.Code < 500 {
+		return false
+	}
+	msg := strings.ToLower(protoErr.Msg)
+	if m := enhancedCodeRe.FindStringSubmatch(msg); m != nil {
+		return m[1] == "5.1.1" || m[1] == "5.1.10"
+	}
+	if protoErr.Code != 550 && protoErr.Code != 551 {
+		return false
+	}
+	for _, text := range []string{"user unknown", "unknown user", "no such user", "no such mailbox", "mailbox does not exist"} {
+		if strings.Contains(msg, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressRecipients remove the suppressed recipients from the envelope.
+// It returns the results reporting them.
+func (e *Envelope) suppressRecipients() ([]Result, error) {
+	if e.Suppression == nil {
+		return nil, nil
+	}
+	var results []Result
+	var recipients []string
+	for _, rcpt := range e.Recipients {
+		suppressed, err := e.Suppression.Suppressed(rcpt)
+		if err != nil {
+			return nil, err
+		}
+		if suppressed {
+			results = append(results, Result{WarnLevel, &SuppressedError{rcpt}, "Suppressed", Fields{
+				"sender":     e.GetSender(),
+				"recipients": rcpt,
+			}})
+			continue
+		}
+		recipients = append(recipients, rcpt)
+	}
+	e.Recipients = recipients
+	return results, nil
+}
+
+// suppressUnknown add the recipients rejected as unknown users
+// to the suppression list.
+func (e *Envelope) suppressUnknown(results <-chan Result) <-chan Result {
+	if e.Suppression == nil || e.dryRun {
+		return results
+	}
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		for result := range results {
+			var rcptErr *RecipientError
+			var protoErr *textproto.Error
+			if errors.As(result.Error, &rcptErr) && errors.As(rcptErr, &protoErr) && isUserUnknown(protoErr) {
+				reason := fmt.Sprintf("%d %s", protoErr.Code, protoErr.Msg)
+				if err := e.Suppression.Suppress(rcptErr.Recipient, reason); err != nil {
+					out <- Result{ErrorLevel, err, "Suppression", Fields{"recipients": rcptErr.Recipient}}
+				}
+			}
+			out <- result
+		}
+	}()
+	return out
+}
@@ -0,0 +1,114 @@
+package sendmail_test
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestSuppression(t *testing.T) {
+	test.StartSMTP()
+
+	dir, err := ioutil.TempDir("", "sendmail-suppression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "suppressed.txt")
+	if err := ioutil.WriteFile(path, []byte("# unsubscribed\nBlocked@Localhost unsubscribe\n@blocked.test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := sendmail.NewFileSuppressionList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]bool{
+		"blocked@localhost":   true,
+		"user@blocked.test":   true,
+		"recipient@localhost": false,
+	} {
+		if suppressed, _ := list.Suppressed(address); suppressed != expected {
+			t.Errorf("Expected suppressed %v for %s", expected, address)
+		}
+	}
+
+	config := testConfigs[0].initial
+	config.Recipients = []string{"recipient@localhost", "blocked@localhost"}
+	config.SmartHost = "localhost:" + test.PortSMTP
+	config.Suppression = list
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	suppressed, sent := 0, 0
+	for result := range errs {
+		switch {
+		case result.Message == "Suppressed":
+			suppressed++
+		case result.Level == sendmail.InfoLevel:
+			sent++
+		default:
+			t.Error(result.Error)
+		}
+	}
+	if suppressed != 1 || sent != 1 {
+		t.Errorf("Expected 1 suppressed and 1 sent got %d and %d", suppressed, sent)
+	}
+
+	// Unknown user is added to the list
+	config.Recipients = []string{"unknown@localhost"}
+	envelope, err = sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err = envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range errs {
+	}
+	if suppressed, _ := list.Suppressed("unknown@localhost"); !suppressed {
+		t.Error("Expected unknown@localhost suppressed after 5.1.1 rejection")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "unknown@localhost 550 5.1.1") {
+		t.Errorf("Expected unknown@localhost in the file:\n%s", data)
+	}
+}
+
+func TestIsUserUnknown(t *testing.T) {
+	for _, tc := range []struct {
+		code     int
+		msg      string
+		expected bool
+	}{
+		{550, "5.1.1 <unknown@example.com>: Recipient address rejected: User unknown", true},
+		{550, "5.1.10 RESOLVER.ADR.RecipientNotFound; Recipient not found by SMTP address lookup", true},
+		{550, "No such user here", true},
+		{551, "User unknown", true},
+		// The policy rejections keep the recipient
+		{550, "5.7.1 Mailbox unavailable: message refused by policy", false},
+		{550, "Requested action not taken: mailbox unavailable", false},
+		{550, "5.7.1 User unknown in relay recipient table", false},
+		{554, "No such user", false},
+		{450, "4.1.1 User unknown", false},
+	} {
+		err := &textproto.Error{Code: tc.code, Msg: tc.msg}
+		if unknown := sendmail.IsUserUnknown(err); unknown != tc.expected {
+			t.Errorf("%d %s: expected unknown user %v", tc.code, tc.msg, tc.expected)
+		}
+	}
+}
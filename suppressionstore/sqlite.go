@@ -0,0 +1,67 @@
+package suppressionstore
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	// SQLite driver
+	_ "modernc.org/sqlite"
+
+	"github.com/n0madic/sendmail"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS suppressions (
+	entry TEXT PRIMARY KEY,
+	reason TEXT NOT NULL DEFAULT '',
+	created INTEGER NOT NULL
+);
+`
+
+// SQLite is the suppression list in SQLite database,
+// the processes of one host may share it.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite open the database, creating it if needed.
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{db: db}, nil
+}
+
+// Close the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// Suppressed reports whether the address or its domain is listed.
+func (s *SQLite) Suppressed(address string) (bool, error) {
+	entry := key(address)
+	var found int
+	err := s.db.QueryRow(`SELECT 1 FROM suppressions WHERE entry IN (?, ?) LIMIT 1`,
+		entry, sendmail.GetDomainFromAddress(entry)).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Suppress add the address or domain to the list,
+// the reason of the listed entry is kept.
+func (s *SQLite) Suppress(entry, reason string) error {
+	_, err := s.db.Exec(`INSERT INTO suppressions (entry, reason, created) VALUES (?, ?, ?)
+		ON CONFLICT (entry) DO NOTHING`,
+		key(entry), strings.Join(strings.Fields(reason), " "), time.Now().UnixNano())
+	return err
+}
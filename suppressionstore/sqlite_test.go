@@ -0,0 +1,88 @@
+package suppressionstore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/suppressionstore"
+)
+
+// testList check the list sharing the entries with other.
+func testList(t *testing.T, list, other sendmail.SuppressionList) {
+	for _, entry := range []string{"Unsubscribed@Example.com", "@example.net"} {
+		if err := list.Suppress(entry, "550 5.1.1\n user unknown"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Suppressing the listed entry again is no error
+	if err := list.Suppress("unsubscribed@example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]bool{
+		"unsubscribed@example.com": true,
+		"UNSUBSCRIBED@example.com": true,
+		"user@example.net":         true,
+		"user@EXAMPLE.NET":         true,
+		"other@example.com":        false,
+		"user@sub.example.net":     false,
+	} {
+		suppressed, err := other.Suppressed(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suppressed != expected {
+			t.Errorf("Expected %s suppressed %v got %v", address, expected, suppressed)
+		}
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-suppression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "suppression.db")
+	list, err := suppressionstore.OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	other, err := suppressionstore.OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	testList(t, list, other)
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-suppression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	list, err := suppressionstore.Open("sqlite:" + filepath.Join(dir, "suppression.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := list.(*suppressionstore.SQLite); !ok {
+		t.Errorf("Expected SQLite list got %T", list)
+	}
+
+	path := filepath.Join(dir, "suppressed.txt")
+	list, err = suppressionstore.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := list.(*sendmail.FileSuppressionList); !ok {
+		t.Fatalf("Expected file list got %T", list)
+	}
+	testList(t, list, list)
+}
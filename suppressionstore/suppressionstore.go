@@ -0,0 +1,24 @@
+// Package suppressionstore stores the suppression list of sendmail
+// in SQLite database, so the daemon instances of several processes
+// share one list.
+package suppressionstore
+
+import (
+	"strings"
+
+	"github.com/n0madic/sendmail"
+)
+
+// Open return the suppression list of the specification:
+// sqlite:/path/suppression.db or the text file of addresses and domains.
+func Open(spec string) (sendmail.SuppressionList, error) {
+	if strings.HasPrefix(spec, "sqlite:") {
+		return OpenSQLite(strings.TrimPrefix(spec, "sqlite:"))
+	}
+	return sendmail.NewFileSuppressionList(spec)
+}
+
+// key normalize the address or domain like the file list.
+func key(entry string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(entry), "@"))
+}
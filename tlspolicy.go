@@ -0,0 +1,70 @@
+package sendmail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy is the TLS requirement of the direct deliveries to a domain.
+type TLSPolicy string
+
+// TLS policies of destination domains.
+const (
+	// TLSPolicyRequireVerified require STARTTLS with valid certificate.
+	TLSPolicyRequireVerified TLSPolicy = "require-verified"
+	// TLSPolicyRequire require STARTTLS with any certificate.
+	TLSPolicyRequire TLSPolicy = "require"
+	// TLSPolicyOpportunistic use STARTTLS when the server offers it (default).
+	TLSPolicyOpportunistic TLSPolicy = "opportunistic"
+	// TLSPolicyNone never use TLS.
+	TLSPolicyNone TLSPolicy = "none"
+)
+
+// Validate check the policy name.
+func (p TLSPolicy) Validate() error {
+	switch p {
+	case TLSPolicyRequireVerified, TLSPolicyRequire, TLSPolicyOpportunistic, TLSPolicyNone:
+		return nil
+	}
+	return fmt.Errorf("unknown TLS policy %q, expected require-verified, require, opportunistic or none", p)
+}
+
+// session return the TLS mode and configuration of the session to the host.
+func (p TLSPolicy) session(host string) (string, *tls.Config) {
+	config := &tls.Config{ServerName: host}
+	switch p {
+	case TLSPolicyRequireVerified:
+		return TLSStartTLS, config
+	case TLSPolicyRequire:
+		config.InsecureSkipVerify = true
+		return TLSStartTLS, config
+	case TLSPolicyNone:
+		return TLSNone, config
+	}
+	return TLSOpportunistic, config
+}
+
+// lowerDomains return the policies by lowercase domain name.
+func lowerDomains(policies map[string]TLSPolicy) map[string]TLSPolicy {
+	if policies == nil {
+		return nil
+	}
+	lower := make(map[string]TLSPolicy, len(policies))
+	for domain, policy := range policies {
+		lower[strings.ToLower(domain)] = policy
+	}
+	return lower
+}
+
+// tlsPolicy return the policy of the destination domain matched
+// by the domain name, "*" is the policy of other domains.
+func (e *Envelope) tlsPolicy(domain string) TLSPolicy {
+	if policy, ok := e.TLSPolicies[strings.ToLower(domain)]; ok {
+		return policy
+	}
+	if policy, ok := e.TLSPolicies["*"]; ok {
+		return policy
+	}
+	return TLSPolicyOpportunistic
+}
@@ -0,0 +1,54 @@
+package sendmail_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	test.StartSMTP()
+
+	// The test server doesn't offer STARTTLS
+	for _, tc := range []struct {
+		policies  map[string]sendmail.TLSPolicy
+		delivered bool
+	}{
+		{nil, true},
+		{map[string]sendmail.TLSPolicy{"localhost": sendmail.TLSPolicyNone}, true},
+		{map[string]sendmail.TLSPolicy{"localhost": sendmail.TLSPolicyRequire}, false},
+		{map[string]sendmail.TLSPolicy{"LocalHost": sendmail.TLSPolicyRequire}, false},
+		{map[string]sendmail.TLSPolicy{"*": sendmail.TLSPolicyRequireVerified}, false},
+		{map[string]sendmail.TLSPolicy{"example.com": sendmail.TLSPolicyRequire}, true},
+	} {
+		config := testConfigs[0].initial
+		config.Resolver = &fakeResolver{
+			mx: map[string][]*net.MX{"localhost": {{Host: "localhost", Pref: 10}}},
+			ip: map[string][]net.IPAddr{"localhost": {{IP: net.ParseIP("127.0.0.1")}}},
+		}
+		config.TLSPolicies = tc.policies
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delivered := false
+		for result := range envelope.SendLikeMTA() {
+			if result.Level == sendmail.InfoLevel {
+				delivered = true
+			}
+			if result.Fields["mx"] != nil && result.Error != nil && !strings.Contains(result.Error.Error(), "STARTTLS") {
+				t.Error("Expected STARTTLS error got", result.Error)
+			}
+		}
+		if delivered != tc.delivered {
+			t.Errorf("Policies %v: expected delivered %v got %v", tc.policies, tc.delivered, delivered)
+		}
+	}
+
+	if err := sendmail.TLSPolicy("strict").Validate(); err == nil {
+		t.Error("Expected error of unknown policy")
+	}
+}
@@ -0,0 +1,404 @@
+package sendmail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result types of TLS negotiation failures (RFC 8460 section 4.3).
+const (
+	TLSResultSTARTTLSNotSupported = "starttls-not-supported"
+	TLSResultCertificateExpired   = "certificate-expired"
+	TLSResultHostMismatch         = "certificate-host-mismatch"
+	TLSResultNotTrusted           = "certificate-not-trusted"
+	TLSResultValidationFailure    = "validation-failure"
+)
+
+// TLSFailure describes failed TLS negotiation with the mail server.
+type TLSFailure struct {
+	ResultType          string
+	SendingMTAIP        string
+	ReceivingMXHostname string
+	ReceivingIP         string
+}
+
+// TLSReporter aggregates the results of TLS negotiations of direct
+// deliveries and sends SMTP TLS reports (RFC 8460) to the domains
+// publishing _smtp._tls TXT record.
+type TLSReporter struct {
+	// OrganizationName and ContactInfo identify the submitter of reports.
+	OrganizationName string
+	ContactInfo      string
+	// Config is the base configuration of the report messages,
+	// Sender is the From address of reports.
+	Config Config
+	// HTTPClient posts the reports to https:// URIs, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	start   time.Time
+	domains map[string]*tlsStats
+}
+
+// tlsStats of the policy domain.
+type tlsStats struct {
+	success  int64
+	failures map[TLSFailure]int64
+}
+
+// NewTLSReporter return reporter starting the report period now.
+func NewTLSReporter(organization, contact string) *TLSReporter {
+	return &TLSReporter{
+		OrganizationName: organization,
+		ContactInfo:      contact,
+		start:            time.Now(),
+		domains:          make(map[string]*tlsStats),
+	}
+}
+
+// stats return the counters of the domain, r.mu must be held.
+func (r *TLSReporter) stats(domain string) *tlsStats {
+	domain = strings.ToLower(domain)
+	if r.domains == nil {
+		r.domains = make(map[string]*tlsStats)
+	}
+	stats, ok := r.domains[domain]
+	if !ok {
+		stats = &tlsStats{failures: make(map[TLSFailure]int64)}
+		r.domains[domain] = stats
+	}
+	return stats
+}
+
+// RecordSuccess count successful TLS session with the server of domain.
+func (r *TLSReporter) RecordSuccess(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats(domain).success++
+}
+
+// RecordFailure count failed TLS session with the server of domain.
+func (r *TLSReporter) RecordFailure(domain string, failure TLSFailure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats(domain).failures[failure]++
+}
+
+// tlsReport is the JSON report of RFC 8460 section 4.4.
+type tlsReport struct {
+	OrganizationName string `json:"organization-name"`
+	DateRange        struct {
+		StartDatetime time.Time `json:"start-datetime"`
+		EndDatetime   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	ContactInfo string            `json:"contact-info"`
+	ReportID    string            `json:"report-id"`
+	Policies    []tlsReportPolicy `json:"policies"`
+}
+
+type tlsReportPolicy struct {
+	Policy struct {
+		PolicyType   string `json:"policy-type"`
+		PolicyDomain string `json:"policy-domain"`
+	} `json:"policy"`
+	Summary struct {
+		TotalSuccessfulSessionCount int64 `json:"total-successful-session-count"`
+		TotalFailureSessionCount    int64 `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []tlsReportFailure `json:"failure-details,omitempty"`
+}
+
+type tlsReportFailure struct {
+	ResultType          string `json:"result-type"`
+	SendingMTAIP        string `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP         string `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int64  `json:"failed-session-count"`
+}
+
+// Report send the reports of the period since the previous report
+// and start the new period. Domains without _smtp._tls record are skipped.
+// It returns channel for results of send, closed after all reports.
+func (r *TLSReporter) Report() <-chan Result {
+	r.mu.Lock()
+	start, end := r.start, time.Now()
+	domains := r.domains
+	r.start = end
+	r.domains = make(map[string]*tlsStats)
+	r.mu.Unlock()
+
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		names := make([]string, 0, len(domains))
+		for domain := range domains {
+			names = append(names, domain)
+		}
+		sort.Strings(names)
+		for _, domain := range names {
+			r.report(domain, domains[domain], start, end, results)
+		}
+	}()
+	return results
+}
+
+func (r *TLSReporter) report(domain string, stats *tlsStats, start, end time.Time, results chan<- Result) {
+	fields := Fields{"domain": domain}
+	rua, err := r.lookupRUA(domain)
+	if err != nil {
+		results <- Result{ErrorLevel, err, "TLS report", fields}
+		return
+	}
+	if len(rua) == 0 {
+		return
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		results <- Result{ErrorLevel, err, "TLS report", fields}
+		return
+	}
+	report := tlsReport{
+		OrganizationName: r.OrganizationName,
+		ContactInfo:      r.ContactInfo,
+		ReportID:         id + "@" + r.submitter(),
+	}
+	report.DateRange.StartDatetime = start.UTC().Truncate(time.Second)
+	report.DateRange.EndDatetime = end.UTC().Truncate(time.Second)
+	policy := tlsReportPolicy{}
+	policy.Policy.PolicyType = "no-policy-found"
+	policy.Policy.PolicyDomain = domain
+	policy.Summary.TotalSuccessfulSessionCount = stats.success
+	for failure, count := range stats.failures {
+		policy.Summary.TotalFailureSessionCount += count
+		policy.FailureDetails = append(policy.FailureDetails, tlsReportFailure{
+			ResultType:          failure.ResultType,
+			SendingMTAIP:        failure.SendingMTAIP,
+			ReceivingMXHostname: failure.ReceivingMXHostname,
+			ReceivingIP:         failure.ReceivingIP,
+			FailedSessionCount:  count,
+		})
+	}
+	sort.Slice(policy.FailureDetails, func(i, j int) bool {
+		return policy.FailureDetails[i].FailedSessionCount > policy.FailureDetails[j].FailedSessionCount
+	})
+	report.Policies = []tlsReportPolicy{policy}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		results <- Result{ErrorLevel, err, "TLS report", fields}
+		return
+	}
+	gz := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(gz)
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		results <- Result{ErrorLevel, err, "TLS report", fields}
+		return
+	}
+
+	for _, uri := range rua {
+		fields := Fields{"domain": domain, "rua": uri, "report_id": report.ReportID}
+		var err error
+		if strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+			err = r.mailReport(uri, domain, &report, gz.Bytes())
+		} else {
+			err = r.postReport(uri, gz.Bytes())
+		}
+		if err != nil {
+			results <- Result{ErrorLevel, err, "TLS report", fields}
+		} else {
+			results <- Result{InfoLevel, nil, "TLS report sent", fields}
+		}
+	}
+}
+
+// lookupRUA return the report URIs of the domain TLSRPT record.
+func (r *TLSReporter) lookupRUA(domain string) ([]string, error) {
+	resolver := r.Config.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	txt, err := resolver.LookupTXT(context.Background(), "_smtp._tls."+domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records []string
+	for _, record := range txt {
+		if strings.HasPrefix(record, "v=TLSRPTv1;") {
+			records = append(records, record)
+		}
+	}
+	// Exactly one record is valid, RFC 8460 section 3
+	if len(records) != 1 {
+		return nil, nil
+	}
+	var rua []string
+	for _, field := range strings.Split(records[0], ";") {
+		field = strings.TrimSpace(field)
+		if !strings.HasPrefix(field, "rua=") {
+			continue
+		}
+		for _, uri := range strings.Split(strings.TrimPrefix(field, "rua="), ",") {
+			uri = strings.TrimSpace(uri)
+			lower := strings.ToLower(uri)
+			if strings.HasPrefix(lower, "mailto:") || strings.HasPrefix(lower, "https:") {
+				rua = append(rua, uri)
+			}
+		}
+	}
+	return rua, nil
+}
+
+// submitter return the domain of the report submitter.
+func (r *TLSReporter) submitter() string {
+	if domain := GetDomainFromAddress(r.Config.Sender); domain != "" {
+		return domain
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
+
+// mailReport send the report as multipart/report message (RFC 8460 section 5.3).
+func (r *TLSReporter) mailReport(uri, domain string, report *tlsReport, gz []byte) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	address, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return err
+	}
+
+	body := bytes.NewBuffer(nil)
+	writer := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=us-ascii")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(part, "This is an aggregate TLS report from %s\r\n", r.OrganizationName)
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Type", "application/tlsrpt+gzip")
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("%s!%s!%d!%d.json.gz", r.submitter(), domain,
+			report.DateRange.StartDatetime.Unix(), report.DateRange.EndDatetime.Unix()),
+	}))
+	part, err = writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if err := writeBase64(part, gz); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	msg := bytes.NewBuffer(nil)
+	fmt.Fprintf(msg, "To: %s\r\n", address)
+	fmt.Fprintf(msg, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", domain, r.submitter(), report.ReportID)
+	fmt.Fprintf(msg, "TLS-Report-Domain: %s\r\n", domain)
+	fmt.Fprintf(msg, "TLS-Report-Submitter: %s\r\n", r.submitter())
+	fmt.Fprintf(msg, "Mime-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/report", map[string]string{
+		"report-type": "tlsrpt",
+		"boundary":    writer.Boundary(),
+	}))
+	msg.Write(body.Bytes())
+
+	config := r.Config
+	config.Recipients = []string{address}
+	config.Body = msg.Bytes()
+	envelope, err := NewEnvelope(&config)
+	if err != nil {
+		return err
+	}
+	results, err := envelope.Send()
+	if err != nil {
+		return err
+	}
+	for result := range results {
+		if result.Level < WarnLevel {
+			err = result.Error
+		}
+	}
+	return err
+}
+
+// postReport send the report to HTTPS endpoint (RFC 8460 section 5.4).
+func (r *TLSReporter) postReport(uri string, gz []byte) error {
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(uri, "application/tlsrpt+gzip", bytes.NewReader(gz))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("TLS report rejected: %s", resp.Status)
+	}
+	return nil
+}
+
+// tlsResultType classify the error of TLS negotiation.
+func tlsResultType(err error) string {
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &hostErr):
+		return TLSResultHostMismatch
+	case errors.As(err, &authErr):
+		return TLSResultNotTrusted
+	case errors.As(err, &certErr) && certErr.Reason == x509.Expired:
+		return TLSResultCertificateExpired
+	}
+	return TLSResultValidationFailure
+}
+
+// tlsReport return the callback recording TLS negotiations with mx of domain.
+func (e *Envelope) tlsReport(domain, mx string) func(resultType string, conn net.Conn) {
+	if e.TLSReporter == nil || e.dryRun {
+		return nil
+	}
+	return func(resultType string, conn net.Conn) {
+		if resultType == "" {
+			e.TLSReporter.RecordSuccess(domain)
+			return
+		}
+		local, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+		remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		e.TLSReporter.RecordFailure(domain, TLSFailure{
+			ResultType:          resultType,
+			SendingMTAIP:        local,
+			ReceivingMXHostname: mx,
+			ReceivingIP:         remote,
+		})
+	}
+}
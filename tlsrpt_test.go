@@ -0,0 +1,91 @@
+package sendmail_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestTLSReporter(t *testing.T) {
+	test.StartSMTP()
+
+	reports := make(chan map[string]interface{}, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/tlsrpt+gzip" {
+			t.Error("Unexpected content type", r.Header.Get("Content-Type"))
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		report := make(map[string]interface{})
+		if err := json.NewDecoder(gz).Decode(&report); err != nil {
+			t.Error(err)
+		}
+		reports <- report
+	}))
+	defer server.Close()
+
+	reporter := sendmail.NewTLSReporter("Example Org", "postmaster@localhost")
+	reporter.HTTPClient = server.Client()
+	reporter.Config = sendmail.Config{
+		Sender:    "sender@localhost",
+		SmartHost: "localhost:" + test.PortSMTP,
+		Resolver: &fakeResolver{
+			ip: map[string][]net.IPAddr{
+				"localhost": {{IP: net.ParseIP("127.0.0.1")}},
+			},
+			txt: map[string][]string{
+				"_smtp._tls.example.com": {"v=TLSRPTv1; rua=" + server.URL},
+				"_smtp._tls.localhost":   {"v=TLSRPTv1;rua=mailto:recipient@localhost"},
+			},
+		},
+	}
+
+	reporter.RecordSuccess("example.com")
+	reporter.RecordSuccess("example.com")
+	reporter.RecordFailure("example.com", sendmail.TLSFailure{
+		ResultType:          sendmail.TLSResultNotTrusted,
+		ReceivingMXHostname: "mx.example.com",
+	})
+	reporter.RecordSuccess("localhost")
+	reporter.RecordSuccess("no-report.example.com")
+
+	sent := 0
+	for result := range reporter.Report() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		} else {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Error("Expected 2 reports sent got", sent)
+	}
+
+	report := <-reports
+	if report["organization-name"] != "Example Org" || report["contact-info"] != "postmaster@localhost" {
+		t.Error("Unexpected report submitter", report)
+	}
+	policy := report["policies"].([]interface{})[0].(map[string]interface{})
+	summary := policy["summary"].(map[string]interface{})
+	if summary["total-successful-session-count"] != 2.0 || summary["total-failure-session-count"] != 1.0 {
+		t.Error("Unexpected report summary", summary)
+	}
+	failure := policy["failure-details"].([]interface{})[0].(map[string]interface{})
+	if failure["result-type"] != "certificate-not-trusted" || failure["receiving-mx-hostname"] != "mx.example.com" {
+		t.Error("Unexpected failure details", failure)
+	}
+
+	// The period starts again after the report
+	for result := range reporter.Report() {
+		t.Error("Unexpected report", result)
+	}
+}
@@ -0,0 +1,231 @@
+package sendmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport delivers the message, e.g. to the mail servers of recipients,
+// through a smarthost or with HTTP API of a mail provider.
+type Transport interface {
+	// Deliver the message of envelope to its recipients. The error is
+	// returned when the delivery could not be attempted, otherwise
+	// the outcome is reported for every recipient.
+	Deliver(ctx context.Context, e *Envelope) ([]RecipientResult, error)
+}
+
+// RecipientResult is the outcome of the delivery to the recipient.
+type RecipientResult struct {
+	Recipient string
+	// Err is nil when the message was accepted.
+	Err error
+	// Server which accepted or refused the message.
+	Server string
+}
+
+// resultsTransport is implemented by the built-in transports
+// reporting every attempt of the delivery.
+type resultsTransport interface {
+	Transport
+	results(ctx context.Context, e *Envelope) <-chan Result
+}
+
+// MXTransport delivers the message directly to the mail servers
+// of recipient domains, like Mail Transfer Agent.
+type MXTransport struct{}
+
+// Deliver the message to the mail servers of recipients.
+func (t MXTransport) Deliver(ctx context.Context, e *Envelope) ([]RecipientResult, error) {
+	return collectResults(e.Recipients, t.results(ctx, e))
+}
+
+func (MXTransport) results(ctx context.Context, e *Envelope) <-chan Result {
+	return e.sendLikeMTA(ctx)
+}
+
+// SmarthostTransport relays the message through an external mail server.
+type SmarthostTransport struct {
+	Relay RelayConfig
+	// Auth overrides the authentication with Relay login and password.
+	Auth smtp.Auth
+}
+
+// Deliver the message through the relay.
+func (t *SmarthostTransport) Deliver(ctx context.Context, e *Envelope) ([]RecipientResult, error) {
+	return collectResults(e.Recipients, t.results(ctx, e))
+}
+
+func (t *SmarthostTransport) results(ctx context.Context, e *Envelope) <-chan Result {
+	auth := t.Auth
+	if auth == nil {
+		auth = t.Relay.auth()
+	}
+	return e.sendRelay(ctx, t.Relay, auth)
+}
+
+// collectResults of the recipients from the delivery results.
+// The fatal result not related to recipients is returned as error.
+func collectResults(recipients []string, results <-chan Result) ([]RecipientResult, error) {
+	outcome := make(map[string]*RecipientResult, len(recipients))
+	for _, rcpt := range recipients {
+		outcome[rcpt] = &RecipientResult{Recipient: rcpt, Err: errors.New("no delivery result")}
+	}
+	var fatal error
+	for result := range results {
+		rcpts, _ := result.Fields["recipients"].(string)
+		if rcpts == "" {
+			if result.Level == FatalLevel && fatal == nil {
+				fatal = result.Error
+			}
+			continue
+		}
+		server, _ := result.Fields["mx"].(string)
+		if server == "" {
+			server, _ = result.Fields["smarthost"].(string)
+		}
+		for _, rcpt := range strings.Split(rcpts, ",") {
+			r, ok := outcome[rcpt]
+			if !ok || (r.Err == nil && r.Server != "") {
+				// Accepted by the server already
+				continue
+			}
+			r.Server = server
+			r.Err = result.Error
+			if result.Level == InfoLevel {
+				r.Err = nil
+			}
+		}
+	}
+	if fatal != nil {
+		return nil, fatal
+	}
+	list := make([]RecipientResult, 0, len(recipients))
+	for _, rcpt := range recipients {
+		list = append(list, *outcome[rcpt])
+	}
+	return list, nil
+}
+
+// SendTransport message delivery with the transport.
+func (e *Envelope) SendTransport(t Transport) <-chan Result {
+	return e.sendTransport(context.Background(), t)
+}
+
+func (e *Envelope) sendTransport(ctx context.Context, t Transport) <-chan Result {
+	if rt, ok := t.(resultsTransport); ok {
+		return rt.results(ctx, e)
+	}
+	results := make(chan Result, len(e.Recipients)+1)
+	go func() {
+		defer close(results)
+		start := time.Now()
+		delivered, err := t.Deliver(ctx, e)
+		duration := time.Since(start)
+		if err != nil {
+			results <- Result{FatalLevel, err, "Transport", Fields{
+				"sender": e.GetSender(),
+			}}
+			return
+		}
+		failed := 0
+		for _, r := range delivered {
+			fields := Fields{
+				"sender":     e.GetSender(),
+				"server":     r.Server,
+				"recipients": r.Recipient,
+				"duration":   duration,
+			}
+			if id := e.Header.Get("Message-Id"); id != "" {
+				fields["message_id"] = id
+			}
+			if r.Err == nil {
+				results <- Result{InfoLevel, nil, e.successMessage(), fields}
+				continue
+			}
+			failed++
+			results <- Result{ErrorLevel, r.Err, "", fields}
+		}
+		if failed > 0 && failed < len(delivered) {
+			results <- Result{ErrorLevel, errors.New("failed to deliver to some recipients"), "", Fields{
+				"sender":  e.GetSender(),
+				"success": len(delivered) - failed,
+				"total":   len(delivered),
+			}}
+		}
+	}()
+	return results
+}
+
+// TransportFactory create the transport of the relay configuration.
+type TransportFactory func(relay RelayConfig) (Transport, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]TransportFactory{
+		TransportSMTP: func(relay RelayConfig) (Transport, error) {
+			return &SmarthostTransport{Relay: relay}, nil
+		},
+	}
+)
+
+// TransportSMTP is the name of the transport relaying through
+// the SMTP server, the default of relays.
+const TransportSMTP = "smtp"
+
+// RegisterTransport make the transport available to the relays
+// of the configuration files by name. It replaces the transport
+// registered with the same name.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[strings.ToLower(name)] = factory
+}
+
+// Transports return the names of the registered transports.
+func Transports() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	return transportNames()
+}
+
+// transportFactory return the factory registered by name, SMTP for empty name.
+func transportFactory(name string) (TransportFactory, error) {
+	if name == "" {
+		name = TransportSMTP
+	}
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	factory, ok := transports[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown relay transport %q, expected one of %s", name, strings.Join(transportNames(), ", "))
+	}
+	return factory, nil
+}
+
+// transportNames of the registered transports, the lock must be held.
+func transportNames() []string {
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTransport create the transport of the relay configuration.
+func (r RelayConfig) NewTransport() (Transport, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	factory, err := transportFactory(r.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return factory(r)
+}
@@ -0,0 +1,128 @@
+package sendmail_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+// fakeTransport accepts the recipients except the rejected.
+type fakeTransport struct {
+	rejected  string
+	delivered []string
+}
+
+func (t *fakeTransport) Deliver(ctx context.Context, e *sendmail.Envelope) ([]sendmail.RecipientResult, error) {
+	var results []sendmail.RecipientResult
+	for _, rcpt := range e.Recipients {
+		result := sendmail.RecipientResult{Recipient: rcpt, Server: "fake"}
+		if rcpt == t.rejected {
+			result.Err = errors.New("rejected")
+		} else {
+			t.delivered = append(t.delivered, rcpt)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func TestSendTransport(t *testing.T) {
+	transport := &fakeTransport{rejected: "bad@example.com"}
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"good@example.com", "bad@example.com"},
+		Body:       []byte("TEST"),
+		Transport:  transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for result := range results {
+		if result.Level < sendmail.WarnLevel {
+			failed++
+		}
+	}
+	if len(transport.delivered) != 1 || transport.delivered[0] != "good@example.com" {
+		t.Error("Expected delivery to good@example.com got", transport.delivered)
+	}
+	// The rejected recipient and the summary
+	if failed != 2 {
+		t.Error("Expected 2 errors got", failed)
+	}
+}
+
+func TestMXTransport(t *testing.T) {
+	test.StartSMTP()
+
+	config := testConfigs[0].initial
+	config.Recipients = []string{"recipient@localhost", "unknown@localhost"}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := sendmail.MXTransport{}.Deliver(context.Background(), &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal("Expected 2 results got", len(results))
+	}
+	var rcptErr *sendmail.RecipientError
+	for _, result := range results {
+		if result.Server != "localhost" {
+			t.Error("Expected server localhost got", result.Server)
+		}
+		if !errors.As(result.Err, &rcptErr) || rcptErr.Code() != 550 {
+			t.Error("Expected 550 for the session with unknown recipient got", result.Err)
+		}
+	}
+}
+
+func TestRegisterTransport(t *testing.T) {
+	transport := &fakeTransport{}
+	sendmail.RegisterTransport("fake", func(relay sendmail.RelayConfig) (sendmail.Transport, error) {
+		return transport, nil
+	})
+
+	file, err := ioutil.TempFile("", "sendmail-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("sender_relays:\n  localhost:\n    transport: fake\n")
+	file.Close()
+
+	config := testConfigs[0].initial
+	config.ConfigFile = file.Name()
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := envelope.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range results {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+	if len(transport.delivered) != 1 {
+		t.Error("Expected delivery with the registered transport")
+	}
+
+	relay := sendmail.RelayConfig{Transport: "unregistered"}
+	if err := relay.Validate(); err == nil {
+		t.Error("Expected error for unregistered transport")
+	}
+}
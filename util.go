@@ -3,6 +3,7 @@ package sendmail
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"net/mail"
 	"strings"
 )
@@ -12,6 +13,12 @@ func GetDumbMessage(sender string, recipients []string, body []byte) (*mail.Mess
 	if len(recipients) == 0 {
 		return nil, errors.New("empty recipients list")
 	}
+	if err := checkHeader("From", sender); err != nil {
+		return nil, err
+	}
+	if err := checkHeader("To", recipients...); err != nil {
+		return nil, err
+	}
 	buf := bytes.NewBuffer(nil)
 	if sender != "" {
 		buf.WriteString("From: " + sender + "\r\n")
@@ -39,3 +46,81 @@ func GetDomainFromAddress(address string) string {
 	}
 	return ""
 }
+
+// uniqueAddresses remove duplicate addresses keeping the order
+func uniqueAddresses(addresses []string) (unique []string) {
+	seen := make(map[string]bool)
+	for _, address := range addresses {
+		key := strings.ToLower(address)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, address)
+		}
+	}
+	return
+}
+
+// excludeAddresses remove excluded addresses from the list
+func excludeAddresses(addresses, excluded []string) (result []string) {
+	skip := make(map[string]bool)
+	for _, address := range excluded {
+		skip[strings.ToLower(address)] = true
+	}
+	for _, address := range addresses {
+		if !skip[strings.ToLower(address)] {
+			result = append(result, address)
+		}
+	}
+	return
+}
+
+// normalizeCRLF convert the bare LF and CR line breaks to CRLF.
+func normalizeCRLF(data []byte) []byte {
+	crlf := bytes.Count(data, []byte("\r\n"))
+	if bytes.Count(data, []byte("\n")) == crlf && bytes.Count(data, []byte("\r")) == crlf {
+		return data
+	}
+	buf := make([]byte, 0, len(data)+len(data)/32)
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '\r':
+			if i+1 < len(data) && data[i+1] == '\n' {
+				i++
+			}
+			buf = append(buf, '\r', '\n')
+		case '\n':
+			buf = append(buf, '\r', '\n')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// validHeaderName reports whether the name consists of printable
+// US-ASCII characters except colon (RFC 5322 section 2.2).
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHeader reject the invalid header name and the line breaks
+// in the values which would start another header.
+func checkHeader(name string, values ...string) error {
+	if !validHeaderName(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("invalid %s header: line break in value %q", name, value)
+		}
+	}
+	return nil
+}
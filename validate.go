@@ -0,0 +1,168 @@
+package sendmail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Results of the RCPT callout of address validation.
+const (
+	// CalloutAccepted the server accepted the recipient.
+	CalloutAccepted = "accepted"
+	// CalloutRejected the server permanently rejected the recipient.
+	CalloutRejected = "rejected"
+	// CalloutUnknown the servers could not be asked or deferred the answer.
+	CalloutUnknown = "unknown"
+)
+
+// ValidateOptions of address validation.
+type ValidateOptions struct {
+	// Resolver for DNS lookups, DefaultResolver if nil.
+	Resolver Resolver
+	// DisableImplicitMX treat the domain without MX records as invalid.
+	DisableImplicitMX bool
+	// Callout probe the mailbox with RCPT command on the mail servers.
+	Callout bool
+	// Sender of MAIL command of the callout, the null sender if empty.
+	Sender string
+	// PortSMTP of the mail servers, 25 if empty.
+	PortSMTP string
+	// AddressFamily policy of the callout connections.
+	AddressFamily AddressFamily
+	// Timeouts of the callout session stages, DefaultTimeouts for not set.
+	Timeouts Timeouts
+}
+
+// AddressVerdict is the result of address validation.
+type AddressVerdict struct {
+	// Address in the normalized form.
+	Address string `json:"address"`
+	// Valid is the overall verdict.
+	Valid bool `json:"valid"`
+	// Syntax of the address is valid.
+	Syntax bool `json:"syntax"`
+	// Domain of the address.
+	Domain string `json:"domain,omitempty"`
+	// MXHosts accepting mail for the domain, ordered by preference.
+	MXHosts []string `json:"mx_hosts,omitempty"`
+	// Route is "mx" or "implicit_mx" for the domain without MX records.
+	Route string `json:"route,omitempty"`
+	// NullMX the domain does not accept mail (RFC 7505).
+	NullMX bool `json:"null_mx,omitempty"`
+	// Callout result, empty if not performed.
+	Callout string `json:"callout,omitempty"`
+	// CalloutCode is the SMTP reply code to RCPT command.
+	CalloutCode int `json:"callout_code,omitempty"`
+	// Reason of the invalid verdict.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ValidateAddress check the syntax of address, the existence of mail
+// servers of its domain and optionally the mailbox with RCPT callout.
+// The error is returned only when the verdict can't be made, e.g. on
+// temporary DNS failure or done context.
+func ValidateAddress(ctx context.Context, addr string, opts *ValidateOptions) (*AddressVerdict, error) {
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+	verdict := &AddressVerdict{Address: addr}
+
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		verdict.Reason = err.Error()
+		return verdict, nil
+	}
+	verdict.Address = parsed.Address
+	verdict.Domain = GetDomainFromAddress(parsed.Address)
+	if verdict.Domain == "" || strings.HasPrefix(verdict.Domain, "[") {
+		verdict.Reason = "mail: no domain in address"
+		return verdict, nil
+	}
+	verdict.Syntax = true
+
+	e := &Envelope{
+		PortSMTP:          opts.PortSMTP,
+		Resolver:          opts.Resolver,
+		DisableImplicitMX: opts.DisableImplicitMX,
+		AddressFamily:     opts.AddressFamily,
+		Timeouts:          opts.Timeouts,
+		dryRun:            true,
+		probeRecipients:   true,
+	}
+	if e.PortSMTP == "" {
+		e.PortSMTP = "25"
+	}
+	hosts, route, err := e.lookupHosts(ctx, verdict.Domain)
+	verdict.Route = route
+	if err != nil && len(hosts) == 0 {
+		var nullMX *NullMXError
+		if errors.As(err, &nullMX) {
+			verdict.NullMX = true
+			verdict.Reason = err.Error()
+			return verdict, nil
+		}
+		if isNotFound(err) {
+			verdict.Reason = "no mail servers of domain " + verdict.Domain
+			return verdict, nil
+		}
+		return nil, err
+	}
+	verdict.MXHosts = hosts
+
+	if opts.Callout {
+		if err := e.callout(ctx, verdict, opts.Sender); err != nil {
+			return nil, err
+		}
+		if verdict.Callout == CalloutRejected {
+			return verdict, nil
+		}
+	}
+	verdict.Valid = true
+	return verdict, nil
+}
+
+// callout ask the mail servers of domain about the recipient
+// until one of them answers.
+func (e *Envelope) callout(ctx context.Context, verdict *AddressVerdict, sender string) error {
+	verdict.Callout = CalloutUnknown
+	for _, host := range verdict.MXHosts {
+		_, err := e.sendMail(ctx, net.JoinHostPort(host, e.PortSMTP), sessionOptions{
+			tlsConfig: &tls.Config{ServerName: host},
+			timeouts:  e.timeouts(),
+			resolver:  e.resolver(),
+			family:    e.AddressFamily,
+		}, sender, []string{verdict.Address}, nil)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var rcptErr *RecipientError
+		switch {
+		case err == nil:
+			verdict.Callout = CalloutAccepted
+			verdict.CalloutCode = 250
+			return nil
+		case errors.As(err, &rcptErr) && rcptErr.Code() >= 500:
+			verdict.Callout = CalloutRejected
+			verdict.CalloutCode = rcptErr.Code()
+			verdict.Reason = err.Error()
+			return nil
+		case errors.As(err, &rcptErr):
+			// Deferred, e.g. greylisting
+			verdict.CalloutCode = rcptErr.Code()
+			verdict.Reason = err.Error()
+			return nil
+		}
+		verdict.Reason = err.Error()
+		// The server answered, the others would not tell more
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			return nil
+		}
+	}
+	return nil
+}
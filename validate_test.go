@@ -0,0 +1,52 @@
+package sendmail_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestValidateAddress(t *testing.T) {
+	test.StartSMTP()
+
+	opts := &sendmail.ValidateOptions{
+		Resolver: &fakeResolver{
+			mx: map[string][]*net.MX{
+				"localhost": {{Host: "mx.test.", Pref: 10}},
+				"null.test": {{Host: ".", Pref: 0}},
+			},
+			ip: map[string][]net.IPAddr{
+				"mx.test": {{IP: net.ParseIP("127.0.0.1")}},
+			},
+		},
+		Callout:  true,
+		Sender:   "sender@localhost",
+		PortSMTP: test.PortSMTP,
+	}
+
+	for _, check := range []struct {
+		address string
+		valid   bool
+		syntax  bool
+		callout string
+	}{
+		{"recipient@localhost", true, true, sendmail.CalloutAccepted},
+		{"Recipient <recipient@localhost>", true, true, sendmail.CalloutAccepted},
+		{"unknown@localhost", false, true, sendmail.CalloutRejected},
+		{"user@null.test", false, true, ""},
+		{"user@missing.test", false, true, ""},
+		{"not an address", false, false, ""},
+	} {
+		verdict, err := sendmail.ValidateAddress(context.Background(), check.address, opts)
+		if err != nil {
+			t.Error(check.address, err)
+			continue
+		}
+		if verdict.Valid != check.valid || verdict.Syntax != check.syntax || verdict.Callout != check.callout {
+			t.Errorf("Unexpected verdict of %s: %+v", check.address, verdict)
+		}
+	}
+}
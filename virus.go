@@ -0,0 +1,190 @@
+package sendmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultVirusTimeout limits the scan of the message by clamd.
+const DefaultVirusTimeout = time.Minute
+
+// Actions of the virus scanner on infected messages.
+const (
+	// VirusReject refuse the message (default).
+	VirusReject = "reject"
+	// VirusQuarantine accept the message and store it in the
+	// quarantine directory instead of the delivery.
+	VirusQuarantine = "quarantine"
+)
+
+// clamdChunkSize is the size of INSTREAM chunks.
+const clamdChunkSize = 64 * 1024
+
+// VirusScanner scans the messages with their attachments by ClamAV clamd
+// before the delivery.
+type VirusScanner struct {
+	// Address of clamd: Unix socket path (/var/run/clamav/clamd.ctl)
+	// or TCP host:port, empty to not scan.
+	Address string `yaml:"address,omitempty"`
+	// Action on infected messages: reject (default) or quarantine.
+	Action string `yaml:"action,omitempty"`
+	// QuarantineDir stores the quarantined messages as eml files.
+	QuarantineDir string `yaml:"quarantine_dir,omitempty"`
+	// Timeout of the scan, DefaultVirusTimeout if 0.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// VirusError is the infection of the message found by the scanner.
+type VirusError struct {
+	Virus string
+}
+
+func (e *VirusError) Error() string {
+	return "message is infected with " + e.Virus
+}
+
+// Enabled reports whether the messages are scanned.
+func (v *VirusScanner) Enabled() bool {
+	return v != nil && v.Address != ""
+}
+
+// Or return the scanner with the fields not set taken from d.
+func (v VirusScanner) Or(d VirusScanner) VirusScanner {
+	if v.Address == "" {
+		v.Address = d.Address
+	}
+	if v.Action == "" {
+		v.Action = d.Action
+	}
+	if v.QuarantineDir == "" {
+		v.QuarantineDir = d.QuarantineDir
+	}
+	if v.Timeout == 0 {
+		v.Timeout = d.Timeout
+	}
+	return v
+}
+
+// Validate check the action and the quarantine directory.
+func (v VirusScanner) Validate() error {
+	switch v.Action {
+	case "", VirusReject:
+	case VirusQuarantine:
+		if v.QuarantineDir == "" {
+			return errors.New("virus quarantine directory is not set")
+		}
+	default:
+		return fmt.Errorf("unknown virus action %q, expected reject or quarantine", v.Action)
+	}
+	if v.Timeout < 0 {
+		return fmt.Errorf("invalid virus scan timeout %s", v.Timeout)
+	}
+	return nil
+}
+
+// Check the message of the envelope, it is the middleware refusing
+// the infected messages or holding them in quarantine.
+func (v *VirusScanner) Check(ctx context.Context, e *Envelope) error {
+	if !v.Enabled() {
+		return nil
+	}
+	message, err := e.GenerateMessage()
+	if err != nil {
+		return err
+	}
+	timeout := v.Timeout
+	if timeout == 0 {
+		timeout = DefaultVirusTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	virus, err := v.scan(ctx, message)
+	if err != nil {
+		return temporaryError{fmt.Errorf("virus scan failed: %s", err)}
+	}
+	if virus == "" {
+		return nil
+	}
+	if v.Action != VirusQuarantine {
+		return &VirusError{virus}
+	}
+
+	fields := Fields{"sender": e.GetSender(), "recipients": strings.Join(e.Recipients, ",")}
+	if !e.dryRun {
+		id, err := newQueueID()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(v.QuarantineDir, 0700); err != nil {
+			return err
+		}
+		path := filepath.Join(v.QuarantineDir, id+".eml")
+		if err := writeFileAtomic(path, message); err != nil {
+			return err
+		}
+		fields["quarantine"] = path
+	}
+	e.held = append(e.held, Result{WarnLevel, &VirusError{virus}, "Quarantined", fields})
+	e.Recipients = nil
+	return nil
+}
+
+// scan the message with INSTREAM command of clamd,
+// it returns the name of the found virus.
+func (v *VirusScanner) scan(ctx context.Context, message []byte) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(v.Address, "/") {
+		network = "unix"
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, v.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	for len(message) > 0 {
+		chunk := message
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		binary.Write(w, binary.BigEndian, uint32(len(chunk)))
+		w.Write(chunk)
+		message = message[len(chunk):]
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	// stream: OK, stream: Eicar-Signature FOUND or <reason> ERROR
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", err
+	}
+	status := string(bytes.TrimRight(reply, "\x00\n"))
+	status = strings.TrimPrefix(status, "stream: ")
+	switch {
+	case status == "OK":
+		return "", nil
+	case strings.HasSuffix(status, " FOUND"):
+		return strings.TrimSuffix(status, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd reply %q", status)
+	}
+}
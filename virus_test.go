@@ -0,0 +1,117 @@
+package sendmail_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+// fakeClamd reports the messages containing EICAR as infected.
+func fakeClamd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			command, _ := reader.ReadString(0)
+			if command != "zINSTREAM\x00" {
+				conn.Close()
+				continue
+			}
+			var stream []byte
+			for {
+				var size uint32
+				if err := binary.Read(reader, binary.BigEndian, &size); err != nil || size == 0 {
+					break
+				}
+				chunk := make([]byte, size)
+				io.ReadFull(reader, chunk)
+				stream = append(stream, chunk...)
+			}
+			if bytes.Contains(stream, []byte("EICAR")) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestVirusScanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sendmail-quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clamd := fakeClamd(t)
+
+	send := func(scanner *sendmail.VirusScanner, body string) (*fakeTransport, []sendmail.Result, error) {
+		transport := &fakeTransport{}
+		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+			Sender:     "sender@example.com",
+			Recipients: []string{"user@example.com"},
+			Body:       []byte(body),
+			Transport:  transport,
+			Middleware: []sendmail.Middleware{scanner.Check},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := envelope.Send()
+		if err != nil {
+			return transport, nil, err
+		}
+		var collected []sendmail.Result
+		for result := range results {
+			collected = append(collected, result)
+		}
+		return transport, collected, nil
+	}
+
+	scanner := &sendmail.VirusScanner{Address: clamd}
+	if transport, _, err := send(scanner, "CLEAN"); err != nil || len(transport.delivered) != 1 {
+		t.Error("Expected delivery of clean message", err)
+	}
+	var virus *sendmail.VirusError
+	if _, _, err := send(scanner, "EICAR"); !errors.As(err, &virus) || virus.Virus != "Eicar-Test-Signature" {
+		t.Error("Expected rejection of infected message got", err)
+	}
+
+	scanner = &sendmail.VirusScanner{Address: clamd, Action: sendmail.VirusQuarantine, QuarantineDir: dir}
+	transport, results, err := send(scanner, "EICAR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.delivered) != 0 {
+		t.Error("Unexpected delivery of quarantined message", transport.delivered)
+	}
+	if len(results) != 1 || !errors.As(results[0].Error, &virus) {
+		t.Fatal("Expected quarantine result got", results)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 || results[0].Fields["quarantine"] != files[0] {
+		t.Error("Expected quarantined message got", files, results[0].Fields)
+	}
+
+	if err := (sendmail.VirusScanner{Address: clamd, Action: sendmail.VirusQuarantine}).Validate(); err == nil {
+		t.Error("Expected error of quarantine without directory")
+	}
+}